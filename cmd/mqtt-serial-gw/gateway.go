@@ -0,0 +1,235 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/safchain/hasc/pkg/serial"
+)
+
+type publisher interface {
+	Publish(id, topic, payload string)
+}
+
+type frameWriter interface {
+	Write(frame []byte) error
+}
+
+type portConfig struct {
+	// Name of the port, used in the logs and the health topic.
+	Name   string
+	Device string
+	Baud   int
+	// PubTopic on which the lines read are published, the ones not routed
+	// by key if Prefix is set.
+	PubTopic string `mapstructure:"pub-topic"`
+	// SubTopic of which the payloads are written to the port.
+	SubTopic string `mapstructure:"sub-topic"`
+	// Prefix of the topics of the key=value lines, published to
+	// <prefix>/<key>. The payloads of <prefix>/<key>/set are written to the
+	// port as key=value.
+	Prefix string
+	// Separator of the key=value lines. Default to =.
+	Separator string
+}
+
+// health of a port published on the health topic.
+type health struct {
+	Connected  bool   `json:"connected"`
+	Reconnects int    `json:"reconnects"`
+	Received   int    `json:"received"`
+	Sent       int    `json:"sent"`
+	Dropped    int    `json:"dropped"`
+	LastError  string `json:"last_error,omitempty"`
+}
+
+// bridge forwards the lines of a serial port to MQTT and the MQTT payloads
+// to the serial port.
+type bridge struct {
+	sync.Mutex
+
+	cfg         portConfig
+	serial      frameWriter
+	pub         publisher
+	healthTopic string
+	health      health
+	wasOpened   bool
+}
+
+func (b *bridge) publishHealth() {
+	if b.healthTopic == "" {
+		return
+	}
+
+	b.Lock()
+	data, _ := json.Marshal(b.health)
+	b.Unlock()
+
+	b.pub.Publish(b.cfg.Name, b.healthTopic+"/"+b.cfg.Name, string(data))
+}
+
+// route returns the topic and the payload of a line.
+func (b *bridge) route(line string) (string, string, bool) {
+	if b.cfg.Prefix != "" {
+		kv := strings.SplitN(line, b.cfg.Separator, 2)
+		if key := strings.TrimSpace(kv[0]); len(kv) == 2 && key != "" && !strings.ContainsAny(key, " \t/+#") {
+			return b.cfg.Prefix + "/" + key, strings.TrimSpace(kv[1]), true
+		}
+	}
+
+	if b.cfg.PubTopic != "" {
+		return b.cfg.PubTopic, line, true
+	}
+	return "", "", false
+}
+
+// OnValueChange handles the lines read from the serial port.
+func (b *bridge) OnValueChange(line string) {
+	topic, payload, ok := b.route(line)
+
+	b.Lock()
+	if ok {
+		b.health.Received++
+	} else {
+		b.health.Dropped++
+	}
+	b.Unlock()
+
+	if !ok {
+		Log.Debugf("%s no topic for %s, dropped", b.cfg.Name, line)
+		return
+	}
+
+	Log.Infof("%s new value %s from serial, publishing to %s", b.cfg.Name, line, topic)
+	b.pub.Publish(b.cfg.Name, topic, payload)
+}
+
+func (b *bridge) OnStatusChange(connected bool, err error) {
+	b.Lock()
+	if connected && !b.health.Connected {
+		if b.wasOpened {
+			b.health.Reconnects++
+		}
+		b.wasOpened = true
+	}
+	b.health.Connected = connected
+	if err != nil {
+		b.health.LastError = err.Error()
+	}
+	b.Unlock()
+
+	b.publishHealth()
+}
+
+// handleCommand writes to the serial port the payload received on a topic.
+func (b *bridge) handleCommand(topic, payload string) {
+	line := payload
+	if topic != b.cfg.SubTopic {
+		key := strings.TrimSuffix(strings.TrimPrefix(topic, b.cfg.Prefix+"/"), "/set")
+		line = key + b.cfg.Separator + payload
+	}
+
+	Log.Infof("%s new value %s from %s, writing to serial", b.cfg.Name, line, topic)
+
+	err := b.serial.Write([]byte(line))
+
+	b.Lock()
+	if err == nil {
+		b.health.Sent++
+	} else {
+		b.health.LastError = err.Error()
+	}
+	b.Unlock()
+
+	if err != nil {
+		Log.Errorf("%s unable to write %s: %s", b.cfg.Name, line, err)
+	}
+}
+
+func (b *bridge) OnMessage(client mqtt.Client, msg mqtt.Message) {
+	b.handleCommand(msg.Topic(), string(msg.Payload()))
+}
+
+// subTopics returns the topics of the payloads to write to the port.
+func (b *bridge) subTopics() []string {
+	var topics []string
+	if b.cfg.SubTopic != "" {
+		topics = append(topics, b.cfg.SubTopic)
+	}
+	if b.cfg.Prefix != "" {
+		topics = append(topics, b.cfg.Prefix+"/+/set")
+	}
+	return topics
+}
+
+func newBridge(cfg portConfig, w frameWriter, pub publisher, healthTopic string) (*bridge, error) {
+	if cfg.Device == "" {
+		return nil, fmt.Errorf("no device for port %s", cfg.Name)
+	}
+	if cfg.Name == "" {
+		cfg.Name = cfg.Device[strings.LastIndex(cfg.Device, "/")+1:]
+	}
+	if cfg.Baud == 0 {
+		cfg.Baud = 9600
+	}
+	if cfg.Separator == "" {
+		cfg.Separator = "="
+	}
+	if cfg.PubTopic != "" && cfg.PubTopic == cfg.SubTopic {
+		return nil, fmt.Errorf("pub topic and sub topic of port %s have to be different", cfg.Name)
+	}
+
+	return &bridge{
+		cfg:         cfg,
+		serial:      w,
+		pub:         pub,
+		healthTopic: healthTopic,
+	}, nil
+}
+
+// serialBridge returns a bridge reading the configured serial port.
+func serialBridge(cfg portConfig, pub publisher, healthTopic string) (*bridge, *serial.Serial, error) {
+	b, err := newBridge(cfg, nil, pub, healthTopic)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := serial.NewSerial(b.cfg.Device, b.cfg.Baud)
+	b.serial = s
+
+	s.AddStatusListener(b)
+	s.AddListener(b)
+
+	// the port may have been opened before the listener was added
+	if s.Connected() {
+		b.OnStatusChange(true, nil)
+	}
+
+	return b, s, nil
+}
@@ -0,0 +1,206 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakePublisher struct {
+	sync.Mutex
+	messages []string
+}
+
+func (p *fakePublisher) Publish(id, topic, payload string) {
+	p.Lock()
+	p.messages = append(p.messages, topic+" "+payload)
+	p.Unlock()
+}
+
+type fakeWriter struct {
+	frames []string
+	err    error
+}
+
+func (w *fakeWriter) Write(frame []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.frames = append(w.frames, string(frame))
+	return nil
+}
+
+func TestBridgeRouting(t *testing.T) {
+	p, w := &fakePublisher{}, &fakeWriter{}
+
+	b, err := newBridge(portConfig{
+		Device:   "/dev/ttyUSB0",
+		PubTopic: "gw/raw",
+		Prefix:   "gw/sensors",
+	}, w, p, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"TEMP=21.5", "HUM = 40", "hello", "a b=1"} {
+		b.OnValueChange(line)
+	}
+
+	expected := []string{"gw/sensors/TEMP 21.5", "gw/sensors/HUM 40", "gw/raw hello", "gw/raw a b=1"}
+	if !reflect.DeepEqual(p.messages, expected) {
+		t.Errorf("expected %v, got: %v", expected, p.messages)
+	}
+
+	if topics := b.subTopics(); !reflect.DeepEqual(topics, []string{"gw/sensors/+/set"}) {
+		t.Errorf("wrong subscriptions: %v", topics)
+	}
+
+	b.handleCommand("gw/sensors/RELAY/set", "1")
+	if !reflect.DeepEqual(w.frames, []string{"RELAY=1"}) {
+		t.Errorf("wrong frames: %v", w.frames)
+	}
+
+	// without prefix nor pub topic the lines are dropped
+	b, _ = newBridge(portConfig{Device: "/dev/ttyUSB0", SubTopic: "gw/in"}, w, p, "")
+	b.OnValueChange("TEMP=21.5")
+	if b.health.Dropped != 1 || len(p.messages) != len(expected) {
+		t.Errorf("line not dropped: %+v", b.health)
+	}
+
+	b.handleCommand("gw/in", "PING")
+	if w.frames[len(w.frames)-1] != "PING" {
+		t.Errorf("wrong frames: %v", w.frames)
+	}
+
+	if _, err := newBridge(portConfig{Device: "/dev/ttyUSB0", PubTopic: "gw", SubTopic: "gw"}, w, p, ""); err == nil {
+		t.Error("expected an error for identical topics")
+	}
+}
+
+func TestBridgeHealth(t *testing.T) {
+	p, w := &fakePublisher{}, &fakeWriter{}
+
+	b, err := newBridge(portConfig{Device: "/dev/ttyUSB0", PubTopic: "gw/raw"}, w, p, "gw/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.cfg.Name != "ttyUSB0" {
+		t.Errorf("wrong default name: %s", b.cfg.Name)
+	}
+
+	b.OnStatusChange(true, nil)
+	b.OnStatusChange(true, nil)
+	b.OnValueChange("hello")
+	b.OnStatusChange(false, errors.New("input/output error"))
+	b.OnStatusChange(true, nil)
+
+	w.err = errors.New("not connected")
+	b.handleCommand("gw/in", "PING")
+
+	expected := health{Connected: true, Reconnects: 1, Received: 1, LastError: "not connected"}
+	if b.health != expected {
+		t.Errorf("expected %+v, got: %+v", expected, b.health)
+	}
+
+	p.Lock()
+	last := p.messages[len(p.messages)-1]
+	p.Unlock()
+
+	var published health
+	if err := json.Unmarshal([]byte(last[len("gw/health/ttyUSB0 "):]), &published); err != nil {
+		t.Fatalf("wrong health message %s: %s", last, err)
+	}
+	if !published.Connected || published.Reconnects != 1 {
+		t.Errorf("wrong health published: %+v", published)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqtt-serial-gw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfgFile = filepath.Join(dir, "gw.yml")
+	defer func() { cfgFile = "" }()
+
+	err = ioutil.WriteFile(cfgFile, []byte(`
+broker: broker:1883
+status-topic: gw/status
+health-topic: gw/health
+health-interval: 10s
+ports:
+  - name: arduino
+    device: /dev/arduino
+    pub-topic: gw/1
+    sub-topic: gw/2
+  - device: /dev/ttyUSB0
+    baud: 115200
+    prefix: gw/sensors
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Broker != "broker:1883" || cfg.StatusTopic != "gw/status" || cfg.HealthInterval != 10*time.Second {
+		t.Errorf("wrong config: %+v", cfg)
+	}
+
+	expected := []portConfig{
+		{Name: "arduino", Device: "/dev/arduino", PubTopic: "gw/1", SubTopic: "gw/2"},
+		{Device: "/dev/ttyUSB0", Baud: 115200, Prefix: "gw/sensors"},
+	}
+	if !reflect.DeepEqual(cfg.Ports, expected) {
+		t.Errorf("expected %+v, got: %+v", expected, cfg.Ports)
+	}
+
+	err = ioutil.WriteFile(cfgFile, []byte(`
+health-interval: 0s
+ports:
+  - device: /dev/ttyUSB0
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg, err = loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.HealthInterval != time.Minute {
+		t.Errorf("expected the default health interval, got: %s", cfg.HealthInterval)
+	}
+}
@@ -23,14 +23,22 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/op/go-logging"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 
 	"github.com/safchain/hasc/pkg/mqtt"
 	"github.com/safchain/hasc/pkg/serial"
 )
 
 var (
+	cfgFile  string
 	device   string
 	baud     int
 	broker   string
@@ -40,27 +48,121 @@ var (
 	Log = logging.MustGetLogger("default")
 )
 
-type serialListener struct {
-	mqtt *mqtt.MQTT
-}
-
-type mqttListener struct {
-	serial *serial.Serial
+type config struct {
+	Broker   string
+	ClientID string `mapstructure:"client-id"`
+	// StatusTopic on which online/offline is published, retained.
+	StatusTopic string `mapstructure:"status-topic"`
+	// HealthTopic prefix on which the health of the ports is published,
+	// <health-topic>/<port name>.
+	HealthTopic    string        `mapstructure:"health-topic"`
+	HealthInterval time.Duration `mapstructure:"health-interval"`
+	Ports          []portConfig
 }
 
-func (s *serialListener) OnValueChange(value string) {
-	Log.Infof("new value %s from serial, publishing to mqtt", value)
-	s.mqtt.PublishValue(value)
+// loadConfig reads the config file if given, a single port is configured
+// from the flags otherwise.
+func loadConfig() (*config, error) {
+	cfg := &config{
+		Broker:         broker,
+		HealthInterval: time.Minute,
+	}
+
+	if cfgFile == "" {
+		cfg.Ports = []portConfig{{
+			Device:   device,
+			Baud:     baud,
+			PubTopic: pubTopic,
+			SubTopic: subTopic,
+		}}
+		return cfg, nil
+	}
+
+	v := viper.New()
+	v.SetConfigFile(cfgFile)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	if err := v.Unmarshal(cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.Ports) == 0 {
+		return nil, fmt.Errorf("no port configured in %s", cfgFile)
+	}
+	if cfg.HealthInterval <= 0 {
+		Log.Warningf("wrong health interval %s, defaulting to 1m", cfg.HealthInterval)
+		cfg.HealthInterval = time.Minute
+	}
+
+	return cfg, nil
 }
 
-func (m *mqttListener) OnValueChange(value string) {
-	Log.Infof("new value %s from mqtt, writting to serial", value)
-	m.serial.WriteValue(value)
+func run() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	conn := mqtt.NewMQTTConn("tcp://"+cfg.Broker, mqtt.MQTTConnOpts{
+		ClientID:    cfg.ClientID,
+		StatusTopic: cfg.StatusTopic,
+	})
+
+	var (
+		bridges []*bridge
+		serials []*serial.Serial
+	)
+	for _, portCfg := range cfg.Ports {
+		b, s, err := serialBridge(portCfg, conn, cfg.HealthTopic)
+		if err != nil {
+			return err
+		}
+		for _, topic := range b.subTopics() {
+			conn.Subscribe(topic, b)
+		}
+
+		bridges = append(bridges, b)
+		serials = append(serials, s)
+	}
+
+	ticker := time.NewTicker(cfg.HealthInterval)
+	defer ticker.Stop()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	for {
+		select {
+		case <-ticker.C:
+			if conn.IsConnected() {
+				for _, b := range bridges {
+					b.publishHealth()
+				}
+			}
+		case sig := <-signals:
+			Log.Infof("%s received, shutting down", sig)
+
+			for _, s := range serials {
+				s.Close()
+			}
+			conn.Close()
+
+			return nil
+		}
+	}
 }
 
 func main() {
-	var cmd cobra.Command
-
+	cmd := cobra.Command{
+		Use:   "mqtt-serial-gw",
+		Short: "Bridge serial ports and MQTT topics",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return run()
+		},
+		SilenceUsage: true,
+	}
+
+	cmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "", "config file configuring several ports, the port flags are ignored if set")
 	cmd.PersistentFlags().StringVarP(&device, "device", "", "/dev/arduino", "serial device, ex: /dev/arduino")
 	cmd.PersistentFlags().IntVarP(&baud, "baud", "", 9600, "baud, ex: 9600")
 	cmd.PersistentFlags().StringVarP(&broker, "address", "", "localhost:1883", "MQTT broker address, ex: localhost:1883")
@@ -70,20 +172,7 @@ func main() {
 	format := logging.MustStringFormatter(`%{color}%{time:15:04:05.000} ▶ %{level:.6s}%{color:reset} %{message}`)
 	logging.SetFormatter(format)
 
-	conn := mqtt.NewMQTTConn("tcp://" + broker)
-	m := mqtt.NewMQTT("GW", conn, pubTopic, subTopic)
-	s := serial.NewSerial(device, baud)
-
-	ml := &mqttListener{serial: s}
-	sl := &serialListener{mqtt: m}
-
-	m.AddListener(ml)
-	s.AddListener(sl)
-
-	ch := make(chan bool)
-	<-ch
-}
-
-func init() {
-
+	if err := cmd.Execute(); err != nil {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,98 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package climate
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Controller returns the heating demand, from 0 to 1, needed to reach the
+// target temperature.
+type Controller interface {
+	Demand(target, current float64, t time.Time) float64
+}
+
+// Hysteresis is an on/off controller, heating starts below target - Delta and
+// stops above target + Delta.
+type Hysteresis struct {
+	sync.Mutex
+	Delta float64
+
+	on bool
+}
+
+// PID is a proportional-integral-derivative controller, the error being in
+// degrees and the time in minutes.
+type PID struct {
+	sync.Mutex
+	Kp float64
+	Ki float64
+	Kd float64
+
+	integral float64
+	lastErr  float64
+	lastTime time.Time
+}
+
+func (h *Hysteresis) Demand(target, current float64, t time.Time) float64 {
+	h.Lock()
+	defer h.Unlock()
+
+	switch {
+	case current < target-h.Delta:
+		h.on = true
+	case current > target+h.Delta:
+		h.on = false
+	}
+
+	if h.on {
+		return 1
+	}
+	return 0
+}
+
+func (p *PID) Demand(target, current float64, t time.Time) float64 {
+	p.Lock()
+	defer p.Unlock()
+
+	err := target - current
+
+	var minutes, derivative float64
+	if !p.lastTime.IsZero() && t.After(p.lastTime) {
+		minutes = t.Sub(p.lastTime).Minutes()
+		derivative = (err - p.lastErr) / minutes
+	}
+	p.lastErr, p.lastTime = err, t
+
+	integral := p.integral + err*minutes
+	output := p.Kp*err + p.Ki*integral + p.Kd*derivative
+
+	// anti-windup, the integral doesn't grow while the output is saturated
+	if output >= 0 && output <= 1 || output > 1 && err < 0 || output < 0 && err > 0 {
+		p.integral = integral
+	}
+
+	return math.Max(0, math.Min(1, output))
+}
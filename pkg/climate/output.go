@@ -0,0 +1,120 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package climate
+
+import (
+	"math"
+
+	"github.com/safchain/hasc/pkg/item"
+	hmqtt "github.com/safchain/hasc/pkg/mqtt"
+	"github.com/safchain/hasc/pkg/opentherm"
+)
+
+// Output drives the heating according to the demand, from 0 to 1.
+type Output interface {
+	Set(demand float64, target float64) error
+}
+
+// SwitchOutput turns a switch item, ex: a relay, ON while there is a demand.
+type SwitchOutput struct {
+	item item.Item
+}
+
+type OpenThermOutputOpts struct {
+	// MinSetPoint is the control setpoint sent without demand. Default to 10.
+	MinSetPoint float64
+	// MaxSetPoint is the control setpoint sent at full demand. Default to 60.
+	MaxSetPoint float64
+}
+
+// OpenThermOutput sends the control setpoint, ID 1, scaled according to the
+// demand, and the room setpoint, ID 16, to an OpenTherm gateway.
+type OpenThermOutput struct {
+	conn  *hmqtt.MQTTConn
+	topic string
+	opts  OpenThermOutputOpts
+}
+
+func (s *SwitchOutput) Set(demand float64, target float64) error {
+	value := item.OFF
+	if demand > 0 {
+		value = item.ON
+	}
+
+	if s.item.GetValue() != value {
+		s.item.SetValue(value)
+	}
+	return nil
+}
+
+// setPoint returns the control setpoint for the given demand, rounded to
+// half a degree.
+func (o *OpenThermOutput) setPoint(demand float64) float64 {
+	sp := o.opts.MinSetPoint + demand*(o.opts.MaxSetPoint-o.opts.MinSetPoint)
+	return math.Round(sp*2) / 2
+}
+
+func (o *OpenThermOutput) Set(demand float64, target float64) error {
+	var msg opentherm.Message
+
+	msg.ThermostatSetPoint(o.setPoint(demand))
+	control, err := msg.Encode()
+	if err != nil {
+		return err
+	}
+
+	msg.RoomSetPoint(target)
+	room, err := msg.Encode()
+	if err != nil {
+		return err
+	}
+
+	o.conn.Publish("CLIMATE", o.topic, control)
+	o.conn.Publish("CLIMATE", o.topic, room)
+
+	return nil
+}
+
+func NewSwitchOutput(it item.Item) *SwitchOutput {
+	return &SwitchOutput{item: it}
+}
+
+// NewOpenThermOutput returns an output publishing the OpenTherm messages to
+// the input topic of the gateway.
+func NewOpenThermOutput(conn *hmqtt.MQTTConn, topic string, opts ...OpenThermOutputOpts) *OpenThermOutput {
+	o := &OpenThermOutput{
+		conn:  conn,
+		topic: topic,
+	}
+	if len(opts) > 0 {
+		o.opts = opts[0]
+	}
+	if o.opts.MinSetPoint == 0 {
+		o.opts.MinSetPoint = 10
+	}
+	if o.opts.MaxSetPoint == 0 {
+		o.opts.MaxSetPoint = 60
+	}
+
+	return o
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package climate
+
+import (
+	"time"
+)
+
+// ScheduleEntry sets the target temperature from the given time of day.
+type ScheduleEntry struct {
+	// Days on which the entry applies, every day if empty.
+	Days []time.Weekday
+	// Start time of day, ex: 06:30.
+	Start string
+	// Target temperature.
+	Target float64
+}
+
+// Schedule is a weekly schedule, the target temperature is the one of the
+// last entry started.
+type Schedule []ScheduleEntry
+
+func (e *ScheduleEntry) hasDay(day time.Weekday) bool {
+	if len(e.Days) == 0 {
+		return true
+	}
+	for _, d := range e.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// TargetAt returns the target temperature at the given time along with the
+// time at which it started, false if the schedule is empty or invalid.
+func (s Schedule) TargetAt(t time.Time) (float64, time.Time, bool) {
+	var (
+		target float64
+		since  time.Time
+		found  bool
+	)
+
+	for _, entry := range s {
+		start, err := time.Parse("15:04", entry.Start)
+		if err != nil {
+			continue
+		}
+
+		// look for the last occurrence of the entry within the past week
+		y, m, d := t.Date()
+		for back := 0; back <= 7; back++ {
+			at := time.Date(y, m, d-back, start.Hour(), start.Minute(), 0, 0, t.Location())
+			if at.After(t) || !entry.hasDay(at.Weekday()) {
+				continue
+			}
+
+			if !found || at.After(since) {
+				target, since, found = entry.Target, at, true
+			}
+			break
+		}
+	}
+
+	return target, since, found
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package climate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	weekDays := []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+	schedule := Schedule{
+		{Days: weekDays, Start: "06:30", Target: 20},
+		{Days: weekDays, Start: "08:30", Target: 17},
+		{Days: weekDays, Start: "17:30", Target: 20},
+		{Days: []time.Weekday{time.Saturday, time.Sunday}, Start: "08:00", Target: 20.5},
+		{Start: "22:00", Target: 16},
+	}
+
+	// 2021-06-21 is a monday
+	tests := []struct {
+		time   time.Time
+		target float64
+	}{
+		{time.Date(2021, 6, 21, 6, 0, 0, 0, time.UTC), 16},
+		{time.Date(2021, 6, 21, 6, 30, 0, 0, time.UTC), 20},
+		{time.Date(2021, 6, 21, 12, 0, 0, 0, time.UTC), 17},
+		{time.Date(2021, 6, 21, 23, 0, 0, 0, time.UTC), 16},
+		{time.Date(2021, 6, 26, 7, 0, 0, 0, time.UTC), 16},
+		{time.Date(2021, 6, 26, 12, 0, 0, 0, time.UTC), 20.5},
+	}
+
+	for _, test := range tests {
+		target, _, ok := schedule.TargetAt(test.time)
+		if !ok || target != test.target {
+			t.Errorf("%s: expected %f, got %f", test.time, test.target, target)
+		}
+	}
+
+	if _, _, ok := (Schedule{}).TargetAt(time.Now()); ok {
+		t.Error("empty schedule shouldn't return a target")
+	}
+}
+
+func TestControllers(t *testing.T) {
+	now := time.Now()
+
+	h := &Hysteresis{Delta: 0.5}
+	for _, test := range []struct {
+		current float64
+		demand  float64
+	}{
+		{19, 1},
+		{20.2, 1},
+		{20.6, 0},
+		{19.8, 0},
+		{19.4, 1},
+	} {
+		if demand := h.Demand(20, test.current, now); demand != test.demand {
+			t.Errorf("hysteresis at %f: expected %f, got %f", test.current, test.demand, demand)
+		}
+	}
+
+	p := &PID{Kp: 0.5, Ki: 0.01}
+	if demand := p.Demand(20, 15, now); demand != 1 {
+		t.Errorf("PID should saturate, got %f", demand)
+	}
+	if demand := p.Demand(20, 25, now.Add(time.Minute)); demand != 0 {
+		t.Errorf("PID should be idle, got %f", demand)
+	}
+
+	// the integral didn't wind up while saturated
+	demand := p.Demand(20, 19.5, now.Add(2*time.Minute))
+	if demand < 0.2 || demand > 0.3 {
+		t.Errorf("PID wrong demand, got %f", demand)
+	}
+}
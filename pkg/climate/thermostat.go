@@ -0,0 +1,358 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package climate
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+const kvBucket = "climate"
+
+// Thermostat modes
+const (
+	ModeOff   = "off"
+	ModeHeat  = "heat"
+	ModeEco   = "eco"
+	ModeAway  = "away"
+	ModeBoost = "boost"
+)
+
+type ThermostatOpts struct {
+	// Comfort is the target temperature of the heat mode without schedule.
+	// Default to 20.
+	Comfort float64
+	// Eco target temperature. Default to 17.
+	Eco float64
+	// Away target temperature. Default to 12.
+	Away float64
+	// BoostDuration is the time during which the heating runs at full
+	// demand before going back to the previous mode. Default to 1 hour.
+	BoostDuration time.Duration
+	// Schedule giving the target temperature of the heat mode.
+	Schedule Schedule
+	// Controller computing the demand. Default to an hysteresis of 0.3°.
+	Controller Controller
+	// SensorTimeout after which the temperature is considered as unknown and
+	// the heating stopped. Default to 30 minutes.
+	SensorTimeout time.Duration
+	// Refresh is the period at which the demand is evaluated. Default to 1
+	// minute.
+	Refresh time.Duration
+}
+
+// ModeItem accepts only the thermostat modes.
+type ModeItem struct {
+	item.AnItem
+}
+
+// Thermostat controls the heating to reach a target temperature according
+// to a mode and a weekly schedule.
+type Thermostat struct {
+	TargetItem  *item.AnItem
+	ModeItem    *ModeItem
+	HeatingItem *item.AnItem
+	DemandItem  *item.AnItem
+
+	id         string
+	sensor     item.Item
+	output     Output
+	lock       sync.Mutex
+	prevMode   string
+	boostUntil time.Time
+	scheduled  time.Time
+	opts       ThermostatOpts
+}
+
+func (m *ModeItem) SetValue(value string) (string, bool) {
+	switch value {
+	case ModeOff, ModeHeat, ModeEco, ModeAway, ModeBoost:
+		return m.AnItem.SetValue(value)
+	}
+
+	server.Log.Errorf("Thermostat %s unknown mode: %s", m.ID, value)
+	return m.GetValue(), false
+}
+
+func formatTemperature(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func (t *Thermostat) save(key, value string) {
+	if server.KV == nil {
+		return
+	}
+
+	if err := server.KV.SetString(kvBucket, fmt.Sprintf("%s/%s", t.id, key), value); err != nil {
+		server.Log.Errorf("Thermostat %s unable to save %s: %s", t.id, key, err)
+	}
+}
+
+func (t *Thermostat) load(key string) string {
+	if server.KV == nil {
+		return ""
+	}
+
+	value, _, err := server.KV.GetString(kvBucket, fmt.Sprintf("%s/%s", t.id, key))
+	if err != nil {
+		server.Log.Errorf("Thermostat %s unable to load %s: %s", t.id, key, err)
+	}
+	return value
+}
+
+// modeTarget returns the target temperature of a mode, false if the mode
+// has no target.
+func (t *Thermostat) modeTarget(mode string, now time.Time) (float64, bool) {
+	switch mode {
+	case ModeHeat:
+		if target, since, ok := t.opts.Schedule.TargetAt(now); ok {
+			t.scheduled = since
+			return target, true
+		}
+		return t.opts.Comfort, true
+	case ModeEco:
+		return t.opts.Eco, true
+	case ModeAway:
+		return t.opts.Away, true
+	}
+	return 0, false
+}
+
+func (t *Thermostat) onModeChange(old, new string, now time.Time) {
+	t.lock.Lock()
+	if new == ModeBoost {
+		if old != ModeBoost {
+			t.prevMode = old
+		}
+		t.boostUntil = now.Add(t.opts.BoostDuration)
+	}
+	target, ok := t.modeTarget(new, now)
+	t.lock.Unlock()
+
+	t.save("MODE", new)
+
+	if ok {
+		t.TargetItem.SetValue(formatTemperature(target))
+	} else {
+		t.evaluate(now)
+	}
+}
+
+func (t *Thermostat) temperature(now time.Time) (float64, error) {
+	value := t.sensor.GetValue()
+	if value == "" {
+		return 0, fmt.Errorf("no temperature from %s", t.sensor.GetID())
+	}
+
+	if elapsed := now.Sub(t.sensor.GetLastValueUpdate()); elapsed > t.opts.SensorTimeout {
+		return 0, fmt.Errorf("no temperature from %s since %s", t.sensor.GetID(), elapsed)
+	}
+
+	return strconv.ParseFloat(value, 64)
+}
+
+// evaluate computes the demand and drives the output.
+func (t *Thermostat) evaluate(now time.Time) {
+	mode := t.ModeItem.GetValue()
+
+	t.lock.Lock()
+
+	if mode == ModeBoost && !now.Before(t.boostUntil) {
+		prevMode := t.prevMode
+		t.lock.Unlock()
+
+		// evaluated again once the mode changed
+		t.ModeItem.SetValue(prevMode)
+		return
+	}
+
+	target, err := strconv.ParseFloat(t.TargetItem.GetValue(), 64)
+	if err != nil {
+		target = t.opts.Comfort
+	}
+
+	// new schedule period, the manual target is overridden
+	var scheduled bool
+	if mode == ModeHeat {
+		if st, since, ok := t.opts.Schedule.TargetAt(now); ok && since.After(t.scheduled) {
+			t.scheduled = since
+			target, scheduled = st, true
+		}
+	}
+
+	var demand float64
+	switch mode {
+	case ModeOff:
+	case ModeBoost:
+		demand = 1
+	default:
+		current, err := t.temperature(now)
+		if err != nil {
+			server.Log.Errorf("Thermostat %s heating stopped: %s", t.id, err)
+			break
+		}
+		demand = t.opts.Controller.Demand(target, current, now)
+	}
+
+	t.lock.Unlock()
+
+	// saved here as the target listener is not notified when evaluating
+	// from it
+	if scheduled {
+		value := formatTemperature(target)
+		t.save("TARGET", value)
+		t.TargetItem.SetValue(value)
+	}
+
+	if err := t.output.Set(demand, target); err != nil {
+		server.Log.Errorf("Thermostat %s output error: %s", t.id, err)
+	}
+
+	heating := item.OFF
+	if demand > 0 {
+		heating = item.ON
+	}
+	if t.HeatingItem.GetValue() != heating {
+		t.HeatingItem.SetValue(heating)
+	}
+	t.DemandItem.SetValue(fmt.Sprintf("%.0f", demand*100))
+}
+
+func (t *Thermostat) refresh() {
+	ticker := time.NewTicker(t.opts.Refresh)
+	for range ticker.C {
+		t.evaluate(time.Now())
+	}
+}
+
+func newThermostat(id string, sensor item.Item, output Output, opts ...ThermostatOpts) *Thermostat {
+	t := &Thermostat{
+		id:       id,
+		sensor:   sensor,
+		output:   output,
+		prevMode: ModeHeat,
+	}
+	if len(opts) > 0 {
+		t.opts = opts[0]
+	}
+	if t.opts.Comfort == 0 {
+		t.opts.Comfort = 20
+	}
+	if t.opts.Eco == 0 {
+		t.opts.Eco = 17
+	}
+	if t.opts.Away == 0 {
+		t.opts.Away = 12
+	}
+	if t.opts.BoostDuration == 0 {
+		t.opts.BoostDuration = time.Hour
+	}
+	if t.opts.Controller == nil {
+		t.opts.Controller = &Hysteresis{Delta: 0.3}
+	}
+	if t.opts.SensorTimeout == 0 {
+		t.opts.SensorTimeout = 30 * time.Minute
+	}
+	if t.opts.Refresh == 0 {
+		t.opts.Refresh = time.Minute
+	}
+
+	t.TargetItem = &item.AnItem{
+		ID:    fmt.Sprintf("%s/TARGET", id),
+		Label: "Target",
+		Type:  "range",
+		Img:   "temperature",
+		Unit:  "°",
+	}
+	t.ModeItem = &ModeItem{
+		AnItem: item.AnItem{
+			ID:    fmt.Sprintf("%s/MODE", id),
+			Label: "Mode",
+			Type:  "state",
+			Img:   "temperature",
+		},
+	}
+	t.HeatingItem = &item.AnItem{
+		ID:    fmt.Sprintf("%s/HEATING", id),
+		Label: "Heating",
+		Type:  "state",
+		Img:   "fire",
+	}
+	t.DemandItem = &item.AnItem{
+		ID:    fmt.Sprintf("%s/DEMAND", id),
+		Label: "Demand",
+		Type:  "value",
+		Img:   "fire",
+		Unit:  "%",
+	}
+
+	t.ModeItem.AddListener(&item.CallbackListener{
+		CbFnc: func(it item.Item, old string, new string) {
+			t.onModeChange(old, new, time.Now())
+		},
+	})
+	t.TargetItem.AddListener(&item.CallbackListener{
+		CbFnc: func(it item.Item, old string, new string) {
+			t.save("TARGET", new)
+			t.evaluate(time.Now())
+		},
+	})
+	sensor.AddListener(&item.CallbackListener{
+		CbFnc: func(it item.Item, old string, new string) {
+			t.evaluate(time.Now())
+		},
+	})
+
+	return t
+}
+
+// NewThermostat returns a thermostat regulating the temperature given by the
+// sensor item through the output, ex: a relay with NewSwitchOutput or a boiler
+// with NewOpenThermOutput. The mode, heat by default, and the target are
+// persisted in the KV store.
+func NewThermostat(id string, sensor item.Item, output Output, opts ...ThermostatOpts) *Thermostat {
+	t := newThermostat(id, sensor, output, opts...)
+
+	mode, target := t.load("MODE"), t.load("TARGET")
+	if mode == "" || mode == ModeBoost {
+		mode = ModeHeat
+	}
+	t.ModeItem.SetValue(mode)
+	if target != "" {
+		t.TargetItem.SetValue(target)
+	}
+
+	server.Registry.Add(t.TargetItem)
+	server.Registry.Add(t.ModeItem)
+	server.Registry.Add(t.HeatingItem)
+	server.Registry.Add(t.DemandItem)
+
+	go t.refresh()
+
+	return t
+}
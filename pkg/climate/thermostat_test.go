@@ -0,0 +1,174 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package climate
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/opentherm"
+)
+
+type fakeOutput struct {
+	sync.Mutex
+	demand float64
+	target float64
+}
+
+func (f *fakeOutput) Set(demand float64, target float64) error {
+	f.Lock()
+	f.demand, f.target = demand, target
+	f.Unlock()
+	return nil
+}
+
+func (f *fakeOutput) get() (float64, float64) {
+	f.Lock()
+	defer f.Unlock()
+	return f.demand, f.target
+}
+
+func TestThermostat(t *testing.T) {
+	sensor := &item.AnItem{ID: "SALON/TEMP"}
+	output := &fakeOutput{}
+
+	th := newThermostat("THERMOSTAT", sensor, output, ThermostatOpts{Comfort: 20, Eco: 17})
+	th.ModeItem.SetValue(ModeHeat)
+
+	if th.TargetItem.GetValue() != "20" {
+		t.Fatalf("expected comfort target, got: %s", th.TargetItem.GetValue())
+	}
+
+	// no temperature yet, no heating
+	if demand, _ := output.get(); demand != 0 {
+		t.Fatalf("expected no demand without temperature, got: %f", demand)
+	}
+
+	sensor.SetValue("18.5")
+	if demand, target := output.get(); demand != 1 || target != 20 || th.HeatingItem.GetValue() != item.ON {
+		t.Fatalf("expected heating, got: %f, %f", demand, target)
+	}
+
+	th.ModeItem.SetValue(ModeEco)
+	if demand, target := output.get(); demand != 0 || target != 17 || th.HeatingItem.GetValue() != item.OFF {
+		t.Fatalf("expected eco, got: %f, %f", demand, target)
+	}
+
+	// unknown mode rejected
+	th.ModeItem.SetValue("turbo")
+	if th.ModeItem.GetValue() != ModeEco {
+		t.Fatalf("mode shouldn't change, got: %s", th.ModeItem.GetValue())
+	}
+
+	// boost then back to eco
+	th.ModeItem.SetValue(ModeBoost)
+	if demand, _ := output.get(); demand != 1 {
+		t.Fatalf("expected boost, got: %f", demand)
+	}
+	th.evaluate(time.Now().Add(2 * time.Hour))
+	if th.ModeItem.GetValue() != ModeEco {
+		t.Fatalf("expected eco after boost, got: %s", th.ModeItem.GetValue())
+	}
+
+	th.ModeItem.SetValue(ModeOff)
+	sensor.SetValue("10")
+	if demand, _ := output.get(); demand != 0 {
+		t.Fatalf("expected no demand when off, got: %f", demand)
+	}
+}
+
+func TestThermostatSchedule(t *testing.T) {
+	sensor := &item.AnItem{ID: "SALON/TEMP"}
+	output := &fakeOutput{}
+
+	schedule := Schedule{
+		{Start: "00:00", Target: 16},
+		{Start: "12:00", Target: 19},
+		{Start: "20:00", Target: 17},
+	}
+
+	th := newThermostat("THERMOSTAT", sensor, output, ThermostatOpts{Schedule: schedule})
+	// tomorrow so that the evaluations triggered by the items at the current
+	// time don't enter a new period
+	y, m, d := time.Now().Date()
+	morning := time.Date(y, m, d+1, 8, 0, 0, 0, time.Local)
+	th.ModeItem.SetValue(ModeHeat)
+	th.onModeChange("", ModeHeat, morning)
+
+	if th.TargetItem.GetValue() != "16" {
+		t.Fatalf("expected scheduled target, got: %s", th.TargetItem.GetValue())
+	}
+
+	// manual override kept until the next schedule period
+	th.TargetItem.SetValue("18")
+	th.evaluate(morning.Add(time.Hour))
+	if th.TargetItem.GetValue() != "18" {
+		t.Fatalf("expected manual target, got: %s", th.TargetItem.GetValue())
+	}
+
+	th.evaluate(morning.Add(5 * time.Hour))
+	if th.TargetItem.GetValue() != "19" {
+		t.Fatalf("expected scheduled target, got: %s", th.TargetItem.GetValue())
+	}
+
+	// new period entered while evaluating from the target listener
+	th.TargetItem.AddListener(&item.CallbackListener{
+		CbFnc: func(it item.Item, old string, new string) {
+			th.evaluate(morning.Add(13 * time.Hour))
+		},
+	})
+	th.TargetItem.SetValue("21")
+	if _, target := output.get(); target != 17 || th.TargetItem.GetValue() != "17" {
+		t.Fatalf("expected scheduled target, got: %f, %s", target, th.TargetItem.GetValue())
+	}
+}
+
+func TestOpenThermSetPoint(t *testing.T) {
+	o := NewOpenThermOutput(nil, "otg/in/message")
+
+	for _, test := range []struct {
+		demand   float64
+		setPoint float64
+	}{
+		{0, 10},
+		{1, 60},
+		{0.5, 35},
+		{0.33, 26.5},
+	} {
+		if sp := o.setPoint(test.demand); sp != test.setPoint {
+			t.Errorf("demand %f: expected %f, got %f", test.demand, test.setPoint, sp)
+		}
+	}
+
+	var msg opentherm.Message
+	msg.ThermostatSetPoint(o.setPoint(0.5))
+	encoded, err := msg.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded != "T90012300" {
+		t.Fatalf("wrong message: %s", encoded)
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package compute
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+type ComputedOpts struct {
+	// Type of the item, default to value.
+	Type string
+	// Img of the item, default to chart.
+	Img string
+	// Unit of the item.
+	Unit string
+}
+
+// ComputedItem is an item whose value is an expression over other items,
+// recomputed whenever one of them changes.
+type ComputedItem struct {
+	item.AnItem
+
+	expr  *Expression
+	items map[string]item.Item
+	opts  ComputedOpts
+}
+
+func (c *ComputedItem) lookup(id string) (string, bool) {
+	it, ok := c.items[id]
+	if !ok {
+		return "", false
+	}
+	return it.GetValue(), true
+}
+
+func (c *ComputedItem) refresh() {
+	// wait for all the dependencies to get a value
+	for _, it := range c.items {
+		if it.GetValue() == "" {
+			return
+		}
+	}
+
+	value, err := c.expr.Eval(c.lookup)
+	if err != nil {
+		server.Log.Errorf("Computed item %s evaluation error: %s", c.ID, err)
+		return
+	}
+
+	if value != c.GetValue() {
+		c.AnItem.SetValue(value)
+	}
+}
+
+func (c *ComputedItem) OnValueChange(it item.Item, old string, new string) {
+	c.refresh()
+}
+
+// Expression returns the expression of the item.
+func (c *ComputedItem) Expression() *Expression {
+	return c.expr
+}
+
+func (c *ComputedItem) MarshalJSON() ([]byte, error) {
+	data, err := c.AnItem.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	fields["Expression"] = c.expr.String()
+	fields["Dependencies"] = c.expr.Dependencies()
+
+	return json.Marshal(fields)
+}
+
+// NewComputedItem returns an item computed from an expression over registered
+// items, see Parse for the syntax, ex: {SALON/TEMP} - {OWM/TEMP} or
+// {BOILER/FLAME} && !{ANYONE_HOME}. The referenced items have to be
+// registered before.
+func NewComputedItem(id string, label string, expression string, opts ...ComputedOpts) (*ComputedItem, error) {
+	expr, err := Parse(expression)
+	if err != nil {
+		return nil, fmt.Errorf("computed item %s: %s", id, err)
+	}
+
+	c := &ComputedItem{
+		expr:  expr,
+		items: make(map[string]item.Item),
+	}
+	if len(opts) > 0 {
+		c.opts = opts[0]
+	}
+	if c.opts.Type == "" {
+		c.opts.Type = "value"
+	}
+	if c.opts.Img == "" {
+		c.opts.Img = "chart"
+	}
+
+	c.AnItem = item.AnItem{
+		ID:    id,
+		Label: label,
+		Type:  c.opts.Type,
+		Img:   c.opts.Img,
+		Unit:  c.opts.Unit,
+	}
+
+	for _, dep := range expr.Dependencies() {
+		it := server.Registry.Get(dep)
+		if it == nil {
+			return nil, fmt.Errorf("computed item %s: unknown item %s", id, dep)
+		}
+		c.items[dep] = it
+	}
+
+	for _, it := range c.items {
+		it.AddListener(c)
+	}
+	c.refresh()
+
+	server.Registry.Add(c)
+
+	return c, nil
+}
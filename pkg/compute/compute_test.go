@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package compute
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/registry"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+func TestComputedItem(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	indoor := &item.AnItem{ID: "SALON/TEMP"}
+	outdoor := &item.AnItem{ID: "OWM/TEMP"}
+	server.Registry.Add(indoor)
+	server.Registry.Add(outdoor)
+
+	c, err := NewComputedItem("DELTA", "Delta", "{SALON/TEMP} - {OWM/TEMP}", ComputedOpts{Unit: "°C"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	indoor.SetValue("20")
+	if c.GetValue() != "" {
+		t.Fatalf("should wait for all the values, got: %s", c.GetValue())
+	}
+
+	outdoor.SetValue("5.5")
+	if c.GetValue() != "14.5" {
+		t.Fatalf("expected 14.5, got: %s", c.GetValue())
+	}
+
+	indoor.SetValue("21")
+	if c.GetValue() != "15.5" {
+		t.Fatalf("expected 15.5, got: %s", c.GetValue())
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields struct {
+		ID           string
+		Value        string
+		Unit         string
+		Dependencies []string
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields.ID != "DELTA" || fields.Value != "15.5" || fields.Unit != "°C" || len(fields.Dependencies) != 2 {
+		t.Errorf("wrong JSON: %s", string(data))
+	}
+
+	if _, err := NewComputedItem("WRONG", "Wrong", "{SALON/TEMP} -"); err == nil {
+		t.Error("should fail on parse error")
+	}
+	if _, err := NewComputedItem("UNKNOWN", "Unknown", "{UNKNOWN} + 1"); err == nil {
+		t.Error("should fail on unknown item")
+	}
+}
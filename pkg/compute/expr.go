@@ -0,0 +1,687 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package compute
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/safchain/hasc/pkg/item"
+)
+
+// Lookup returns the value of an item, false if the item doesn't exist.
+type Lookup func(id string) (string, bool)
+
+type node interface {
+	eval(lookup Lookup) (interface{}, error)
+}
+
+type literal struct {
+	value interface{}
+}
+
+type itemRef struct {
+	id string
+}
+
+type unary struct {
+	op      string
+	operand node
+}
+
+type binary struct {
+	op          string
+	left, right node
+}
+
+type ternary struct {
+	cond, yes, no node
+}
+
+type call struct {
+	name string
+	args []node
+}
+
+// Expression is a parsed expression over item values.
+type Expression struct {
+	source string
+	root   node
+	deps   []string
+}
+
+type parser struct {
+	input []rune
+	pos   int
+	deps  []string
+}
+
+var functions = map[string]func(args []interface{}) (interface{}, error){
+	"min": func(args []interface{}) (interface{}, error) {
+		return fold(args, math.Min)
+	},
+	"max": func(args []interface{}) (interface{}, error) {
+		return fold(args, math.Max)
+	},
+	"abs": func(args []interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, errors.New("abs expects 1 argument")
+		}
+		v, err := toNumber(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return math.Abs(v), nil
+	},
+	"round": func(args []interface{}) (interface{}, error) {
+		if len(args) != 1 && len(args) != 2 {
+			return nil, errors.New("round expects 1 or 2 arguments")
+		}
+		v, err := toNumber(args[0])
+		if err != nil {
+			return nil, err
+		}
+		var digits float64
+		if len(args) == 2 {
+			if digits, err = toNumber(args[1]); err != nil {
+				return nil, err
+			}
+		}
+		p := math.Pow(10, digits)
+		return math.Round(v*p) / p, nil
+	},
+	"format": func(args []interface{}) (interface{}, error) {
+		if len(args) == 0 {
+			return nil, errors.New("format expects at least 1 argument")
+		}
+		f, ok := args[0].(string)
+		if !ok {
+			return nil, errors.New("format expects a string as first argument")
+		}
+		return fmt.Sprintf(f, args[1:]...), nil
+	},
+}
+
+func fold(args []interface{}, fnc func(a, b float64) float64) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, errors.New("at least 1 argument expected")
+	}
+
+	var result float64
+	for i, arg := range args {
+		v, err := toNumber(arg)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			result = v
+		} else {
+			result = fnc(result, v)
+		}
+	}
+	return result, nil
+}
+
+func toNumber(v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, fmt.Errorf("not a number: %q", v)
+		}
+		return f, nil
+	}
+	return 0, fmt.Errorf("not a number: %v", v)
+}
+
+// toBool returns the truth value, strings are true unless empty, OFF, false
+// or 0.
+func toBool(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		switch strings.ToLower(v) {
+		case "", "off", "false", "0":
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// formatValue returns the item value of an evaluation result, booleans are
+// converted to ON/OFF.
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return item.ON
+		}
+		return item.OFF
+	case float64:
+		// get rid of the floating point noise, ex: 21.3 - 8.1
+		return strconv.FormatFloat(math.Round(v*1e6)/1e6, 'f', -1, 64)
+	case string:
+		return v
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// itemValue converts an item value to a number when possible.
+func itemValue(s string) interface{} {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	return s
+}
+
+func (l *literal) eval(lookup Lookup) (interface{}, error) {
+	return l.value, nil
+}
+
+func (r *itemRef) eval(lookup Lookup) (interface{}, error) {
+	value, ok := lookup(r.id)
+	if !ok {
+		return nil, fmt.Errorf("unknown item: %s", r.id)
+	}
+	return itemValue(value), nil
+}
+
+func (u *unary) eval(lookup Lookup) (interface{}, error) {
+	v, err := u.operand.eval(lookup)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.op == "!" {
+		return !toBool(v), nil
+	}
+
+	f, err := toNumber(v)
+	if err != nil {
+		return nil, err
+	}
+	return -f, nil
+}
+
+func equals(l, r interface{}) bool {
+	_, lb := l.(bool)
+	_, rb := r.(bool)
+	if lb || rb {
+		return toBool(l) == toBool(r)
+	}
+
+	lf, lok := l.(float64)
+	rf, rok := r.(float64)
+	if lok && rok {
+		return lf == rf
+	}
+
+	return formatValue(l) == formatValue(r)
+}
+
+func compare(op string, l, r interface{}) (interface{}, error) {
+	ls, lok := l.(string)
+	rs, rok := r.(string)
+	if lok && rok {
+		switch op {
+		case "<":
+			return ls < rs, nil
+		case "<=":
+			return ls <= rs, nil
+		case ">":
+			return ls > rs, nil
+		}
+		return ls >= rs, nil
+	}
+
+	lf, err := toNumber(l)
+	if err != nil {
+		return nil, err
+	}
+	rf, err := toNumber(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case "<":
+		return lf < rf, nil
+	case "<=":
+		return lf <= rf, nil
+	case ">":
+		return lf > rf, nil
+	}
+	return lf >= rf, nil
+}
+
+func arithmetic(op string, l, r interface{}) (interface{}, error) {
+	if op == "+" {
+		_, lok := l.(string)
+		_, rok := r.(string)
+		if lok || rok {
+			return formatValue(l) + formatValue(r), nil
+		}
+	}
+
+	lf, err := toNumber(l)
+	if err != nil {
+		return nil, err
+	}
+	rf, err := toNumber(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case "+":
+		return lf + rf, nil
+	case "-":
+		return lf - rf, nil
+	case "*":
+		return lf * rf, nil
+	}
+
+	if rf == 0 {
+		return nil, errors.New("division by zero")
+	}
+	if op == "%" {
+		return math.Mod(lf, rf), nil
+	}
+	return lf / rf, nil
+}
+
+func (b *binary) eval(lookup Lookup) (interface{}, error) {
+	l, err := b.left.eval(lookup)
+	if err != nil {
+		return nil, err
+	}
+
+	// short-circuit evaluation
+	switch b.op {
+	case "&&":
+		if !toBool(l) {
+			return false, nil
+		}
+	case "||":
+		if toBool(l) {
+			return true, nil
+		}
+	}
+
+	r, err := b.right.eval(lookup)
+	if err != nil {
+		return nil, err
+	}
+
+	switch b.op {
+	case "&&", "||":
+		return toBool(r), nil
+	case "==":
+		return equals(l, r), nil
+	case "!=":
+		return !equals(l, r), nil
+	case "<", "<=", ">", ">=":
+		return compare(b.op, l, r)
+	}
+	return arithmetic(b.op, l, r)
+}
+
+func (t *ternary) eval(lookup Lookup) (interface{}, error) {
+	cond, err := t.cond.eval(lookup)
+	if err != nil {
+		return nil, err
+	}
+	if toBool(cond) {
+		return t.yes.eval(lookup)
+	}
+	return t.no.eval(lookup)
+}
+
+func (c *call) eval(lookup Lookup) (interface{}, error) {
+	var args []interface{}
+	for _, arg := range c.args {
+		v, err := arg.eval(lookup)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+
+	v, err := functions[c.name](args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", c.name, err)
+	}
+	return v, nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s at position %d", fmt.Sprintf(format, args...), p.pos)
+}
+
+func (p *parser) skipSpaces() {
+	for p.pos < len(p.input) && unicode.IsSpace(p.input[p.pos]) {
+		p.pos++
+	}
+}
+
+func (p *parser) peek(ops ...string) string {
+	p.skipSpaces()
+	for _, op := range ops {
+		if strings.HasPrefix(string(p.input[p.pos:]), op) {
+			return op
+		}
+	}
+	return ""
+}
+
+func (p *parser) accept(ops ...string) string {
+	op := p.peek(ops...)
+	p.pos += len([]rune(op))
+	return op
+}
+
+func (p *parser) expect(op string) error {
+	if p.accept(op) == "" {
+		return p.errorf("%s expected", op)
+	}
+	return nil
+}
+
+func (p *parser) parseExpression() (node, error) {
+	cond, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.accept("?") == "" {
+		return cond, nil
+	}
+
+	yes, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	no, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ternary{cond: cond, yes: yes, no: no}, nil
+}
+
+// operators by increasing precedence, the longest operators first
+var precedences = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<=", ">=", "<", ">"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *parser) parseBinary(level int) (node, error) {
+	if level == len(precedences) {
+		return p.parseUnary()
+	}
+
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op := p.accept(precedences[level]...)
+		if op == "" {
+			return left, nil
+		}
+
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binary{op: op, left: left, right: right}
+	}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	// ! but not !=
+	if op := p.peek("!=", "!", "-"); op == "!" || op == "-" {
+		p.pos++
+
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unary{op: op, operand: operand}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *parser) parseString() (node, error) {
+	start := p.pos
+	p.pos++
+
+	var sb strings.Builder
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		p.pos++
+
+		switch c {
+		case '"':
+			return &literal{value: sb.String()}, nil
+		case '\\':
+			if p.pos < len(p.input) {
+				sb.WriteRune(p.input[p.pos])
+				p.pos++
+			}
+		default:
+			sb.WriteRune(c)
+		}
+	}
+
+	p.pos = start
+	return nil, p.errorf("unterminated string")
+}
+
+func (p *parser) parseItemRef() (node, error) {
+	start := p.pos
+	p.pos++
+
+	for p.pos < len(p.input) && p.input[p.pos] != '}' {
+		p.pos++
+	}
+	if p.pos == len(p.input) {
+		p.pos = start
+		return nil, p.errorf("unterminated item reference")
+	}
+	id := strings.TrimSpace(string(p.input[start+1 : p.pos]))
+	p.pos++
+
+	if id == "" {
+		p.pos = start
+		return nil, p.errorf("empty item reference")
+	}
+
+	found := false
+	for _, dep := range p.deps {
+		if dep == id {
+			found = true
+			break
+		}
+	}
+	if !found {
+		p.deps = append(p.deps, id)
+	}
+
+	return &itemRef{id: id}, nil
+}
+
+func (p *parser) parseNumber() (node, error) {
+	start := p.pos
+	for p.pos < len(p.input) && (unicode.IsDigit(p.input[p.pos]) || p.input[p.pos] == '.') {
+		p.pos++
+	}
+
+	f, err := strconv.ParseFloat(string(p.input[start:p.pos]), 64)
+	if err != nil {
+		p.pos = start
+		return nil, p.errorf("wrong number")
+	}
+	return &literal{value: f}, nil
+}
+
+func (p *parser) parseIdent() (node, error) {
+	start := p.pos
+	for p.pos < len(p.input) && (unicode.IsLetter(p.input[p.pos]) || unicode.IsDigit(p.input[p.pos]) || p.input[p.pos] == '_') {
+		p.pos++
+	}
+	name := string(p.input[start:p.pos])
+
+	switch name {
+	case "true":
+		return &literal{value: true}, nil
+	case "false":
+		return &literal{value: false}, nil
+	case item.ON, item.OFF:
+		return &literal{value: name}, nil
+	}
+
+	if _, ok := functions[name]; !ok {
+		p.pos = start
+		return nil, p.errorf("unknown identifier %s", name)
+	}
+
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	c := &call{name: name}
+	if p.accept(")") != "" {
+		return c, nil
+	}
+
+	for {
+		arg, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		c.args = append(c.args, arg)
+
+		if p.accept(")") != "" {
+			return c, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	p.skipSpaces()
+	if p.pos >= len(p.input) {
+		return nil, p.errorf("unexpected end of expression")
+	}
+
+	c := p.input[p.pos]
+	switch {
+	case c == '(':
+		p.pos++
+		n, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return n, nil
+	case c == '"':
+		return p.parseString()
+	case c == '{':
+		return p.parseItemRef()
+	case unicode.IsDigit(c) || c == '.':
+		return p.parseNumber()
+	case unicode.IsLetter(c) || c == '_':
+		return p.parseIdent()
+	}
+
+	return nil, p.errorf("unexpected character %q", c)
+}
+
+// Parse parses an expression over item values. The items are referenced by
+// their ID between braces, ex: {SALON/TEMP} - {OWM/TEMP}. The expression
+// supports numbers, strings between double quotes, true, false, ON, OFF, the
+// arithmetic operators + - * / %, the comparisons == != < <= > >=, the boolean
+// operators && || !, the conditional operator cond ? a : b and the functions
+// min, max, abs, round(value[, digits]) and format(format, values...).
+func Parse(source string) (*Expression, error) {
+	p := &parser{input: []rune(source)}
+
+	root, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.skipSpaces(); p.pos < len(p.input) {
+		return nil, p.errorf("unexpected %q", string(p.input[p.pos:]))
+	}
+
+	return &Expression{source: source, root: root, deps: p.deps}, nil
+}
+
+// Dependencies returns the IDs of the items referenced by the expression.
+func (e *Expression) Dependencies() []string {
+	return e.deps
+}
+
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Eval evaluates the expression and returns the result as an item value,
+// booleans being returned as ON/OFF.
+func (e *Expression) Eval(lookup Lookup) (string, error) {
+	v, err := e.root.eval(lookup)
+	if err != nil {
+		return "", err
+	}
+	return formatValue(v), nil
+}
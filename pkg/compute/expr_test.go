@@ -0,0 +1,120 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package compute
+
+import (
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	values := map[string]string{
+		"SALON/TEMP":  "21.3",
+		"OWM/TEMP":    "8.1",
+		"BOILER":      "ON",
+		"ANYONE_HOME": "OFF",
+		"MODE":        "eco",
+	}
+	lookup := func(id string) (string, bool) {
+		v, ok := values[id]
+		return v, ok
+	}
+
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{`{SALON/TEMP} - {OWM/TEMP}`, "13.2"},
+		{`1 + 2 * 3 - 4 / 2`, "5"},
+		{`(1 + 2) * 3 % 4`, "1"},
+		{`-{OWM/TEMP}`, "-8.1"},
+		{`{BOILER} && !{ANYONE_HOME}`, "ON"},
+		{`{BOILER} == ON && {ANYONE_HOME} != OFF`, "OFF"},
+		{`{SALON/TEMP} > 20 || {OWM/TEMP} < 0`, "ON"},
+		{`{SALON/TEMP} <= 21.3`, "ON"},
+		{`{MODE} == "eco" ? 18 : 20`, "18"},
+		{`min({SALON/TEMP}, {OWM/TEMP}, 10)`, "8.1"},
+		{`max({SALON/TEMP}, {OWM/TEMP})`, "21.3"},
+		{`abs({OWM/TEMP} - {SALON/TEMP})`, "13.2"},
+		{`round(2 / 3, 2)`, "0.67"},
+		{`format("%.1f°C", {SALON/TEMP} - {OWM/TEMP})`, "13.2°C"},
+		{`"mode: " + {MODE}`, "mode: eco"},
+		{`true == {BOILER}`, "ON"},
+	}
+
+	for _, test := range tests {
+		expr, err := Parse(test.expr)
+		if err != nil {
+			t.Fatalf("%s: %s", test.expr, err)
+		}
+
+		value, err := expr.Eval(lookup)
+		if err != nil {
+			t.Fatalf("%s: %s", test.expr, err)
+		}
+		if value != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.expr, test.expected, value)
+		}
+	}
+
+	expr, _ := Parse(`{MODE} / 2`)
+	if _, err := expr.Eval(lookup); err == nil {
+		t.Error("should fail as not a number")
+	}
+
+	expr, _ = Parse(`1 / ({BOILER} && false)`)
+	if _, err := expr.Eval(lookup); err == nil {
+		t.Error("should fail on division by zero")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		``,
+		`1 +`,
+		`(1 + 2`,
+		`{SALON/TEMP`,
+		`{}`,
+		`"abc`,
+		`foo(1)`,
+		`min(1, 2`,
+		`1 = 2`,
+		`1 ? 2`,
+		`1.2.3`,
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("%s: should fail", expr)
+		}
+	}
+}
+
+func TestDependencies(t *testing.T) {
+	expr, err := Parse(`{A} + {B} * {A}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deps := expr.Dependencies()
+	if len(deps) != 2 || deps[0] != "A" || deps[1] != "B" {
+		t.Errorf("wrong dependencies: %v", deps)
+	}
+}
@@ -0,0 +1,275 @@
+/*
+ * Copyright (C) 2021 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package energy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+const kvBucket = "energy"
+
+type EnergyOpts struct {
+	// Tariff per kWh.
+	Tariff Tariff
+	// Currency used as unit of the cost items. Default to €.
+	Currency string
+	// Refresh is the period at which the counters are updated and persisted
+	// while the power doesn't change. Default to 1 minute.
+	Refresh time.Duration
+}
+
+// counters is the persisted state of a meter.
+type counters struct {
+	Day       string
+	Month     string
+	Today     float64
+	ThisMonth float64
+	Total     float64
+	TodayCost float64
+	MonthCost float64
+}
+
+// EnergyMeter integrates a power item, in watts, into kWh counters and their
+// cost. The counters are persisted in the KV store.
+type EnergyMeter struct {
+	TodayItem     *item.AnItem
+	MonthItem     *item.AnItem
+	TotalItem     *item.AnItem
+	TodayCostItem *item.AnItem
+	MonthCostItem *item.AnItem
+
+	id       string
+	lock     sync.Mutex
+	last     time.Time
+	watts    float64
+	counters counters
+	opts     EnergyOpts
+}
+
+func nextMidnight(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, t.Location())
+}
+
+// rollover resets the daily and monthly counters when entering a new day or
+// month.
+func (m *EnergyMeter) rollover(t time.Time) {
+	if day := t.Format("2006-01-02"); day != m.counters.Day {
+		m.counters.Day = day
+		m.counters.Today, m.counters.TodayCost = 0, 0
+	}
+	if month := t.Format("2006-01"); month != m.counters.Month {
+		m.counters.Month = month
+		m.counters.ThisMonth, m.counters.MonthCost = 0, 0
+	}
+}
+
+// integrate accumulates the energy consumed since the last update, the
+// interval is split at midnight so that each day gets its own share.
+func (m *EnergyMeter) integrate(now time.Time) {
+	for m.last.Before(now) {
+		m.rollover(m.last)
+
+		end := now
+		if midnight := nextMidnight(m.last); midnight.Before(end) {
+			end = midnight
+		}
+
+		kWh := m.watts * end.Sub(m.last).Hours() / 1000
+		cost := m.opts.Tariff.Cost(kWh, m.last)
+
+		m.counters.Today += kWh
+		m.counters.ThisMonth += kWh
+		m.counters.Total += kWh
+		m.counters.TodayCost += cost
+		m.counters.MonthCost += cost
+
+		m.last = end
+	}
+	m.rollover(now)
+}
+
+func (m *EnergyMeter) publish(c counters) {
+	m.TodayItem.SetValue(fmt.Sprintf("%.3f", c.Today))
+	m.MonthItem.SetValue(fmt.Sprintf("%.3f", c.ThisMonth))
+	m.TotalItem.SetValue(fmt.Sprintf("%.3f", c.Total))
+	m.TodayCostItem.SetValue(fmt.Sprintf("%.2f", c.TodayCost))
+	m.MonthCostItem.SetValue(fmt.Sprintf("%.2f", c.MonthCost))
+}
+
+func (m *EnergyMeter) save(c counters) {
+	if server.KV == nil {
+		return
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		server.Log.Errorf("Energy %s unable to marshal counters: %s", m.id, err)
+		return
+	}
+	if err := server.KV.SetString(kvBucket, m.id, string(data)); err != nil {
+		server.Log.Errorf("Energy %s unable to save counters: %s", m.id, err)
+	}
+}
+
+func (m *EnergyMeter) load() {
+	if server.KV == nil {
+		return
+	}
+
+	data, found, err := server.KV.GetString(kvBucket, m.id)
+	if err != nil || !found {
+		return
+	}
+	if err := json.Unmarshal([]byte(data), &m.counters); err != nil {
+		server.Log.Errorf("Energy %s unable to load counters: %s", m.id, err)
+	}
+}
+
+// update integrates up to the given time, then uses the given power.
+func (m *EnergyMeter) update(now time.Time, watts float64) {
+	m.lock.Lock()
+	m.integrate(now)
+	m.watts = watts
+	c := m.counters
+	m.lock.Unlock()
+
+	m.publish(c)
+}
+
+func (m *EnergyMeter) OnValueChange(it item.Item, old string, new string) {
+	watts, err := strconv.ParseFloat(new, 64)
+	if err != nil {
+		server.Log.Errorf("Energy %s wrong power value %s: %s", m.id, new, err)
+		return
+	}
+
+	// only the consumption is accounted, not what is exported
+	if watts < 0 {
+		watts = 0
+	}
+
+	m.update(time.Now(), watts)
+}
+
+func (m *EnergyMeter) refresh() {
+	ticker := time.NewTicker(m.opts.Refresh)
+	for range ticker.C {
+		m.lock.Lock()
+		m.integrate(time.Now())
+		c := m.counters
+		m.lock.Unlock()
+
+		m.publish(c)
+		m.save(c)
+	}
+}
+
+func newEnergyMeter(id string, opts ...EnergyOpts) *EnergyMeter {
+	m := &EnergyMeter{
+		id: id,
+	}
+	if len(opts) > 0 {
+		m.opts = opts[0]
+	}
+	if m.opts.Currency == "" {
+		m.opts.Currency = "€"
+	}
+	if m.opts.Refresh == 0 {
+		m.opts.Refresh = time.Minute
+	}
+
+	m.TodayItem = &item.AnItem{
+		ID:    fmt.Sprintf("%s/TODAY", id),
+		Label: "Today",
+		Type:  "value",
+		Img:   "electricity",
+		Unit:  "kWh",
+	}
+	m.MonthItem = &item.AnItem{
+		ID:    fmt.Sprintf("%s/MONTH", id),
+		Label: "This month",
+		Type:  "value",
+		Img:   "electricity",
+		Unit:  "kWh",
+	}
+	m.TotalItem = &item.AnItem{
+		ID:    fmt.Sprintf("%s/TOTAL", id),
+		Label: "Total",
+		Type:  "value",
+		Img:   "electricity",
+		Unit:  "kWh",
+	}
+	m.TodayCostItem = &item.AnItem{
+		ID:    fmt.Sprintf("%s/TODAY_COST", id),
+		Label: "Cost today",
+		Type:  "value",
+		Img:   "price",
+		Unit:  m.opts.Currency,
+	}
+	m.MonthCostItem = &item.AnItem{
+		ID:    fmt.Sprintf("%s/MONTH_COST", id),
+		Label: "Cost this month",
+		Type:  "value",
+		Img:   "price",
+		Unit:  m.opts.Currency,
+	}
+
+	return m
+}
+
+// NewEnergyMeter returns a meter integrating the given power item, in watts,
+// into kWh per day, per month and in total, along with their cost according
+// to the tariff.
+func NewEnergyMeter(id string, power item.Item, opts ...EnergyOpts) *EnergyMeter {
+	m := newEnergyMeter(id, opts...)
+
+	m.load()
+
+	now := time.Now()
+	m.last = now
+	m.rollover(now)
+	if watts, err := strconv.ParseFloat(power.GetValue(), 64); err == nil && watts > 0 {
+		m.watts = watts
+	}
+	m.publish(m.counters)
+
+	server.Registry.Add(m.TodayItem)
+	server.Registry.Add(m.MonthItem)
+	server.Registry.Add(m.TotalItem)
+	server.Registry.Add(m.TodayCostItem)
+	server.Registry.Add(m.MonthCostItem)
+
+	power.AddListener(m)
+
+	go m.refresh()
+
+	return m
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright (C) 2021 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package energy
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/safchain/hasc/pkg/kv"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+var testTariff = Tariff{
+	Price: 0.20,
+	Periods: []Period{
+		// off-peak hours every night
+		{Start: "22:00", End: "06:00", Price: 0.10},
+		// weekend day
+		{Start: "06:00", End: "22:00", Days: []time.Weekday{time.Saturday, time.Sunday}, Price: 0.15},
+	},
+}
+
+func assertFloat(t *testing.T, name string, value, expected float64) {
+	if math.Abs(value-expected) > 1e-9 {
+		t.Fatalf("%s: expected %f, got %f", name, expected, value)
+	}
+}
+
+func TestTariff(t *testing.T) {
+	// 2021-06-21 is a monday
+	tests := []struct {
+		time  time.Time
+		price float64
+	}{
+		{time.Date(2021, 6, 21, 12, 0, 0, 0, time.UTC), 0.20},
+		{time.Date(2021, 6, 21, 22, 0, 0, 0, time.UTC), 0.10},
+		{time.Date(2021, 6, 22, 5, 59, 0, 0, time.UTC), 0.10},
+		{time.Date(2021, 6, 22, 6, 0, 0, 0, time.UTC), 0.20},
+		{time.Date(2021, 6, 26, 12, 0, 0, 0, time.UTC), 0.15},
+		{time.Date(2021, 6, 26, 23, 0, 0, 0, time.UTC), 0.10},
+	}
+
+	for _, test := range tests {
+		assertFloat(t, test.time.String(), testTariff.PriceAt(test.time), test.price)
+	}
+
+	// night period of the weekend only, starting on sunday
+	tariff := Tariff{Price: 1, Periods: []Period{{Start: "23:00", End: "01:00", Days: []time.Weekday{time.Sunday}, Price: 2}}}
+	assertFloat(t, "sunday night", tariff.PriceAt(time.Date(2021, 6, 28, 0, 30, 0, 0, time.UTC)), 2)
+	assertFloat(t, "monday night", tariff.PriceAt(time.Date(2021, 6, 29, 0, 30, 0, 0, time.UTC)), 1)
+}
+
+func TestIntegration(t *testing.T) {
+	m := newEnergyMeter("HEATER", EnergyOpts{Tariff: testTariff})
+
+	start := time.Date(2021, 6, 21, 21, 0, 0, 0, time.UTC)
+	m.last = start
+	m.rollover(start)
+
+	// 2kW from 21:00 to 01:00, across midnight
+	m.update(start, 2000)
+	m.update(start.Add(4*time.Hour), 0)
+
+	assertFloat(t, "total", m.counters.Total, 8)
+	assertFloat(t, "today", m.counters.Today, 2)
+	assertFloat(t, "month", m.counters.ThisMonth, 8)
+	// the price is sampled at the start of each interval
+	assertFloat(t, "today cost", m.counters.TodayCost, 2*0.10)
+	assertFloat(t, "month cost", m.counters.MonthCost, 6*0.20+2*0.10)
+
+	if m.counters.Day != "2021-06-22" || m.TodayItem.GetValue() != "2.000" || m.TotalItem.GetValue() != "8.000" {
+		t.Fatalf("wrong counters: %+v", m.counters)
+	}
+
+	// month rollover
+	m.update(time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC), 1000)
+	m.update(time.Date(2021, 7, 1, 0, 30, 0, 0, time.UTC), 0)
+
+	assertFloat(t, "month", m.counters.ThisMonth, 0.5)
+	assertFloat(t, "total", m.counters.Total, 8.5)
+}
+
+func TestPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hasc-energy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := viper.New()
+	cfg.Set("data", dir)
+	server.KV = kv.NewKVStore(cfg)
+	defer func() { server.KV = nil }()
+
+	m := newEnergyMeter("HEATER")
+	m.counters = counters{Day: "2021-06-21", Month: "2021-06", Today: 1, ThisMonth: 2, Total: 3}
+	m.save(m.counters)
+
+	m = newEnergyMeter("HEATER")
+	m.load()
+	if m.counters.Total != 3 || m.counters.ThisMonth != 2 {
+		t.Fatalf("counters not restored: %+v", m.counters)
+	}
+
+	// a new day resets the daily counters only
+	m.rollover(time.Date(2021, 6, 22, 8, 0, 0, 0, time.UTC))
+	if m.counters.Today != 0 || m.counters.ThisMonth != 2 || m.counters.Total != 3 {
+		t.Fatalf("wrong rollover: %+v", m.counters)
+	}
+}
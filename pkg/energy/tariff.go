@@ -0,0 +1,104 @@
+/*
+ * Copyright (C) 2021 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package energy
+
+import (
+	"time"
+)
+
+// Period is a time-of-use period of a tariff.
+type Period struct {
+	// Start and End of the period, ex: 22:00 and 06:00, the end is excluded.
+	// A period ending before its start spans midnight.
+	Start string
+	End   string
+	// Days on which the period applies, every day if empty.
+	Days []time.Weekday
+	// Price per unit during the period.
+	Price float64
+}
+
+// Tariff gives the price of a unit, kWh, m3, etc., at a given time.
+type Tariff struct {
+	// Price per unit outside of the periods.
+	Price float64
+	// Periods with a specific price, the first matching period is used.
+	Periods []Period
+}
+
+func minutesOfDay(s string) (int, bool) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, false
+	}
+	return t.Hour()*60 + t.Minute(), true
+}
+
+func (p *Period) hasDay(day time.Weekday) bool {
+	if len(p.Days) == 0 {
+		return true
+	}
+	for _, d := range p.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Period) match(t time.Time) bool {
+	start, ok := minutesOfDay(p.Start)
+	if !ok {
+		return false
+	}
+	end, ok := minutesOfDay(p.End)
+	if !ok {
+		return false
+	}
+	now := t.Hour()*60 + t.Minute()
+
+	if start <= end {
+		return p.hasDay(t.Weekday()) && now >= start && now < end
+	}
+
+	// spanning midnight, the day is the one on which the period starts
+	if now >= start {
+		return p.hasDay(t.Weekday())
+	}
+	return now < end && p.hasDay(t.AddDate(0, 0, -1).Weekday())
+}
+
+// PriceAt returns the price of a unit at the given time.
+func (t *Tariff) PriceAt(tm time.Time) float64 {
+	for _, p := range t.Periods {
+		if p.match(tm) {
+			return p.Price
+		}
+	}
+	return t.Price
+}
+
+// Cost returns the cost of the given quantity consumed at the given time.
+func (t *Tariff) Cost(quantity float64, tm time.Time) float64 {
+	return quantity * t.PriceAt(tm)
+}
@@ -23,11 +23,16 @@
 package envoy
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"math"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/tidwall/gjson"
@@ -36,13 +41,44 @@ import (
 	"github.com/safchain/hasc/pkg/server"
 )
 
+const statusOK = "OK"
+
+type EnvoyOpts struct {
+	// Token used by the firmwares 7+, retrieved from https://entrez.enphaseenergy.com.
+	Token string
+	// InsecureSkipVerify disables the verification of the self-signed
+	// certificate of the Envoy.
+	InsecureSkipVerify bool
+	// InvertersEndpoint, default to /api/v1/production/inverters on the
+	// host of the production endpoint.
+	InvertersEndpoint string
+	// Inverters serial numbers for which an item is created right away, the
+	// other inverters get an item once reported.
+	Inverters []string
+}
+
 type Envoy struct {
 	TotalProductionItem  *item.AnItem
 	TotalConsumptionItem *item.AnItem
 	NetConsumptionItem   *item.AnItem
 	InvertersItem        *item.AnItem
 
-	endpoint string
+	ProductionTodayItem     *item.AnItem
+	ProductionLifetimeItem  *item.AnItem
+	ConsumptionTodayItem    *item.AnItem
+	ConsumptionLifetimeItem *item.AnItem
+	SelfConsumptionItem     *item.AnItem
+	GridImportItem          *item.AnItem
+	GridExportItem          *item.AnItem
+	StatusItem              *item.AnItem
+
+	id                string
+	endpoint          string
+	invertersEndpoint string
+	client            *http.Client
+	lock              sync.RWMutex
+	inverterItems     map[string]*item.AnItem
+	opts              EnvoyOpts
 }
 
 func stringToFloatString(value string) string {
@@ -50,30 +86,147 @@ func stringToFloatString(value string) string {
 	return fmt.Sprintf("%.2f", f)
 }
 
-func (e *Envoy) refreshFnc() {
-	resp, err := http.Get(e.endpoint)
+func floatString(f float64) string {
+	return fmt.Sprintf("%.2f", f)
+}
+
+func (e *Envoy) get(endpoint string) ([]byte, error) {
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if e.opts.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+e.opts.Token)
+	}
+
+	resp, err := e.client.Do(req)
 	if err != nil {
-		log.Panic(err)
-		return
+		return nil, err
 	}
 	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return nil, errors.New("unauthorized, the token is missing or expired")
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (e *Envoy) inverterItem(serial string) *item.AnItem {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	it, ok := e.inverterItems[serial]
+	if !ok {
+		it = &item.AnItem{
+			ID:    fmt.Sprintf("%s/INVERTER_%s", e.id, serial),
+			Label: fmt.Sprintf("Inverter %s", serial),
+			Img:   "electricity",
+			Type:  "value",
+			Unit:  "W",
+		}
+		e.inverterItems[serial] = it
+
+		server.Registry.Add(it)
+	}
+
+	return it
+}
+
+// InverterItems returns the production items of the inverters, by serial
+// number.
+func (e *Envoy) InverterItems() map[string]*item.AnItem {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+
+	items := make(map[string]*item.AnItem)
+	for serial, it := range e.inverterItems {
+		items[serial] = it
+	}
+	return items
+}
+
+func (e *Envoy) refreshProduction() error {
+	b, err := e.get(e.endpoint)
 	if err != nil {
-		log.Panic(err)
-		return
+		return err
+	}
+	body := string(b)
+
+	if !gjson.Valid(body) {
+		return errors.New("invalid production JSON")
 	}
 
-	value := gjson.Get(string(body), `production.#(type=="inverters").activeCount`)
+	value := gjson.Get(body, `production.#(type=="inverters").activeCount`)
 	e.InvertersItem.SetValue(stringToFloatString(value.String()))
 
-	value = gjson.Get(string(body), `production.#(type=="eim").wNow`)
-	e.TotalProductionItem.SetValue(stringToFloatString(value.String()))
+	production := gjson.Get(body, `production.#(type=="eim")`)
+	e.TotalProductionItem.SetValue(stringToFloatString(production.Get("wNow").String()))
+	e.ProductionTodayItem.SetValue(stringToFloatString(production.Get("whToday").String()))
+	e.ProductionLifetimeItem.SetValue(stringToFloatString(production.Get("whLifetime").String()))
+
+	consumption := gjson.Get(body, `consumption.#(measurementType=="total-consumption")`)
+	e.TotalConsumptionItem.SetValue(stringToFloatString(consumption.Get("wNow").String()))
+	e.ConsumptionTodayItem.SetValue(stringToFloatString(consumption.Get("whToday").String()))
+	e.ConsumptionLifetimeItem.SetValue(stringToFloatString(consumption.Get("whLifetime").String()))
+
+	net := gjson.Get(body, `consumption.#(measurementType=="net-consumption").wNow`).Float()
+	e.NetConsumptionItem.SetValue(floatString(net))
+
+	// net consumption is positive when importing, negative when exporting
+	e.GridImportItem.SetValue(floatString(math.Max(net, 0)))
+	e.GridExportItem.SetValue(floatString(math.Max(-net, 0)))
+
+	// the production consumed locally
+	produced := math.Max(production.Get("wNow").Float(), 0)
+	e.SelfConsumptionItem.SetValue(floatString(math.Min(produced, consumption.Get("wNow").Float())))
+
+	return nil
+}
+
+func (e *Envoy) refreshInverters() error {
+	b, err := e.get(e.invertersEndpoint)
+	if err != nil {
+		return err
+	}
+	body := string(b)
+
+	if !gjson.Valid(body) {
+		return errors.New("invalid inverters JSON")
+	}
+
+	for _, inverter := range gjson.Parse(body).Array() {
+		serial := inverter.Get("serialNumber").String()
+		if serial == "" {
+			continue
+		}
+		e.inverterItem(serial).SetValue(stringToFloatString(inverter.Get("lastReportWatts").String()))
+	}
+
+	return nil
+}
+
+func (e *Envoy) refreshFnc() {
+	var status []string
 
-	value = gjson.Get(string(body), `consumption.#(measurementType=="total-consumption").wNow`)
-	e.TotalConsumptionItem.SetValue(stringToFloatString(value.String()))
+	if err := e.refreshProduction(); err != nil {
+		server.Log.Errorf("Envoy production refresh error: %s", err)
+		status = append(status, fmt.Sprintf("production: %s", err))
+	}
+
+	if err := e.refreshInverters(); err != nil {
+		server.Log.Errorf("Envoy inverters refresh error: %s", err)
+		status = append(status, fmt.Sprintf("inverters: %s", err))
+	}
 
-	value = gjson.Get(string(body), `consumption.#(measurementType=="net-consumption").wNow`)
-	e.NetConsumptionItem.SetValue(stringToFloatString(value.String()))
+	if len(status) == 0 {
+		e.StatusItem.SetValue(statusOK)
+	} else {
+		e.StatusItem.SetValue("Error: " + strings.Join(status, "; "))
+	}
 }
 
 func (e *Envoy) refresh(refresh time.Duration) {
@@ -88,9 +241,11 @@ func (e *Envoy) refresh(refresh time.Duration) {
 	}
 }
 
-func NewEnvoy(id string, label string, endpoint string, refresh time.Duration) *Envoy {
+func newEnvoy(id string, endpoint string, opts ...EnvoyOpts) (*Envoy, error) {
 	e := &Envoy{
-		endpoint: endpoint,
+		id:            id,
+		endpoint:      endpoint,
+		inverterItems: make(map[string]*item.AnItem),
 		TotalProductionItem: &item.AnItem{
 			ID:    fmt.Sprintf("%s/TOTAL_PRODUCTION", id),
 			Label: "Total production",
@@ -119,14 +274,113 @@ func NewEnvoy(id string, label string, endpoint string, refresh time.Duration) *
 			Type:  "value",
 			Unit:  "",
 		},
+		ProductionTodayItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/PRODUCTION_TODAY", id),
+			Label: "Production today",
+			Img:   "electricity",
+			Type:  "value",
+			Unit:  "Wh",
+		},
+		ProductionLifetimeItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/PRODUCTION_LIFETIME", id),
+			Label: "Production lifetime",
+			Img:   "electricity",
+			Type:  "value",
+			Unit:  "Wh",
+		},
+		ConsumptionTodayItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/CONSUMPTION_TODAY", id),
+			Label: "Consumption today",
+			Img:   "electricity",
+			Type:  "value",
+			Unit:  "Wh",
+		},
+		ConsumptionLifetimeItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/CONSUMPTION_LIFETIME", id),
+			Label: "Consumption lifetime",
+			Img:   "electricity",
+			Type:  "value",
+			Unit:  "Wh",
+		},
+		SelfConsumptionItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/SELF_CONSUMPTION", id),
+			Label: "Self consumption",
+			Img:   "electricity",
+			Type:  "value",
+			Unit:  "W",
+		},
+		GridImportItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/GRID_IMPORT", id),
+			Label: "Grid import",
+			Img:   "electricity",
+			Type:  "value",
+			Unit:  "W",
+		},
+		GridExportItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/GRID_EXPORT", id),
+			Label: "Grid export",
+			Img:   "electricity",
+			Type:  "value",
+			Unit:  "W",
+		},
+		StatusItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/STATUS", id),
+			Label: "Status",
+			Img:   "dev",
+			Type:  "value",
+		},
+	}
+	if len(opts) > 0 {
+		e.opts = opts[0]
+	}
+
+	e.invertersEndpoint = e.opts.InvertersEndpoint
+	if e.invertersEndpoint == "" {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		u.Path, u.RawQuery = "/api/v1/production/inverters", ""
+		e.invertersEndpoint = u.String()
+	}
+
+	e.client = &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: e.opts.InsecureSkipVerify},
+		},
+	}
+
+	return e, nil
+}
+
+// NewEnvoy returns an Envoy polling the production endpoint, ex:
+// http://envoy.local/production.json, and the inverters endpoint.
+func NewEnvoy(id string, label string, endpoint string, refresh time.Duration, opts ...EnvoyOpts) (*Envoy, error) {
+	e, err := newEnvoy(id, endpoint, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("Envoy wrong endpoint %s: %s", endpoint, err)
 	}
 
 	server.Registry.Add(e.TotalConsumptionItem)
 	server.Registry.Add(e.TotalProductionItem)
 	server.Registry.Add(e.NetConsumptionItem)
 	server.Registry.Add(e.InvertersItem)
+	server.Registry.Add(e.ProductionTodayItem)
+	server.Registry.Add(e.ProductionLifetimeItem)
+	server.Registry.Add(e.ConsumptionTodayItem)
+	server.Registry.Add(e.ConsumptionLifetimeItem)
+	server.Registry.Add(e.SelfConsumptionItem)
+	server.Registry.Add(e.GridImportItem)
+	server.Registry.Add(e.GridExportItem)
+	server.Registry.Add(e.StatusItem)
+
+	for _, serial := range e.opts.Inverters {
+		e.inverterItem(serial)
+	}
 
 	go e.refresh(refresh)
 
-	return e
+	return e, nil
 }
@@ -0,0 +1,131 @@
+/*
+ * Copyright (C) 2017 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package envoy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/registry"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+func newTestServer(token string) *httptest.Server {
+	mux := http.NewServeMux()
+	serve := func(file string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if token != "" && r.Header.Get("Authorization") != "Bearer "+token {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			http.ServeFile(w, r, filepath.Join("testdata", file))
+		}
+	}
+	mux.HandleFunc("/production.json", serve("production.json"))
+	mux.HandleFunc("/api/v1/production/inverters", serve("inverters.json"))
+
+	return httptest.NewServer(mux)
+}
+
+func TestEnvoy(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	ts := newTestServer("")
+	defer ts.Close()
+
+	e, err := newEnvoy("ENVOY", ts.URL+"/production.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.refreshFnc()
+
+	if e.StatusItem.GetValue() != statusOK {
+		t.Fatalf("unexpected status: %s", e.StatusItem.GetValue())
+	}
+
+	for _, test := range []struct {
+		item     *item.AnItem
+		expected string
+	}{
+		{e.InvertersItem, "2.00"},
+		{e.TotalProductionItem, "530.21"},
+		{e.ProductionTodayItem, "3520.00"},
+		{e.ProductionLifetimeItem, "1210345.50"},
+		{e.TotalConsumptionItem, "380.50"},
+		{e.ConsumptionTodayItem, "5120.00"},
+		{e.ConsumptionLifetimeItem, "2304567.20"},
+		{e.NetConsumptionItem, "-149.71"},
+		{e.GridImportItem, "0.00"},
+		{e.GridExportItem, "149.71"},
+		{e.SelfConsumptionItem, "380.50"},
+	} {
+		if test.item.GetValue() != test.expected {
+			t.Fatalf("%s: expected %s, got %s", test.item.GetID(), test.expected, test.item.GetValue())
+		}
+	}
+
+	inverters := e.InverterItems()
+	if len(inverters) != 2 || inverters["121935012345"].GetValue() != "258.00" {
+		t.Fatalf("wrong inverters: %v", inverters)
+	}
+	if server.Registry.Get("ENVOY/INVERTER_121935012346") == nil {
+		t.Fatal("inverter item not registered")
+	}
+}
+
+func TestEnvoyToken(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	ts := newTestServer("secret")
+	defer ts.Close()
+
+	e, err := newEnvoy("ENVOY", ts.URL+"/production.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.refreshFnc()
+
+	expected := "Error: production: unauthorized, the token is missing or expired; inverters: unauthorized, the token is missing or expired"
+	if e.StatusItem.GetValue() != expected {
+		t.Fatalf("unexpected status: %s", e.StatusItem.GetValue())
+	}
+
+	e.opts.Token = "secret"
+	e.refreshFnc()
+
+	if e.StatusItem.GetValue() != statusOK || e.TotalProductionItem.GetValue() != "530.21" {
+		t.Fatalf("unexpected status: %s", e.StatusItem.GetValue())
+	}
+}
+
+func TestEnvoyWrongEndpoint(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	if e, err := NewEnvoy("ENVOY", "Envoy", "://envoy.local", time.Minute); err == nil || e != nil {
+		t.Fatalf("expected an error, got: %v", e)
+	}
+}
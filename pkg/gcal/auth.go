@@ -0,0 +1,275 @@
+/*
+ * Copyright (C) 2021 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package gcal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/safchain/hasc/pkg/server"
+)
+
+const (
+	statusConnected    = "Connected"
+	statusUnauthorized = "Authorization required"
+)
+
+var deviceCodeURL = "https://oauth2.googleapis.com/device/code"
+
+// savingTokenSource persists the token each time it gets refreshed.
+type savingTokenSource struct {
+	sync.Mutex
+	src  oauth2.TokenSource
+	last string
+	save func(token *oauth2.Token)
+}
+
+type deviceCode struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURL string `json:"verification_url"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+}
+
+type deviceToken struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	Error        string `json:"error"`
+}
+
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.src.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	if token.AccessToken != s.last {
+		s.last = token.AccessToken
+		s.save(token)
+	}
+	s.Unlock()
+
+	return token, nil
+}
+
+func newState() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestDeviceCode starts the OAuth device flow, the user code has to be
+// entered at the verification URL.
+func requestDeviceCode(config *oauth2.Config) (*deviceCode, error) {
+	resp, err := http.PostForm(deviceCodeURL, url.Values{
+		"client_id": {config.ClientID},
+		"scope":     {strings.Join(config.Scopes, " ")},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	code := &deviceCode{}
+	if err := json.NewDecoder(resp.Body).Decode(code); err != nil {
+		return nil, err
+	}
+	if code.Interval <= 0 {
+		code.Interval = 5
+	}
+
+	return code, nil
+}
+
+// pollDeviceToken polls the token endpoint until the user grants, or denies,
+// the access.
+func pollDeviceToken(config *oauth2.Config, code *deviceCode) (*oauth2.Token, error) {
+	interval := time.Duration(code.Interval) * time.Second
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		resp, err := http.PostForm(config.Endpoint.TokenURL, url.Values{
+			"client_id":     {config.ClientID},
+			"client_secret": {config.ClientSecret},
+			"device_code":   {code.DeviceCode},
+			"grant_type":    {"urn:ietf:params:oauth:grant-type:device_code"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		dt := &deviceToken{}
+		err = json.NewDecoder(resp.Body).Decode(dt)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		switch dt.Error {
+		case "":
+			return &oauth2.Token{
+				AccessToken:  dt.AccessToken,
+				TokenType:    dt.TokenType,
+				RefreshToken: dt.RefreshToken,
+				Expiry:       time.Now().Add(time.Duration(dt.ExpiresIn) * time.Second),
+			}, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			return nil, fmt.Errorf("authorization failed: %s", dt.Error)
+		}
+	}
+
+	return nil, fmt.Errorf("authorization code expired")
+}
+
+func (g *GCal) setStatus(status string) {
+	g.StatusItem.SetValue(status)
+}
+
+func (g *GCal) authPath() string {
+	return "/gcal/" + strings.ToLower(g.opts.ID)
+}
+
+func (g *GCal) redirectURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s/callback", scheme, r.Host, g.authPath())
+}
+
+// authorize redirects the browser to the Google consent page.
+func (g *GCal) authorize(w http.ResponseWriter, r *http.Request) {
+	config := *g.config
+	config.RedirectURL = g.redirectURL(r)
+
+	g.lock.Lock()
+	g.state = newState()
+	authURL := config.AuthCodeURL(g.state, oauth2.AccessTypeOffline, oauth2.SetAuthURLParam("prompt", "consent"))
+	g.lock.Unlock()
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// callback exchanges the authorization code returned by Google for a token.
+func (g *GCal) callback(w http.ResponseWriter, r *http.Request) {
+	g.lock.RLock()
+	state := g.state
+	g.lock.RUnlock()
+
+	if state == "" || r.FormValue("state") != state {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400 - Invalid state"))
+		return
+	}
+
+	if e := r.FormValue("error"); e != "" {
+		g.setStatus("Error: " + e)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("403 - " + e))
+		return
+	}
+
+	config := *g.config
+	config.RedirectURL = g.redirectURL(r)
+
+	token, err := config.Exchange(context.Background(), r.FormValue("code"))
+	if err != nil {
+		server.Log.Errorf("GCal unable to retrieve token from web %v", err)
+		g.setStatus(fmt.Sprintf("Error: %s", err))
+
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("500 - Unable to retrieve token"))
+		return
+	}
+
+	g.lock.Lock()
+	g.state = ""
+	g.lock.Unlock()
+
+	g.saveToken(g.tokenCacheFile(), token)
+	g.connect(token)
+	go g.refreshFnc(g.name)
+
+	w.Write([]byte("GCal authorization completed"))
+}
+
+// authorizeDevice runs the OAuth device flow, the code to enter is reported
+// through the status item.
+func (g *GCal) authorizeDevice() {
+	for {
+		code, err := requestDeviceCode(g.config)
+		if err != nil {
+			server.Log.Errorf("GCal unable to request a device code: %s", err)
+			g.setStatus(fmt.Sprintf("Error: %s", err))
+
+			time.Sleep(time.Minute)
+			continue
+		}
+
+		server.Log.Warningf("GCal go to %s and enter the code %s", code.VerificationURL, code.UserCode)
+		g.setStatus(fmt.Sprintf("%s: go to %s and enter the code %s", statusUnauthorized, code.VerificationURL, code.UserCode))
+
+		token, err := pollDeviceToken(g.config, code)
+		if err != nil {
+			server.Log.Errorf("GCal device authorization failed: %s", err)
+			g.setStatus(fmt.Sprintf("Error: %s", err))
+
+			time.Sleep(time.Minute)
+			continue
+		}
+
+		g.saveToken(g.tokenCacheFile(), token)
+		g.connect(token)
+		g.refreshFnc(g.name)
+
+		return
+	}
+}
+
+func (g *GCal) registerAuthHandlers() {
+	server.HandleFunc(g.authPath()+"/auth", g.authorize).Methods("GET")
+	server.HandleFunc(g.authPath()+"/callback", g.callback).Methods("GET")
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (C) 2021 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package gcal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestDeviceFlow(t *testing.T) {
+	var polls int
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device/code", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("client_id") != "id" || r.FormValue("scope") != "calendar" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"device_code":"dc","user_code":"ABCD-EFGH","verification_url":"https://www.google.com/device","expires_in":30,"interval":1}`))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("device_code") != "dc" {
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		if polls++; polls < 2 {
+			w.Write([]byte(`{"error":"authorization_pending"}`))
+			return
+		}
+		w.Write([]byte(`{"access_token":"at","refresh_token":"rt","token_type":"Bearer","expires_in":3600}`))
+	})
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	deviceCodeURL = ts.URL + "/device/code"
+
+	config := &oauth2.Config{
+		ClientID: "id",
+		Scopes:   []string{"calendar"},
+		Endpoint: oauth2.Endpoint{TokenURL: ts.URL + "/token"},
+	}
+
+	code, err := requestDeviceCode(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code.UserCode != "ABCD-EFGH" {
+		t.Fatalf("wrong user code: %s", code.UserCode)
+	}
+
+	token, err := pollDeviceToken(config, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "at" || token.RefreshToken != "rt" || polls != 2 {
+		t.Fatalf("wrong token: %+v, polls: %d", token, polls)
+	}
+
+	code.DeviceCode = "unknown"
+	if _, err = pollDeviceToken(config, code); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+type fakeTokenSource struct {
+	token *oauth2.Token
+}
+
+func (f *fakeTokenSource) Token() (*oauth2.Token, error) {
+	return f.token, nil
+}
+
+func TestSavingTokenSource(t *testing.T) {
+	var saved []string
+
+	src := &fakeTokenSource{token: &oauth2.Token{AccessToken: "a"}}
+	s := &savingTokenSource{
+		src:  src,
+		last: "a",
+		save: func(token *oauth2.Token) {
+			saved = append(saved, token.AccessToken)
+		},
+	}
+
+	s.Token()
+	src.token = &oauth2.Token{AccessToken: "b"}
+	s.Token()
+	s.Token()
+
+	if len(saved) != 1 || saved[0] != "b" {
+		t.Fatalf("only the refreshed token should be saved, got: %v", saved)
+	}
+}
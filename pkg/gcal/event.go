@@ -0,0 +1,438 @@
+/*
+ * Copyright (C) 2021 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package gcal
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+type actionKind int
+
+const (
+	startAction actionKind = iota
+	endAction
+	sceneAction
+)
+
+// calEvent is a calendar event independent of the calendar backend.
+type calEvent struct {
+	id          string
+	summary     string
+	description string
+	start       time.Time
+	end         time.Time
+}
+
+// action is an item change described by a line of the event description.
+type action struct {
+	kind   actionKind
+	offset time.Duration
+	itemID string
+	value  string
+	// loose actions have no colon after the keyword and may be prose
+	loose bool
+}
+
+type scheduledEvent struct {
+	key         string
+	id          string
+	summary     string
+	description string
+	errors      []string
+	cancel      chan bool
+	// ended with actions still pending, ex: END+5m
+	ended bool
+}
+
+// scheduler schedules the actions of calendar events.
+type scheduler struct {
+	sync.RWMutex
+
+	ActiveItem *item.AnItem
+	ErrorItem  *item.AnItem
+
+	name   string
+	events map[string]*scheduledEvent
+	active map[*scheduledEvent]string
+}
+
+var (
+	actionRe = regexp.MustCompile(`(?i)^(START|END|SCENE)(?:\s*([+-]\s*[0-9][0-9a-z.]*))?\s*(:|\s)\s*(.*)$`)
+	// itemIDRe matches the item IDs of the actions without colon, the other
+	// lines being prose, ex: End, see you.
+	itemIDRe = regexp.MustCompile(`(?i)^[A-Z0-9_]+(?:[/.\-][A-Z0-9_]+)*$`)
+	brRe     = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</div>`)
+	tagRe    = regexp.MustCompile(`<[^>]*>`)
+)
+
+func (k actionKind) String() string {
+	switch k {
+	case startAction:
+		return "START"
+	case endAction:
+		return "END"
+	case sceneAction:
+		return "SCENE"
+	}
+	return "UNKNOWN"
+}
+
+func (a *action) time(event *calEvent) time.Time {
+	if a.kind == endAction {
+		return event.end.Add(a.offset)
+	}
+	return event.start.Add(a.offset)
+}
+
+func (e *scheduledEvent) stop() {
+	select {
+	case e.cancel <- true:
+	default:
+	}
+}
+
+func calEventID(event *calEvent) string {
+	u := uuid.NewV5(uuid.NamespaceOID,
+		fmt.Sprintf("%s-%s-%s-%s", event.summary, event.description,
+			event.start.Format(time.RFC3339), event.end.Format(time.RFC3339)))
+	return u.String()
+}
+
+// parseActions returns the actions found in the given description, one per
+// line, using the following format :
+// START[+-offset] <Object ID> <State>
+// END[+-offset] <Object ID> <State>
+// SCENE[+-offset] <Scene ID>
+// The keyword may be followed by a colon, ex: START: HEATER ON. Lines not
+// starting with a keyword are ignored. The lines without colon are loose
+// actions, ignored when their item is a lower case word without value, ex:
+// Start here, or not found, ex: End of meeting.
+func parseActions(description string) ([]*action, []error) {
+	var (
+		actions []*action
+		errs    []error
+	)
+
+	description = brRe.ReplaceAllString(description, "\n")
+	description = tagRe.ReplaceAllString(description, "")
+	description = strings.NewReplacer("&nbsp;", " ", "&amp;", "&", "&lt;", "<", "&gt;", ">").Replace(description)
+
+	for _, line := range strings.Split(description, "\n") {
+		line = strings.TrimSpace(line)
+
+		res := actionRe.FindStringSubmatch(line)
+		if len(res) == 0 {
+			continue
+		}
+
+		fields := strings.Fields(res[4])
+		loose := res[3] != ":"
+		if loose && (len(fields) == 0 || !itemIDRe.MatchString(fields[0]) ||
+			len(fields) == 1 && isProse(fields[0]) && strings.ToUpper(res[1]) != "SCENE") {
+			continue
+		}
+
+		a := &action{loose: loose}
+		switch strings.ToUpper(res[1]) {
+		case "START":
+			a.kind = startAction
+		case "END":
+			a.kind = endAction
+		case "SCENE":
+			a.kind = sceneAction
+		}
+
+		if res[2] != "" {
+			offset, err := time.ParseDuration(strings.Replace(res[2], " ", "", -1))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("wrong offset in '%s': %s", line, err))
+				continue
+			}
+			a.offset = offset
+		}
+
+		if len(fields) > 0 {
+			a.itemID = fields[0]
+			a.value = strings.Join(fields[1:], " ")
+		}
+
+		switch {
+		case a.itemID == "":
+			errs = append(errs, fmt.Errorf("missing item in '%s'", line))
+			continue
+		case a.kind == sceneAction:
+			if a.value != "" {
+				errs = append(errs, fmt.Errorf("unexpected value in '%s'", line))
+				continue
+			}
+			a.value = item.ON
+		case a.value == "":
+			errs = append(errs, fmt.Errorf("missing value in '%s'", line))
+			continue
+		}
+
+		actions = append(actions, a)
+	}
+
+	return actions, errs
+}
+
+// lookupItem returns the item with the given ID, ignoring the case if there
+// is no exact match.
+func lookupItem(id string) item.Item {
+	if it := server.Registry.Get(id); it != nil {
+		return it
+	}
+	for _, it := range server.Registry.Items() {
+		if strings.EqualFold(it.GetID(), id) {
+			return it
+		}
+	}
+	return nil
+}
+
+// isProse returns whether the first word of a loose action is likely prose
+// rather than an item ID, ex: of in End of meeting.
+func isProse(word string) bool {
+	return word != strings.ToUpper(word) && !strings.ContainsAny(word, "/.-_0123456789")
+}
+
+func (s *scheduler) applyAction(a *action) {
+	if it := server.Registry.Get(a.itemID); it != nil {
+		server.Log.Infof("%s set %s to %s", s.name, it.GetID(), a.value)
+		it.SetValue(a.value)
+	}
+}
+
+func (s *scheduler) setActive(e *scheduledEvent, active bool) {
+	s.Lock()
+	if active {
+		s.active[e] = e.summary
+	} else {
+		delete(s.active, e)
+	}
+
+	var summaries []string
+	for _, summary := range s.active {
+		summaries = append(summaries, summary)
+	}
+	s.Unlock()
+
+	sort.Strings(summaries)
+	s.ActiveItem.SetValue(strings.Join(summaries, ", "))
+}
+
+func (s *scheduler) newEvent(event *calEvent) (*scheduledEvent, error) {
+	e := &scheduledEvent{
+		key:         event.id,
+		id:          calEventID(event),
+		summary:     event.summary,
+		description: event.description,
+		cancel:      make(chan bool, 1),
+	}
+
+	now := time.Now()
+	if !event.end.After(now) {
+		return nil, fmt.Errorf("%s event already ended: %s", s.name, event.summary)
+	}
+
+	actions, errs := parseActions(event.description)
+	for _, err := range errs {
+		e.errors = append(e.errors, fmt.Sprintf("%s: %s", event.summary, err))
+	}
+
+	var pending []*action
+	for _, a := range actions {
+		it := lookupItem(a.itemID)
+		if it == nil {
+			if a.loose && isProse(a.itemID) {
+				continue
+			}
+			e.errors = append(e.errors, fmt.Sprintf("%s: item %s not found", event.summary, a.itemID))
+			continue
+		}
+		a.itemID = it.GetID()
+
+		if a.time(event).After(now) {
+			pending = append(pending, a)
+		} else if a.kind != endAction {
+			// event already in progress, apply the action right now
+			s.applyAction(a)
+		}
+	}
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].time(event).Before(pending[j].time(event))
+	})
+
+	inProgress := !event.start.After(now)
+	if inProgress {
+		s.setActive(e, true)
+	}
+
+	go func() {
+		defer func() {
+			s.setActive(e, false)
+
+			s.Lock()
+			if s.events[e.key] == e {
+				delete(s.events, e.key)
+			}
+			s.Unlock()
+		}()
+
+		startAfter := time.After(event.start.Sub(now))
+		if inProgress {
+			startAfter = nil
+		}
+		endAfter := time.After(event.end.Sub(now))
+
+		for {
+			var actionAfter <-chan time.Time
+			if len(pending) > 0 {
+				actionAfter = time.After(time.Until(pending[0].time(event)))
+			}
+
+			select {
+			case <-actionAfter:
+				s.applyAction(pending[0])
+				pending = pending[1:]
+			case <-startAfter:
+				s.setActive(e, true)
+			case <-endAfter:
+				// let the remaining actions, ex: END+5m, being applied
+				if len(pending) == 0 {
+					return
+				}
+				s.setActive(e, false)
+				endAfter = nil
+
+				// not returned anymore by the calendars
+				s.Lock()
+				e.ended = true
+				s.Unlock()
+			case <-e.cancel:
+				server.Log.Infof("%s event terminated: %s summary: %s, description: %s", s.name, e.id, e.summary, strings.Replace(e.description, "\n", "; ", -1))
+				return
+			}
+
+			if len(pending) == 0 && !event.end.After(time.Now()) {
+				return
+			}
+		}
+	}()
+
+	return e, nil
+}
+
+func (s *scheduler) scheduleEvent(event *calEvent) (*scheduledEvent, error) {
+	s.RLock()
+	e, ok := s.events[event.id]
+	s.RUnlock()
+
+	if ok {
+		if e.id == calEventID(event) {
+			return e, nil
+		}
+		e.stop()
+	}
+	e, err := s.newEvent(event)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	s.events[event.id] = e
+	s.Unlock()
+
+	server.Log.Infof("%s new event scheduled: %s summary: %s, description: %s", s.name, event.id, event.summary, strings.Replace(event.description, "\n", "; ", -1))
+
+	return e, nil
+}
+
+// sync schedules the given events and cancels the ones not present anymore,
+// the errors of the events not retrieved being reported with the parsing ones.
+func (s *scheduler) sync(events []*calEvent, feedErrors []string) {
+	errors := append([]string{}, feedErrors...)
+
+	scheduled := make(map[string]*scheduledEvent)
+	for _, event := range events {
+		e, err := s.scheduleEvent(event)
+		if err != nil {
+			server.Log.Errorf("%s error while scheduling: %s", s.name, err)
+			continue
+		}
+		scheduled[e.id] = e
+
+		for _, err := range e.errors {
+			server.Log.Errorf("%s error while parsing: %s", s.name, err)
+		}
+		errors = append(errors, e.errors...)
+	}
+
+	// close event not scheduled anymore, the ended ones having to apply their
+	// remaining actions
+	s.RLock()
+	for _, e := range s.events {
+		if _, ok := scheduled[e.id]; !ok && !e.ended {
+			e.stop()
+		}
+	}
+	s.RUnlock()
+
+	s.ErrorItem.SetValue(strings.Join(errors, "; "))
+}
+
+func newScheduler(name string, id string) *scheduler {
+	s := &scheduler{
+		name:   name,
+		events: make(map[string]*scheduledEvent),
+		active: make(map[*scheduledEvent]string),
+		ActiveItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/ACTIVE_EVENTS", id),
+			Label: "Active events",
+			Type:  "value",
+			Img:   "clock",
+		},
+		ErrorItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/ERRORS", id),
+			Label: "Errors",
+			Type:  "value",
+			Img:   "dev",
+		},
+	}
+
+	server.Registry.Add(s.ActiveItem)
+	server.Registry.Add(s.ErrorItem)
+
+	return s
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright (C) 2021 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package gcal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/registry"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+func TestParseActions(t *testing.T) {
+	description := `Heating schedule<br>START HEATER ON
+START-15m: BOILER/MODE eco mode
+END+1h30m LIGHT OFF
+SCENE MORNING
+START heater ON
+END living/light off
+Starting soon, nothing to parse here
+End of meeting with Bob
+Start here
+START+5x HEATER ON
+END HEATER
+SCENE MORNING ON
+END:`
+
+	actions, errs := parseActions(description)
+	if len(actions) != 7 {
+		t.Fatalf("expected 7 actions, got: %d", len(actions))
+	}
+	if len(errs) != 4 {
+		t.Fatalf("expected 4 errors, got: %v", errs)
+	}
+
+	expected := []action{
+		{kind: startAction, itemID: "HEATER", value: "ON", loose: true},
+		{kind: startAction, offset: -15 * time.Minute, itemID: "BOILER/MODE", value: "eco mode"},
+		{kind: endAction, offset: 90 * time.Minute, itemID: "LIGHT", value: "OFF", loose: true},
+		{kind: sceneAction, itemID: "MORNING", value: item.ON, loose: true},
+		{kind: startAction, itemID: "heater", value: "ON", loose: true},
+		{kind: endAction, itemID: "living/light", value: "off", loose: true},
+		// prose, ignored if there is no item of
+		{kind: endAction, itemID: "of", value: "meeting with Bob", loose: true},
+	}
+	for i, a := range actions {
+		if *a != expected[i] {
+			t.Fatalf("expected %+v, got %+v", expected[i], *a)
+		}
+	}
+}
+
+func TestEventInProgress(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	heater := &item.AnItem{ID: "HEATER"}
+	light := &item.AnItem{ID: "LIGHT"}
+	server.Registry.Add(heater)
+	server.Registry.Add(light)
+
+	s := newScheduler("Test", "TEST")
+
+	now := time.Now()
+	s.sync([]*calEvent{
+		{
+			id:          "1",
+			summary:     "In progress",
+			description: "start heater ON\nEND HEATER OFF\nEND-500ms LIGHT ON\nSTART UNKNOWN ON\nEnd of meeting with Bob\nEND living/light off",
+			start:       now.Add(-time.Second),
+			end:         now.Add(time.Second),
+		},
+	}, nil)
+
+	if heater.GetValue() != item.ON {
+		t.Fatalf("should get ON state, got: %s", heater.GetValue())
+	}
+	if s.ActiveItem.GetValue() != "In progress" {
+		t.Fatalf("wrong active events: %s", s.ActiveItem.GetValue())
+	}
+	if s.ErrorItem.GetValue() != "In progress: item UNKNOWN not found; In progress: item living/light not found" {
+		t.Fatalf("wrong errors: %s", s.ErrorItem.GetValue())
+	}
+
+	time.Sleep(700 * time.Millisecond)
+	if light.GetValue() != item.ON {
+		t.Fatalf("should get ON state, got: %s", light.GetValue())
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	if heater.GetValue() != item.OFF {
+		t.Fatalf("should get OFF state, got: %s", heater.GetValue())
+	}
+	if s.ActiveItem.GetValue() != "" {
+		t.Fatalf("wrong active events: %s", s.ActiveItem.GetValue())
+	}
+}
+
+func TestEventEndedPendingActions(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	light := &item.AnItem{ID: "LIGHT"}
+	server.Registry.Add(light)
+
+	s := newScheduler("Test", "TEST")
+
+	now := time.Now()
+	s.sync([]*calEvent{
+		{
+			id:          "1",
+			summary:     "Ending",
+			description: "START LIGHT ON\nEND+500ms: LIGHT OFF",
+			start:       now.Add(-time.Second),
+			end:         now.Add(200 * time.Millisecond),
+		},
+	}, nil)
+
+	if light.GetValue() != item.ON {
+		t.Fatalf("should get ON state, got: %s", light.GetValue())
+	}
+
+	// the ended event is not returned anymore by the calendar
+	time.Sleep(400 * time.Millisecond)
+	s.sync(nil, nil)
+
+	time.Sleep(500 * time.Millisecond)
+	if light.GetValue() != item.OFF {
+		t.Fatalf("should get OFF state, got: %s", light.GetValue())
+	}
+}
@@ -28,170 +28,74 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
-	"regexp"
-	"strings"
 	"sync"
 	"time"
 
+	"github.com/safchain/hasc/pkg/item"
 	"github.com/safchain/hasc/pkg/server"
-	uuid "github.com/satori/go.uuid"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	calendar "google.golang.org/api/calendar/v3"
 )
 
-type eventGCal struct {
-	id          string
-	summary     string
-	description string
-	cancel      chan bool
+type GCalOpts struct {
+	// ID used as prefix of the status items. Default to GCAL.
+	ID string
+	// Window is the period of time, starting now, for which the events will be
+	// scheduled. Default to 30 days.
+	Window time.Duration
+	// DeviceFlow uses the OAuth device flow instead of the web UI to authorize
+	// the access to the calendar. The client secret has to be of the "TVs and
+	// Limited Input devices" type.
+	DeviceFlow bool
 }
 
 type GCal struct {
-	sync.RWMutex
-	service *calendar.Service
-	events  map[string]*eventGCal
-}
-
-func (e *eventGCal) stop() {
-	e.cancel <- true
-}
+	*scheduler
+	StatusItem *item.AnItem
 
-func eventGCalID(event *calendar.Event) string {
-	u := uuid.NewV5(uuid.NamespaceOID,
-		fmt.Sprintf("%s-%s-%s-%s-%s-%s", event.Summary, event.Description,
-			event.Start.Date, event.Start.DateTime,
-			event.End.Date, event.End.DateTime))
-	return u.String()
+	lock    sync.RWMutex
+	name    string
+	config  *oauth2.Config
+	service *calendar.Service
+	state   string
+	opts    GCalOpts
 }
 
-func (g *GCal) newEventGCal(event *calendar.Event) (*eventGCal, error) {
-	e := &eventGCal{
-		id:          eventGCalID(event),
-		summary:     event.Summary,
-		description: event.Description,
-		cancel:      make(chan bool, 2),
+func parseGCalDate(date *calendar.EventDateTime) (time.Time, error) {
+	if date.DateTime != "" {
+		return time.Parse(time.RFC3339, date.DateTime)
 	}
+	return time.ParseInLocation("2006-01-02", date.Date, time.Local)
+}
 
-	var start, end time.Time
-	var err error
-
-	if event.Start.DateTime != "" {
-		start, err = time.Parse(time.RFC3339, event.Start.DateTime)
-	} else {
-		start, err = time.Parse(time.RFC3339, event.Start.Date)
-	}
+func newCalEventGCal(event *calendar.Event) (*calEvent, error) {
+	start, err := parseGCalDate(event.Start)
 	if err != nil {
 		return nil, fmt.Errorf("GCal unable to parse event date: %v", event)
 	}
 
-	if event.End.DateTime != "" {
-		end, err = time.Parse(time.RFC3339, event.End.DateTime)
-	} else {
-		end, err = time.Parse(time.RFC3339, event.End.Date)
-	}
+	end, err := parseGCalDate(event.End)
 	if err != nil {
 		return nil, fmt.Errorf("GCal unable to parse event date: %v", event)
 	}
 
-	now := time.Now()
-	if start.Before(now) {
-		return nil, fmt.Errorf("GCal event start in the past: %v", event)
-	}
-
-	startIn := start.Sub(now)
-	endIn := end.Sub(now)
-
-	startAfter := time.After(startIn)
-	endAfter := time.After(endIn)
-
-	go func() {
-		defer func() {
-			g.Lock()
-			delete(g.events, e.id)
-			g.Unlock()
-		}()
-
-		for {
-			select {
-			case <-startAfter:
-				re := regexp.MustCompile(`(?i)START\s*([^\s]*)\s*(.*)`)
-				if res := re.FindStringSubmatch(event.Description); len(res) > 0 {
-					if item := server.Registry.Get(res[1]); item != nil {
-						server.Log.Infof("GCal set %s to %s", item.GetID(), res[2])
-						item.SetValue(res[2])
-					}
-				}
-			case <-endAfter:
-				re := regexp.MustCompile(`(?i)END\s*([^\s]*)\s*(.*)`)
-				if res := re.FindStringSubmatch(event.Description); len(res) > 0 {
-					if item := server.Registry.Get(res[1]); item != nil {
-						server.Log.Infof("GCal set %s to %s", item.GetID(), res[2])
-						item.SetValue(res[2])
-					}
-				}
-				return
-			case <-e.cancel:
-				server.Log.Infof("GCal event terminated: %s summary: %s, description: %s", e.id, e.summary, strings.Replace(e.description, "\n", "; ", -1))
-				return
-			}
-		}
-	}()
-
-	return e, nil
-}
-
-func (g *GCal) scheduleGCalEvent(event *calendar.Event) (*eventGCal, error) {
-	g.RLock()
-	e, ok := g.events[event.Id]
-	g.RUnlock()
-
-	if ok {
-		if e.id == eventGCalID(event) {
-			return e, nil
-		}
-		e.stop()
-	}
-	e, err := g.newEventGCal(event)
-	if err != nil {
-		return nil, err
-	}
-
-	g.Lock()
-	g.events[event.Id] = e
-	g.Unlock()
-
-	server.Log.Infof("GCal new event scheduled: %s summary: %s, description: %s", event.Id, event.Summary, strings.Replace(event.Description, "\n", "; ", -1))
-
-	return e, nil
+	return &calEvent{
+		id:          event.Id,
+		summary:     event.Summary,
+		description: event.Description,
+		start:       start,
+		end:         end,
+	}, nil
 }
 
 func (g *GCal) tokenCacheFile() string {
 	return filepath.Join(server.Cfg.GetString("data"), url.QueryEscape("gcal_token.json"))
 }
 
-func (g *GCal) getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	server.Log.Warningf("GCal go to the following link in your browser then type the authorization code: \n%v\n", authURL)
-
-	var code string
-	if _, err := fmt.Scan(&code); err != nil {
-		server.Log.Errorf("GCal unable to read authorization code %v", err)
-		return nil
-	}
-
-	tok, err := config.Exchange(context.Background(), code)
-	if err != nil {
-		log.Fatalf("GCal unable to retrieve token from web %v", err)
-		return nil
-	}
-	return tok
-}
-
 func (g *GCal) tokenFromFile(file string) (*oauth2.Token, error) {
 	f, err := os.Open(file)
 	if err != nil {
@@ -208,18 +112,30 @@ func (g *GCal) saveToken(file string, token *oauth2.Token) {
 	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		server.Log.Errorf("Unable to cache oauth token: %v", err)
+		return
 	}
 	defer f.Close()
 	json.NewEncoder(f).Encode(token)
 }
 
 func (g *GCal) refreshFnc(name string) {
+	g.lock.RLock()
+	service := g.service
+	g.lock.RUnlock()
+
+	if service == nil {
+		server.Log.Warningf("GCal %s not authorized yet", name)
+		return
+	}
+
 	server.Log.Infof("GCal %s refresh", name)
-	l, err := g.service.CalendarList.List().Do()
+	l, err := service.CalendarList.List().Do()
 	if err != nil {
 		server.Log.Errorf("GCal unable to list calendars: %s", err)
+		g.setStatus(fmt.Sprintf("Error: %s", err))
 		return
 	}
+	g.setStatus(statusConnected)
 
 	var item *calendar.CalendarListEntry
 	for _, i := range l.Items {
@@ -234,32 +150,27 @@ func (g *GCal) refreshFnc(name string) {
 		return
 	}
 
-	t := time.Now().Format(time.RFC3339)
-	events, err := g.service.Events.List(item.Id).ShowDeleted(false).
-		SingleEvents(true).TimeMin(t).MaxResults(100).OrderBy("startTime").Do()
+	// recurring events are expanded as single events
+	now := time.Now()
+	events, err := service.Events.List(item.Id).ShowDeleted(false).
+		SingleEvents(true).TimeMin(now.Format(time.RFC3339)).TimeMax(now.Add(g.opts.Window).Format(time.RFC3339)).
+		MaxResults(100).OrderBy("startTime").Do()
 	if err != nil {
 		server.Log.Errorf("GCal unable to retrieve next ten of the user's events. %v", err)
 		return
 	}
 
-	scheduled := make(map[string]*eventGCal)
+	var calEvents []*calEvent
 	for _, i := range events.Items {
-		e, err := g.scheduleGCalEvent(i)
+		e, err := newCalEventGCal(i)
 		if err != nil {
 			server.Log.Errorf("GCal error while scheduling: %s", err)
 			continue
 		}
-		scheduled[e.id] = e
+		calEvents = append(calEvents, e)
 	}
 
-	// close event not scheduled anymore
-	g.RLock()
-	for _, s := range g.events {
-		if _, ok := scheduled[s.id]; !ok {
-			s.stop()
-		}
-	}
-	g.RUnlock()
+	g.sync(calEvents, nil)
 }
 
 func (g *GCal) refresh(name string, refresh time.Duration) {
@@ -271,22 +182,47 @@ func (g *GCal) refresh(name string, refresh time.Duration) {
 	}
 }
 
-func (g *GCal) getClient(ctx context.Context, config *oauth2.Config) *http.Client {
-	tok, err := g.tokenFromFile(g.tokenCacheFile())
+// connect creates the calendar service, refreshed tokens are saved back to the
+// token cache file.
+func (g *GCal) connect(token *oauth2.Token) {
+	ctx := context.Background()
+
+	src := &savingTokenSource{
+		src:  g.config.TokenSource(ctx, token),
+		last: token.AccessToken,
+		save: func(token *oauth2.Token) {
+			g.saveToken(g.tokenCacheFile(), token)
+		},
+	}
+
+	service, err := calendar.New(oauth2.NewClient(ctx, src))
 	if err != nil {
-		tok = g.getTokenFromWeb(config)
-		g.saveToken(g.tokenCacheFile(), tok)
+		server.Log.Errorf("Unable to retrieve calendar Client %v", err)
+		g.setStatus(fmt.Sprintf("Error: %s", err))
+		return
 	}
-	return config.Client(ctx, tok)
+
+	g.lock.Lock()
+	g.service = service
+	g.lock.Unlock()
+
+	g.setStatus(statusConnected)
 }
 
 // NewGCalTrigger creates a GCal trigger allowing to trigger state changes according
 // to rules present in GCal events. It will use the gcal_secret.json in the data
 // folder. Please go to https://console.developers.google.com for further explanation.
-// The format that has to be used is the following :
-// START: <Object ID> <State>
-// END: <Object ID> <State>
-func NewGCalTrigger(name string, refresh time.Duration) *GCal {
+// The format that has to be used is the following, one action per line :
+// START[+-offset]: <Object ID> <State>
+// END[+-offset]: <Object ID> <State>
+// SCENE[+-offset]: <Scene ID>
+// ex: START-15m: HEATER ON. Events already in progress have their START actions
+// applied right away.
+// Without any token cached, the access has to be granted by browsing
+// /gcal/<id>/auth, the redirect URI /gcal/<id>/callback has to be allowed for
+// the OAuth client. With the DeviceFlow option, the code to enter is reported
+// by the <ID>/STATUS item instead.
+func NewGCalTrigger(name string, refresh time.Duration, opts ...GCalOpts) *GCal {
 	server.Log.Infof("New GCal: %s", name)
 
 	secretFile := filepath.Join(server.Cfg.GetString("data"), url.QueryEscape("gcal_secret.json"))
@@ -300,13 +236,37 @@ func NewGCalTrigger(name string, refresh time.Duration) *GCal {
 		log.Fatalf("Unable to parse client secret file to config: %v", err)
 	}
 
-	g := &GCal{
-		events: make(map[string]*eventGCal),
+	g := &GCal{name: name, config: config}
+	if len(opts) > 0 {
+		g.opts = opts[0]
+	}
+	if g.opts.ID == "" {
+		g.opts.ID = "GCAL"
+	}
+	if g.opts.Window == 0 {
+		g.opts.Window = 30 * 24 * time.Hour
+	}
+	g.scheduler = newScheduler("GCal", g.opts.ID)
+
+	g.StatusItem = &item.AnItem{
+		ID:    fmt.Sprintf("%s/STATUS", g.opts.ID),
+		Label: "Status",
+		Type:  "value",
+		Img:   "dev",
+	}
+	server.Registry.Add(g.StatusItem)
+
+	if token, err := g.tokenFromFile(g.tokenCacheFile()); err == nil {
+		g.connect(token)
+	} else if g.opts.DeviceFlow {
+		go g.authorizeDevice()
+	} else {
+		server.Log.Warningf("GCal go to %s/auth to authorize the access to the calendar", g.authPath())
+		g.setStatus(fmt.Sprintf("%s: go to %s/auth", statusUnauthorized, g.authPath()))
 	}
 
-	client := g.getClient(context.Background(), config)
-	if g.service, err = calendar.New(client); err != nil {
-		log.Fatalf("Unable to retrieve calendar Client %v", err)
+	if !g.opts.DeviceFlow {
+		g.registerAuthHandlers()
 	}
 
 	go g.refresh(name, refresh)
@@ -0,0 +1,763 @@
+/*
+ * Copyright (C) 2021 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package gcal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/safchain/hasc/pkg/server"
+)
+
+const (
+	icalDateLayout     = "20060102"
+	icalDateTimeLayout = "20060102T150405"
+	maxOccurrences     = 10000
+)
+
+type ICalOpts struct {
+	// ID used as prefix of the status items. Default to ICAL.
+	ID string
+	// Username and Password used for the basic authentication.
+	Username string
+	Password string
+	// CalDAV specifies that the url is a CalDAV calendar collection.
+	CalDAV bool
+	// Window is the period of time, starting now, for which the events will be
+	// scheduled. Default to 30 days.
+	Window time.Duration
+}
+
+type ICal struct {
+	*scheduler
+
+	source string
+	opts   ICalOpts
+	client *http.Client
+}
+
+type icalProp struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+type icalEvent struct {
+	uid          string
+	summary      string
+	description  string
+	status       string
+	start        time.Time
+	end          time.Time
+	allDay       bool
+	rrule        string
+	exdates      []time.Time
+	recurrenceID time.Time
+}
+
+type recurrenceRule struct {
+	freq     string
+	interval int
+	count    int
+	until    time.Time
+	byDay    []time.Weekday
+}
+
+var icalWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+func unescapeICalText(value string) string {
+	r := strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`)
+	return r.Replace(value)
+}
+
+// unfoldICal returns the content lines of an iCalendar stream, continuation
+// lines being merged.
+func unfoldICal(r io.Reader) ([]string, error) {
+	var lines []string
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines, scanner.Err()
+}
+
+func parseICalProp(line string) (*icalProp, error) {
+	var quoted bool
+
+	sep := -1
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			sep = i
+			break
+		}
+	}
+	if sep < 0 {
+		return nil, fmt.Errorf("malformed line: %s", line)
+	}
+
+	fields := strings.Split(line[:sep], ";")
+	prop := &icalProp{
+		name:   strings.ToUpper(fields[0]),
+		params: make(map[string]string),
+		value:  line[sep+1:],
+	}
+	for _, param := range fields[1:] {
+		if kv := strings.SplitN(param, "=", 2); len(kv) == 2 {
+			prop.params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], `"`)
+		}
+	}
+
+	return prop, nil
+}
+
+// parseICalTime parses a DATE or DATE-TIME value. Floating times and dates are
+// expressed in the local timezone.
+func parseICalTime(prop *icalProp) (time.Time, bool, error) {
+	loc := time.Local
+	if tzid := prop.params["TZID"]; tzid != "" {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+
+	value := prop.value
+	if prop.params["VALUE"] == "DATE" || len(value) == len(icalDateLayout) {
+		t, err := time.ParseInLocation(icalDateLayout, value, loc)
+		return t, true, err
+	}
+
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.ParseInLocation(icalDateTimeLayout, strings.TrimSuffix(value, "Z"), time.UTC)
+		return t, false, err
+	}
+
+	t, err := time.ParseInLocation(icalDateTimeLayout, value, loc)
+	return t, false, err
+}
+
+// parseICalDuration parses a RFC 5545 duration, ex: PT1H30M, -P1D
+func parseICalDuration(value string) (time.Duration, error) {
+	var (
+		d      time.Duration
+		number string
+		inTime bool
+		sign   time.Duration = 1
+	)
+
+	s := value
+	switch {
+	case strings.HasPrefix(s, "-"):
+		sign = -1
+		s = s[1:]
+	case strings.HasPrefix(s, "+"):
+		s = s[1:]
+	}
+
+	if !strings.HasPrefix(s, "P") {
+		return 0, fmt.Errorf("malformed duration: %s", value)
+	}
+
+	for _, c := range s[1:] {
+		if c >= '0' && c <= '9' {
+			number += string(c)
+			continue
+		}
+
+		if c == 'T' {
+			inTime = true
+			continue
+		}
+
+		n, err := strconv.Atoi(number)
+		if err != nil {
+			return 0, fmt.Errorf("malformed duration: %s", value)
+		}
+		number = ""
+
+		switch {
+		case c == 'W' && !inTime:
+			d += time.Duration(n) * 7 * 24 * time.Hour
+		case c == 'D' && !inTime:
+			d += time.Duration(n) * 24 * time.Hour
+		case c == 'H' && inTime:
+			d += time.Duration(n) * time.Hour
+		case c == 'M' && inTime:
+			d += time.Duration(n) * time.Minute
+		case c == 'S' && inTime:
+			d += time.Duration(n) * time.Second
+		default:
+			return 0, fmt.Errorf("malformed duration: %s", value)
+		}
+	}
+
+	if number != "" {
+		return 0, fmt.Errorf("malformed duration: %s", value)
+	}
+
+	return sign * d, nil
+}
+
+func parseRecurrenceRule(value string, loc *time.Location) (*recurrenceRule, error) {
+	rule := &recurrenceRule{interval: 1}
+
+	for _, part := range strings.Split(value, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch strings.ToUpper(kv[0]) {
+		case "FREQ":
+			rule.freq = strings.ToUpper(kv[1])
+		case "INTERVAL":
+			n, err := strconv.Atoi(kv[1])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("wrong interval: %s", kv[1])
+			}
+			rule.interval = n
+		case "COUNT":
+			n, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("wrong count: %s", kv[1])
+			}
+			rule.count = n
+		case "UNTIL":
+			until, _, err := parseICalTime(&icalProp{value: kv[1], params: map[string]string{}})
+			if err != nil {
+				return nil, fmt.Errorf("wrong until: %s", kv[1])
+			}
+			if len(kv[1]) == len(icalDateLayout) {
+				// inclusive date, use the end of the day
+				until = time.Date(until.Year(), until.Month(), until.Day(), 23, 59, 59, 0, loc)
+			}
+			rule.until = until
+		case "BYDAY":
+			for _, day := range strings.Split(kv[1], ",") {
+				// numeric prefixes, ex: 1MO, are not supported
+				wd, ok := icalWeekdays[strings.ToUpper(day)]
+				if !ok {
+					return nil, fmt.Errorf("unsupported day: %s", day)
+				}
+				rule.byDay = append(rule.byDay, wd)
+			}
+		}
+	}
+
+	switch rule.freq {
+	case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+	default:
+		return nil, fmt.Errorf("unsupported frequency: %s", rule.freq)
+	}
+
+	if len(rule.byDay) > 0 && rule.freq != "WEEKLY" {
+		return nil, fmt.Errorf("BYDAY only supported for weekly frequency")
+	}
+
+	return rule, nil
+}
+
+// occurrences returns the start times of the occurrences of the rule, starting
+// at dtstart, until the given time.
+func (r *recurrenceRule) occurrences(dtstart time.Time, to time.Time) []time.Time {
+	var starts []time.Time
+
+	add := func(t time.Time) bool {
+		if !r.until.IsZero() && t.After(r.until) {
+			return false
+		}
+		if r.count > 0 && len(starts) >= r.count {
+			return false
+		}
+		if t.After(to) {
+			return false
+		}
+		starts = append(starts, t)
+		return true
+	}
+
+	// the week of the WEEKLY rule starts on monday
+	weekStart := dtstart.AddDate(0, 0, -((int(dtstart.Weekday()) + 6) % 7))
+
+	for n := 0; n < maxOccurrences; n++ {
+		switch r.freq {
+		case "DAILY":
+			if !add(dtstart.AddDate(0, 0, n*r.interval)) {
+				return starts
+			}
+		case "WEEKLY":
+			if len(r.byDay) == 0 {
+				if !add(dtstart.AddDate(0, 0, 7*n*r.interval)) {
+					return starts
+				}
+				continue
+			}
+
+			week := weekStart.AddDate(0, 0, 7*n*r.interval)
+
+			var days []time.Time
+			for _, wd := range r.byDay {
+				day := week.AddDate(0, 0, (int(wd)+6)%7)
+				if !day.Before(dtstart) {
+					days = append(days, day)
+				}
+			}
+			sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+
+			for _, day := range days {
+				if !add(day) {
+					return starts
+				}
+			}
+		case "MONTHLY", "YEARLY":
+			var t time.Time
+			if r.freq == "MONTHLY" {
+				t = dtstart.AddDate(0, n*r.interval, 0)
+			} else {
+				t = dtstart.AddDate(n*r.interval, 0, 0)
+			}
+
+			// skip invalid dates like 31th of february
+			if t.Day() != dtstart.Day() {
+				if t.After(to) {
+					return starts
+				}
+				continue
+			}
+			if !add(t) {
+				return starts
+			}
+		}
+	}
+
+	return starts
+}
+
+func parseICalEvent(props []*icalProp) (*icalEvent, error) {
+	var (
+		event    icalEvent
+		hasEnd   bool
+		duration time.Duration
+		err      error
+	)
+
+	for _, prop := range props {
+		switch prop.name {
+		case "UID":
+			event.uid = prop.value
+		case "SUMMARY":
+			event.summary = unescapeICalText(prop.value)
+		case "DESCRIPTION":
+			event.description = unescapeICalText(prop.value)
+		case "STATUS":
+			event.status = strings.ToUpper(prop.value)
+		case "DTSTART":
+			if event.start, event.allDay, err = parseICalTime(prop); err != nil {
+				return nil, fmt.Errorf("wrong DTSTART %s: %s", prop.value, err)
+			}
+		case "DTEND":
+			if event.end, _, err = parseICalTime(prop); err != nil {
+				return nil, fmt.Errorf("wrong DTEND %s: %s", prop.value, err)
+			}
+			hasEnd = true
+		case "DURATION":
+			if duration, err = parseICalDuration(prop.value); err != nil {
+				return nil, err
+			}
+		case "RRULE":
+			event.rrule = prop.value
+		case "EXDATE":
+			for _, value := range strings.Split(prop.value, ",") {
+				exdate, _, err := parseICalTime(&icalProp{name: prop.name, params: prop.params, value: value})
+				if err != nil {
+					return nil, fmt.Errorf("wrong EXDATE %s: %s", value, err)
+				}
+				event.exdates = append(event.exdates, exdate)
+			}
+		case "RECURRENCE-ID":
+			if event.recurrenceID, _, err = parseICalTime(prop); err != nil {
+				return nil, fmt.Errorf("wrong RECURRENCE-ID %s: %s", prop.value, err)
+			}
+		}
+	}
+
+	if event.start.IsZero() {
+		return nil, fmt.Errorf("event without DTSTART: %s", event.uid)
+	}
+
+	if !hasEnd {
+		switch {
+		case duration != 0:
+			event.end = event.start.Add(duration)
+		case event.allDay:
+			event.end = event.start.AddDate(0, 0, 1)
+		default:
+			event.end = event.start
+		}
+	}
+
+	return &event, nil
+}
+
+func instanceID(uid string, start time.Time) string {
+	return fmt.Sprintf("%s/%s", uid, start.UTC().Format(time.RFC3339))
+}
+
+// icalEventName returns the summary, or the UID, of an event for the errors.
+func icalEventName(props []*icalProp) string {
+	var uid string
+	for _, prop := range props {
+		switch prop.name {
+		case "SUMMARY":
+			return unescapeICalText(prop.value)
+		case "UID":
+			uid = prop.value
+		}
+	}
+	return uid
+}
+
+// parseICal parses an iCalendar stream and returns the events, recurring events
+// being expanded, overlapping the given period of time. The events that can't
+// be parsed are skipped, an error being returned per event.
+func parseICal(r io.Reader, from time.Time, to time.Time) ([]*calEvent, []error, error) {
+	lines, err := unfoldICal(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		events    []*icalEvent
+		errs      []error
+		props     []*icalProp
+		propErr   error
+		inEvent   bool
+		nestLevel int
+	)
+
+	for _, line := range lines {
+		prop, err := parseICalProp(line)
+		if err != nil {
+			// the event is skipped once ended
+			if inEvent && propErr == nil {
+				propErr = err
+			} else if !inEvent {
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		switch {
+		case prop.name == "BEGIN" && strings.ToUpper(prop.value) == "VEVENT":
+			inEvent, props, propErr, nestLevel = true, nil, nil, 0
+		case prop.name == "END" && strings.ToUpper(prop.value) == "VEVENT":
+			inEvent = false
+
+			if propErr != nil {
+				errs = append(errs, fmt.Errorf("event %s: %s", icalEventName(props), propErr))
+				continue
+			}
+
+			event, err := parseICalEvent(props)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("event %s: %s", icalEventName(props), err))
+				continue
+			}
+			events = append(events, event)
+		case !inEvent:
+		case prop.name == "BEGIN":
+			// sub-components like VALARM
+			nestLevel++
+		case prop.name == "END":
+			nestLevel--
+		case nestLevel == 0:
+			props = append(props, prop)
+		}
+	}
+
+	// instances overridden by a RECURRENCE-ID event
+	overridden := make(map[string]bool)
+	for _, event := range events {
+		if !event.recurrenceID.IsZero() {
+			overridden[instanceID(event.uid, event.recurrenceID)] = true
+		}
+	}
+
+	var calEvents []*calEvent
+
+	addInstance := func(event *icalEvent, id string, start, end time.Time) {
+		if !end.After(from) || !start.Before(to) {
+			return
+		}
+
+		calEvents = append(calEvents, &calEvent{
+			id:          id,
+			summary:     event.summary,
+			description: event.description,
+			start:       start,
+			end:         end,
+		})
+	}
+
+	for _, event := range events {
+		if event.status == "CANCELLED" {
+			continue
+		}
+
+		if !event.recurrenceID.IsZero() {
+			addInstance(event, instanceID(event.uid, event.recurrenceID), event.start, event.end)
+			continue
+		}
+
+		if event.rrule == "" {
+			addInstance(event, event.uid, event.start, event.end)
+			continue
+		}
+
+		rule, err := parseRecurrenceRule(event.rrule, event.start.Location())
+		if err != nil {
+			name := event.summary
+			if name == "" {
+				name = event.uid
+			}
+			errs = append(errs, fmt.Errorf("event %s: %s", name, err))
+			continue
+		}
+
+		excluded := make(map[time.Time]bool)
+		for _, exdate := range event.exdates {
+			excluded[exdate.UTC()] = true
+		}
+
+		duration := event.end.Sub(event.start)
+		for _, start := range rule.occurrences(event.start, to) {
+			id := instanceID(event.uid, start)
+			if excluded[start.UTC()] || overridden[id] {
+				continue
+			}
+			addInstance(event, id, start, start.Add(duration))
+		}
+	}
+
+	return calEvents, errs, nil
+}
+
+type calDAVMultiStatus struct {
+	Responses []struct {
+		Propstats []struct {
+			CalendarData string `xml:"prop>calendar-data"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+func (i *ICal) doRequest(method string, body io.Reader, headers map[string]string) ([]byte, error) {
+	req, err := http.NewRequest(method, i.source, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if i.opts.Username != "" {
+		req.SetBasicAuth(i.opts.Username, i.opts.Password)
+	}
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (i *ICal) fetchCalDAV(from time.Time, to time.Time) ([]*calEvent, []error, error) {
+	const query = `<?xml version="1.0" encoding="utf-8" ?>
+<C:calendar-query xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav">
+  <D:prop>
+    <C:calendar-data>
+      <C:expand start="%[1]s" end="%[2]s"/>
+    </C:calendar-data>
+  </D:prop>
+  <C:filter>
+    <C:comp-filter name="VCALENDAR">
+      <C:comp-filter name="VEVENT">
+        <C:time-range start="%[1]s" end="%[2]s"/>
+      </C:comp-filter>
+    </C:comp-filter>
+  </C:filter>
+</C:calendar-query>`
+
+	start := from.UTC().Format(icalDateTimeLayout) + "Z"
+	end := to.UTC().Format(icalDateTimeLayout) + "Z"
+
+	body, err := i.doRequest("REPORT", strings.NewReader(fmt.Sprintf(query, start, end)), map[string]string{
+		"Depth":        "1",
+		"Content-Type": "application/xml; charset=utf-8",
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var ms calDAVMultiStatus
+	if err := xml.Unmarshal(body, &ms); err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		events []*calEvent
+		errs   []error
+	)
+	for _, resp := range ms.Responses {
+		for _, ps := range resp.Propstats {
+			if ps.CalendarData == "" {
+				continue
+			}
+
+			e, perrs, err := parseICal(strings.NewReader(ps.CalendarData), from, to)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			events = append(events, e...)
+			errs = append(errs, perrs...)
+		}
+	}
+
+	return events, errs, nil
+}
+
+func (i *ICal) fetch(from time.Time, to time.Time) ([]*calEvent, []error, error) {
+	if i.opts.CalDAV {
+		return i.fetchCalDAV(from, to)
+	}
+
+	var (
+		data []byte
+		err  error
+	)
+
+	if strings.HasPrefix(i.source, "http://") || strings.HasPrefix(i.source, "https://") {
+		data, err = i.doRequest("GET", nil, nil)
+	} else {
+		data, err = ioutil.ReadFile(strings.TrimPrefix(i.source, "file://"))
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return parseICal(bytes.NewReader(data), from, to)
+}
+
+func (i *ICal) refreshFnc() {
+	server.Log.Infof("ICal %s refresh", i.source)
+
+	now := time.Now()
+
+	events, errs, err := i.fetch(now, now.Add(i.opts.Window))
+	if err != nil {
+		server.Log.Errorf("ICal unable to retrieve events of %s: %s", i.source, err)
+		return
+	}
+
+	var feedErrors []string
+	for _, err := range errs {
+		server.Log.Errorf("ICal %s skipped: %s", i.source, err)
+		feedErrors = append(feedErrors, err.Error())
+	}
+
+	i.sync(events, feedErrors)
+}
+
+func (i *ICal) refresh(refresh time.Duration) {
+	i.refreshFnc()
+
+	ticker := time.NewTicker(refresh)
+	for range ticker.C {
+		i.refreshFnc()
+	}
+}
+
+// NewICalTrigger creates an iCalendar trigger allowing to trigger state changes
+// according to rules present in the events of an ICS file or of a CalDAV
+// calendar. The source can be a local path, a file:// or http(s):// URL of an ICS
+// file or the URL of a CalDAV calendar collection, ex: Nextcloud, in which case
+// the CalDAV option has to be set.
+// The format of the event description is the same as the GCal one. The
+// events that can't be parsed, ex: unsupported recurrence rules, are skipped
+// and reported by the <ID>/ERRORS item.
+func NewICalTrigger(source string, refresh time.Duration, opts ...ICalOpts) *ICal {
+	server.Log.Infof("New ICal: %s", source)
+
+	i := &ICal{
+		source: source,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+
+	if len(opts) > 0 {
+		i.opts = opts[0]
+	}
+	if i.opts.ID == "" {
+		i.opts.ID = "ICAL"
+	}
+	if i.opts.Window == 0 {
+		i.opts.Window = 30 * 24 * time.Hour
+	}
+	i.scheduler = newScheduler("ICal", i.opts.ID)
+
+	go i.refresh(refresh)
+
+	return i
+}
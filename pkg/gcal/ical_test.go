@@ -0,0 +1,262 @@
+/*
+ * Copyright (C) 2021 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package gcal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/registry"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+const testICal = `BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//hasc//test//EN
+BEGIN:VEVENT
+UID:simple
+DTSTART:20210621T080000Z
+DTEND:20210621T090000Z
+SUMMARY:Heating
+DESCRIPTION:START HEATER ON\nEND HEA
+ TER OFF
+BEGIN:VALARM
+ACTION:DISPLAY
+DESCRIPTION:alarm
+TRIGGER:-PT15M
+END:VALARM
+END:VEVENT
+BEGIN:VEVENT
+UID:allday
+DTSTART;VALUE=DATE:20210622
+SUMMARY:Holidays
+END:VEVENT
+BEGIN:VEVENT
+UID:weekly
+DTSTART;TZID=Europe/Paris:20210621T070000
+DURATION:PT30M
+RRULE:FREQ=WEEKLY;BYDAY=MO,WE;COUNT=4
+EXDATE;TZID=Europe/Paris:20210623T070000
+SUMMARY:Wake up
+END:VEVENT
+BEGIN:VEVENT
+UID:weekly
+RECURRENCE-ID;TZID=Europe/Paris:20210628T070000
+DTSTART;TZID=Europe/Paris:20210628T080000
+DTEND;TZID=Europe/Paris:20210628T083000
+SUMMARY:Wake up later
+END:VEVENT
+BEGIN:VEVENT
+UID:cancelled
+DTSTART:20210621T100000Z
+DTEND:20210621T110000Z
+STATUS:CANCELLED
+END:VEVENT
+BEGIN:VEVENT
+UID:past
+DTSTART:20200621T100000Z
+DTEND:20200621T110000Z
+END:VEVENT
+END:VCALENDAR
+`
+
+const testBadICal = `BEGIN:VCALENDAR
+BEGIN:VEVENT
+UID:monthly
+SUMMARY:First monday
+DTSTART:20210607T080000Z
+DTEND:20210607T090000Z
+RRULE:FREQ=MONTHLY;BYDAY=1MO
+END:VEVENT
+BEGIN:VEVENT
+UID:malformed
+SUMMARY:Malformed
+DTSTART:20210621T080000Z
+a line without colon
+END:VEVENT
+BEGIN:VEVENT
+UID:nostart
+DTSTART:2021-06-21
+END:VEVENT
+BEGIN:VEVENT
+UID:good
+SUMMARY:Good
+DTSTART:20210621T100000Z
+DTEND:20210621T110000Z
+END:VEVENT
+END:VCALENDAR
+`
+
+func TestParseICalBadEvents(t *testing.T) {
+	from := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	events, errs, err := parseICal(strings.NewReader(testBadICal), from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 || events[0].id != "good" {
+		t.Fatalf("expected the good event only, got: %v", events)
+	}
+
+	var messages []string
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	if len(messages) != 3 ||
+		!strings.HasPrefix(messages[0], "event Malformed: malformed line") ||
+		!strings.HasPrefix(messages[1], "event nostart: wrong DTSTART") ||
+		messages[2] != "event First monday: unsupported day: 1MO" {
+		t.Fatalf("wrong errors: %v", messages)
+	}
+}
+
+func TestParseICal(t *testing.T) {
+	from := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2021, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	events, errs, err := parseICal(strings.NewReader(testICal), from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	byID := make(map[string]*calEvent)
+	for _, e := range events {
+		byID[e.id] = e
+	}
+
+	if len(events) != 5 {
+		t.Fatalf("expected 5 events, got: %d, %v", len(events), byID)
+	}
+
+	e := byID["simple"]
+	if e == nil {
+		t.Fatal("simple event not found")
+	}
+	if e.description != "START HEATER ON\nEND HEATER OFF" {
+		t.Fatalf("wrong description: %s", e.description)
+	}
+	if e.end.Sub(e.start) != time.Hour {
+		t.Fatalf("wrong duration: %s", e.end.Sub(e.start))
+	}
+
+	e = byID["allday"]
+	if e == nil || e.end.Sub(e.start) != 24*time.Hour {
+		t.Fatalf("wrong all day event: %+v", e)
+	}
+
+	paris, _ := time.LoadLocation("Europe/Paris")
+	for _, expected := range []time.Time{
+		time.Date(2021, 6, 21, 7, 0, 0, 0, paris),
+		time.Date(2021, 6, 30, 7, 0, 0, 0, paris),
+	} {
+		id := instanceID("weekly", expected)
+		if e := byID[id]; e == nil || !e.start.Equal(expected) || e.end.Sub(e.start) != 30*time.Minute {
+			t.Fatalf("wrong recurring instance %s: %+v", id, e)
+		}
+	}
+
+	id := instanceID("weekly", time.Date(2021, 6, 28, 7, 0, 0, 0, paris))
+	if e := byID[id]; e == nil || e.summary != "Wake up later" || e.start.Hour() != 8 {
+		t.Fatalf("wrong overridden instance %s: %+v", id, e)
+	}
+}
+
+func TestParseICalDuration(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"PT1H30M", 90 * time.Minute},
+		{"-PT15M", -15 * time.Minute},
+		{"P1D", 24 * time.Hour},
+		{"P1W", 7 * 24 * time.Hour},
+		{"P1DT2H3M4S", 26*time.Hour + 3*time.Minute + 4*time.Second},
+	}
+
+	for _, test := range tests {
+		d, err := parseICalDuration(test.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d != test.expected {
+			t.Fatalf("%s: expected %s, got %s", test.value, test.expected, d)
+		}
+	}
+
+	for _, value := range []string{"1H", "PT1", "P1H"} {
+		if _, err := parseICalDuration(value); err == nil {
+			t.Fatalf("%s: error expected", value)
+		}
+	}
+}
+
+func TestICalTrigger(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	it := &item.AnItem{ID: "HEATER"}
+	server.Registry.Add(it)
+
+	dir, err := ioutil.TempDir("", "hasc-ical")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now().UTC()
+	start := now.Add(2 * time.Second).Format(icalDateTimeLayout)
+	end := now.Add(4 * time.Second).Format(icalDateTimeLayout)
+
+	ics := fmt.Sprintf("BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nUID:test\r\nDTSTART:%sZ\r\nDTEND:%sZ\r\nDESCRIPTION:START HEATER ON\\nEND HEATER OFF\r\nEND:VEVENT\r\n"+
+		"BEGIN:VEVENT\r\nUID:bad\r\nDTSTART:%sZ\r\nRRULE:FREQ=HOURLY\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n", start, end, start)
+
+	path := filepath.Join(dir, "test.ics")
+	if err := ioutil.WriteFile(path, []byte(ics), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	i := NewICalTrigger(path, time.Minute)
+
+	time.Sleep(2500 * time.Millisecond)
+	if it.GetValue() != item.ON {
+		t.Fatalf("should get ON state, got: %s", it.GetValue())
+	}
+	if errs := i.ErrorItem.GetValue(); errs != "event bad: unsupported frequency: HOURLY" {
+		t.Fatalf("wrong errors: %s", errs)
+	}
+
+	time.Sleep(2 * time.Second)
+	if it.GetValue() != item.OFF {
+		t.Fatalf("should get OFF state, got: %s", it.GetValue())
+	}
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+// Package httpitem updates items from HTTP, either polling a URL or receiving
+// the requests of external systems through webhooks.
+package httpitem
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/transform"
+)
+
+var (
+	// ErrNoMatch is returned when the value of an item is not found in a body.
+	ErrNoMatch = errors.New("no match")
+	// ErrInvalidJSON is returned when the body of an item having a path is
+	// not JSON.
+	ErrInvalidJSON = errors.New("invalid JSON")
+)
+
+// ItemMapping describes how the value of an item is extracted from a body,
+// through a gjson path, ex: main.temp, or a regex, the first group being the
+// value if any, the whole match otherwise.
+type ItemMapping struct {
+	// Name of the item, the ID being <id>/<name>.
+	Name string
+	// Label of the item. Default to the name.
+	Label string
+	// Type of the item, value or state. Default to value.
+	Type string
+	// Img of the item. Default to chart for values, switch otherwise.
+	Img string
+	// Unit of the item.
+	Unit string
+	// Transform applied to the numeric values, the one configured for the
+	// item ID in the transforms section taking precedence.
+	Transform string
+	// Path gjson of the value.
+	Path string
+	// Regex of the value, used if no path set.
+	Regex string
+}
+
+type mappedItem struct {
+	item      *item.AnItem
+	mapping   ItemMapping
+	regex     *regexp.Regexp
+	transform transform.Pipeline
+}
+
+func normalizeState(value string) string {
+	switch strings.ToLower(value) {
+	case "1", "on", "true":
+		return item.ON
+	}
+	return item.OFF
+}
+
+func newMappedItem(id string, mapping ItemMapping) (*mappedItem, error) {
+	if mapping.Name == "" {
+		return nil, errors.New("item without name")
+	}
+
+	switch mapping.Type {
+	case "":
+		mapping.Type = "value"
+	case "value", "state":
+	default:
+		return nil, fmt.Errorf("unknown type for %s: %s", mapping.Name, mapping.Type)
+	}
+
+	label := mapping.Label
+	if label == "" {
+		label = mapping.Name
+	}
+
+	img := mapping.Img
+	if img == "" {
+		img = "switch"
+		if mapping.Type == "value" {
+			img = "chart"
+		}
+	}
+
+	mi := &mappedItem{mapping: mapping}
+
+	switch {
+	case mapping.Path != "":
+	case mapping.Regex != "":
+		re, err := regexp.Compile(mapping.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("wrong regex for %s: %s", mapping.Name, err)
+		}
+		mi.regex = re
+	default:
+		return nil, fmt.Errorf("no path nor regex for %s", mapping.Name)
+	}
+
+	itemID := fmt.Sprintf("%s/%s", id, mapping.Name)
+	if _, err := transform.Parse(mapping.Transform); err != nil {
+		return nil, fmt.Errorf("wrong transform for %s: %s", mapping.Name, err)
+	}
+	mi.transform = transform.ForItem(itemID, mapping.Transform)
+
+	mi.item = &item.AnItem{
+		ID:    itemID,
+		Label: label,
+		Type:  mapping.Type,
+		Img:   img,
+		Unit:  mapping.Unit,
+	}
+
+	return mi, nil
+}
+
+func (mi *mappedItem) extract(body string) (string, error) {
+	if mi.regex != nil {
+		match := mi.regex.FindStringSubmatch(body)
+		switch {
+		case match == nil:
+			return "", ErrNoMatch
+		case len(match) > 1:
+			return match[1], nil
+		}
+		return match[0], nil
+	}
+
+	if !gjson.Valid(body) {
+		return "", ErrInvalidJSON
+	}
+
+	result := gjson.Get(body, mi.mapping.Path)
+	switch {
+	case !result.Exists():
+		return "", ErrNoMatch
+	case result.Type == gjson.True:
+		return item.ON, nil
+	case result.Type == gjson.False:
+		return item.OFF, nil
+	}
+	return result.String(), nil
+}
+
+func (mi *mappedItem) update(value string) {
+	value = strings.TrimSpace(value)
+
+	if mi.mapping.Type == "state" {
+		value = normalizeState(value)
+	} else if f, err := strconv.ParseFloat(value, 64); err == nil {
+		if f, ok := mi.transform.Apply(f, time.Now()); ok {
+			value = strconv.FormatFloat(f, 'f', -1, 64)
+		} else {
+			return
+		}
+	}
+
+	mi.item.SetValue(value)
+}
+
+func newMappedItems(id string, mappings []ItemMapping) ([]*mappedItem, error) {
+	if len(mappings) == 0 {
+		return nil, errors.New("no item")
+	}
+
+	var items []*mappedItem
+	names := make(map[string]bool)
+	for _, mapping := range mappings {
+		if names[mapping.Name] {
+			return nil, fmt.Errorf("duplicate item: %s", mapping.Name)
+		}
+		names[mapping.Name] = true
+
+		mi, err := newMappedItem(id, mapping)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, mi)
+	}
+
+	return items, nil
+}
+
+// updateItems updates the items with the values extracted from the body,
+// returning the errors of the items not updated.
+func updateItems(items []*mappedItem, body string) []string {
+	var errs []string
+	for _, mi := range items {
+		value, err := mi.extract(body)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", mi.mapping.Name, err))
+			continue
+		}
+		mi.update(value)
+	}
+	return errs
+}
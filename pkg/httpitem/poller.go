@@ -0,0 +1,241 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package httpitem
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+const statusOK = "OK"
+
+// maxBodySize of the responses and of the webhook requests.
+const maxBodySize = 1 << 20
+
+type PollerOpts struct {
+	// Method of the requests. Default to GET.
+	Method string
+	// Body of the requests, ex: for a POST.
+	Body string
+	// Headers of the requests.
+	Headers map[string]string
+	// Username and Password for the basic authentication.
+	Username string
+	Password string
+	// Token for the bearer authentication.
+	Token string
+	// Interval between two requests. Default to 1 minute.
+	Interval time.Duration
+	// Timeout of the requests. Default to 30 seconds.
+	Timeout time.Duration
+	// InsecureSkipVerify disables the verification of the certificate.
+	InsecureSkipVerify bool `mapstructure:"insecure-skip-verify"`
+	// Items extracted from the responses.
+	Items []ItemMapping
+}
+
+// Poller requests periodically a URL and updates the items with the values
+// extracted from the responses.
+type Poller struct {
+	StatusItem *item.AnItem
+
+	id     string
+	url    string
+	client *http.Client
+	items  []*mappedItem
+	opts   PollerOpts
+}
+
+// pollerConfig is the configuration of a poller in the http section.
+type pollerConfig struct {
+	URL        string
+	PollerOpts `mapstructure:",squash"`
+}
+
+func (p *Poller) get() (string, error) {
+	var body io.Reader
+	if p.opts.Body != "" {
+		body = strings.NewReader(p.opts.Body)
+	}
+
+	req, err := http.NewRequest(p.opts.Method, p.url, body)
+	if err != nil {
+		return "", err
+	}
+
+	for key, value := range p.opts.Headers {
+		req.Header.Set(key, value)
+	}
+	switch {
+	case p.opts.Token != "":
+		req.Header.Set("Authorization", "Bearer "+p.opts.Token)
+	case p.opts.Username != "":
+		req.SetBasicAuth(p.opts.Username, p.opts.Password)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return "", errors.New("unauthorized")
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return "", fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, maxBodySize))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Refresh requests the URL and updates the items.
+func (p *Poller) Refresh() error {
+	body, err := p.get()
+	if err != nil {
+		server.Log.Errorf("HTTP %s refresh error: %s", p.id, err)
+		p.StatusItem.SetValue("Error: " + err.Error())
+		return err
+	}
+
+	if errs := updateItems(p.items, body); len(errs) > 0 {
+		err := errors.New(strings.Join(errs, "; "))
+		server.Log.Errorf("HTTP %s extract error: %s", p.id, err)
+		p.StatusItem.SetValue("Error: " + err.Error())
+		return err
+	}
+
+	p.StatusItem.SetValue(statusOK)
+
+	return nil
+}
+
+func (p *Poller) refresh() {
+	p.Refresh()
+
+	ticker := time.NewTicker(p.opts.Interval)
+	for range ticker.C {
+		p.Refresh()
+	}
+}
+
+// Item returns the item of the given name.
+func (p *Poller) Item(name string) item.Item {
+	for _, mi := range p.items {
+		if mi.mapping.Name == name {
+			return mi.item
+		}
+	}
+	return nil
+}
+
+func newPoller(id string, url string, opts ...PollerOpts) (*Poller, error) {
+	p := &Poller{
+		id:  id,
+		url: url,
+		StatusItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/STATUS", id),
+			Label: "Status",
+			Img:   "dev",
+			Type:  "value",
+		},
+	}
+	if len(opts) > 0 {
+		p.opts = opts[0]
+	}
+	if p.opts.Method == "" {
+		p.opts.Method = "GET"
+	}
+	if p.opts.Interval == 0 {
+		p.opts.Interval = time.Minute
+	}
+	if p.opts.Timeout == 0 {
+		p.opts.Timeout = 30 * time.Second
+	}
+
+	if url == "" {
+		return nil, errors.New("no URL")
+	}
+
+	items, err := newMappedItems(id, p.opts.Items)
+	if err != nil {
+		return nil, err
+	}
+	p.items = items
+
+	p.client = &http.Client{
+		Timeout: p.opts.Timeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: p.opts.InsecureSkipVerify},
+		},
+	}
+
+	return p, nil
+}
+
+// NewPoller registers an item, <id>/<name>, per mapping, and a status item,
+// <id>/STATUS, then requests the URL periodically to update them.
+func NewPoller(id string, url string, opts ...PollerOpts) (*Poller, error) {
+	p, err := newPoller(id, url, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP %s: %s", id, err)
+	}
+
+	for _, mi := range p.items {
+		server.Registry.Add(mi.item)
+	}
+	server.Registry.Add(p.StatusItem)
+
+	go p.refresh()
+
+	return p, nil
+}
+
+// NewPollerFromConfig returns the poller configured under the http section of
+// the config file for the given ID.
+func NewPollerFromConfig(id string) (*Poller, error) {
+	if server.Cfg == nil {
+		return nil, fmt.Errorf("no configuration for HTTP %s", id)
+	}
+
+	var cfg pollerConfig
+	if err := server.Cfg.UnmarshalKey("http."+strings.ToLower(id), &cfg); err != nil {
+		return nil, err
+	}
+
+	return NewPoller(id, cfg.URL, cfg.PollerOpts)
+}
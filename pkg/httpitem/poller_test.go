@@ -0,0 +1,186 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package httpitem
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/registry"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+func assertValue(t *testing.T, it item.Item, expected string) {
+	if it == nil {
+		t.Fatalf("item not found")
+	}
+	if it.GetValue() != expected {
+		t.Errorf("%s expected %s, got: %s", it.GetID(), expected, it.GetValue())
+	}
+}
+
+func TestPollerJSON(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	var body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer TOKEN" || r.Header.Get("Accept") != "application/json" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+	defer ts.Close()
+
+	p, err := newPoller("WEATHER", ts.URL, PollerOpts{
+		Token:   "TOKEN",
+		Headers: map[string]string{"accept": "application/json"},
+		Items: []ItemMapping{
+			{Name: "TEMPERATURE", Path: "main.temp", Transform: "linear(1, -273.15)", Unit: "°"},
+			{Name: "HUMIDITY", Path: "main.humidity", Unit: "%"},
+			{Name: "RAIN", Path: "rain", Type: "state"},
+			{Name: "CITY", Path: "name"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body = `{"main": {"temp": 294.65, "humidity": 60}, "rain": true, "name": "Paris"}`
+	if err := p.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	assertValue(t, p.Item("TEMPERATURE"), "21.5")
+	assertValue(t, p.Item("HUMIDITY"), "60")
+	assertValue(t, p.Item("RAIN"), item.ON)
+	assertValue(t, p.Item("CITY"), "Paris")
+	assertValue(t, p.StatusItem, statusOK)
+
+	body = `{"main": {"temp": 293.15}, "rain": false, "name": "Paris"}`
+	if err := p.Refresh(); err == nil {
+		t.Error("expected an error for the missing humidity")
+	}
+	assertValue(t, p.Item("TEMPERATURE"), "20")
+	assertValue(t, p.Item("HUMIDITY"), "60")
+	assertValue(t, p.Item("RAIN"), item.OFF)
+	if !strings.Contains(p.StatusItem.GetValue(), "HUMIDITY") {
+		t.Errorf("wrong status: %s", p.StatusItem.GetValue())
+	}
+
+	p.opts.Token = "WRONG"
+	if err := p.Refresh(); err == nil {
+		t.Error("expected an unauthorized error")
+	}
+}
+
+func TestPollerRegex(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "admin" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "<html><span id=\"power\">1250 W</span><b>relay: on</b></html>")
+	}))
+	defer ts.Close()
+
+	p, err := newPoller("PLUG", ts.URL, PollerOpts{
+		Username: "admin",
+		Password: "secret",
+		Items: []ItemMapping{
+			{Name: "POWER", Regex: `id="power">([0-9.]+)`, Unit: "W"},
+			{Name: "RELAY", Regex: `relay: (\w+)`, Type: "state"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	assertValue(t, p.Item("POWER"), "1250")
+	assertValue(t, p.Item("RELAY"), item.ON)
+}
+
+func TestPollerErrors(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	tests := []PollerOpts{
+		{},
+		{Items: []ItemMapping{{Name: "A"}}},
+		{Items: []ItemMapping{{Name: "A", Regex: "("}}},
+		{Items: []ItemMapping{{Name: "A", Path: "a", Type: "switch"}}},
+		{Items: []ItemMapping{{Name: "A", Path: "a", Transform: "unknown(1)"}}},
+		{Items: []ItemMapping{{Name: "A", Path: "a"}, {Name: "A", Path: "b"}}},
+	}
+
+	for _, opts := range tests {
+		if _, err := newPoller("ERR", "http://localhost", opts); err == nil {
+			t.Errorf("expected an error for %+v", opts)
+		}
+	}
+}
+
+func TestPollerFromConfig(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	cfg := viper.New()
+	cfg.SetConfigType("yaml")
+	err := cfg.ReadConfig(strings.NewReader(`
+http:
+  weather:
+    url: http://localhost/weather
+    interval: 5m
+    insecure-skip-verify: true
+    headers:
+      X-Api-Key: KEY
+    items:
+      - name: TEMPERATURE
+        path: main.temp
+        unit: °
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Cfg = cfg
+	defer func() { server.Cfg = nil }()
+
+	var pc pollerConfig
+	if err := server.Cfg.UnmarshalKey("http.weather", &pc); err != nil {
+		t.Fatal(err)
+	}
+	if pc.URL != "http://localhost/weather" || pc.Interval.Minutes() != 5 || !pc.InsecureSkipVerify {
+		t.Errorf("wrong config: %+v", pc)
+	}
+	if pc.Headers["x-api-key"] != "KEY" || len(pc.Items) != 1 || pc.Items[0].Path != "main.temp" {
+		t.Errorf("wrong config: %+v", pc)
+	}
+}
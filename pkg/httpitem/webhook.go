@@ -0,0 +1,179 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package httpitem
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/safchain/hasc/pkg/server"
+)
+
+type WebhookOpts struct {
+	// Secret of the webhook, required. It is either passed as is, through
+	// the X-Webhook-Secret header, a bearer token or the secret query
+	// parameter, or used to sign the body, HMAC SHA256 in the
+	// X-Hub-Signature-256 header, ex: sha256=<hex>.
+	Secret string
+	// Items extracted from the bodies of the requests.
+	Items []ItemMapping
+}
+
+// Webhook is an endpoint, /webhook/<id>, where external systems can POST
+// updates of its items. A request updating none of the items is rejected,
+// with 400 if its body is not valid JSON, 422 otherwise.
+type Webhook struct {
+	id    string
+	items []*mappedItem
+	opts  WebhookOpts
+}
+
+func (w *Webhook) authorized(r *http.Request, body []byte) bool {
+	secret := []byte(w.opts.Secret)
+
+	if signature := r.Header.Get("X-Hub-Signature-256"); signature != "" {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(body)
+		expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+		return hmac.Equal([]byte(signature), []byte(expected))
+	}
+
+	provided := r.Header.Get("X-Webhook-Secret")
+	if provided == "" {
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			provided = strings.TrimPrefix(auth, "Bearer ")
+		}
+	}
+	if provided == "" {
+		provided = r.URL.Query().Get("secret")
+	}
+
+	return subtle.ConstantTimeCompare([]byte(provided), secret) == 1
+}
+
+func (w *Webhook) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(rw, r.Body, maxBodySize))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !w.authorized(r, body) {
+		server.Log.Errorf("Webhook %s unauthorized request from %s", w.id, r.RemoteAddr)
+		http.Error(rw, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// the items may not all be part of each request
+	errs := updateItems(w.items, string(body))
+	if len(errs) < len(w.items) {
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if w.hasPath() && !gjson.Valid(string(body)) {
+		server.Log.Errorf("Webhook %s invalid JSON body from %s", w.id, r.RemoteAddr)
+		http.Error(rw, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	server.Log.Errorf("Webhook %s no item in the body from %s: %s", w.id, r.RemoteAddr, strings.Join(errs, "; "))
+	http.Error(rw, "no item in the body, "+strings.Join(errs, "; "), http.StatusUnprocessableEntity)
+}
+
+// hasPath returns whether some items are extracted from JSON bodies.
+func (w *Webhook) hasPath() bool {
+	for _, mi := range w.items {
+		if mi.regex == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Path returns the path of the webhook endpoint.
+func (w *Webhook) Path() string {
+	return server.WebhookPath + strings.ToLower(w.id)
+}
+
+func newWebhook(id string, opts ...WebhookOpts) (*Webhook, error) {
+	w := &Webhook{id: id}
+	if len(opts) > 0 {
+		w.opts = opts[0]
+	}
+
+	if w.opts.Secret == "" {
+		return nil, errors.New("no secret")
+	}
+
+	items, err := newMappedItems(id, w.opts.Items)
+	if err != nil {
+		return nil, err
+	}
+	w.items = items
+
+	return w, nil
+}
+
+// NewWebhook registers an item, <id>/<name>, per mapping, updated by the
+// requests POSTed to /webhook/<id>. It has to be called from the onInit
+// callback of server.Start.
+func NewWebhook(id string, opts ...WebhookOpts) (*Webhook, error) {
+	w, err := newWebhook(id, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("webhook %s: %s", id, err)
+	}
+
+	for _, mi := range w.items {
+		server.Registry.Add(mi.item)
+	}
+
+	server.HandleFunc(w.Path(), w.ServeHTTP).Methods("POST")
+
+	return w, nil
+}
+
+// NewWebhookFromConfig returns the webhook configured under the webhooks
+// section of the config file for the given ID.
+func NewWebhookFromConfig(id string) (*Webhook, error) {
+	if server.Cfg == nil {
+		return nil, fmt.Errorf("no configuration for webhook %s", id)
+	}
+
+	var opts WebhookOpts
+	if err := server.Cfg.UnmarshalKey("webhooks."+strings.ToLower(id), &opts); err != nil {
+		return nil, err
+	}
+
+	return NewWebhook(id, opts)
+}
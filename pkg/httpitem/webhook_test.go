@@ -0,0 +1,145 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package httpitem
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/registry"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+func post(w *Webhook, target, body string, headers map[string]string) int {
+	code, _ := postBody(w, target, body, headers)
+	return code
+}
+
+func postBody(w *Webhook, target, body string, headers map[string]string) (int, string) {
+	req := httptest.NewRequest("POST", target, strings.NewReader(body))
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	rec := httptest.NewRecorder()
+	w.ServeHTTP(rec, req)
+
+	return rec.Code, rec.Body.String()
+}
+
+func TestWebhook(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	w, err := newWebhook("METER", WebhookOpts{
+		Secret: "s3cr3t",
+		Items: []ItemMapping{
+			{Name: "POWER", Path: "power", Unit: "W"},
+			{Name: "GRID", Path: "grid", Type: "state"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Path() != "/webhook/meter" {
+		t.Errorf("wrong path: %s", w.Path())
+	}
+
+	power := w.items[0].item
+	grid := w.items[1].item
+
+	code := post(w, "/webhook/meter", `{"power": 1200, "grid": true}`, map[string]string{"X-Webhook-Secret": "s3cr3t"})
+	if code != http.StatusNoContent {
+		t.Fatalf("unexpected status: %d", code)
+	}
+	assertValue(t, power, "1200")
+	assertValue(t, grid, item.ON)
+
+	// partial update
+	code = post(w, "/webhook/meter", `{"power": 900}`, map[string]string{"Authorization": "Bearer s3cr3t"})
+	if code != http.StatusNoContent {
+		t.Fatalf("unexpected status: %d", code)
+	}
+	assertValue(t, power, "900")
+	assertValue(t, grid, item.ON)
+
+	code = post(w, "/webhook/meter?secret=s3cr3t", `{"power": 800}`, nil)
+	if code != http.StatusNoContent {
+		t.Fatalf("unexpected status: %d", code)
+	}
+	assertValue(t, power, "800")
+
+	body := `{"power": 700}`
+	mac := hmac.New(sha256.New, []byte("s3cr3t"))
+	mac.Write([]byte(body))
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	code = post(w, "/webhook/meter", body, map[string]string{"X-Hub-Signature-256": signature})
+	if code != http.StatusNoContent {
+		t.Fatalf("unexpected status: %d", code)
+	}
+	assertValue(t, power, "700")
+
+	// the signature of another body
+	code = post(w, "/webhook/meter", `{"power": 0}`, map[string]string{"X-Hub-Signature-256": signature})
+	if code != http.StatusUnauthorized {
+		t.Errorf("expected unauthorized, got: %d", code)
+	}
+
+	for _, headers := range []map[string]string{nil, {"X-Webhook-Secret": "wrong"}, {"Authorization": "Basic s3cr3t"}} {
+		if code := post(w, "/webhook/meter", `{"power": 0}`, headers); code != http.StatusUnauthorized {
+			t.Errorf("expected unauthorized for %v, got: %d", headers, code)
+		}
+	}
+	assertValue(t, power, "700")
+
+	code, resp := postBody(w, "/webhook/meter", `{"voltage": 230}`, map[string]string{"X-Webhook-Secret": "s3cr3t"})
+	if code != http.StatusUnprocessableEntity {
+		t.Errorf("expected unprocessable entity, got: %d", code)
+	}
+	if !strings.Contains(resp, "POWER: no match; GRID: no match") {
+		t.Errorf("unexpected response: %s", resp)
+	}
+
+	code, resp = postBody(w, "/webhook/meter", `{"power": `, map[string]string{"X-Webhook-Secret": "s3cr3t"})
+	if code != http.StatusBadRequest {
+		t.Errorf("expected bad request, got: %d", code)
+	}
+	if !strings.Contains(resp, "invalid JSON") {
+		t.Errorf("unexpected response: %s", resp)
+	}
+}
+
+func TestWebhookNoSecret(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	_, err := newWebhook("METER", WebhookOpts{Items: []ItemMapping{{Name: "POWER", Path: "power"}}})
+	if err == nil {
+		t.Error("expected an error for a webhook without secret")
+	}
+}
@@ -0,0 +1,365 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package modbus
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/safchain/hasc/pkg/button"
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+type DeviceOpts struct {
+	// UnitID of the device. Default to 1.
+	UnitID byte `mapstructure:"unit-id"`
+	// Interval between two polls of the registers. Default to 30 seconds.
+	Interval time.Duration
+	// Registers polled.
+	Registers []Register
+}
+
+type deviceRegister struct {
+	Register
+	item item.Item
+
+	lock     sync.Mutex
+	reported string
+}
+
+// Device polls the registers of a Modbus device into items and writes the
+// writable registers when their item is set.
+type Device struct {
+	ErrorItem *item.AnItem
+
+	id        string
+	client    *Client
+	registers []*deviceRegister
+	opts      DeviceOpts
+}
+
+// deviceConfig is the configuration of a device in the modbus section.
+type deviceConfig struct {
+	// Address of a Modbus TCP device, host:port.
+	Address string
+	// Device path of a Modbus RTU device.
+	Device     string
+	Baud       int
+	Parity     string
+	Timeout    time.Duration
+	DeviceOpts `mapstructure:",squash"`
+}
+
+func (d *Device) setError(err error) {
+	if err != nil {
+		d.ErrorItem.SetValue(err.Error())
+	} else {
+		d.ErrorItem.SetValue("")
+	}
+}
+
+// read returns the item value of a register.
+func (d *Device) read(r *deviceRegister) (string, error) {
+	unitID := d.opts.UnitID
+
+	switch r.Kind {
+	case Coil, Discrete:
+		read := d.client.ReadCoils
+		if r.Kind == Discrete {
+			read = d.client.ReadDiscreteInputs
+		}
+
+		bits, err := read(unitID, r.Address, 1)
+		if err != nil {
+			return "", err
+		}
+		return formatBit(bits[0]), nil
+	}
+
+	read := d.client.ReadHoldingRegisters
+	if r.Kind == Input {
+		read = d.client.ReadInputRegisters
+	}
+
+	registers, err := read(unitID, r.Address, r.count())
+	if err != nil {
+		return "", err
+	}
+	return r.format(r.decode(registers)), nil
+}
+
+// Poll reads all the registers and updates their items.
+func (d *Device) Poll() error {
+	var lastErr error
+
+	for _, r := range d.registers {
+		value, err := d.read(r)
+		if err != nil {
+			server.Log.Errorf("Modbus %s unable to read %s: %s", d.id, r.Name, err)
+			lastErr = err
+			continue
+		}
+
+		r.lock.Lock()
+		r.reported = value
+		r.lock.Unlock()
+
+		r.item.SetValue(value)
+	}
+	d.setError(lastErr)
+
+	return lastErr
+}
+
+func (d *Device) write(r *deviceRegister, value string) error {
+	if r.Kind == Coil {
+		return d.client.WriteSingleCoil(d.opts.UnitID, r.Address, value == item.ON)
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return err
+	}
+
+	registers, err := r.encode(f)
+	if err != nil {
+		return err
+	}
+	if len(registers) == 1 {
+		return d.client.WriteSingleRegister(d.opts.UnitID, r.Address, registers[0])
+	}
+	return d.client.WriteMultipleRegisters(d.opts.UnitID, r.Address, registers)
+}
+
+func (d *Device) onItemChange(r *deviceRegister, value string) {
+	r.lock.Lock()
+	reported := r.reported
+	r.lock.Unlock()
+
+	// value read from the device, nothing to write
+	if value == reported {
+		return
+	}
+
+	err := d.write(r, value)
+	if err != nil {
+		server.Log.Errorf("Modbus %s unable to write %s to %s: %s", d.id, value, r.Name, err)
+	} else {
+		r.lock.Lock()
+		r.reported = value
+		r.lock.Unlock()
+	}
+	d.setError(err)
+}
+
+func (d *Device) poll() {
+	ticker := time.NewTicker(d.opts.Interval)
+	for range ticker.C {
+		d.Poll()
+	}
+}
+
+// Item returns the item of the register of the given name.
+func (d *Device) Item(name string) item.Item {
+	for _, r := range d.registers {
+		if r.Name == name {
+			return r.item
+		}
+	}
+	return nil
+}
+
+func (d *Device) newRegister(reg Register) (*deviceRegister, error) {
+	if reg.Kind == "" {
+		reg.Kind = Holding
+	}
+	if reg.Type == "" {
+		reg.Type = "uint16"
+	}
+	if reg.ByteOrder == "" {
+		reg.ByteOrder = "big"
+	}
+	if reg.WordOrder == "" {
+		reg.WordOrder = "big"
+	}
+	if reg.Scale == 0 {
+		reg.Scale = 1
+	}
+	if reg.Label == "" {
+		reg.Label = reg.Name
+	}
+	if err := reg.validate(); err != nil {
+		return nil, fmt.Errorf("register %s: %s", reg.Name, err)
+	}
+
+	r := &deviceRegister{Register: reg}
+
+	id := fmt.Sprintf("%s/%s", d.id, reg.Name)
+	switch {
+	case reg.Kind == Coil && reg.Writable:
+		img := reg.Img
+		if img == "" {
+			img = "switch"
+		}
+		r.item = &button.SwitchItem{
+			AnItem: item.AnItem{
+				ID:    id,
+				Label: reg.Label,
+				Type:  "switch",
+				Img:   img,
+			},
+		}
+	case reg.isBit():
+		img := reg.Img
+		if img == "" {
+			img = "switch"
+		}
+		r.item = &item.AnItem{
+			ID:    id,
+			Label: reg.Label,
+			Type:  "state",
+			Img:   img,
+		}
+	default:
+		img, kind := reg.Img, "value"
+		if img == "" {
+			img = "chart"
+		}
+		if reg.Writable {
+			kind = "range"
+		}
+		r.item = &item.AnItem{
+			ID:    id,
+			Label: reg.Label,
+			Type:  kind,
+			Img:   img,
+			Unit:  reg.Unit,
+		}
+	}
+
+	if reg.Writable {
+		r.item.AddListener(&item.CallbackListener{
+			CbFnc: func(it item.Item, old string, new string) {
+				d.onItemChange(r, new)
+			},
+		})
+	}
+
+	return r, nil
+}
+
+func newDevice(id string, client *Client, opts ...DeviceOpts) (*Device, error) {
+	d := &Device{
+		ErrorItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/ERROR", id),
+			Label: "Error",
+			Type:  "value",
+			Img:   "dev",
+		},
+		id:     id,
+		client: client,
+	}
+	if len(opts) > 0 {
+		d.opts = opts[0]
+	}
+	if d.opts.UnitID == 0 {
+		d.opts.UnitID = 1
+	}
+	if d.opts.Interval == 0 {
+		d.opts.Interval = 30 * time.Second
+	}
+
+	for _, reg := range d.opts.Registers {
+		r, err := d.newRegister(reg)
+		if err != nil {
+			return nil, err
+		}
+		d.registers = append(d.registers, r)
+	}
+
+	return d, nil
+}
+
+// NewDevice registers an item per register, <id>/<name>, polled
+// periodically, along with the <id>/ERROR item reporting the last error.
+func NewDevice(id string, client *Client, opts ...DeviceOpts) (*Device, error) {
+	d, err := newDevice(id, client, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	server.Registry.Add(d.ErrorItem)
+	for _, r := range d.registers {
+		server.Registry.Add(r.item)
+	}
+
+	go func() {
+		d.Poll()
+		d.poll()
+	}()
+
+	return d, nil
+}
+
+// NewDeviceFromConfig connects to the device configured under the modbus
+// section of the config file for the given ID, over TCP if an address is
+// set, RTU otherwise, and registers its items.
+func NewDeviceFromConfig(id string) (*Device, error) {
+	if server.Cfg == nil {
+		return nil, fmt.Errorf("no configuration for modbus %s", id)
+	}
+
+	var cfg deviceConfig
+	if err := server.Cfg.UnmarshalKey("modbus."+strings.ToLower(id), &cfg); err != nil {
+		return nil, err
+	}
+
+	var transport Transport
+	switch {
+	case cfg.Address != "":
+		transport = NewTCPTransport(cfg.Address, TCPOpts{Timeout: cfg.Timeout})
+	case cfg.Device != "":
+		if cfg.Baud == 0 {
+			cfg.Baud = 9600
+		}
+
+		opts := RTUOpts{Timeout: cfg.Timeout}
+		if cfg.Parity != "" {
+			opts.Parity = strings.ToUpper(cfg.Parity)[0]
+		}
+		transport = NewRTUTransport(cfg.Device, cfg.Baud, opts)
+	default:
+		return nil, fmt.Errorf("no address nor device configured for modbus %s", id)
+	}
+
+	d, err := NewDevice(id, NewClient(transport), cfg.DeviceOpts)
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+	return d, nil
+}
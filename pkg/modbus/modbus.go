@@ -0,0 +1,227 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Function codes.
+const (
+	ReadCoils              byte = 1
+	ReadDiscreteInputs     byte = 2
+	ReadHoldingRegisters   byte = 3
+	ReadInputRegisters     byte = 4
+	WriteSingleCoil        byte = 5
+	WriteSingleRegister    byte = 6
+	WriteMultipleRegisters byte = 16
+)
+
+var (
+	// ErrInvalidResponse is returned when a response doesn't match its
+	// request.
+	ErrInvalidResponse = errors.New("invalid modbus response")
+	// ErrTimeout is returned when a device doesn't respond.
+	ErrTimeout = errors.New("modbus request timeout")
+)
+
+// ExceptionError is returned when a device responds with an exception.
+type ExceptionError struct {
+	Function byte
+	Code     byte
+}
+
+// Transport sends a request PDU, function code and data, to a unit and
+// returns the response PDU.
+type Transport interface {
+	Send(unitID byte, pdu []byte) ([]byte, error)
+	Close() error
+}
+
+// Client issues the requests of the functions over a transport.
+type Client struct {
+	transport Transport
+}
+
+var exceptions = map[byte]string{
+	1:  "illegal function",
+	2:  "illegal data address",
+	3:  "illegal data value",
+	4:  "server device failure",
+	5:  "acknowledge",
+	6:  "server device busy",
+	8:  "memory parity error",
+	10: "gateway path unavailable",
+	11: "gateway target device failed to respond",
+}
+
+func (e *ExceptionError) Error() string {
+	if desc, ok := exceptions[e.Code]; ok {
+		return fmt.Sprintf("modbus exception %d on function %d: %s", e.Code, e.Function, desc)
+	}
+	return fmt.Sprintf("modbus exception %d on function %d", e.Code, e.Function)
+}
+
+// request returns a PDU made of the function code followed by the given
+// values.
+func request(function byte, values ...uint16) []byte {
+	pdu := make([]byte, 1+2*len(values))
+	pdu[0] = function
+	for i, value := range values {
+		binary.BigEndian.PutUint16(pdu[1+2*i:], value)
+	}
+	return pdu
+}
+
+func (c *Client) send(unitID byte, pdu []byte) ([]byte, error) {
+	resp, err := c.transport.Send(unitID, pdu)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp) == 2 && resp[0] == pdu[0]|0x80 {
+		return nil, &ExceptionError{Function: pdu[0], Code: resp[1]}
+	}
+	if len(resp) == 0 || resp[0] != pdu[0] {
+		return nil, ErrInvalidResponse
+	}
+
+	return resp, nil
+}
+
+func (c *Client) read(unitID byte, function byte, address, quantity uint16) ([]byte, error) {
+	resp, err := c.send(unitID, request(function, address, quantity))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 2 || int(resp[1]) != len(resp)-2 {
+		return nil, ErrInvalidResponse
+	}
+
+	return resp[2:], nil
+}
+
+func (c *Client) readBits(unitID byte, function byte, address, quantity uint16) ([]bool, error) {
+	data, err := c.read(unitID, function, address, quantity)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < (int(quantity)+7)/8 {
+		return nil, ErrInvalidResponse
+	}
+
+	bits := make([]bool, quantity)
+	for i := range bits {
+		bits[i] = data[i/8]&(1<<uint(i%8)) != 0
+	}
+	return bits, nil
+}
+
+func (c *Client) readRegisters(unitID byte, function byte, address, quantity uint16) ([]uint16, error) {
+	data, err := c.read(unitID, function, address, quantity)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 2*int(quantity) {
+		return nil, ErrInvalidResponse
+	}
+
+	registers := make([]uint16, quantity)
+	for i := range registers {
+		registers[i] = binary.BigEndian.Uint16(data[2*i:])
+	}
+	return registers, nil
+}
+
+func (c *Client) ReadCoils(unitID byte, address, quantity uint16) ([]bool, error) {
+	return c.readBits(unitID, ReadCoils, address, quantity)
+}
+
+func (c *Client) ReadDiscreteInputs(unitID byte, address, quantity uint16) ([]bool, error) {
+	return c.readBits(unitID, ReadDiscreteInputs, address, quantity)
+}
+
+func (c *Client) ReadHoldingRegisters(unitID byte, address, quantity uint16) ([]uint16, error) {
+	return c.readRegisters(unitID, ReadHoldingRegisters, address, quantity)
+}
+
+func (c *Client) ReadInputRegisters(unitID byte, address, quantity uint16) ([]uint16, error) {
+	return c.readRegisters(unitID, ReadInputRegisters, address, quantity)
+}
+
+func (c *Client) WriteSingleCoil(unitID byte, address uint16, value bool) error {
+	var v uint16
+	if value {
+		v = 0xff00
+	}
+
+	pdu := request(WriteSingleCoil, address, v)
+	resp, err := c.send(unitID, pdu)
+	if err != nil {
+		return err
+	}
+	if string(resp) != string(pdu) {
+		return ErrInvalidResponse
+	}
+	return nil
+}
+
+func (c *Client) WriteSingleRegister(unitID byte, address, value uint16) error {
+	pdu := request(WriteSingleRegister, address, value)
+	resp, err := c.send(unitID, pdu)
+	if err != nil {
+		return err
+	}
+	if string(resp) != string(pdu) {
+		return ErrInvalidResponse
+	}
+	return nil
+}
+
+func (c *Client) WriteMultipleRegisters(unitID byte, address uint16, values []uint16) error {
+	pdu := request(WriteMultipleRegisters, address, uint16(len(values)))
+	pdu = append(pdu, byte(2*len(values)))
+	for _, value := range values {
+		pdu = append(pdu, byte(value>>8), byte(value))
+	}
+
+	resp, err := c.send(unitID, pdu)
+	if err != nil {
+		return err
+	}
+	if len(resp) != 5 || string(resp[:5]) != string(pdu[:5]) {
+		return ErrInvalidResponse
+	}
+	return nil
+}
+
+// Close closes the transport.
+func (c *Client) Close() error {
+	return c.transport.Close()
+}
+
+func NewClient(transport Transport) *Client {
+	return &Client{transport: transport}
+}
@@ -0,0 +1,343 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package modbus
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/registry"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+// fakeServer is an in-process Modbus server.
+type fakeServer struct {
+	sync.Mutex
+	holding  map[uint16]uint16
+	input    map[uint16]uint16
+	coils    map[uint16]bool
+	discrete map[uint16]bool
+	writes   int
+}
+
+func newFakeServer() *fakeServer {
+	return &fakeServer{
+		holding:  make(map[uint16]uint16),
+		input:    make(map[uint16]uint16),
+		coils:    make(map[uint16]bool),
+		discrete: make(map[uint16]bool),
+	}
+}
+
+func exception(function, code byte) []byte {
+	return []byte{function | 0x80, code}
+}
+
+// handle returns the response PDU of a request PDU.
+func (s *fakeServer) handle(pdu []byte) []byte {
+	s.Lock()
+	defer s.Unlock()
+
+	function := pdu[0]
+	address := binary.BigEndian.Uint16(pdu[1:])
+	value := binary.BigEndian.Uint16(pdu[3:])
+
+	switch function {
+	case ReadCoils, ReadDiscreteInputs:
+		bits := s.coils
+		if function == ReadDiscreteInputs {
+			bits = s.discrete
+		}
+
+		data := make([]byte, (value+7)/8)
+		for i := uint16(0); i < value; i++ {
+			set, ok := bits[address+i]
+			if !ok {
+				return exception(function, 2)
+			}
+			if set {
+				data[i/8] |= 1 << (i % 8)
+			}
+		}
+		return append([]byte{function, byte(len(data))}, data...)
+	case ReadHoldingRegisters, ReadInputRegisters:
+		registers := s.holding
+		if function == ReadInputRegisters {
+			registers = s.input
+		}
+
+		resp := []byte{function, byte(2 * value)}
+		for i := uint16(0); i < value; i++ {
+			register, ok := registers[address+i]
+			if !ok {
+				return exception(function, 2)
+			}
+			resp = append(resp, byte(register>>8), byte(register))
+		}
+		return resp
+	case WriteSingleCoil:
+		s.coils[address] = value == 0xff00
+		s.writes++
+		return pdu
+	case WriteSingleRegister:
+		s.holding[address] = value
+		s.writes++
+		return pdu
+	case WriteMultipleRegisters:
+		for i := uint16(0); i < value; i++ {
+			s.holding[address+i] = binary.BigEndian.Uint16(pdu[6+2*i:])
+		}
+		s.writes++
+		return pdu[:5]
+	}
+
+	return exception(function, 1)
+}
+
+// serveTCP serves the Modbus TCP requests, unit 1 only.
+func (s *fakeServer) serveTCP(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				for {
+					header := make([]byte, 7)
+					if _, err := io.ReadFull(conn, header); err != nil {
+						return
+					}
+					pdu := make([]byte, binary.BigEndian.Uint16(header[4:])-1)
+					if _, err := io.ReadFull(conn, pdu); err != nil {
+						return
+					}
+					if header[6] != 1 {
+						continue
+					}
+
+					resp := s.handle(pdu)
+					binary.BigEndian.PutUint16(header[4:], uint16(len(resp)+1))
+					conn.Write(append(header, resp...))
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestClientTCP(t *testing.T) {
+	s := newFakeServer()
+	s.holding[10], s.holding[11] = 0x1234, 0x5678
+	s.input[20] = 42
+	s.coils[0], s.coils[1], s.coils[2] = true, false, true
+	s.discrete[5] = true
+
+	client := NewClient(NewTCPTransport(s.serveTCP(t)))
+	defer client.Close()
+
+	registers, err := client.ReadHoldingRegisters(1, 10, 2)
+	if err != nil || len(registers) != 2 || registers[0] != 0x1234 || registers[1] != 0x5678 {
+		t.Fatalf("wrong holding registers: %v, %v", registers, err)
+	}
+
+	registers, err = client.ReadInputRegisters(1, 20, 1)
+	if err != nil || registers[0] != 42 {
+		t.Fatalf("wrong input registers: %v, %v", registers, err)
+	}
+
+	bits, err := client.ReadCoils(1, 0, 3)
+	if err != nil || !bits[0] || bits[1] || !bits[2] {
+		t.Fatalf("wrong coils: %v, %v", bits, err)
+	}
+
+	bits, err = client.ReadDiscreteInputs(1, 5, 1)
+	if err != nil || !bits[0] {
+		t.Fatalf("wrong discrete inputs: %v, %v", bits, err)
+	}
+
+	if err := client.WriteSingleRegister(1, 10, 7); err != nil || s.holding[10] != 7 {
+		t.Fatalf("register not written: %v", err)
+	}
+	if err := client.WriteMultipleRegisters(1, 30, []uint16{1, 2}); err != nil || s.holding[30] != 1 || s.holding[31] != 2 {
+		t.Fatalf("registers not written: %v", err)
+	}
+	if err := client.WriteSingleCoil(1, 1, true); err != nil || !s.coils[1] {
+		t.Fatalf("coil not written: %v", err)
+	}
+
+	_, err = client.ReadHoldingRegisters(1, 100, 1)
+	if e, ok := err.(*ExceptionError); !ok || e.Code != 2 || e.Function != ReadHoldingRegisters {
+		t.Fatalf("expected an illegal data address exception, got: %v", err)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	s := newFakeServer()
+	s.holding[0] = 1
+
+	client := NewClient(NewTCPTransport(s.serveTCP(t), TCPOpts{Timeout: 200 * time.Millisecond}))
+	defer client.Close()
+
+	// unit not served
+	if _, err := client.ReadHoldingRegisters(2, 0, 1); err != ErrTimeout {
+		t.Fatalf("expected a timeout, got: %v", err)
+	}
+
+	// the connection is re-established
+	if registers, err := client.ReadHoldingRegisters(1, 0, 1); err != nil || registers[0] != 1 {
+		t.Fatalf("wrong holding registers: %v, %v", registers, err)
+	}
+}
+
+func TestRegisterCodec(t *testing.T) {
+	tests := []struct {
+		register  Register
+		registers []uint16
+		value     float64
+	}{
+		{Register{Type: "int16"}, []uint16{0xff9c}, -100},
+		{Register{Type: "uint16", Scale: 0.1}, []uint16{215}, 21.5},
+		{Register{Type: "int32"}, []uint16{0xffff, 0xfffe}, -2},
+		{Register{Type: "uint32", WordOrder: "little"}, []uint16{0x0002, 0x0001}, 0x10002},
+		{Register{Type: "float32"}, []uint16{0x41ac, 0x0000}, 21.5},
+		{Register{Type: "float32", WordOrder: "little", ByteOrder: "little"}, []uint16{0x0000, 0xac41}, 21.5},
+	}
+
+	for _, test := range tests {
+		r := test.register
+		if r.Scale == 0 {
+			r.Scale = 1
+		}
+		if r.ByteOrder == "" {
+			r.ByteOrder = "big"
+		}
+		if r.WordOrder == "" {
+			r.WordOrder = "big"
+		}
+
+		if value := r.decode(test.registers); value != test.value && r.format(value) != r.format(test.value) {
+			t.Errorf("%+v expected %f, got: %f", r, test.value, value)
+		}
+
+		registers, err := r.encode(test.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range registers {
+			if registers[i] != test.registers[i] {
+				t.Errorf("%+v expected %x, got: %x", r, test.registers, registers)
+			}
+		}
+	}
+
+	r := Register{Type: "uint16", Scale: 1}
+	if _, err := r.encode(-1); err == nil {
+		t.Error("expected an out of range error")
+	}
+}
+
+func TestDevice(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	s := newFakeServer()
+	s.holding[0], s.holding[1] = 0x41ac, 0x0000
+	s.holding[2] = 200
+	s.input[0] = 0xff9c
+	s.coils[0] = false
+	s.discrete[0] = true
+
+	client := NewClient(NewTCPTransport(s.serveTCP(t)))
+	defer client.Close()
+
+	d, err := newDevice("HEATPUMP", client, DeviceOpts{
+		Registers: []Register{
+			{Name: "FLOW_TEMPERATURE", Type: "float32", Unit: "°"},
+			{Name: "SETPOINT", Address: 2, Scale: 0.1, Writable: true},
+			{Name: "OUTSIDE_TEMPERATURE", Kind: Input, Type: "int16", Scale: 0.1},
+			{Name: "PUMP", Kind: Coil, Writable: true},
+			{Name: "DEFROST", Kind: Discrete},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Poll(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"FLOW_TEMPERATURE":    "21.5",
+		"SETPOINT":            "20.0",
+		"OUTSIDE_TEMPERATURE": "-10.0",
+		"PUMP":                item.OFF,
+		"DEFROST":             item.ON,
+	}
+	for name, value := range expected {
+		if got := d.Item(name).GetValue(); got != value {
+			t.Errorf("%s expected %s, got: %s", name, value, got)
+		}
+	}
+	if s.writes != 0 {
+		t.Fatalf("polled values written back: %d", s.writes)
+	}
+	if d.Item("SETPOINT").GetType() != "range" || d.Item("PUMP").GetType() != "switch" {
+		t.Errorf("wrong item types")
+	}
+
+	d.Item("SETPOINT").SetValue("21.5")
+	d.Item("PUMP").SetValue(item.ON)
+
+	if s.holding[2] != 215 || !s.coils[0] {
+		t.Errorf("registers not written: %d, %v", s.holding[2], s.coils[0])
+	}
+
+	// unknown register
+	s.Lock()
+	delete(s.holding, 2)
+	s.Unlock()
+
+	if err := d.Poll(); err == nil || d.ErrorItem.GetValue() == "" {
+		t.Error("expected an error")
+	}
+
+	if _, err := newDevice("HEATPUMP", client, DeviceOpts{
+		Registers: []Register{{Name: "TEMP", Kind: Input, Writable: true}},
+	}); err == nil {
+		t.Error("expected a read only error")
+	}
+}
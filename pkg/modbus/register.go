@@ -0,0 +1,214 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package modbus
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/safchain/hasc/pkg/item"
+)
+
+// Kinds of registers.
+const (
+	Holding  = "holding"
+	Input    = "input"
+	Coil     = "coil"
+	Discrete = "discrete"
+)
+
+// Register describes a value of a device.
+type Register struct {
+	// Name of the item, <device id>/<name>.
+	Name  string
+	Label string
+	Unit  string
+	Img   string
+	// Kind of register, holding, input, coil or discrete. Default to
+	// holding.
+	Kind    string
+	Address uint16
+	// Type of the value of the registers, int16, uint16, int32, uint32 or
+	// float32. Default to uint16. Ignored for coils and discrete inputs.
+	Type string
+	// ByteOrder of the registers, big or little. Default to big.
+	ByteOrder string `mapstructure:"byte-order"`
+	// WordOrder of the 32 bits values, big, the high word first, or little.
+	// Default to big.
+	WordOrder string `mapstructure:"word-order"`
+	// Scale applied to the value read, the value written being divided by
+	// it. Default to 1.
+	Scale float64
+	// Writable registers, holding or coil, are written when their item is
+	// set.
+	Writable bool
+}
+
+func (r *Register) isBit() bool {
+	return r.Kind == Coil || r.Kind == Discrete
+}
+
+// count returns the number of registers or bits of the value.
+func (r *Register) count() uint16 {
+	switch r.Type {
+	case "int32", "uint32", "float32":
+		return 2
+	}
+	return 1
+}
+
+func (r *Register) validate() error {
+	switch r.Kind {
+	case Holding, Input, Coil, Discrete:
+	default:
+		return fmt.Errorf("unknown register kind: %s", r.Kind)
+	}
+	switch r.Type {
+	case "int16", "uint16", "int32", "uint32", "float32":
+	default:
+		return fmt.Errorf("unknown register type: %s", r.Type)
+	}
+	if r.ByteOrder != "big" && r.ByteOrder != "little" {
+		return fmt.Errorf("unknown byte order: %s", r.ByteOrder)
+	}
+	if r.WordOrder != "big" && r.WordOrder != "little" {
+		return fmt.Errorf("unknown word order: %s", r.WordOrder)
+	}
+	if r.Writable && (r.Kind == Input || r.Kind == Discrete) {
+		return fmt.Errorf("%s registers are read only", r.Kind)
+	}
+	return nil
+}
+
+func swapBytes(value uint16) uint16 {
+	return value<<8 | value>>8
+}
+
+// decode returns the value of the registers.
+func (r *Register) decode(registers []uint16) float64 {
+	words := make([]uint16, len(registers))
+	for i, value := range registers {
+		if r.ByteOrder == "little" {
+			value = swapBytes(value)
+		}
+		words[i] = value
+	}
+
+	var raw uint32
+	if len(words) == 2 {
+		if r.WordOrder == "little" {
+			words[0], words[1] = words[1], words[0]
+		}
+		raw = uint32(words[0])<<16 | uint32(words[1])
+	} else {
+		raw = uint32(words[0])
+	}
+
+	var value float64
+	switch r.Type {
+	case "int16":
+		value = float64(int16(raw))
+	case "int32":
+		value = float64(int32(raw))
+	case "uint32", "uint16":
+		value = float64(raw)
+	case "float32":
+		value = float64(math.Float32frombits(raw))
+	}
+
+	return value * r.Scale
+}
+
+// encode returns the registers of the value.
+func (r *Register) encode(value float64) ([]uint16, error) {
+	value /= r.Scale
+
+	var raw uint32
+	switch r.Type {
+	case "int16":
+		v := math.Round(value)
+		if v < math.MinInt16 || v > math.MaxInt16 {
+			return nil, fmt.Errorf("value out of range: %f", value)
+		}
+		raw = uint32(uint16(int16(v)))
+	case "uint16":
+		v := math.Round(value)
+		if v < 0 || v > math.MaxUint16 {
+			return nil, fmt.Errorf("value out of range: %f", value)
+		}
+		raw = uint32(v)
+	case "int32":
+		v := math.Round(value)
+		if v < math.MinInt32 || v > math.MaxInt32 {
+			return nil, fmt.Errorf("value out of range: %f", value)
+		}
+		raw = uint32(int32(v))
+	case "uint32":
+		v := math.Round(value)
+		if v < 0 || v > math.MaxUint32 {
+			return nil, fmt.Errorf("value out of range: %f", value)
+		}
+		raw = uint32(v)
+	case "float32":
+		raw = math.Float32bits(float32(value))
+	}
+
+	words := []uint16{uint16(raw)}
+	if r.count() == 2 {
+		words = []uint16{uint16(raw >> 16), uint16(raw)}
+		if r.WordOrder == "little" {
+			words[0], words[1] = words[1], words[0]
+		}
+	}
+	if r.ByteOrder == "little" {
+		for i := range words {
+			words[i] = swapBytes(words[i])
+		}
+	}
+
+	return words, nil
+}
+
+// format returns the item value of a register value, with the decimals of
+// the scale.
+func (r *Register) format(value float64) string {
+	switch {
+	case r.Type == "float32":
+		return strconv.FormatFloat(value, 'f', -1, 32)
+	case r.Scale != 1:
+		decimals := int(math.Ceil(-math.Log10(math.Abs(r.Scale))))
+		if decimals < 0 {
+			decimals = 0
+		}
+		return strconv.FormatFloat(value, 'f', decimals, 64)
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func formatBit(value bool) string {
+	if value {
+		return item.ON
+	}
+	return item.OFF
+}
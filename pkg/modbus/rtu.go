@@ -0,0 +1,213 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package modbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/safchain/hasc/pkg/serial"
+)
+
+type RTUOpts struct {
+	// Parity, N, E or O. Default to E as specified by Modbus.
+	Parity byte
+	// Timeout of the requests. Default to 1 second.
+	Timeout time.Duration
+}
+
+// rtuFraming delimits the RTU frames, unit ID, PDU and CRC, according to the
+// function code of the responses, the bytes not making a valid frame are
+// skipped. The bytes waiting for the rest of a frame for more than the
+// silence are dropped, ex: noise announcing a large byte count.
+type rtuFraming struct {
+	silence time.Duration
+	held    []byte
+	since   time.Time
+}
+
+// RTUTransport sends the requests over Modbus RTU, one at a time.
+type RTUTransport struct {
+	sync.Mutex
+
+	serial    *serial.Serial
+	responses chan []byte
+	opts      RTUOpts
+}
+
+func crc16(data []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// frameSize returns the size of the response frame starting data, 0 if more
+// data is needed, -1 if the function code is unknown.
+func frameSize(data []byte) int {
+	if len(data) < 2 {
+		return 0
+	}
+
+	function := data[1]
+	switch {
+	case function&0x80 != 0:
+		return 5
+	case function >= ReadCoils && function <= ReadInputRegisters:
+		if len(data) < 3 {
+			return 0
+		}
+		return 5 + int(data[2])
+	case function == WriteSingleCoil || function == WriteSingleRegister || function == WriteMultipleRegisters:
+		return 8
+	}
+	return -1
+}
+
+// Split skips the bytes until a valid frame within a single call, the scanner
+// reading more data after each call not returning a frame.
+func (f *rtuFraming) Split(data []byte, atEOF bool) (int, []byte, error) {
+	now := time.Now()
+
+	start := 0
+	if f.silence > 0 && len(f.held) > 0 && now.Sub(f.since) > f.silence && bytes.HasPrefix(data, f.held) {
+		start = len(f.held)
+	}
+
+	for ; start < len(data); start++ {
+		size := frameSize(data[start:])
+		if size < 0 {
+			continue
+		}
+		if size == 0 || len(data[start:]) < size {
+			break
+		}
+
+		frame := data[start : start+size]
+		if crc16(frame[:size-2]) == binary.LittleEndian.Uint16(frame[size-2:]) {
+			f.held = nil
+			return start + size, frame, nil
+		}
+	}
+
+	if atEOF {
+		f.held = nil
+		return len(data), nil, nil
+	}
+
+	// the silence starts with the first byte of the pending frame
+	pending := data[start:]
+	if !bytes.HasPrefix(pending, f.held) || len(f.held) == 0 {
+		f.since = now
+	}
+	f.held = append(f.held[:0], pending...)
+
+	return start, nil, nil
+}
+
+func (f *rtuFraming) Encode(frame []byte) ([]byte, error) {
+	data := append([]byte{}, frame...)
+	crc := crc16(data)
+	return append(data, byte(crc), byte(crc>>8)), nil
+}
+
+// OnValueChange handles the frames read from the serial port.
+func (t *RTUTransport) OnValueChange(frame string) {
+	select {
+	case t.responses <- []byte(frame):
+	default:
+	}
+}
+
+func (t *RTUTransport) Send(unitID byte, pdu []byte) ([]byte, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	// drop the late responses
+	for len(t.responses) > 0 {
+		<-t.responses
+	}
+
+	if err := t.serial.Write(append([]byte{unitID}, pdu...)); err != nil {
+		return nil, err
+	}
+
+	timeout := time.After(t.opts.Timeout)
+	for {
+		select {
+		case frame := <-t.responses:
+			if frame[0] != unitID {
+				continue
+			}
+			return frame[1 : len(frame)-2], nil
+		case <-timeout:
+			return nil, ErrTimeout
+		}
+	}
+}
+
+func (t *RTUTransport) Close() error {
+	return t.serial.Close()
+}
+
+func newRTUTransport(s *serial.Serial, opts RTUOpts) *RTUTransport {
+	t := &RTUTransport{
+		serial:    s,
+		responses: make(chan []byte, 10),
+		opts:      opts,
+	}
+	s.AddListener(t)
+
+	return t
+}
+
+// NewRTUTransport returns a transport over the given serial device.
+func NewRTUTransport(dev string, baud int, opts ...RTUOpts) *RTUTransport {
+	var o RTUOpts
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if o.Parity == 0 {
+		o.Parity = 'E'
+	}
+	if o.Timeout == 0 {
+		o.Timeout = time.Second
+	}
+
+	s := serial.NewSerial(dev, baud, serial.SerialOpts{
+		Framing: &rtuFraming{silence: o.Timeout},
+		Parity:  o.Parity,
+	})
+
+	return newRTUTransport(s, o)
+}
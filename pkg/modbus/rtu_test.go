@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package modbus
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestCRC16(t *testing.T) {
+	if crc := crc16([]byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x0a}); crc != 0xcdc5 {
+		t.Errorf("wrong crc: %04x", crc)
+	}
+}
+
+func TestRTUFraming(t *testing.T) {
+	framing := &rtuFraming{}
+
+	var data []byte
+	for _, frame := range [][]byte{
+		{0x01, ReadHoldingRegisters, 0x04, 0x00, 0x01, 0x00, 0x02},
+		{0x01, WriteSingleRegister, 0x00, 0x02, 0x00, 0x07},
+		{0x11, ReadHoldingRegisters | 0x80, 0x02},
+	} {
+		encoded, _ := framing.Encode(frame)
+		data = append(data, encoded...)
+
+		// noise between the frames
+		data = append(data, 0x00)
+	}
+	// corrupted frame
+	data = append(data, 0x01, WriteSingleCoil, 0x00, 0x01, 0xff, 0x00, 0x00, 0x00)
+
+	// frames read from a stream, without EOF
+	var frames [][]byte
+	for len(data) > 0 {
+		advance, frame, err := framing.Split(data, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if advance == 0 {
+			break
+		}
+		if frame != nil {
+			frames = append(frames, frame)
+		}
+		data = data[advance:]
+	}
+
+	if len(frames) != 3 {
+		t.Fatalf("expected 3 frames, got: %x", frames)
+	}
+	if frames[2][0] != 0x11 || len(frames[0]) != 9 || len(frames[1]) != 8 {
+		t.Errorf("wrong frames: %x", frames)
+	}
+}
+
+func TestRTUFramingSilence(t *testing.T) {
+	framing := &rtuFraming{silence: 50 * time.Millisecond}
+
+	// noise announcing a frame of 255 bytes
+	garbage := []byte{0x01, ReadHoldingRegisters, 0xff, 0x12}
+	response, _ := framing.Encode([]byte{0x01, ReadHoldingRegisters, 0x02, 0x00, 0x2a})
+
+	if advance, frame, _ := framing.Split(garbage, false); advance != 0 || frame != nil {
+		t.Fatalf("expected to wait for more data, got: %d, %x", advance, frame)
+	}
+
+	// the noise is dropped once the silence elapsed
+	time.Sleep(100 * time.Millisecond)
+
+	data := append(append([]byte{}, garbage...), response...)
+	advance, frame, err := framing.Split(data, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if advance != len(data) || !bytes.Equal(frame, response) {
+		t.Fatalf("expected the response, got: %d, %x", advance, frame)
+	}
+
+	// noise followed by a valid frame, resync within a single call
+	data = append([]byte{0x00, 0x99}, response...)
+	if advance, frame, _ := framing.Split(data, false); advance != len(data) || !bytes.Equal(frame, response) {
+		t.Fatalf("expected the response, got: %d, %x", advance, frame)
+	}
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package modbus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxPDUSize is the maximum size of a PDU.
+const maxPDUSize = 253
+
+type TCPOpts struct {
+	// Timeout of the connection and of the requests. Default to 5 seconds.
+	Timeout time.Duration
+}
+
+// TCPTransport sends the requests over Modbus TCP, the connection is
+// established on the first request and re-established after a failure.
+type TCPTransport struct {
+	sync.Mutex
+
+	address       string
+	conn          net.Conn
+	transactionID uint16
+	opts          TCPOpts
+}
+
+func (t *TCPTransport) closeConn() {
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+}
+
+func (t *TCPTransport) send(unitID byte, pdu []byte) ([]byte, error) {
+	if t.conn == nil {
+		conn, err := net.DialTimeout("tcp", t.address, t.opts.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		t.conn = conn
+	}
+	t.conn.SetDeadline(time.Now().Add(t.opts.Timeout))
+
+	t.transactionID++
+
+	adu := make([]byte, 7, 7+len(pdu))
+	binary.BigEndian.PutUint16(adu[0:], t.transactionID)
+	binary.BigEndian.PutUint16(adu[4:], uint16(len(pdu)+1))
+	adu[6] = unitID
+	adu = append(adu, pdu...)
+
+	if _, err := t.conn.Write(adu); err != nil {
+		return nil, err
+	}
+
+	for {
+		header := make([]byte, 7)
+		if _, err := io.ReadFull(t.conn, header); err != nil {
+			return nil, err
+		}
+
+		length := int(binary.BigEndian.Uint16(header[4:]))
+		if binary.BigEndian.Uint16(header[2:]) != 0 || length < 2 || length > maxPDUSize+1 {
+			return nil, fmt.Errorf("%s: wrong header %x", ErrInvalidResponse, header)
+		}
+
+		resp := make([]byte, length-1)
+		if _, err := io.ReadFull(t.conn, resp); err != nil {
+			return nil, err
+		}
+
+		// response to a previous request that timed out
+		if binary.BigEndian.Uint16(header[0:]) != t.transactionID {
+			continue
+		}
+		if header[6] != unitID {
+			return nil, ErrInvalidResponse
+		}
+
+		return resp, nil
+	}
+}
+
+func (t *TCPTransport) Send(unitID byte, pdu []byte) ([]byte, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	resp, err := t.send(unitID, pdu)
+	if err != nil {
+		t.closeConn()
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			return nil, ErrTimeout
+		}
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (t *TCPTransport) Close() error {
+	t.Lock()
+	defer t.Unlock()
+
+	t.closeConn()
+	return nil
+}
+
+// NewTCPTransport returns a transport to the given address, host:port, the
+// Modbus TCP port being 502.
+func NewTCPTransport(address string, opts ...TCPOpts) *TCPTransport {
+	t := &TCPTransport{address: address}
+	if len(opts) > 0 {
+		t.opts = opts[0]
+	}
+	if t.opts.Timeout == 0 {
+		t.opts.Timeout = 5 * time.Second
+	}
+
+	return t
+}
@@ -40,6 +40,23 @@ type Subscriber struct {
 	handler MessageHandler
 }
 
+const (
+	// StatusOnline is the payload of the status topic while connected.
+	StatusOnline = "online"
+	// StatusOffline is the payload of the status topic once disconnected,
+	// published by the broker if the connection is lost.
+	StatusOffline = "offline"
+)
+
+type MQTTConnOpts struct {
+	// ClientID used to connect to the broker, a random one if empty.
+	ClientID string
+	// StatusTopic on which online is published, retained, once connected
+	// and offline on Close, or by the broker as last will if the connection
+	// is lost.
+	StatusTopic string
+}
+
 // MQTTConn Object
 type MQTTConn struct {
 	sync.RWMutex
@@ -47,6 +64,7 @@ type MQTTConn struct {
 	broker      string
 	client      mqtt.Client
 	subscribers []*Subscriber
+	opts        MQTTConnOpts
 }
 
 func (m *MQTTConn) Subscribe(topic string, handler MessageHandler) {
@@ -76,13 +94,39 @@ func (m *MQTTConn) subscribe(subscriber *Subscriber) error {
 	return nil
 }
 
-func (m *MQTTConn) Publish(id, topic, payload string) {
+func (m *MQTTConn) publish(id, topic, payload string, retained bool) {
 	server.Log.Infof("MQTT %s send payload: %s", id, payload)
-	if token := m.client.Publish(topic, 0, false, []byte(payload)); token.Wait() && token.Error() != nil {
+	if token := m.client.Publish(topic, 0, retained, []byte(payload)); token.Wait() && token.Error() != nil {
 		server.Log.Errorf("MQTT error while publishing: %s", token.Error())
 	}
 }
 
+func (m *MQTTConn) Publish(id, topic, payload string) {
+	m.publish(id, topic, payload, false)
+}
+
+// PublishRetained publishes a payload kept by the broker for the next
+// subscribers.
+func (m *MQTTConn) PublishRetained(id, topic, payload string) {
+	m.publish(id, topic, payload, true)
+}
+
+// IsConnected returns whether the connection to the broker is established.
+func (m *MQTTConn) IsConnected() bool {
+	return atomic.LoadInt64(&m.connected) == 1
+}
+
+// Close publishes the offline status, if a status topic is set, and
+// disconnects from the broker.
+func (m *MQTTConn) Close() {
+	if m.opts.StatusTopic != "" && m.IsConnected() {
+		m.PublishRetained("MQTT", m.opts.StatusTopic, StatusOffline)
+	}
+	atomic.StoreInt64(&m.connected, 0)
+
+	m.client.Disconnect(250)
+}
+
 func (m *MQTTConn) subscribeAll() {
 	if atomic.LoadInt64(&m.connected) == 1 {
 		m.RLock()
@@ -96,13 +140,22 @@ func (m *MQTTConn) subscribeAll() {
 }
 
 // NewMQTTConn creates a new MQTTConn Object, publishing and subscribing to the given broker/topic
-func NewMQTTConn(broker string) *MQTTConn {
+func NewMQTTConn(broker string, connOpts ...MQTTConnOpts) *MQTTConn {
 	m := &MQTTConn{
 		broker: broker,
 	}
+	if len(connOpts) > 0 {
+		m.opts = connOpts[0]
+	}
 
 	opts := mqtt.NewClientOptions().AddBroker(broker)
 	opts.SetAutoReconnect(true)
+	if m.opts.ClientID != "" {
+		opts.SetClientID(m.opts.ClientID)
+	}
+	if m.opts.StatusTopic != "" {
+		opts.SetWill(m.opts.StatusTopic, StatusOffline, 0, true)
+	}
 	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
 		server.Log.Errorf("MQTT connection lost: %s", err)
 
@@ -113,6 +166,10 @@ func NewMQTTConn(broker string) *MQTTConn {
 
 		atomic.StoreInt64(&m.connected, 1)
 		m.subscribeAll()
+
+		if m.opts.StatusTopic != "" {
+			m.PublishRetained("MQTT", m.opts.StatusTopic, StatusOnline)
+		}
 	})
 
 	m.client = mqtt.NewClient(opts)
@@ -23,30 +23,39 @@
 package netmon
 
 import (
-	"net"
-	"sync/atomic"
+	"fmt"
+	"sync"
 	"time"
 
-	fastping "github.com/tatsushid/go-fastping"
-
 	"github.com/safchain/hasc/pkg/item"
 	"github.com/safchain/hasc/pkg/server"
 )
 
+type NetMonOpts struct {
+	// Retry is the number of consecutive failures before reporting the target
+	// as down.
+	Retry int
+	// Timeout of a probe. Default to 5 seconds.
+	Timeout time.Duration
+	// Window is the number of probes used to compute the packet loss. Default
+	// to 10.
+	Window int
+}
+
+// NetMonItem is ON while the target is reachable according to its probe. The
+// round trip time and the packet loss are reported by sub items.
 type NetMonItem struct {
 	item.AnItem
-
-	pinger      *fastping.Pinger
-	pinging     atomic.Value
-	lastSuccess time.Time
-	retry       int
-	fail        int
+	RTTItem  *item.AnItem
+	LossItem *item.AnItem
+
+	lock    sync.Mutex
+	probe   Probe
+	fail    int
+	results []bool
+	opts    NetMonOpts
 }
 
-const (
-	pingTimeout = 5 * time.Second
-)
-
 func (n *NetMonItem) SetValue(new string) (string, bool) {
 	switch new {
 	case "on", "ON", "1":
@@ -58,40 +67,49 @@ func (n *NetMonItem) SetValue(new string) (string, bool) {
 	return n.AnItem.SetValue(new)
 }
 
-func (n *NetMonItem) onRecv(addr *net.IPAddr, rtt time.Duration) {
-	n.pinging.Store(false)
+// loss returns the percentage of failed probes over the window.
+func (n *NetMonItem) loss(success bool) float64 {
+	n.results = append(n.results, success)
+	if len(n.results) > n.opts.Window {
+		n.results = n.results[len(n.results)-n.opts.Window:]
+	}
 
-	n.lastSuccess = time.Now()
-	n.fail = 0
+	var failed int
+	for _, ok := range n.results {
+		if !ok {
+			failed++
+		}
+	}
 
-	n.SetValue(item.ON)
+	return float64(failed) * 100 / float64(len(n.results))
 }
 
-func (n *NetMonItem) onIdle() {
-	n.pinging.Store(false)
-
-	if n.lastSuccess.Add(pingTimeout).After(time.Now()) {
-		return
-	}
+func (n *NetMonItem) refreshFnc() {
+	rtt, err := n.probe.Probe(n.opts.Timeout)
 
-	n.fail++
-	if n.fail > n.retry {
-		n.SetValue(item.OFF)
+	n.lock.Lock()
+	loss := n.loss(err == nil)
+	if err == nil {
+		n.fail = 0
 	} else {
-		server.Log.Infof("NetMon error %s, fails: %d", n.GetID(), n.fail)
+		n.fail++
 	}
-}
+	fail := n.fail
+	n.lock.Unlock()
 
-func (n *NetMonItem) refreshFnc() {
-	if n.pinging.Load() == true {
-		time.Sleep(time.Second)
+	n.LossItem.SetValue(fmt.Sprintf("%.0f", loss))
+
+	if err == nil {
+		n.RTTItem.SetValue(fmt.Sprintf("%.1f", float64(rtt)/float64(time.Millisecond)))
+		n.SetValue(item.ON)
 		return
 	}
 
-	n.pinging.Store(true)
-	if err := n.pinger.Run(); err != nil {
-		server.Log.Fatalf("NetMon check error: %s", err)
-		n.pinging.Store(false)
+	if fail > n.opts.Retry {
+		n.RTTItem.SetValue("")
+		n.SetValue(item.OFF)
+	} else {
+		server.Log.Infof("NetMon error %s: %s, fails: %d", n.GetID(), err, fail)
 	}
 }
 
@@ -104,14 +122,7 @@ func (n *NetMonItem) refresh(refresh time.Duration) {
 	}
 }
 
-func NewNetMonItem(id string, label string, address string, refresh time.Duration, retry int) *NetMonItem {
-	p := fastping.NewPinger()
-	ra, err := net.ResolveIPAddr("ip4:icmp", address)
-	if err != nil {
-		server.Log.Fatalf("NetMon address resolution error: %s", err)
-	}
-	p.AddIPAddr(ra)
-
+func newNetMonItem(id string, label string, probe Probe, opts ...NetMonOpts) *NetMonItem {
 	n := &NetMonItem{
 		AnItem: item.AnItem{
 			ID:    id,
@@ -119,16 +130,50 @@ func NewNetMonItem(id string, label string, address string, refresh time.Duratio
 			Type:  "state",
 			Img:   "netmon",
 		},
-		pinger: p,
-		retry:  retry,
+		RTTItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/RTT", id),
+			Label: "Latency",
+			Type:  "value",
+			Img:   "netmon",
+			Unit:  "ms",
+		},
+		LossItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/LOSS", id),
+			Label: "Packet loss",
+			Type:  "value",
+			Img:   "netmon",
+			Unit:  "%",
+		},
+		probe: probe,
+	}
+	if len(opts) > 0 {
+		n.opts = opts[0]
+	}
+	if n.opts.Timeout == 0 {
+		n.opts.Timeout = 5 * time.Second
+	}
+	if n.opts.Window == 0 {
+		n.opts.Window = 10
 	}
 
-	p.OnRecv = n.onRecv
-	p.OnIdle = n.onIdle
+	return n
+}
 
-	go n.refresh(refresh)
+// NewNetMonProbeItem returns an item monitoring a target with the given probe,
+// see NewTCPProbe, NewHTTPProbe, NewDNSProbe and NewICMPProbe.
+func NewNetMonProbeItem(id string, label string, probe Probe, refresh time.Duration, opts ...NetMonOpts) *NetMonItem {
+	n := newNetMonItem(id, label, probe, opts...)
 
 	server.Registry.Add(n)
+	server.Registry.Add(n.RTTItem)
+	server.Registry.Add(n.LossItem)
+
+	go n.refresh(refresh)
 
 	return n
 }
+
+// NewNetMonItem returns an item pinging the given IPv4 or IPv6 address.
+func NewNetMonItem(id string, label string, address string, refresh time.Duration, retry int) *NetMonItem {
+	return NewNetMonProbeItem(id, label, NewICMPProbe(address), refresh, NetMonOpts{Retry: retry})
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright (C) 2017 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package netmon
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/safchain/hasc/pkg/item"
+)
+
+type fakeProbe struct {
+	results []bool
+}
+
+func (f *fakeProbe) Probe(timeout time.Duration) (time.Duration, error) {
+	ok := f.results[0]
+	f.results = f.results[1:]
+
+	if !ok {
+		return 0, errors.New("timeout")
+	}
+	return 12500 * time.Microsecond, nil
+}
+
+func TestNetMonItem(t *testing.T) {
+	probe := &fakeProbe{results: []bool{true, false, true, false, false}}
+	n := newNetMonItem("HOST", "Host", probe, NetMonOpts{Retry: 1, Window: 4})
+
+	expected := []struct {
+		state string
+		rtt   string
+		loss  string
+	}{
+		{item.ON, "12.5", "0"},
+		{item.ON, "12.5", "50"},
+		{item.ON, "12.5", "33"},
+		{item.ON, "12.5", "50"},
+		{item.OFF, "", "75"},
+	}
+
+	for i, e := range expected {
+		n.refreshFnc()
+
+		if n.GetValue() != e.state || n.RTTItem.GetValue() != e.rtt || n.LossItem.GetValue() != e.loss {
+			t.Fatalf("probe %d: expected %+v, got: %s, %s, %s", i, e, n.GetValue(), n.RTTItem.GetValue(), n.LossItem.GetValue())
+		}
+	}
+}
@@ -0,0 +1,296 @@
+/*
+ * Copyright (C) 2021 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package netmon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+const (
+	protocolICMP     = 1
+	protocolIPv6ICMP = 58
+)
+
+type pingRequest struct {
+	seq   int
+	ip    net.IP
+	sent  time.Time
+	reply chan time.Duration
+}
+
+type pingConn struct {
+	*icmp.PacketConn
+	v6         bool
+	privileged bool
+}
+
+// pinger sends the ICMP echo requests of all the monitored addresses over a
+// socket per address family. Unprivileged datagram sockets are used when
+// allowed, see net.ipv4.ping_group_range, raw sockets otherwise.
+type pinger struct {
+	ErrorItem *item.AnItem
+
+	lock    sync.Mutex
+	id      int
+	seq     int
+	conns   map[bool]*pingConn
+	pending map[int]*pingRequest
+	queue   chan *pingRequest
+}
+
+var (
+	shared     *pinger
+	sharedOnce sync.Once
+)
+
+func listenICMP(v6 bool) (*pingConn, error) {
+	network, rawNetwork, address := "udp4", "ip4:icmp", "0.0.0.0"
+	if v6 {
+		network, rawNetwork, address = "udp6", "ip6:ipv6-icmp", "::"
+	}
+
+	conn, err := icmp.ListenPacket(network, address)
+	if err == nil {
+		return &pingConn{PacketConn: conn, v6: v6}, nil
+	}
+
+	conn, rawErr := icmp.ListenPacket(rawNetwork, address)
+	if rawErr == nil {
+		return &pingConn{PacketConn: conn, v6: v6, privileged: true}, nil
+	}
+
+	return nil, fmt.Errorf("unable to open an ICMP socket, unprivileged: %s, privileged: %s", err, rawErr)
+}
+
+func (p *pinger) setError(err error) {
+	if err != nil {
+		server.Log.Errorf("NetMon pinger error: %s", err)
+		p.ErrorItem.SetValue(err.Error())
+	} else {
+		p.ErrorItem.SetValue("")
+	}
+}
+
+func (p *pinger) conn(v6 bool) (*pingConn, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if conn, ok := p.conns[v6]; ok {
+		return conn, nil
+	}
+
+	conn, err := listenICMP(v6)
+	p.setError(err)
+	if err != nil {
+		return nil, err
+	}
+	p.conns[v6] = conn
+
+	go p.read(conn)
+
+	return conn, nil
+}
+
+func (p *pinger) closeConn(conn *pingConn) {
+	p.lock.Lock()
+	if p.conns[conn.v6] == conn {
+		delete(p.conns, conn.v6)
+	}
+	p.lock.Unlock()
+
+	conn.Close()
+}
+
+func (p *pinger) read(conn *pingConn) {
+	proto := protocolICMP
+	if conn.v6 {
+		proto = protocolIPv6ICMP
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			server.Log.Errorf("NetMon pinger read error: %s", err)
+			p.closeConn(conn)
+			return
+		}
+		now := time.Now()
+
+		msg, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || (msg.Type != ipv4.ICMPTypeEchoReply && msg.Type != ipv6.ICMPTypeEchoReply) {
+			continue
+		}
+
+		echo, ok := msg.Body.(*icmp.Echo)
+		// the kernel sets the ID of the datagram sockets
+		if !ok || conn.privileged && echo.ID != p.id {
+			continue
+		}
+
+		var ip net.IP
+		switch addr := peer.(type) {
+		case *net.UDPAddr:
+			ip = addr.IP
+		case *net.IPAddr:
+			ip = addr.IP
+		}
+
+		p.lock.Lock()
+		req, ok := p.pending[echo.Seq]
+		if ok && req.ip.Equal(ip) {
+			delete(p.pending, echo.Seq)
+			req.reply <- now.Sub(req.sent)
+		}
+		p.lock.Unlock()
+	}
+}
+
+func (p *pinger) send(req *pingRequest) {
+	conn, err := p.conn(req.ip.To4() == nil)
+	if err != nil {
+		return
+	}
+
+	msg := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: p.id, Seq: req.seq, Data: []byte("hasc")},
+	}
+	if conn.v6 {
+		msg.Type = ipv6.ICMPTypeEchoRequest
+	}
+
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		server.Log.Errorf("NetMon pinger error: %s", err)
+		return
+	}
+
+	var addr net.Addr = &net.UDPAddr{IP: req.ip}
+	if conn.privileged {
+		addr = &net.IPAddr{IP: req.ip}
+	}
+
+	p.lock.Lock()
+	req.sent = time.Now()
+	p.lock.Unlock()
+
+	if _, err := conn.WriteTo(b, addr); err != nil {
+		server.Log.Errorf("NetMon pinger unable to ping %s: %s", req.ip, err)
+	}
+}
+
+func (p *pinger) run() {
+	for req := range p.queue {
+		batch := []*pingRequest{req}
+
+		// send all the queued requests at once
+	DRAIN:
+		for {
+			select {
+			case req := <-p.queue:
+				batch = append(batch, req)
+			default:
+				break DRAIN
+			}
+		}
+
+		for _, req := range batch {
+			p.send(req)
+		}
+	}
+}
+
+// Ping sends an echo request to the given IP and returns the round trip time.
+func (p *pinger) Ping(ip net.IP, timeout time.Duration) (time.Duration, error) {
+	// fail right away if no socket can be opened
+	if _, err := p.conn(ip.To4() == nil); err != nil {
+		return 0, err
+	}
+
+	req := &pingRequest{
+		ip:    ip,
+		reply: make(chan time.Duration, 1),
+	}
+
+	p.lock.Lock()
+	p.seq = (p.seq + 1) & 0xffff
+	req.seq = p.seq
+	p.pending[req.seq] = req
+	p.lock.Unlock()
+
+	p.queue <- req
+
+	select {
+	case rtt := <-req.reply:
+		return rtt, nil
+	case <-time.After(timeout):
+		p.lock.Lock()
+		if p.pending[req.seq] == req {
+			delete(p.pending, req.seq)
+		}
+		p.lock.Unlock()
+
+		return 0, errors.New("timeout")
+	}
+}
+
+func newPinger() *pinger {
+	p := &pinger{
+		ErrorItem: &item.AnItem{
+			ID:    "NETMON/PINGER_ERROR",
+			Label: "Pinger error",
+			Type:  "value",
+			Img:   "dev",
+		},
+		id:      os.Getpid() & 0xffff,
+		conns:   make(map[bool]*pingConn),
+		pending: make(map[int]*pingRequest),
+		queue:   make(chan *pingRequest, 100),
+	}
+
+	go p.run()
+
+	return p
+}
+
+// sharedPinger returns the pinger used by all the ICMP probes.
+func sharedPinger() *pinger {
+	sharedOnce.Do(func() {
+		shared = newPinger()
+		server.Registry.Add(shared.ErrorItem)
+	})
+	return shared
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright (C) 2017 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package netmon
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPinger(t *testing.T) {
+	p := newPinger()
+
+	for _, address := range []string{"127.0.0.1", "::1"} {
+		ip := net.ParseIP(address)
+		if _, err := p.conn(ip.To4() == nil); err != nil {
+			t.Logf("skipping %s: %s", address, err)
+			continue
+		}
+
+		// concurrent requests share the same socket
+		var wg sync.WaitGroup
+		errs := make(chan error, 10)
+		for i := 0; i != 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				if _, err := p.Ping(ip, 2*time.Second); err != nil {
+					errs <- err
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			t.Fatalf("%s should answer: %s", address, err)
+		}
+		if p.ErrorItem.GetValue() != "" {
+			t.Fatalf("unexpected error: %s", p.ErrorItem.GetValue())
+		}
+	}
+}
@@ -0,0 +1,189 @@
+/*
+ * Copyright (C) 2021 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package netmon
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Probe checks that a target is reachable and returns the round trip time.
+type Probe interface {
+	Probe(timeout time.Duration) (time.Duration, error)
+}
+
+// TCPProbe checks that a TCP connection can be established.
+type TCPProbe struct {
+	address string
+}
+
+type HTTPProbeOpts struct {
+	// Status expected, default to any 2xx status.
+	Status int
+	// Match is a regular expression that the body has to match.
+	Match string
+}
+
+// HTTPProbe checks the status and optionally the body of an HTTP response.
+type HTTPProbe struct {
+	url   string
+	match *regexp.Regexp
+	opts  HTTPProbeOpts
+}
+
+type DNSProbeOpts struct {
+	// Server to query, ip:port, default to the system resolver.
+	Server string
+}
+
+// DNSProbe checks that a name can be resolved.
+type DNSProbe struct {
+	name     string
+	resolver *net.Resolver
+}
+
+// ICMPProbe sends an ICMP echo request, IPv4 or IPv6 according to the
+// address, through the pinger shared by all the ICMP probes.
+type ICMPProbe struct {
+	address string
+	pinger  *pinger
+}
+
+func (p *TCPProbe) Probe(timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+
+	conn, err := net.DialTimeout("tcp", p.address, timeout)
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	conn.Close()
+
+	return rtt, nil
+}
+
+func (p *HTTPProbe) Probe(timeout time.Duration) (time.Duration, error) {
+	client := &http.Client{Timeout: timeout}
+
+	start := time.Now()
+
+	resp, err := client.Get(p.url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	rtt := time.Since(start)
+
+	if p.opts.Status != 0 && resp.StatusCode != p.opts.Status ||
+		p.opts.Status == 0 && (resp.StatusCode < 200 || resp.StatusCode >= 300) {
+		return 0, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	if p.match != nil {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return 0, err
+		}
+		if !p.match.Match(body) {
+			return 0, fmt.Errorf("body doesn't match %s", p.match)
+		}
+	}
+
+	return rtt, nil
+}
+
+func (p *DNSProbe) Probe(timeout time.Duration) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+
+	addrs, err := p.resolver.LookupHost(ctx, p.name)
+	if err != nil {
+		return 0, err
+	}
+	if len(addrs) == 0 {
+		return 0, fmt.Errorf("no address found for %s", p.name)
+	}
+
+	return time.Since(start), nil
+}
+
+func (p *ICMPProbe) Probe(timeout time.Duration) (time.Duration, error) {
+	ra, err := net.ResolveIPAddr("ip", p.address)
+	if err != nil {
+		return 0, err
+	}
+
+	return p.pinger.Ping(ra.IP, timeout)
+}
+
+// NewTCPProbe returns a probe connecting to address, host:port or
+// [ipv6]:port.
+func NewTCPProbe(address string) *TCPProbe {
+	return &TCPProbe{address: address}
+}
+
+func NewHTTPProbe(url string, opts ...HTTPProbeOpts) (*HTTPProbe, error) {
+	p := &HTTPProbe{url: url}
+	if len(opts) > 0 {
+		p.opts = opts[0]
+	}
+
+	if p.opts.Match != "" {
+		re, err := regexp.Compile(p.opts.Match)
+		if err != nil {
+			return nil, err
+		}
+		p.match = re
+	}
+
+	return p, nil
+}
+
+func NewDNSProbe(name string, opts ...DNSProbeOpts) *DNSProbe {
+	p := &DNSProbe{name: name, resolver: net.DefaultResolver}
+
+	if len(opts) > 0 && opts[0].Server != "" {
+		server := opts[0].Server
+		p.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	return p
+}
+
+func NewICMPProbe(address string) *ICMPProbe {
+	return &ICMPProbe{address: address, pinger: sharedPinger()}
+}
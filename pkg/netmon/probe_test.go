@@ -0,0 +1,148 @@
+/*
+ * Copyright (C) 2017 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package netmon
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestTCPProbe(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:0", "[::1]:0"} {
+		l, err := net.Listen("tcp", address)
+		if err != nil {
+			t.Logf("unable to listen on %s: %s", address, err)
+			continue
+		}
+
+		p := NewTCPProbe(l.Addr().String())
+		if _, err := p.Probe(time.Second); err != nil {
+			t.Fatalf("%s should be reachable: %s", address, err)
+		}
+
+		l.Close()
+		if _, err := p.Probe(time.Second); err == nil {
+			t.Fatalf("%s shouldn't be reachable", address)
+		}
+	}
+}
+
+func TestHTTPProbe(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"status": "healthy"}`))
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		path    string
+		opts    HTTPProbeOpts
+		success bool
+	}{
+		{"/", HTTPProbeOpts{}, true},
+		{"/down", HTTPProbeOpts{}, false},
+		{"/down", HTTPProbeOpts{Status: http.StatusServiceUnavailable}, true},
+		{"/", HTTPProbeOpts{Match: `"status":\s*"healthy"`}, true},
+		{"/", HTTPProbeOpts{Match: `unhealthy`}, false},
+	}
+
+	for _, test := range tests {
+		p, err := NewHTTPProbe(ts.URL+test.path, test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = p.Probe(time.Second); (err == nil) != test.success {
+			t.Fatalf("%s %+v: expected success %v, got: %v", test.path, test.opts, test.success, err)
+		}
+	}
+
+	if _, err := NewHTTPProbe(ts.URL, HTTPProbeOpts{Match: "("}); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+// serveDNS answers A queries for known.test only.
+func serveDNS(t *testing.T, conn net.PacketConn) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil || len(msg.Questions) == 0 {
+			continue
+		}
+
+		q := msg.Questions[0]
+		msg.Header.Response = true
+		msg.Header.RCode = dnsmessage.RCodeNameError
+
+		if q.Name.String() == "known.test." {
+			msg.Header.RCode = dnsmessage.RCodeSuccess
+			if q.Type == dnsmessage.TypeA {
+				msg.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+					Body:   &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}},
+				}}
+			}
+		}
+
+		b, err := msg.Pack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.WriteTo(b, addr)
+	}
+}
+
+func TestDNSProbe(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	go serveDNS(t, conn)
+
+	p := NewDNSProbe("known.test", DNSProbeOpts{Server: conn.LocalAddr().String()})
+	if _, err := p.Probe(time.Second); err != nil {
+		t.Fatalf("should be resolved: %s", err)
+	}
+
+	p = NewDNSProbe("unknown.test", DNSProbeOpts{Server: conn.LocalAddr().String()})
+	if _, err := p.Probe(time.Second); err == nil {
+		t.Fatal("shouldn't be resolved")
+	}
+}
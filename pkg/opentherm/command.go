@@ -0,0 +1,323 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package opentherm
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+// Command status
+const (
+	StatusPending  = "Pending"
+	StatusAck      = "Acknowledged"
+	StatusInvalid  = "Invalid data"
+	StatusUnknown  = "Unknown data ID"
+	StatusTimeout  = "Timeout"
+	StatusReplaced = "Replaced"
+	StatusError    = "Error"
+)
+
+var (
+	ErrInvalidData   = errors.New("data invalid for the boiler")
+	ErrUnknownDataID = errors.New("data ID unknown to the boiler")
+	ErrAckTimeout    = errors.New("no acknowledgement from the boiler")
+	ErrReplaced      = errors.New("replaced by a newer request")
+)
+
+// Request tracks the response of the boiler to a message sent.
+type Request struct {
+	Message *Message
+	Sent    time.Time
+
+	// data word of the request, acknowledged as is by the boiler
+	data  string
+	once  sync.Once
+	done  chan struct{}
+	reply *Message
+	err   error
+}
+
+// SetPointItem sends its value to the boiler, the response of the boiler is
+// reported by its status item.
+type SetPointItem struct {
+	item.AnItem
+
+	StatusItem *item.AnItem
+
+	msgID     int
+	opentherm *OpenTherm
+}
+
+func (r *Request) resolve(reply *Message, err error) {
+	r.once.Do(func() {
+		r.reply, r.err = reply, err
+		close(r.done)
+	})
+}
+
+// Wait waits for the response of the boiler, an error is returned if the
+// boiler rejected the message or didn't respond in time.
+func (r *Request) Wait(timeout time.Duration) (*Message, error) {
+	select {
+	case <-r.done:
+		return r.reply, r.err
+	case <-time.After(timeout):
+		return nil, ErrAckTimeout
+	}
+}
+
+// Status returns the status of the request.
+func (r *Request) Status() string {
+	select {
+	case <-r.done:
+	default:
+		return StatusPending
+	}
+
+	switch r.err {
+	case nil:
+		return StatusAck
+	case ErrInvalidData:
+		return StatusInvalid
+	case ErrUnknownDataID:
+		return StatusUnknown
+	case ErrReplaced:
+		return StatusReplaced
+	case ErrAckTimeout:
+		return StatusTimeout
+	}
+	return StatusError
+}
+
+// dataWord returns the data word of the given encoded message, ex: 3200 for
+// T90383200.
+func dataWord(payload string) string {
+	return payload[5:]
+}
+
+// ack resolves the pending request matching a response of the boiler, a write
+// acknowledgement having to carry the written data word.
+func (o *OpenTherm) ack(msg *Message) {
+	if msg.Src != B && msg.Src != A {
+		return
+	}
+
+	var err error
+	switch msg.Type {
+	case WriteAck:
+	case DataInv:
+		err = ErrInvalidData
+	case UnkDataId:
+		err = ErrUnknownDataID
+	default:
+		return
+	}
+
+	o.Lock()
+	req, ok := o.pending[msg.ID]
+	if ok && msg.Type == WriteAck {
+		payload, err := msg.Encode()
+		ok = err == nil && dataWord(payload) == req.data
+	}
+	if ok {
+		delete(o.pending, msg.ID)
+	}
+	o.Unlock()
+
+	if ok {
+		req.resolve(msg, err)
+	}
+}
+
+// Send publishes a message to the input topic of the gateway, or issues the
+// matching command to an OTGW. A write request is tracked until acknowledged
+// by the boiler or until the acknowledgement timeout, or, for the commands
+// answered by the OTGW itself, until the response of the OTGW, without reply
+// message.
+func (o *OpenTherm) Send(msg *Message) (*Request, error) {
+	payload, err := msg.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	// the OTGW doesn't accept raw messages but commands
+	var command, value string
+	if o.otgw != nil {
+		if command, value, err = otgwCommand(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	req := &Request{
+		Message: msg,
+		Sent:    time.Now(),
+		data:    dataWord(payload),
+		done:    make(chan struct{}),
+	}
+
+	if msg.Type == WriteData {
+		o.Lock()
+		prev := o.pending[msg.ID]
+		o.pending[msg.ID] = req
+		o.Unlock()
+
+		if prev != nil {
+			prev.resolve(nil, ErrReplaced)
+		}
+
+		time.AfterFunc(o.opts.AckTimeout, func() {
+			o.Lock()
+			if o.pending[msg.ID] == req {
+				delete(o.pending, msg.ID)
+			}
+			o.Unlock()
+
+			req.resolve(nil, ErrAckTimeout)
+		})
+	}
+
+	if o.otgw != nil {
+		go func() {
+			if _, err := o.otgw.Command(command, value); err != nil {
+				server.Log.Errorf("Opentherm %s command %s=%s error: %s", o.id, command, value, err)
+				req.resolve(nil, err)
+				return
+			}
+
+			// no acknowledgement of the boiler to wait for
+			if otgwAnswered[command] {
+				o.Lock()
+				if o.pending[msg.ID] == req {
+					delete(o.pending, msg.ID)
+				}
+				o.Unlock()
+
+				req.resolve(nil, nil)
+			}
+		}()
+	} else {
+		o.publish(o.opts.InputTopic, payload)
+	}
+
+	return req, nil
+}
+
+// SetControlSetPoint overrides the control setpoint, ID 1, the water
+// temperature requested to the boiler.
+func (o *OpenTherm) SetControlSetPoint(value float64) (*Request, error) {
+	msg := &Message{}
+	msg.ThermostatSetPoint(value)
+	return o.Send(msg)
+}
+
+// SetRoomSetPointOverride overrides the room setpoint, ID 9, 0 to cancel the
+// override.
+func (o *OpenTherm) SetRoomSetPointOverride(value float64) (*Request, error) {
+	msg := &Message{}
+	msg.RoomSetPointOverride(value)
+	return o.Send(msg)
+}
+
+// SetDHWSetPoint sets the domestic hot water setpoint, ID 56.
+func (o *OpenTherm) SetDHWSetPoint(value float64) (*Request, error) {
+	msg := &Message{}
+	msg.DHWSetPoint(value)
+	return o.Send(msg)
+}
+
+// SetMaxCHSetPoint sets the maximum central heating water setpoint, ID 57.
+func (o *OpenTherm) SetMaxCHSetPoint(value float64) (*Request, error) {
+	msg := &Message{}
+	msg.MaxCHSetPoint(value)
+	return o.Send(msg)
+}
+
+func (s *SetPointItem) SetValue(value string) (string, bool) {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		server.Log.Errorf("Opentherm %s wrong setpoint: %s", s.ID, value)
+		return s.GetValue(), false
+	}
+
+	msg := &Message{
+		Src:    T,
+		Type:   WriteData,
+		ID:     s.msgID,
+		Values: []interface{}{f},
+	}
+
+	req, err := s.opentherm.Send(msg)
+	if err != nil {
+		server.Log.Errorf("Opentherm %s unable to send setpoint: %s", s.ID, err)
+		return s.GetValue(), false
+	}
+	s.StatusItem.SetValue(StatusPending)
+
+	go func() {
+		if _, err := req.Wait(s.opentherm.opts.AckTimeout + time.Second); err != nil {
+			server.Log.Errorf("Opentherm %s setpoint %s: %s", s.ID, value, err)
+		}
+		s.StatusItem.SetValue(req.Status())
+	}()
+
+	return s.AnItem.SetValue(value)
+}
+
+// RegisterSetPointItem returns an item writing its value to the boiler with
+// the given message ID, ex: 56 for the DHW setpoint.
+func (o *OpenTherm) RegisterSetPointItem(id, label string, msgID int) (*SetPointItem, error) {
+	md, ok := messageDefs[msgID]
+	if !ok || md.arg1 != f8 || md.arg2 != ns {
+		return nil, fmt.Errorf("not a setpoint message: %d", msgID)
+	}
+
+	s := &SetPointItem{
+		AnItem: item.AnItem{
+			ID:    fmt.Sprintf("%s/%s", o.id, id),
+			Label: label,
+			Type:  "range",
+			Img:   "temperature",
+			Unit:  "°",
+		},
+		StatusItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/%s_STATUS", o.id, id),
+			Label: fmt.Sprintf("%s status", label),
+			Type:  "value",
+			Img:   "dev",
+		},
+		msgID:     msgID,
+		opentherm: o,
+	}
+
+	server.Registry.Add(s)
+	server.Registry.Add(s.StatusItem)
+
+	return s, nil
+}
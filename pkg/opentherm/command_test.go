@@ -0,0 +1,124 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package opentherm
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type published struct {
+	sync.Mutex
+	payloads []string
+}
+
+func (p *published) publish(topic, payload string) {
+	p.Lock()
+	p.payloads = append(p.payloads, payload)
+	p.Unlock()
+}
+
+func newTestOpenTherm(p *published) *OpenTherm {
+	o := newOpenTherm("OPENTHERM", OpenThermOpts{AckTimeout: 200 * time.Millisecond})
+	o.publish = p.publish
+
+	return o
+}
+
+func reply(t *testing.T, o *OpenTherm, raw string) {
+	var msg Message
+	if err := msg.Decode(raw); err != nil {
+		t.Fatal(err)
+	}
+	o.ack(&msg)
+}
+
+func TestSendAck(t *testing.T) {
+	p := &published{}
+	o := newTestOpenTherm(p)
+
+	req, err := o.SetDHWSetPoint(50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.payloads) != 1 || p.payloads[0] != "T90383200" {
+		t.Fatalf("wrong payload: %v", p.payloads)
+	}
+	if req.Status() != StatusPending {
+		t.Fatalf("expected pending, got: %s", req.Status())
+	}
+
+	// ack of another message ID
+	reply(t, o, "B5039FF00")
+	if req.Status() != StatusPending {
+		t.Fatalf("expected pending, got: %s", req.Status())
+	}
+
+	// ack of another value, ex: the one of a previous request
+	reply(t, o, "B50383100")
+	if req.Status() != StatusPending {
+		t.Fatalf("expected pending, got: %s", req.Status())
+	}
+
+	reply(t, o, "B50383200")
+	if _, err := req.Wait(time.Second); err != nil || req.Status() != StatusAck {
+		t.Fatalf("expected ack, got: %s, %v", req.Status(), err)
+	}
+}
+
+func TestSendRejected(t *testing.T) {
+	o := newTestOpenTherm(&published{})
+
+	req, _ := o.SetMaxCHSetPoint(90)
+	reply(t, o, "B6039FF00")
+	if _, err := req.Wait(time.Second); err != ErrInvalidData || req.Status() != StatusInvalid {
+		t.Fatalf("expected invalid data, got: %s, %v", req.Status(), err)
+	}
+
+	req, _ = o.SetRoomSetPointOverride(19)
+	reply(t, o, "BF009FF00")
+	if _, err := req.Wait(time.Second); err != ErrUnknownDataID {
+		t.Fatalf("expected unknown data ID, got: %v", err)
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	o := newTestOpenTherm(&published{})
+
+	first, _ := o.SetControlSetPoint(40)
+	second, _ := o.SetControlSetPoint(45)
+
+	if _, err := first.Wait(time.Second); err != ErrReplaced {
+		t.Fatalf("expected replaced, got: %v", err)
+	}
+	if _, err := second.Wait(time.Second); err != ErrAckTimeout || second.Status() != StatusTimeout {
+		t.Fatalf("expected timeout, got: %s, %v", second.Status(), err)
+	}
+
+	// late ack ignored
+	reply(t, o, "BD001FF00")
+	if len(o.pending) != 0 {
+		t.Fatal("no request should be pending")
+	}
+}
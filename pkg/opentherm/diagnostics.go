@@ -0,0 +1,288 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package opentherm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+// application-specific fault flags of the message 5
+var faultFlags = []string{
+	"Service request",
+	"Lockout reset",
+	"Low water pressure",
+	"Gas/flame fault",
+	"Air pressure fault",
+	"Water over-temperature",
+}
+
+var counterDefs = []struct {
+	msgID int
+	name  string
+	label string
+	unit  string
+}{
+	{113, "UNSUCCESSFUL_BURNER_STARTS", "Unsuccessful burner starts", ""},
+	{114, "FLAME_SIGNAL_LOW", "Flame signal too low", ""},
+	{116, "BURNER_STARTS", "Burner starts", ""},
+	{117, "CH_PUMP_STARTS", "CH pump starts", ""},
+	{118, "DHW_PUMP_STARTS", "DHW pump/valve starts", ""},
+	{119, "DHW_BURNER_STARTS", "DHW burner starts", ""},
+	{120, "BURNER_HOURS", "Burner operation hours", "h"},
+	{121, "CH_PUMP_HOURS", "CH pump operation hours", "h"},
+	{122, "DHW_PUMP_HOURS", "DHW pump/valve operation hours", "h"},
+	{123, "DHW_BURNER_HOURS", "DHW burner operation hours", "h"},
+}
+
+// TrafficEntry is a decoded message of the traffic log.
+type TrafficEntry struct {
+	Time   time.Time
+	Raw    string
+	Src    string
+	Type   string
+	ID     int
+	Desc   string
+	Values []string
+}
+
+type trafficLog struct {
+	sync.RWMutex
+	entries []TrafficEntry
+	next    int
+	full    bool
+}
+
+// Diagnostics exposes the health of the boiler: faults, OEM codes, start and
+// operation hour counters.
+type Diagnostics struct {
+	FaultItem             *item.AnItem
+	FaultFlagsItem        *item.AnItem
+	OEMFaultCodeItem      *item.AnItem
+	OEMDiagnosticCodeItem *item.AnItem
+	FaultBufferItem       *item.AnItem
+	// CounterItems by message ID, from 113 to 123.
+	CounterItems map[int]*item.AnItem
+
+	lock        sync.Mutex
+	faultBuffer map[int64]int64
+}
+
+func newTrafficLog(size int) *trafficLog {
+	return &trafficLog{entries: make([]TrafficEntry, size)}
+}
+
+func (t *trafficLog) add(raw string, msg *Message) {
+	entry := TrafficEntry{
+		Time: time.Now(),
+		Raw:  raw,
+		Src:  msg.Src.String(),
+		Type: msg.Type.String(),
+		ID:   msg.ID,
+		Desc: msg.Desc,
+	}
+	for _, value := range msg.Values {
+		entry.Values = append(entry.Values, fmt.Sprintf("%v", value))
+	}
+
+	t.Lock()
+	t.entries[t.next] = entry
+	t.next = (t.next + 1) % len(t.entries)
+	if t.next == 0 {
+		t.full = true
+	}
+	t.Unlock()
+}
+
+// list returns the entries from the oldest to the newest.
+func (t *trafficLog) list() []TrafficEntry {
+	t.RLock()
+	defer t.RUnlock()
+
+	if !t.full {
+		return append([]TrafficEntry{}, t.entries[:t.next]...)
+	}
+	return append(append([]TrafficEntry{}, t.entries[t.next:]...), t.entries[:t.next]...)
+}
+
+// Traffic returns the last decoded messages, from the oldest to the newest.
+func (o *OpenTherm) Traffic() []TrafficEntry {
+	return o.traffic.list()
+}
+
+func (o *OpenTherm) trafficHandler(w http.ResponseWriter, r *http.Request) {
+	entries := o.Traffic()
+
+	if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && limit >= 0 && limit < len(entries) {
+		entries = entries[len(entries)-limit:]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		server.Log.Errorf("Opentherm %s unable to encode the traffic log: %s", o.id, err)
+	}
+}
+
+func formatFaultFlags(flags int64) string {
+	var faults []string
+	for i, desc := range faultFlags {
+		if flags&(1<<uint(i)) > 0 {
+			faults = append(faults, desc)
+		}
+	}
+	if len(faults) == 0 {
+		return "OK"
+	}
+	return strings.Join(faults, ", ")
+}
+
+func (d *Diagnostics) formatFaultBuffer() string {
+	var indexes []int
+	for index := range d.faultBuffer {
+		indexes = append(indexes, int(index))
+	}
+	sort.Ints(indexes)
+
+	var entries []string
+	for _, index := range indexes {
+		entries = append(entries, fmt.Sprintf("%d:%d", index, d.faultBuffer[int64(index)]))
+	}
+	return strings.Join(entries, ", ")
+}
+
+// handle updates the items with the responses of the boiler.
+func (d *Diagnostics) handle(msg *Message) {
+	if msg.Src != B && msg.Src != A || msg.Type != ReadAck {
+		return
+	}
+
+	switch msg.ID {
+	case 0:
+		if msg.IsSlaveFault() {
+			d.FaultItem.SetValue(item.ON)
+		} else {
+			d.FaultItem.SetValue(item.OFF)
+		}
+	case 5:
+		d.FaultFlagsItem.SetValue(formatFaultFlags(msg.Values[0].(int64)))
+		d.OEMFaultCodeItem.SetValue(fmt.Sprintf("%d", msg.Values[1]))
+	case 13:
+		d.lock.Lock()
+		d.faultBuffer[msg.Values[0].(int64)] = msg.Values[1].(int64)
+		value := d.formatFaultBuffer()
+		d.lock.Unlock()
+
+		d.FaultBufferItem.SetValue(value)
+	case 115:
+		d.OEMDiagnosticCodeItem.SetValue(fmt.Sprintf("%d", msg.Values[0]))
+	default:
+		if it, ok := d.CounterItems[msg.ID]; ok {
+			it.SetValue(fmt.Sprintf("%d", msg.Values[0]))
+		}
+	}
+}
+
+func newDiagnostics(id string) *Diagnostics {
+	d := &Diagnostics{
+		FaultItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/FAULT", id),
+			Label: "Fault",
+			Type:  "state",
+			Img:   "fire",
+		},
+		FaultFlagsItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/FAULT_FLAGS", id),
+			Label: "Fault flags",
+			Type:  "value",
+			Img:   "fire",
+		},
+		OEMFaultCodeItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/OEM_FAULT_CODE", id),
+			Label: "OEM fault code",
+			Type:  "value",
+			Img:   "fire",
+		},
+		OEMDiagnosticCodeItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/OEM_DIAGNOSTIC_CODE", id),
+			Label: "OEM diagnostic code",
+			Type:  "value",
+			Img:   "fire",
+		},
+		FaultBufferItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/FAULT_BUFFER", id),
+			Label: "Fault buffer",
+			Type:  "value",
+			Img:   "fire",
+		},
+		CounterItems: make(map[int]*item.AnItem),
+		faultBuffer:  make(map[int64]int64),
+	}
+
+	for _, def := range counterDefs {
+		d.CounterItems[def.msgID] = &item.AnItem{
+			ID:    fmt.Sprintf("%s/%s", id, def.name),
+			Label: def.label,
+			Type:  "value",
+			Img:   "chart",
+			Unit:  def.unit,
+		}
+	}
+
+	return d
+}
+
+// RegisterDiagnostics registers the diagnostic items, updated with the
+// responses of the boiler to the thermostat, and the traffic log endpoint,
+// /opentherm/<id>/traffic, returning the last decoded messages, limited by
+// the optional limit parameter. It has to be called from the onInit callback
+// of server.Start.
+func (o *OpenTherm) RegisterDiagnostics() *Diagnostics {
+	d := newDiagnostics(o.id)
+
+	server.Registry.Add(d.FaultItem)
+	server.Registry.Add(d.FaultFlagsItem)
+	server.Registry.Add(d.OEMFaultCodeItem)
+	server.Registry.Add(d.OEMDiagnosticCodeItem)
+	server.Registry.Add(d.FaultBufferItem)
+	for _, def := range counterDefs {
+		server.Registry.Add(d.CounterItems[def.msgID])
+	}
+
+	o.Lock()
+	o.diagnostics = d
+	o.Unlock()
+
+	path := fmt.Sprintf("/opentherm/%s/traffic", strings.ToLower(o.id))
+	server.HandleFunc(path, o.trafficHandler).Methods("GET")
+
+	return d
+}
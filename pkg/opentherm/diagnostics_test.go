@@ -0,0 +1,114 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package opentherm
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDiagnostics(t *testing.T) {
+	o := newOpenTherm("OPENTHERM")
+	d := newDiagnostics("OPENTHERM")
+	o.diagnostics = d
+
+	for _, raw := range []string{
+		"B40000001", // slave fault
+		"B4005052A", // service request, low water pressure, OEM code 42
+		"B400D0107", // fault buffer entry 1: 7
+		"B400D0003", // fault buffer entry 0: 3
+		"B407404D2", // 1234 burner starts
+		"B40781388", // 5000 burner hours
+		"B40730102", // OEM diagnostic code 258
+		"T00740000", // read request, ignored
+		"BF0740000", // unknown data ID, ignored
+	} {
+		o.HandleMessage(raw)
+	}
+
+	expected := []struct {
+		value string
+		got   string
+	}{
+		{"ON", d.FaultItem.GetValue()},
+		{"Service request, Low water pressure", d.FaultFlagsItem.GetValue()},
+		{"42", d.OEMFaultCodeItem.GetValue()},
+		{"0:3, 1:7", d.FaultBufferItem.GetValue()},
+		{"1234", d.CounterItems[116].GetValue()},
+		{"5000", d.CounterItems[120].GetValue()},
+		{"258", d.OEMDiagnosticCodeItem.GetValue()},
+	}
+	for _, e := range expected {
+		if e.got != e.value {
+			t.Errorf("expected %s, got: %s", e.value, e.got)
+		}
+	}
+
+	o.HandleMessage("BC0050000")
+	if value := d.FaultFlagsItem.GetValue(); value != "OK" {
+		t.Errorf("expected OK, got: %s", value)
+	}
+}
+
+func TestTrafficLog(t *testing.T) {
+	o := newOpenTherm("OPENTHERM", OpenThermOpts{TrafficLogSize: 3})
+
+	frames := []string{"B40730000", "BC0730001", "BC0730002", "B40730003", "BC0730004"}
+	for _, raw := range frames {
+		o.HandleMessage(raw)
+	}
+
+	entries := o.Traffic()
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got: %d", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Raw != frames[i+2] {
+			t.Errorf("expected %s, got: %s", frames[i+2], entry.Raw)
+		}
+	}
+	if entries[0].Src != "Boiler" || entries[0].ID != 115 || entries[0].Values[0] != "2" {
+		t.Errorf("wrong entry: %+v", entries[0])
+	}
+
+	w := httptest.NewRecorder()
+	o.trafficHandler(w, httptest.NewRequest("GET", "/opentherm/opentherm/traffic?limit=2", nil))
+
+	var got []TrafficEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[1].Raw != "BC0730004" {
+		t.Errorf("wrong traffic log: %+v", got)
+	}
+}
+
+func TestTrafficLogNegativeSize(t *testing.T) {
+	o := newOpenTherm("OPENTHERM", OpenThermOpts{TrafficLogSize: -1})
+
+	o.HandleMessage("B40730000")
+	if len(o.Traffic()) != 1 {
+		t.Fatalf("expected 1 entry, got: %d", len(o.Traffic()))
+	}
+}
@@ -24,9 +24,12 @@ package opentherm
 
 import (
 	"fmt"
+	"math"
+	"math/bits"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 
@@ -34,9 +37,13 @@ import (
 	"github.com/safchain/hasc/pkg/item"
 	hmqtt "github.com/safchain/hasc/pkg/mqtt"
 	"github.com/safchain/hasc/pkg/server"
+	"github.com/safchain/hasc/pkg/transform"
 	"github.com/safchain/hasc/pkg/value"
 )
 
+// amps to watts, calibrated for the boiler, readings above 7000W are glitches
+const defaultCurrentTransform = "linear(220) | threshold(100, 0) | linear(1.13, -324) | clamp(, 7000, drop)"
+
 type argType int
 
 const (
@@ -46,6 +53,7 @@ const (
 	u16
 	nu
 	s8
+	s16
 	dt
 	tm
 	ns
@@ -91,6 +99,25 @@ const (
 	T Src = 'T'
 	A Src = 'A'
 	R Src = 'R'
+	// Master matches the messages of the thermostat, T, and of the gateway
+	// to the boiler, R, items registered with it follow the latest of both.
+	Master Src = 'M'
+	// Slave matches the messages of the boiler, B, and of the gateway to the
+	// thermostat, A, items registered with it follow the latest of both.
+	Slave Src = 'S'
+)
+
+// Part of the data of a message an item is bound to.
+type Part int
+
+const (
+	// Word is the value of the message, the first one for the messages
+	// carrying two bytes.
+	Word Part = iota
+	// HighByte is the value of the high byte of the message.
+	HighByte
+	// LowByte is the value of the low byte of the message.
+	LowByte
 )
 
 type Message struct {
@@ -101,6 +128,20 @@ type Message struct {
 	Desc   string
 }
 
+// Date of the message 21.
+type Date struct {
+	Month time.Month
+	Day   int
+}
+
+// DayTime of the message 20, the weekday is not set if HasWeekday is false.
+type DayTime struct {
+	Weekday    time.Weekday
+	HasWeekday bool
+	Hour       int
+	Minute     int
+}
+
 type messageDef struct {
 	id   int
 	arg1 argType
@@ -108,35 +149,30 @@ type messageDef struct {
 	desc string
 }
 
+// messageDefs are the data IDs of OpenTherm 2.2 and 4.0, the IDs from 128 are
+// vendor specific.
 var messageDefs = map[int]messageDef{
 	0:   {id: 0, arg1: flag8, arg2: flag8, desc: "Status"},
 	1:   {id: 1, arg1: f8, arg2: ns, desc: "Control setpoint"},
-	5:   {id: 5, arg1: flag8, arg2: u8, desc: "Application-specific flags"},
-	8:   {id: 8, arg1: f8, arg2: ns, desc: "Control setpoint 2"},
-	70:  {id: 70, arg1: flag8, arg2: flag8, desc: "Status V/H"},
-	71:  {id: 71, arg1: nu, arg2: u8, desc: "Control setpoint V/H"},
-	72:  {id: 72, arg1: flag8, arg2: u8, desc: "Fault flags/code V/H"},
-	73:  {id: 73, arg1: u16, arg2: ns, desc: "OEM diagnostic code V/H"},
-	101: {id: 101, arg1: flag8, arg2: flag8, desc: "Solar storage mode and status"},
-	102: {id: 102, arg1: flag8, arg2: u8, desc: "Solar storage fault flags"},
-	115: {id: 115, arg1: u16, arg2: ns, desc: "OEM diagnostic code"},
 	2:   {id: 2, arg1: flag8, arg2: u8, desc: "Master configuration"},
 	3:   {id: 3, arg1: flag8, arg2: u8, desc: "Slave configuration"},
-	74:  {id: 74, arg1: flag8, arg2: u8, desc: "Configuration/memberid V/H"},
-	75:  {id: 75, arg1: f8, arg2: ns, desc: "OpenTherm version V/H"},
-	76:  {id: 76, arg1: u8, arg2: u8, desc: "Product version V/H"},
-	103: {id: 103, arg1: flag8, arg2: u8, desc: "Solar storage config/memberid"},
-	104: {id: 104, arg1: u8, arg2: u8, desc: "Solar storage product version"},
-	124: {id: 124, arg1: f8, arg2: ns, desc: "OpenTherm version Master"},
-	125: {id: 125, arg1: f8, arg2: ns, desc: "OpenTherm version Slave"},
-	126: {id: 126, arg1: u8, arg2: u8, desc: "Master product version"},
-	127: {id: 127, arg1: u8, arg2: u8, desc: "Slave product version"},
 	4:   {id: 4, arg1: u8, arg2: u8, desc: "Remote command"},
+	5:   {id: 5, arg1: flag8, arg2: u8, desc: "Application-specific flags"},
+	6:   {id: 6, arg1: flag8, arg2: flag8, desc: "Remote parameter flags"},
+	7:   {id: 7, arg1: f8, arg2: ns, desc: "Cooling control signal"},
+	8:   {id: 8, arg1: f8, arg2: ns, desc: "Control setpoint 2"},
+	9:   {id: 9, arg1: f8, arg2: ns, desc: "Remote override room setpoint"},
+	10:  {id: 10, arg1: u8, arg2: nu, desc: "Number of TSPs"},
+	11:  {id: 11, arg1: u8, arg2: u8, desc: "TSP setting"},
+	12:  {id: 12, arg1: u8, arg2: nu, desc: "Size of fault buffer"},
+	13:  {id: 13, arg1: u8, arg2: u8, desc: "Fault buffer entry"},
+	14:  {id: 14, arg1: f8, arg2: ns, desc: "Maximum relative modulation level"},
+	15:  {id: 15, arg1: u8, arg2: u8, desc: "Boiler capacity and modulation limits"},
 	16:  {id: 16, arg1: f8, arg2: ns, desc: "Room setpoint"},
 	17:  {id: 17, arg1: f8, arg2: ns, desc: "Relative modulation level"},
 	18:  {id: 18, arg1: f8, arg2: ns, desc: "CH water pressure"},
 	19:  {id: 19, arg1: f8, arg2: ns, desc: "DHW flow rate"},
-	20:  {id: 20, arg1: tm, arg2: ns, desc: "Day of week and tm of day"},
+	20:  {id: 20, arg1: tm, arg2: ns, desc: "Day of week and time of day"},
 	21:  {id: 21, arg1: dt, arg2: ns, desc: "Date"},
 	22:  {id: 22, arg1: u16, arg2: ns, desc: "Year"},
 	23:  {id: 23, arg1: f8, arg2: ns, desc: "Room Setpoint CH2"},
@@ -146,33 +182,16 @@ var messageDefs = map[int]messageDef{
 	27:  {id: 27, arg1: f8, arg2: ns, desc: "Outside temperature"},
 	28:  {id: 28, arg1: f8, arg2: ns, desc: "Return water temperature"},
 	29:  {id: 29, arg1: f8, arg2: ns, desc: "Solar storage temperature"},
-	30:  {id: 30, arg1: f8, arg2: ns, desc: "Solar collector temperature"},
+	30:  {id: 30, arg1: s16, arg2: ns, desc: "Solar collector temperature"},
 	31:  {id: 31, arg1: f8, arg2: ns, desc: "Flow temperature CH2"},
 	32:  {id: 32, arg1: f8, arg2: ns, desc: "DHW2 temperature"},
-	33:  {id: 33, arg1: f8, arg2: ns, desc: "Exhaust temperature"},
+	33:  {id: 33, arg1: s16, arg2: ns, desc: "Exhaust temperature"},
 	34:  {id: 34, arg1: f8, arg2: ns, desc: "Boiler heat exchanger temperature"},
 	35:  {id: 35, arg1: u8, arg2: u8, desc: "Boiler fan speed and setpoint"},
+	36:  {id: 36, arg1: f8, arg2: ns, desc: "Flame current"},
 	37:  {id: 37, arg1: f8, arg2: ns, desc: "Room temperature CH2"},
-	77:  {id: 77, arg1: nu, arg2: u8, desc: "Relative ventilation"},
-	78:  {id: 78, arg1: u8, arg2: u8, desc: "Relative humidity exhaust air"},
-	79:  {id: 79, arg1: u16, arg2: ns, desc: "CO2 level exhaust air"},
-	80:  {id: 80, arg1: f8, arg2: ns, desc: "Supply inlet temperature"},
-	81:  {id: 81, arg1: f8, arg2: ns, desc: "Supply outlet temperature"},
-	82:  {id: 82, arg1: f8, arg2: ns, desc: "Exhaust inlet temperature"},
-	83:  {id: 83, arg1: f8, arg2: ns, desc: "Exhaust outlet temperature"},
-	84:  {id: 84, arg1: u16, arg2: ns, desc: "Exhaust fan speed"},
-	85:  {id: 85, arg1: u16, arg2: ns, desc: "Inlet fan speed"},
-	113: {id: 113, arg1: u16, arg2: ns, desc: "Unsuccessful burner starts"},
-	114: {id: 114, arg1: u16, arg2: ns, desc: "Flame signal too low count"},
-	116: {id: 116, arg1: u16, arg2: ns, desc: "Burner starts"},
-	117: {id: 117, arg1: u16, arg2: ns, desc: "CH pump starts"},
-	118: {id: 118, arg1: u16, arg2: ns, desc: "DHW pump/valve starts"},
-	119: {id: 119, arg1: u16, arg2: ns, desc: "DHW burner starts"},
-	120: {id: 120, arg1: u16, arg2: ns, desc: "Burner operation hours"},
-	121: {id: 121, arg1: u16, arg2: ns, desc: "CH pump operation hours"},
-	122: {id: 122, arg1: u16, arg2: ns, desc: "DHW pump/valve operation hours"},
-	123: {id: 123, arg1: u16, arg2: ns, desc: "DHW burner operation hours"},
-	6:   {id: 6, arg1: flag8, arg2: flag8, desc: "Remote parameter flags"},
+	38:  {id: 38, arg1: f8, arg2: ns, desc: "Relative humidity"},
+	39:  {id: 39, arg1: f8, arg2: ns, desc: "Remote override room setpoint 2"},
 	48:  {id: 48, arg1: s8, arg2: s8, desc: "DHW setpoint boundaries"},
 	49:  {id: 49, arg1: s8, arg2: s8, desc: "Max CH setpoint boundaries"},
 	50:  {id: 50, arg1: s8, arg2: s8, desc: "OTC heat curve ratio boundaries"},
@@ -189,25 +208,86 @@ var messageDefs = map[int]messageDef{
 	61:  {id: 61, arg1: f8, arg2: ns, desc: "Remote parameter 6"},
 	62:  {id: 62, arg1: f8, arg2: ns, desc: "Remote parameter 7"},
 	63:  {id: 63, arg1: f8, arg2: ns, desc: "Remote parameter 8"},
+	70:  {id: 70, arg1: flag8, arg2: flag8, desc: "Status V/H"},
+	71:  {id: 71, arg1: nu, arg2: u8, desc: "Control setpoint V/H"},
+	72:  {id: 72, arg1: flag8, arg2: u8, desc: "Fault flags/code V/H"},
+	73:  {id: 73, arg1: u16, arg2: ns, desc: "OEM diagnostic code V/H"},
+	74:  {id: 74, arg1: flag8, arg2: u8, desc: "Configuration/memberid V/H"},
+	75:  {id: 75, arg1: f8, arg2: ns, desc: "OpenTherm version V/H"},
+	76:  {id: 76, arg1: u8, arg2: u8, desc: "Product version V/H"},
+	77:  {id: 77, arg1: nu, arg2: u8, desc: "Relative ventilation"},
+	78:  {id: 78, arg1: u8, arg2: u8, desc: "Relative humidity exhaust air"},
+	79:  {id: 79, arg1: u16, arg2: ns, desc: "CO2 level exhaust air"},
+	80:  {id: 80, arg1: f8, arg2: ns, desc: "Supply inlet temperature"},
+	81:  {id: 81, arg1: f8, arg2: ns, desc: "Supply outlet temperature"},
+	82:  {id: 82, arg1: f8, arg2: ns, desc: "Exhaust inlet temperature"},
+	83:  {id: 83, arg1: f8, arg2: ns, desc: "Exhaust outlet temperature"},
+	84:  {id: 84, arg1: u16, arg2: ns, desc: "Exhaust fan speed"},
+	85:  {id: 85, arg1: u16, arg2: ns, desc: "Inlet fan speed"},
 	86:  {id: 86, arg1: flag8, arg2: flag8, desc: "Remote parameter settings V/H"},
 	87:  {id: 87, arg1: u8, arg2: nu, desc: "Nominal ventilation value"},
-	10:  {id: 10, arg1: u8, arg2: nu, desc: "Number of TSPs"},
-	11:  {id: 11, arg1: u8, arg2: u8, desc: "TSP setting"},
 	88:  {id: 88, arg1: u8, arg2: nu, desc: "Number of TSPs V/H"},
 	89:  {id: 89, arg1: u8, arg2: u8, desc: "TSP setting V/H"},
-	105: {id: 105, arg1: u8, arg2: nu, desc: "Number of TSPs solar storage"},
-	106: {id: 106, arg1: u8, arg2: u8, desc: "TSP setting solar storage"},
-	12:  {id: 12, arg1: u8, arg2: nu, desc: "Size of fault buffer"},
-	13:  {id: 13, arg1: u8, arg2: u8, desc: "Fault buffer entry"},
 	90:  {id: 90, arg1: u8, arg2: nu, desc: "Size of fault buffer V/H"},
 	91:  {id: 91, arg1: u8, arg2: u8, desc: "Fault buffer entry V/H"},
-	107: {id: 107, arg1: u8, arg2: u8, desc: "Size of fault buffer solar storage"},
-	108: {id: 108, arg1: u8, arg2: u8, desc: "Fault buffer entry solar storage"},
-	7:   {id: 7, arg1: f8, arg2: ns, desc: "Cooling control signal"},
-	9:   {id: 9, arg1: f8, arg2: ns, desc: "Remote override room setpoint"},
-	14:  {id: 14, arg1: f8, arg2: ns, desc: "Maximum relative modulation level"},
-	15:  {id: 15, arg1: u8, arg2: u8, desc: "Boiler capacity and modulation limits"},
+	93:  {id: 93, arg1: u8, arg2: u8, desc: "Brand index and character"},
+	94:  {id: 94, arg1: u8, arg2: u8, desc: "Brand version index and character"},
+	95:  {id: 95, arg1: u8, arg2: u8, desc: "Brand serial number index and character"},
+	96:  {id: 96, arg1: u16, arg2: ns, desc: "Cooling operation hours"},
+	97:  {id: 97, arg1: u16, arg2: ns, desc: "Power cycles"},
+	98:  {id: 98, arg1: u8, arg2: u8, desc: "RF sensor status"},
+	99:  {id: 99, arg1: u8, arg2: u8, desc: "Remote override operating mode heating/DHW"},
 	100: {id: 100, arg1: nu, arg2: flag8, desc: "Remote override function"},
+	101: {id: 101, arg1: flag8, arg2: flag8, desc: "Solar storage mode and status"},
+	102: {id: 102, arg1: flag8, arg2: u8, desc: "Solar storage fault flags"},
+	103: {id: 103, arg1: flag8, arg2: u8, desc: "Solar storage config/memberid"},
+	104: {id: 104, arg1: u8, arg2: u8, desc: "Solar storage product version"},
+	105: {id: 105, arg1: u8, arg2: nu, desc: "Number of TSPs solar storage"},
+	106: {id: 106, arg1: u8, arg2: u8, desc: "TSP setting solar storage"},
+	107: {id: 107, arg1: u8, arg2: nu, desc: "Size of fault buffer solar storage"},
+	108: {id: 108, arg1: u8, arg2: u8, desc: "Fault buffer entry solar storage"},
+	109: {id: 109, arg1: u16, arg2: ns, desc: "Electricity producer starts"},
+	110: {id: 110, arg1: u16, arg2: ns, desc: "Electricity producer hours"},
+	111: {id: 111, arg1: u16, arg2: ns, desc: "Electricity production"},
+	112: {id: 112, arg1: u16, arg2: ns, desc: "Cumulative electricity production"},
+	113: {id: 113, arg1: u16, arg2: ns, desc: "Unsuccessful burner starts"},
+	114: {id: 114, arg1: u16, arg2: ns, desc: "Flame signal too low count"},
+	115: {id: 115, arg1: u16, arg2: ns, desc: "OEM diagnostic code"},
+	116: {id: 116, arg1: u16, arg2: ns, desc: "Burner starts"},
+	117: {id: 117, arg1: u16, arg2: ns, desc: "CH pump starts"},
+	118: {id: 118, arg1: u16, arg2: ns, desc: "DHW pump/valve starts"},
+	119: {id: 119, arg1: u16, arg2: ns, desc: "DHW burner starts"},
+	120: {id: 120, arg1: u16, arg2: ns, desc: "Burner operation hours"},
+	121: {id: 121, arg1: u16, arg2: ns, desc: "CH pump operation hours"},
+	122: {id: 122, arg1: u16, arg2: ns, desc: "DHW pump/valve operation hours"},
+	123: {id: 123, arg1: u16, arg2: ns, desc: "DHW burner operation hours"},
+	124: {id: 124, arg1: f8, arg2: ns, desc: "OpenTherm version Master"},
+	125: {id: 125, arg1: f8, arg2: ns, desc: "OpenTherm version Slave"},
+	126: {id: 126, arg1: u8, arg2: u8, desc: "Master product version"},
+	127: {id: 127, arg1: u8, arg2: u8, desc: "Slave product version"},
+}
+
+func (d Date) String() string {
+	return fmt.Sprintf("%02d-%02d", int(d.Month), d.Day)
+}
+
+func (d DayTime) String() string {
+	if d.HasWeekday {
+		return fmt.Sprintf("%s %02d:%02d", d.Weekday, d.Hour, d.Minute)
+	}
+	return fmt.Sprintf("%02d:%02d", d.Hour, d.Minute)
+}
+
+// lookupDef returns the definition of a data ID, the vendor specific IDs are
+// decoded as raw u16.
+func lookupDef(id int) (messageDef, bool) {
+	if md, ok := messageDefs[id]; ok {
+		return md, true
+	}
+	if id >= 128 && id <= 255 {
+		return messageDef{id: id, arg1: u16, arg2: ns, desc: fmt.Sprintf("Vendor specific %d", id)}, true
+	}
+	return messageDef{}, false
 }
 
 func (s Src) String() string {
@@ -220,6 +300,10 @@ func (s Src) String() string {
 		return "Thermostat"
 	case A:
 		return "Answer"
+	case Master:
+		return "Master"
+	case Slave:
+		return "Slave"
 	}
 	return string(s)
 }
@@ -279,85 +363,290 @@ func (m *Message) RoomSetPoint(value float64) {
 	m.Values = []interface{}{value}
 }
 
+// RoomSetPointOverride sets the remote override room setpoint, 0 to cancel
+// the override.
+func (m *Message) RoomSetPointOverride(value float64) {
+	m.Src = T
+	m.Type = WriteData
+	m.ID = 9
+
+	m.Values = []interface{}{value}
+}
+
+func (m *Message) DHWSetPoint(value float64) {
+	m.Src = T
+	m.Type = WriteData
+	m.ID = 56
+
+	m.Values = []interface{}{value}
+}
+
+func (m *Message) MaxCHSetPoint(value float64) {
+	m.Src = T
+	m.Type = WriteData
+	m.ID = 57
+
+	m.Values = []interface{}{value}
+}
+
+func toInt64(v interface{}) (int64, error) {
+	switch v := v.(type) {
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case float64:
+		return int64(math.Round(v)), nil
+	}
+	return 0, fmt.Errorf("not an integer: %v", v)
+}
+
+func toFloat64(v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case int:
+		return float64(v), nil
+	}
+	return 0, fmt.Errorf("not a number: %v", v)
+}
+
+// encodeWord encodes a 16 bits value.
+func encodeWord(arg argType, v interface{}) (uint16, error) {
+	switch arg {
+	case f8:
+		f, err := toFloat64(v)
+		if err != nil {
+			return 0, err
+		}
+		if f < -128 || f >= 128 {
+			return 0, fmt.Errorf("f8.8 out of range: %f", f)
+		}
+		return uint16(int16(math.Round(f * 256))), nil
+	case u16:
+		i, err := toInt64(v)
+		if err != nil {
+			return 0, err
+		}
+		if i < 0 || i > math.MaxUint16 {
+			return 0, fmt.Errorf("u16 out of range: %d", i)
+		}
+		return uint16(i), nil
+	case s16:
+		i, err := toInt64(v)
+		if err != nil {
+			return 0, err
+		}
+		if i < math.MinInt16 || i > math.MaxInt16 {
+			return 0, fmt.Errorf("s16 out of range: %d", i)
+		}
+		return uint16(int16(i)), nil
+	case dt:
+		d, ok := v.(Date)
+		if !ok {
+			return 0, fmt.Errorf("not a date: %v", v)
+		}
+		return uint16(d.Month)<<8 | uint16(d.Day), nil
+	case tm:
+		t, ok := v.(DayTime)
+		if !ok {
+			return 0, fmt.Errorf("not a day time: %v", v)
+		}
+		var day uint16
+		if t.HasWeekday {
+			// 1 for monday to 7 for sunday
+			day = uint16((int(t.Weekday)+6)%7 + 1)
+		}
+		return (day<<5|uint16(t.Hour))<<8 | uint16(t.Minute), nil
+	}
+	return 0, fmt.Errorf("not a 16 bits type: %d", arg)
+}
+
+// encodeByte encodes a 8 bits value.
+func encodeByte(arg argType, v interface{}) (uint8, error) {
+	i, err := toInt64(v)
+	if err != nil {
+		return 0, err
+	}
+
+	if arg == s8 {
+		if i < math.MinInt8 || i > math.MaxInt8 {
+			return 0, fmt.Errorf("s8 out of range: %d", i)
+		}
+		return uint8(int8(i)), nil
+	}
+
+	if i < 0 || i > math.MaxUint8 {
+		return 0, fmt.Errorf("u8 out of range: %d", i)
+	}
+	return uint8(i), nil
+}
+
+func decodeWord(arg argType, data uint16) interface{} {
+	switch arg {
+	case f8:
+		return float64(int16(data)) / 256
+	case s16:
+		return int64(int16(data))
+	case dt:
+		return Date{Month: time.Month(data >> 8), Day: int(data & 0xff)}
+	case tm:
+		t := DayTime{Hour: int(data>>8) & 0x1f, Minute: int(data & 0xff)}
+		if day := int(data >> 13); day > 0 {
+			t.Weekday, t.HasWeekday = time.Weekday(day%7), true
+		}
+		return t
+	}
+	return int64(data)
+}
+
+func decodeByte(arg argType, data uint8) interface{} {
+	if arg == s8 {
+		return int64(int8(data))
+	}
+	return int64(data)
+}
+
+// parity returns the even parity bit of a frame.
+func parity(frame uint32) uint32 {
+	return uint32(bits.OnesCount32(frame&0x7fffffff) & 1)
+}
+
+// Encode returns the message in the gateway format, ex: T90012300, the source
+// followed by the 32 bits frame including the parity bit. The values are the
+// ones of the used arguments, ex: a single value for a 16 bits argument.
 func (m *Message) Encode() (string, error) {
-	md, ok := messageDefs[m.ID]
+	md, ok := lookupDef(m.ID)
 	if !ok {
 		return "", fmt.Errorf("message type not found: %d", m.ID)
 	}
-	res := fmt.Sprintf("%1c%1X0%2X", m.Src, int(m.Type), m.ID)
-
-	args := []argType{md.arg1, md.arg2}
-	for i, arg := range args {
-		switch arg {
-		case u8, s8, u16, flag8:
-			res += fmt.Sprintf("%2X", int(m.Values[i].(float64)))
-		case f8:
-			f := m.Values[i].(float64)
-			v1 := int(f)
-			v2 := int(f*100) - int(f)*100
-			res += fmt.Sprintf("%2X%2X", v1, v2*255/100)
-			break
+
+	var data uint16
+	if md.arg2 == ns {
+		if len(m.Values) != 1 {
+			return "", fmt.Errorf("message %d expects 1 value, got %d", m.ID, len(m.Values))
+		}
+
+		word, err := encodeWord(md.arg1, m.Values[0])
+		if err != nil {
+			return "", err
+		}
+		data = word
+	} else {
+		values := m.Values
+		for i, arg := range []argType{md.arg1, md.arg2} {
+			data <<= 8
+			if arg == nu {
+				continue
+			}
+
+			if len(values) == 0 {
+				return "", fmt.Errorf("message %d missing value %d", m.ID, i+1)
+			}
+
+			b, err := encodeByte(arg, values[0])
+			if err != nil {
+				return "", err
+			}
+			data |= uint16(b)
+			values = values[1:]
 		}
 	}
 
-	return res, nil
+	frame := uint32(m.Type&7)<<28 | uint32(m.ID&0xff)<<16 | uint32(data)
+	frame |= parity(frame) << 31
+
+	return fmt.Sprintf("%c%08X", m.Src, frame), nil
 }
 
+// Decode decodes a message in the gateway format, the source followed by the
+// 32 bits frame.
 func (m *Message) Decode(msg string) error {
-	var src rune
-	var kind int
-	var id int
-	var data int
-
 	if len(msg) != 9 {
 		return fmt.Errorf("wrong message format: %s", msg)
 	}
 
-	fmt.Sscanf(msg, "%1c%1X0%2X%4X", &src, &kind, &id, &data)
-
-	switch Src(src) {
+	src := Src(msg[0])
+	switch src {
 	case B, T, A, R:
 	default:
 		return fmt.Errorf("src not supported: %c", src)
 	}
 
-	kind &= 7
+	raw, err := strconv.ParseUint(msg[1:], 16, 32)
+	if err != nil {
+		return fmt.Errorf("wrong message format: %s", msg)
+	}
+	frame := uint32(raw)
+
+	if uint32(frame>>31) != parity(frame) {
+		return fmt.Errorf("parity error: %s", msg)
+	}
 
-	md, ok := messageDefs[id]
+	id := int(frame>>16) & 0xff
+	md, ok := lookupDef(id)
 	if !ok {
 		return fmt.Errorf("message type not found: %d", id)
 	}
 
 	m.ID = id
-	m.Src = Src(src)
-	m.Type = MessageType(kind)
+	m.Src = src
+	m.Type = MessageType(frame>>28) & 7
 	m.Desc = md.desc
 
-	var values []int64
+	data := uint16(frame)
+
+	m.Values = m.Values[:0]
 	if md.arg2 == ns {
-		values = []int64{int64(data)}
+		m.Values = append(m.Values, decodeWord(md.arg1, data))
 	} else {
-		values = []int64{int64(data) >> 8, int64(data) & 0xff}
+		if md.arg1 != nu {
+			m.Values = append(m.Values, decodeByte(md.arg1, uint8(data>>8)))
+		}
+		if md.arg2 != nu {
+			m.Values = append(m.Values, decodeByte(md.arg2, uint8(data)))
+		}
 	}
 
-	arg := md.arg1
+	return nil
+}
 
-	m.Values = m.Values[:0]
-	for _, value := range values {
-		switch arg {
-		case u8, s8, u16, flag8:
-			m.Values = append(m.Values, int64(value))
-		case f8:
-			f := float64(int8(value >> 8))
-			f += float64(float64(value&0xff) / 255)
-			f = float64(int64(f*100+0.5)) / 100
-
-			m.Values = append(m.Values, f)
+// value returns the value of the given part of the message, false if the
+// message doesn't carry it.
+func (m *Message) value(part Part) (interface{}, bool) {
+	if part == Word {
+		if len(m.Values) == 0 {
+			return nil, false
 		}
-		arg = md.arg2
+		return m.Values[0], true
 	}
 
-	return nil
+	md, ok := lookupDef(m.ID)
+	if !ok || md.arg2 == ns {
+		return nil, false
+	}
+
+	index := 0
+	switch part {
+	case HighByte:
+		if md.arg1 == nu {
+			return nil, false
+		}
+	case LowByte:
+		if md.arg2 == nu {
+			return nil, false
+		}
+		if md.arg1 != nu {
+			index = 1
+		}
+	}
+	if index >= len(m.Values) {
+		return nil, false
+	}
+
+	return m.Values[index], true
 }
 
 type oItemKey struct {
@@ -366,9 +655,12 @@ type oItemKey struct {
 	kind MessageType
 }
 
+// OpenthermItem is bound to a part of a message, a flag item is ON when the
+// bits of its flag are set.
 type OpenthermItem struct {
 	Item item.Item
 
+	part Part
 	flag Flag
 }
 
@@ -392,6 +684,18 @@ type pauseModeListener struct {
 	opentherm *OpenTherm
 }
 
+type OpenThermOpts struct {
+	// InputTopic on which the messages to send to the boiler are published.
+	// Default to otg/in/message.
+	InputTopic string
+	// AckTimeout is the time to wait for the boiler to acknowledge a write.
+	// Default to 30 seconds.
+	AckTimeout time.Duration
+	// TrafficLogSize is the number of decoded messages kept in the traffic
+	// log. Default to 100.
+	TrafficLogSize int
+}
+
 type OpenTherm struct {
 	sync.RWMutex
 
@@ -401,10 +705,16 @@ type OpenTherm struct {
 	PauseModeItem  *button.SwitchItem
 
 	id     string
-	oItems map[oItemKey]*OpenthermItem
-
-	forceSetPoint float64
-	conn          *hmqtt.MQTTConn
+	oItems map[oItemKey][]*OpenthermItem
+
+	conn             *hmqtt.MQTTConn
+	otgw             *OTGW
+	publish          func(topic, payload string)
+	pending          map[int]*Request
+	traffic          *trafficLog
+	diagnostics      *Diagnostics
+	currentTransform transform.Pipeline
+	opts             OpenThermOpts
 }
 
 func (s *OpenTherm) OnValueChange(it item.Item, old string, new string) {
@@ -416,7 +726,12 @@ func (s *OpenTherm) OnValueChange(it item.Item, old string, new string) {
 }
 
 func (o *OpenTherm) OnMessage(client mqtt.Client, msg mqtt.Message) {
-	new := string(msg.Payload())
+	o.HandleMessage(string(msg.Payload()))
+}
+
+// HandleMessage decodes a message in the gateway format, ex: B40192ED1, and
+// updates the registered items.
+func (o *OpenTherm) HandleMessage(new string) {
 	new = strings.TrimRight(new, "\r\n")
 	if len(new) == 0 {
 		return
@@ -429,72 +744,70 @@ func (o *OpenTherm) OnMessage(client mqtt.Client, msg mqtt.Message) {
 	}
 	server.Log.Debugf("Opentherm message %d from '%s' '%s': %+v(%s) [%s]", omsg.ID, omsg.Src, omsg.Desc, omsg.Values, omsg.Type, new)
 
-	key := oItemKey{
-		src:  omsg.Src,
-		id:   omsg.ID,
-		kind: omsg.Type,
+	o.traffic.add(new, omsg)
+	o.ack(omsg)
+
+	o.RLock()
+	diagnostics := o.diagnostics
+	o.RUnlock()
+
+	if diagnostics != nil {
+		diagnostics.handle(omsg)
 	}
 
+	// items of the source then the ones following both sources
+	var oitems []*OpenthermItem
 	o.RLock()
-	oitem := o.oItems[key]
+	oitems = append(oitems, o.oItems[oItemKey{src: omsg.Src, id: omsg.ID, kind: omsg.Type}]...)
+	if group := srcGroup(omsg.Src); group != omsg.Src {
+		oitems = append(oitems, o.oItems[oItemKey{src: group, id: omsg.ID, kind: omsg.Type}]...)
+	}
 	o.RUnlock()
 
-	if oitem != nil {
-		if omsg.ID == 0 {
-			var state bool
-
-			if omsg.Src == B || omsg.Src == A {
-				switch oitem.flag {
-				case SlaveFault:
-					state = omsg.IsSlaveFault()
-				case SlaveCH:
-					state = omsg.IsSlaveCH()
-				case SlaveDHW:
-					state = omsg.IsSlaveDHW()
-				case SlaveFlame:
-					state = omsg.IsSlaveFlame()
-				case SlaveCooling:
-					state = omsg.IsSlaveCooling()
-				case SlaveCH2:
-					state = omsg.IsSlaveCH2()
-				case SlaveDiagnostic:
-					state = omsg.IsSlaveDiagnostic()
-				case SlaveElectricity:
-					state = omsg.IsSlaveElectricity()
-				}
-			} else if omsg.Src == T || omsg.Src == R {
-				switch oitem.flag {
-				case MasterCH:
-					state = omsg.IsMasterCH()
-				case MasterDHW:
-					state = omsg.IsMasterDHW()
-				case MasterCooling:
-					state = omsg.IsMasterCooling()
-				case MasterOTC:
-					state = omsg.IsMasterOTC()
-				case MasterCH2:
-					state = omsg.IsMasterCH2()
-				case MasterSummer:
-					state = omsg.IsMasterSummer()
-				case MasterDHWBlocking:
-					state = omsg.IsMasterDHWBlocking()
-				}
-			}
+	for _, oitem := range oitems {
+		oitem.update(omsg)
+	}
+}
 
-			if state {
-				oitem.Item.SetValue(item.ON)
-			} else {
-				oitem.Item.SetValue(item.OFF)
-			}
+// srcGroup returns the source matching both the given source and its
+// counterpart, Master or Slave.
+func srcGroup(src Src) Src {
+	switch src {
+	case T, R:
+		return Master
+	case B, A:
+		return Slave
+	}
+	return src
+}
+
+func (oi *OpenthermItem) update(msg *Message) {
+	value, ok := msg.value(oi.part)
+	if !ok {
+		return
+	}
+
+	if oi.flag != 0 {
+		bits, ok := value.(int64)
+		if !ok {
+			return
+		}
+
+		if bits&int64(oi.flag) == int64(oi.flag) {
+			oi.Item.SetValue(item.ON)
 		} else {
-			value := omsg.Values[0]
-			switch value.(type) {
-			case int64:
-				oitem.Item.SetValue(fmt.Sprintf("%d", value))
-			case float64:
-				oitem.Item.SetValue(fmt.Sprintf("%.2f", value))
-			}
+			oi.Item.SetValue(item.OFF)
 		}
+		return
+	}
+
+	switch value.(type) {
+	case int64:
+		oi.Item.SetValue(fmt.Sprintf("%d", value))
+	case float64:
+		oi.Item.SetValue(fmt.Sprintf("%.2f", value))
+	default:
+		oi.Item.SetValue(fmt.Sprintf("%v", value))
 	}
 }
 
@@ -516,13 +829,7 @@ func (o *currentMessageHandler) OnMessage(client mqtt.Client, msg mqtt.Message)
 	value := string(msg.Payload())
 
 	amp, _ := strconv.ParseFloat(value, 64)
-	watt := amp * 220
-	if watt < 100 {
-		watt = 0
-	}
-
-	watt = 1.13*watt - 324
-	if watt < 7000 {
+	if watt, ok := o.opentherm.currentTransform.Apply(amp, time.Now()); ok {
 		o.opentherm.CurrentItem.SetValue(fmt.Sprintf("%.2f", watt))
 	}
 }
@@ -539,97 +846,125 @@ func (o *pauseStateMessageHandler) OnMessage(client mqtt.Client, msg mqtt.Messag
 	o.opentherm.PauseStateItem.SetValue(value)
 }
 
-func (o *OpenTherm) RegisterFlagItem(id, label, unit string, src Src, kind MessageType, flag Flag) item.Item {
+func (o *OpenTherm) register(src Src, msgID int, kind MessageType, oitem *OpenthermItem) {
 	key := oItemKey{
 		src:  src,
-		id:   0,
+		id:   msgID,
 		kind: kind,
 	}
 
 	o.Lock()
-	defer o.Unlock()
+	o.oItems[key] = append(o.oItems[key], oitem)
+	o.Unlock()
+
+	server.Registry.Add(oitem.Item)
+}
+
+// RegisterFlagItem registers a state item following a flag of the status
+// message, the master flags for T, R and Master, the slave ones otherwise.
+func (o *OpenTherm) RegisterFlagItem(id, label, unit string, src Src, kind MessageType, flag Flag) item.Item {
+	part := LowByte
+	if srcGroup(src) == Master {
+		part = HighByte
+	}
+
+	return o.RegisterBitItem(id, label, src, 0, kind, part, flag)
+}
 
+// RegisterBitItem registers a state item, ON when the bits of flag are set in
+// the given byte of the message.
+func (o *OpenTherm) RegisterBitItem(id, label string, src Src, msgID int, kind MessageType, part Part, flag Flag) item.Item {
 	item := &item.AnItem{
 		ID:    fmt.Sprintf("%s/%s", o.id, id),
 		Label: label,
 		Type:  "state",
 		Img:   "switch",
 	}
-	o.oItems[key] = &OpenthermItem{
+	o.register(src, msgID, kind, &OpenthermItem{
 		Item: item,
+		part: part,
 		flag: flag,
-	}
-
-	server.Registry.Add(item)
+	})
 
 	return item
 }
 
-func (o *OpenTherm) RegisterValueItem(id, label, unit string, src Src, msgID int, kind MessageType) item.Item {
-	key := oItemKey{
-		src:  src,
-		id:   msgID,
-		kind: kind,
-	}
-
-	o.Lock()
-	defer o.Unlock()
-
+// RegisterByteItem registers an item following the value of the given byte
+// of the message.
+func (o *OpenTherm) RegisterByteItem(id, label, unit string, src Src, msgID int, kind MessageType, part Part) item.Item {
 	value := value.NewValueItem(fmt.Sprintf("%s/%s", o.id, id), label, unit)
-	o.oItems[key] = &OpenthermItem{
+	o.register(src, msgID, kind, &OpenthermItem{
 		Item: value,
-	}
-
-	server.Registry.Add(value)
+		part: part,
+	})
 
 	return value
 }
 
-/*func (o *OpenTherm) RegisterSetPointItem(label string) item.Item {
-	value := value.NewValueItem(fmt.Sprintf("%s/FORCE_SETPOINT", o.id), label, "°")
-	value.SetValue("17.5")
-	value.Type = "range"
+// RegisterValueItem registers an item following the value of the message.
+func (o *OpenTherm) RegisterValueItem(id, label, unit string, src Src, msgID int, kind MessageType) item.Item {
+	return o.RegisterByteItem(id, label, unit, src, msgID, kind, Word)
+}
 
-	server.Registry.Add(value)
-	value.AddListener(o)
+func newOpenTherm(id string, opts ...OpenThermOpts) *OpenTherm {
+	o := &OpenTherm{
+		id:      id,
+		oItems:  make(map[oItemKey][]*OpenthermItem),
+		pending: make(map[int]*Request),
+	}
+	if len(opts) > 0 {
+		o.opts = opts[0]
+	}
+	if o.opts.InputTopic == "" {
+		o.opts.InputTopic = "otg/in/message"
+	}
+	if o.opts.AckTimeout == 0 {
+		o.opts.AckTimeout = 30 * time.Second
+	}
+	if o.opts.TrafficLogSize <= 0 {
+		o.opts.TrafficLogSize = 100
+	}
+	o.traffic = newTrafficLog(o.opts.TrafficLogSize)
 
-	return value
-}*/
+	return o
+}
 
-func NewOpenTherm(id string, conn *hmqtt.MQTTConn, topic, currentTopic, returnTopic, pauseTopic string) *OpenTherm {
-	o := &OpenTherm{
-		id:     id,
-		oItems: make(map[oItemKey]*OpenthermItem),
-		CurrentItem: &item.AnItem{
-			ID:    fmt.Sprintf("%s/CURRENT", id),
-			Label: "Current",
-			Type:  "value",
-			Img:   "electricity",
-			Unit:  "W",
-		},
-		ReturnTempItem: &item.AnItem{
-			ID:    fmt.Sprintf("%s/RETURN_TEMPERATURE", id),
-			Label: "Return temperature",
-			Type:  "value",
-			Img:   "temperature",
-			Unit:  "°",
-		},
-		PauseStateItem: &item.AnItem{
-			ID:    fmt.Sprintf("%s/RELAY_STATE", id),
-			Label: "State",
-			Type:  "state",
+func NewOpenTherm(id string, conn *hmqtt.MQTTConn, topic, currentTopic, returnTopic, pauseTopic string, opts ...OpenThermOpts) *OpenTherm {
+	o := newOpenTherm(id, opts...)
+	o.CurrentItem = &item.AnItem{
+		ID:    fmt.Sprintf("%s/CURRENT", id),
+		Label: "Current",
+		Type:  "value",
+		Img:   "electricity",
+		Unit:  "W",
+	}
+	o.ReturnTempItem = &item.AnItem{
+		ID:    fmt.Sprintf("%s/RETURN_TEMPERATURE", id),
+		Label: "Return temperature",
+		Type:  "value",
+		Img:   "temperature",
+		Unit:  "°",
+	}
+	o.PauseStateItem = &item.AnItem{
+		ID:    fmt.Sprintf("%s/RELAY_STATE", id),
+		Label: "State",
+		Type:  "state",
+		Img:   "plug",
+	}
+	o.PauseModeItem = &button.SwitchItem{
+		AnItem: item.AnItem{
+			ID:    fmt.Sprintf("%s/RELAY_MODE", id),
+			Label: "Mode",
+			Type:  "switch",
 			Img:   "plug",
 		},
-		PauseModeItem: &button.SwitchItem{
-			AnItem: item.AnItem{
-				ID:    fmt.Sprintf("%s/RELAY_MODE", id),
-				Label: "Mode",
-				Type:  "switch",
-				Img:   "plug",
-			},
-		},
-		conn: conn,
 	}
+	o.conn = conn
+	o.publish = func(topic, payload string) {
+		conn.Publish(id, topic, payload)
+	}
+
+	o.currentTransform = transform.ForItem(o.CurrentItem.ID, defaultCurrentTransform)
 
 	o.PauseModeItem.SetValue(item.ON)
 
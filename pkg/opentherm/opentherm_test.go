@@ -22,7 +22,16 @@
 
 package opentherm
 
-import "testing"
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/registry"
+	"github.com/safchain/hasc/pkg/server"
+)
 
 func TestDecode1(t *testing.T) {
 	var msg Message
@@ -38,7 +47,8 @@ func TestDecode1(t *testing.T) {
 	if len(msg.Values) != 1 {
 		t.Fatal("Wrong number of values")
 	}
-	if msg.Values[0].(float64) != 46.82 {
+	// f8.8, 0x2ED1 / 256
+	if msg.Values[0].(float64) != 46.81640625 {
 		t.Fatal("Wrong value")
 	}
 }
@@ -118,3 +128,193 @@ func TestEncode(t *testing.T) {
 		t.Fatalf("got %s expected %s", m, expected)
 	}
 }
+
+func TestDecodeTypes(t *testing.T) {
+	tests := []struct {
+		raw    string
+		values []interface{}
+	}{
+		{"B401BFF80", []interface{}{-0.5}},
+		{"BC0304BF6", []interface{}{int64(75), int64(-10)}},
+		{"BC021FFD8", []interface{}{int64(-40)}},
+		{"B40741234", []interface{}{int64(4660)}},
+		{"T90150C1F", []interface{}{Date{Month: time.December, Day: 31}}},
+		{"T10146E2D", []interface{}{DayTime{Weekday: time.Wednesday, HasWeekday: true, Hour: 14, Minute: 45}}},
+		{"B4083ABCD", []interface{}{int64(0xABCD)}},
+		{"BC0470028", []interface{}{int64(40)}},
+	}
+
+	for _, test := range tests {
+		var msg Message
+		if err := msg.Decode(test.raw); err != nil {
+			t.Fatalf("%s: %s", test.raw, err)
+		}
+		if !reflect.DeepEqual(msg.Values, test.values) {
+			t.Errorf("%s: expected %v, got %v", test.raw, test.values, msg.Values)
+		}
+
+		encoded, err := msg.Encode()
+		if err != nil {
+			t.Fatalf("%s: %s", test.raw, err)
+		}
+		if encoded != test.raw {
+			t.Errorf("expected %s, got %s", test.raw, encoded)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	for _, raw := range []string{
+		"",
+		"B40192ED",
+		"X40192ED1",
+		"B4019ZED1",
+		// parity error
+		"BC0192ED1",
+		// unknown data ID
+		"BC028FFFF",
+	} {
+		var msg Message
+		if err := msg.Decode(raw); err == nil {
+			t.Errorf("%s should fail", raw)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	words := []uint16{0x0000, 0x0001, 0x1234, 0x7fff, 0x8000, 0xa55a, 0xffff}
+
+	for id := 0; id < 256; id++ {
+		md, ok := lookupDef(id)
+		if !ok {
+			continue
+		}
+
+		for _, word := range words {
+			// the unused bytes are encoded as 0
+			if md.arg1 == nu {
+				word &= 0x00ff
+			}
+			if md.arg2 == nu {
+				word &= 0xff00
+			}
+
+			for _, src := range []Src{T, B} {
+				for kind := ReadData; kind <= UnkDataId; kind++ {
+					frame := uint32(kind)<<28 | uint32(id)<<16 | uint32(word)
+					frame |= parity(frame) << 31
+					raw := fmt.Sprintf("%c%08X", src, frame)
+
+					var msg Message
+					if err := msg.Decode(raw); err != nil {
+						t.Fatalf("%s: %s", raw, err)
+					}
+					if msg.ID != id || msg.Src != src || msg.Type != kind {
+						t.Fatalf("%s: wrong header: %+v", raw, msg)
+					}
+
+					encoded, err := msg.Encode()
+					if err != nil {
+						t.Fatalf("%s: %s", raw, err)
+					}
+					if encoded != raw {
+						t.Fatalf("%s: got %s, values %v", raw, encoded, msg.Values)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeValues(t *testing.T) {
+	tests := []struct {
+		msg      Message
+		expected string
+	}{
+		{Message{Src: T, Type: WriteData, ID: 1, Values: []interface{}{45.5}}, "T90012D80"},
+		{Message{Src: T, Type: WriteData, ID: 56, Values: []interface{}{int64(50)}}, "T90383200"},
+		{Message{Src: T, Type: ReadData, ID: 0, Values: []interface{}{int64(MasterCH | MasterDHW), 0}}, "T00000300"},
+	}
+
+	for _, test := range tests {
+		encoded, err := test.msg.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoded != test.expected {
+			t.Errorf("expected %s, got %s", test.expected, encoded)
+		}
+	}
+
+	for _, msg := range []Message{
+		{Src: T, Type: WriteData, ID: 1, Values: []interface{}{200.0}},
+		{Src: T, Type: WriteData, ID: 48, Values: []interface{}{int64(200), int64(10)}},
+		{Src: T, Type: WriteData, ID: 21, Values: []interface{}{12.0}},
+		{Src: T, Type: WriteData, ID: 1},
+	} {
+		if _, err := msg.Encode(); err == nil {
+			t.Errorf("%+v should fail", msg)
+		}
+	}
+}
+
+func TestRegisterItems(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	o := newOpenTherm("OPENTHERM")
+
+	masterCH := o.RegisterFlagItem("MASTER_CH", "CH enabled", "", T, ReadData, MasterCH)
+	masterDHW := o.RegisterFlagItem("MASTER_DHW", "DHW enabled", "", T, ReadData, MasterDHW)
+	latestCH := o.RegisterFlagItem("LATEST_CH", "CH enabled", "", Master, ReadData, MasterCH)
+	slaveCH := o.RegisterFlagItem("SLAVE_CH", "CH active", "", B, ReadAck, SlaveCH)
+	slaveFlame := o.RegisterFlagItem("SLAVE_FLAME", "Flame", "", B, ReadAck, SlaveFlame)
+	latestFlame := o.RegisterFlagItem("LATEST_FLAME", "Flame", "", Slave, ReadAck, SlaveFlame)
+	dhwPresent := o.RegisterBitItem("DHW_PRESENT", "DHW present", B, 3, ReadAck, HighByte, 1)
+	memberID := o.RegisterByteItem("MEMBER_ID", "Member ID", "", B, 3, ReadAck, LowByte)
+
+	for _, raw := range []string{
+		"T00000300", // CH and DHW enabled
+		"BC000030A", // CH active and flame
+		"B40030105", // DHW present, member ID 5
+	} {
+		o.HandleMessage(raw)
+	}
+
+	expected := []struct {
+		it    item.Item
+		value string
+	}{
+		{masterCH, item.ON},
+		{masterDHW, item.ON},
+		{latestCH, item.ON},
+		{slaveCH, item.ON},
+		{slaveFlame, item.ON},
+		{latestFlame, item.ON},
+		{dhwPresent, item.ON},
+		{memberID, "5"},
+	}
+	for _, e := range expected {
+		if value := e.it.GetValue(); value != e.value {
+			t.Errorf("%s expected %s, got: %s", e.it.GetID(), e.value, value)
+		}
+	}
+
+	// the latest of both sources is followed
+	o.HandleMessage("R00000000")
+	o.HandleMessage("AC0000000")
+
+	expected = []struct {
+		it    item.Item
+		value string
+	}{
+		{masterCH, item.ON},
+		{latestCH, item.OFF},
+		{slaveFlame, item.ON},
+		{latestFlame, item.OFF},
+	}
+	for _, e := range expected {
+		if value := e.it.GetValue(); value != e.value {
+			t.Errorf("%s expected %s, got: %s", e.it.GetID(), e.value, value)
+		}
+	}
+}
@@ -0,0 +1,400 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package opentherm
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/serial"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+// OTGW gateway modes
+const (
+	ModeMonitor = "0"
+	ModeGateway = "1"
+	ModeReset   = "R"
+)
+
+// errors returned by the OTGW in response to a command
+var otgwErrors = map[string]string{
+	"NG": "no good, unknown command",
+	"SE": "syntax error",
+	"BV": "bad value",
+	"OR": "out of range",
+	"NS": "no space",
+	"NF": "not found",
+	"OE": "overrun error",
+}
+
+// otgwAnswered are the commands answered by the gateway itself to the
+// thermostat, ex: TT with the A frames of the room setpoint override, the
+// boiler never acknowledging them.
+var otgwAnswered = map[string]bool{
+	"TT": true,
+	"TC": true,
+}
+
+var ErrNotConnected = errors.New("not connected to the gateway")
+
+type OTGWOpts struct {
+	// Reconnect is the delay before reconnecting. Default to 5 seconds.
+	Reconnect time.Duration
+	// CommandTimeout is the time to wait for the response to a command.
+	// Default to 5 seconds.
+	CommandTimeout time.Duration
+}
+
+type otgwResponse struct {
+	value string
+	err   error
+}
+
+// OTGW is a connection to an OpenTherm Gateway, over a serial port or a TCP
+// socket, speaking the OTGW protocol: a message per line, ex: T80000200, and
+// commands like TT=19.5 answered by TT: 19.50.
+type OTGW struct {
+	sync.RWMutex
+
+	ConnectedItem *item.AnItem
+
+	id        string
+	start     func()
+	write     func(line string) error
+	conn      io.ReadWriteCloser
+	cmdLock   sync.Mutex
+	waiting   string
+	response  chan otgwResponse
+	onMessage func(msg string)
+	opts      OTGWOpts
+}
+
+// otgwCommand returns the OTGW command writing the given message.
+func otgwCommand(msg *Message) (string, string, error) {
+	if msg.Type != WriteData || len(msg.Values) != 1 {
+		return "", "", fmt.Errorf("message %d not supported by the gateway", msg.ID)
+	}
+
+	value, err := toFloat64(msg.Values[0])
+	if err != nil {
+		return "", "", err
+	}
+
+	var command string
+	switch msg.ID {
+	case 1:
+		command = "CS"
+	case 9:
+		command = "TT"
+	case 56:
+		command = "SW"
+	case 57:
+		command = "SH"
+	default:
+		return "", "", fmt.Errorf("message %d not supported by the gateway", msg.ID)
+	}
+
+	return command, fmt.Sprintf("%.2f", value), nil
+}
+
+// isMessage returns whether the line is an OpenTherm message, ex: T80000200,
+// the other lines being responses, ex: TT: 19.50, or reports.
+func isMessage(line string) bool {
+	if len(line) != 9 {
+		return false
+	}
+	switch Src(line[0]) {
+	case B, T, A, R:
+		_, err := strconv.ParseUint(line[1:], 16, 32)
+		return err == nil
+	}
+	return false
+}
+
+func (g *OTGW) setConnected(connected bool) {
+	if connected {
+		g.ConnectedItem.SetValue(item.ON)
+	} else {
+		g.ConnectedItem.SetValue(item.OFF)
+	}
+}
+
+func (g *OTGW) handleLine(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+
+	if isMessage(line) {
+		if g.onMessage != nil {
+			g.onMessage(line)
+		}
+		return
+	}
+
+	g.Lock()
+	waiting, response := g.waiting, g.response
+	if waiting == "" {
+		g.Unlock()
+		server.Log.Debugf("OTGW %s: %s", g.id, line)
+		return
+	}
+
+	var resp otgwResponse
+	if desc, ok := otgwErrors[line]; ok {
+		resp.err = fmt.Errorf("%s: %s", line, desc)
+	} else if strings.HasPrefix(line, waiting+":") {
+		resp.value = strings.TrimSpace(line[len(waiting)+1:])
+	} else {
+		g.Unlock()
+		server.Log.Debugf("OTGW %s: %s", g.id, line)
+		return
+	}
+	g.waiting = ""
+	g.Unlock()
+
+	response <- resp
+}
+
+// runTCP connects to the gateway, reads the lines, and reconnects when lost.
+func (g *OTGW) runTCP(dial func() (io.ReadWriteCloser, error)) {
+	for {
+		conn, err := dial()
+		if err != nil {
+			server.Log.Errorf("OTGW %s connection error: %s", g.id, err)
+			time.Sleep(g.opts.Reconnect)
+			continue
+		}
+		server.Log.Infof("OTGW %s connected", g.id)
+
+		g.Lock()
+		g.conn = conn
+		g.Unlock()
+		g.setConnected(true)
+
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			g.handleLine(scanner.Text())
+		}
+
+		err = scanner.Err()
+		if err == nil {
+			err = io.EOF
+		}
+		server.Log.Errorf("OTGW %s connection lost: %s", g.id, err)
+
+		g.Lock()
+		g.conn = nil
+		g.Unlock()
+		g.setConnected(false)
+		conn.Close()
+
+		time.Sleep(g.opts.Reconnect)
+	}
+}
+
+// Command sends a command to the gateway, ex: TT and 19.5, and returns the
+// value of the response.
+func (g *OTGW) Command(command string, value string) (string, error) {
+	g.cmdLock.Lock()
+	defer g.cmdLock.Unlock()
+
+	response := make(chan otgwResponse, 1)
+
+	g.Lock()
+	g.waiting, g.response = command, response
+	g.Unlock()
+
+	defer func() {
+		g.Lock()
+		g.waiting = ""
+		g.Unlock()
+	}()
+
+	server.Log.Infof("OTGW %s send command: %s=%s", g.id, command, value)
+	if err := g.write(fmt.Sprintf("%s=%s", command, value)); err != nil {
+		return "", err
+	}
+
+	select {
+	case resp := <-response:
+		return resp.value, resp.err
+	case <-time.After(g.opts.CommandTimeout):
+		return "", fmt.Errorf("no response to %s", command)
+	}
+}
+
+// SetTemporarySetPoint overrides the room setpoint until the next change of
+// the thermostat program, 0 to cancel.
+func (g *OTGW) SetTemporarySetPoint(value float64) error {
+	_, err := g.Command("TT", fmt.Sprintf("%.2f", value))
+	return err
+}
+
+// SetConstantSetPoint overrides the room setpoint permanently, 0 to cancel.
+func (g *OTGW) SetConstantSetPoint(value float64) error {
+	_, err := g.Command("TC", fmt.Sprintf("%.2f", value))
+	return err
+}
+
+// SetControlSetPoint overrides the control setpoint, 0 to give the control
+// back to the thermostat.
+func (g *OTGW) SetControlSetPoint(value float64) error {
+	_, err := g.Command("CS", fmt.Sprintf("%.2f", value))
+	return err
+}
+
+// SetOutsideTemperature provides the outside temperature to the thermostat.
+func (g *OTGW) SetOutsideTemperature(value float64) error {
+	_, err := g.Command("OT", fmt.Sprintf("%.2f", value))
+	return err
+}
+
+// SetGatewayMode switches between the monitor mode and the gateway mode, or
+// resets the gateway, see ModeMonitor, ModeGateway and ModeReset.
+func (g *OTGW) SetGatewayMode(mode string) error {
+	_, err := g.Command("GW", mode)
+	return err
+}
+
+// Report returns the report of the gateway for the given letter, ex: A for
+// the firmware version.
+func (g *OTGW) Report(letter string) (string, error) {
+	return g.Command("PR", letter)
+}
+
+func newOTGW(id string, opts ...OTGWOpts) *OTGW {
+	g := &OTGW{
+		id: id,
+		ConnectedItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/CONNECTED", id),
+			Label: "Gateway connected",
+			Type:  "state",
+			Img:   "dev",
+		},
+	}
+	if len(opts) > 0 {
+		g.opts = opts[0]
+	}
+	if g.opts.Reconnect == 0 {
+		g.opts.Reconnect = 5 * time.Second
+	}
+	if g.opts.CommandTimeout == 0 {
+		g.opts.CommandTimeout = 5 * time.Second
+	}
+
+	g.ConnectedItem.SetValue(item.OFF)
+
+	return g
+}
+
+// NewOTGWSerial returns a gateway connected through a serial port, ex:
+// /dev/ttyUSB0 at 9600 bauds, opened once the gateway is started.
+func NewOTGWSerial(id string, dev string, baud int, opts ...OTGWOpts) *OTGW {
+	g := newOTGW(id, opts...)
+
+	var port *serial.Serial
+	g.start = func() {
+		p := serial.NewSerial(dev, baud, serial.SerialOpts{MinBackoff: g.opts.Reconnect})
+		p.AddListener(&serial.CallbackListener{CbFnc: g.handleLine})
+		p.AddStatusListener(&serial.StatusCallbackListener{
+			CbFnc: func(connected bool, err error) {
+				g.setConnected(connected)
+			},
+		})
+
+		g.Lock()
+		port = p
+		g.Unlock()
+
+		// the port may have been opened before the listener was added
+		g.setConnected(p.Connected())
+	}
+	g.write = func(line string) error {
+		g.RLock()
+		p := port
+		g.RUnlock()
+
+		if p == nil {
+			return ErrNotConnected
+		}
+
+		// the framing of the port adds the \n
+		err := p.Write([]byte(line + "\r"))
+		if err == serial.ErrNotConnected {
+			return ErrNotConnected
+		}
+		return err
+	}
+
+	return g
+}
+
+// NewOTGWTCP returns a gateway connected through a TCP socket, ex: the
+// serial-over-wifi adapter of the gateway listening on port 25238.
+func NewOTGWTCP(id string, address string, opts ...OTGWOpts) *OTGW {
+	g := newOTGW(id, opts...)
+
+	g.start = func() {
+		go g.runTCP(func() (io.ReadWriteCloser, error) {
+			return net.DialTimeout("tcp", address, 5*time.Second)
+		})
+	}
+	g.write = func(line string) error {
+		g.RLock()
+		conn := g.conn
+		g.RUnlock()
+
+		if conn == nil {
+			return ErrNotConnected
+		}
+		_, err := fmt.Fprintf(conn, "%s\r\n", line)
+		return err
+	}
+
+	return g
+}
+
+// NewOpenThermOTGW returns an OpenTherm decoding the messages of the gateway,
+// the setpoints are written with the gateway commands.
+func NewOpenThermOTGW(id string, gw *OTGW, opts ...OpenThermOpts) *OpenTherm {
+	o := newOpenTherm(id, opts...)
+	o.otgw = gw
+
+	gw.onMessage = o.HandleMessage
+
+	server.Registry.Add(gw.ConnectedItem)
+
+	gw.start()
+
+	return o
+}
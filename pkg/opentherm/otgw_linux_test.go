@@ -0,0 +1,91 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package opentherm
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/registry"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+// openPty returns the master side of a pseudo-terminal pair and the path of
+// the slave side.
+func openPty(t *testing.T) (*os.File, string) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("pseudo-terminals not available: %s", err)
+	}
+
+	fd := int(master.Fd())
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		t.Skipf("unable to unlock the pseudo-terminal: %s", err)
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		t.Skipf("unable to get the pseudo-terminal number: %s", err)
+	}
+
+	return master, fmt.Sprintf("/dev/pts/%d", n)
+}
+
+func TestOTGWSerial(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	master, slave := openPty(t)
+	defer master.Close()
+
+	// the gateway answers the commands
+	go func() {
+		scanner := bufio.NewScanner(master)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if strings.HasPrefix(line, "TT=") {
+				fmt.Fprintf(master, "TT: %s\r\n", line[3:])
+			}
+		}
+	}()
+
+	gw := NewOTGWSerial("OTGW", slave, 9600, OTGWOpts{Reconnect: 100 * time.Millisecond, CommandTimeout: time.Second})
+	o := NewOpenThermOTGW("OPENTHERM", gw, OpenThermOpts{AckTimeout: time.Second})
+	boilerTemp := o.RegisterValueItem("BOILER_TEMPERATURE", "Boiler temperature", "°", B, 25, ReadAck)
+
+	waitFor(t, "connection", func() bool { return gw.ConnectedItem.GetValue() == item.ON })
+
+	fmt.Fprint(master, "B40192ED1\r\n")
+	waitFor(t, "message", func() bool { return boilerTemp.GetValue() == "46.82" })
+
+	if err := gw.SetTemporarySetPoint(20); err != nil {
+		t.Fatalf("expected TT response, got: %v", err)
+	}
+}
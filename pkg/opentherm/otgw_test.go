@@ -0,0 +1,213 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package opentherm
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/registry"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+// fakeGateway emulates an OTGW listening on a TCP socket.
+type fakeGateway struct {
+	sync.Mutex
+	listener net.Listener
+	conn     net.Conn
+	commands []string
+}
+
+func newFakeGateway(t *testing.T) *fakeGateway {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeGateway{listener: l}
+	go f.serve()
+
+	return f
+}
+
+func (f *fakeGateway) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		f.Lock()
+		f.conn = conn
+		f.Unlock()
+
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeGateway) handle(conn net.Conn) {
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		f.Lock()
+		f.commands = append(f.commands, line)
+		f.Unlock()
+
+		fields := strings.SplitN(line, "=", 2)
+		if len(fields) != 2 {
+			fmt.Fprint(conn, "SE\r\n")
+			continue
+		}
+
+		switch fields[0] {
+		case "PR":
+			fmt.Fprintf(conn, "PR: %s=OpenTherm Gateway 5.1\r\n", fields[1])
+		case "GW":
+			if fields[1] != ModeMonitor && fields[1] != ModeGateway {
+				fmt.Fprint(conn, "BV\r\n")
+				continue
+			}
+			fmt.Fprintf(conn, "GW: %s\r\n", fields[1])
+		case "TT", "TC":
+			value, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				fmt.Fprint(conn, "SE\r\n")
+				continue
+			}
+			fmt.Fprintf(conn, "%s: %.2f\r\n", fields[0], value)
+			// the gateway answers the next read of the thermostat, the boiler
+			// never sees the override
+			fmt.Fprint(conn, "T00090000\r\n")
+			fmt.Fprint(conn, "A40091300\r\n")
+		default:
+			fmt.Fprint(conn, "NG\r\n")
+		}
+	}
+}
+
+func (f *fakeGateway) send(line string) {
+	f.Lock()
+	defer f.Unlock()
+	fmt.Fprintf(f.conn, "%s\r\n", line)
+}
+
+func (f *fakeGateway) disconnect() {
+	f.Lock()
+	defer f.Unlock()
+	f.conn.Close()
+}
+
+func waitFor(t *testing.T, desc string, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %s", desc)
+}
+
+func TestIsMessage(t *testing.T) {
+	for line, expected := range map[string]bool{
+		"T80000200": true,
+		"B40192ED1": true,
+		"A40091300": true,
+		"TT: 19.50": false,
+		"TC: 19.50": false,
+		"R: 100000": false,
+		"GW: 1":     false,
+	} {
+		if isMessage(line) != expected {
+			t.Errorf("%s expected message %v", line, expected)
+		}
+	}
+}
+
+func TestOTGW(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	f := newFakeGateway(t)
+	defer f.listener.Close()
+
+	gw := NewOTGWTCP("OTGW", f.listener.Addr().String(), OTGWOpts{Reconnect: 200 * time.Millisecond, CommandTimeout: time.Second})
+	o := NewOpenThermOTGW("OPENTHERM", gw, OpenThermOpts{AckTimeout: time.Second})
+	boilerTemp := o.RegisterValueItem("BOILER_TEMPERATURE", "Boiler temperature", "°", B, 25, ReadAck)
+
+	waitFor(t, "connection", func() bool { return gw.ConnectedItem.GetValue() == item.ON })
+
+	// messages are decoded, other lines ignored
+	f.send("OpenTherm Gateway 5.1")
+	f.send("B40192ED1")
+	waitFor(t, "message", func() bool { return boilerTemp.GetValue() == "46.82" })
+
+	report, err := gw.Report("A")
+	if err != nil || report != "A=OpenTherm Gateway 5.1" {
+		t.Fatalf("wrong report: %s, %v", report, err)
+	}
+
+	if err := gw.SetGatewayMode("X"); err == nil || !strings.HasPrefix(err.Error(), "BV") {
+		t.Fatalf("expected bad value error, got: %v", err)
+	}
+
+	if err := gw.SetTemporarySetPoint(19.5); err != nil {
+		t.Fatalf("expected TT response, got: %v", err)
+	}
+	if err := gw.SetConstantSetPoint(0); err != nil {
+		t.Fatalf("expected TC response, got: %v", err)
+	}
+
+	req, err := o.SetRoomSetPointOverride(19)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := req.Wait(2 * time.Second); err != nil {
+		t.Fatalf("expected ack, got: %v", err)
+	}
+	if req.Status() != StatusAck {
+		t.Fatalf("wrong status: %s", req.Status())
+	}
+
+	f.Lock()
+	commands := strings.Join(f.commands, ",")
+	f.Unlock()
+	if commands != "PR=A,GW=X,TT=19.50,TC=0.00,TT=19.00" {
+		t.Fatalf("wrong commands: %s", commands)
+	}
+
+	// not supported through the gateway
+	if _, err := o.Send(&Message{Src: T, Type: WriteData, ID: 16, Values: []interface{}{20.0}}); err == nil {
+		t.Fatal("should fail")
+	}
+
+	f.disconnect()
+	waitFor(t, "disconnection", func() bool { return gw.ConnectedItem.GetValue() == item.OFF })
+	waitFor(t, "reconnection", func() bool { return gw.ConnectedItem.GetValue() == item.ON })
+}
@@ -26,71 +26,39 @@ import (
 	"fmt"
 	"time"
 
-	owm "github.com/briandowns/openweathermap"
-
+	"github.com/safchain/hasc/pkg/httpitem"
 	"github.com/safchain/hasc/pkg/item"
 	"github.com/safchain/hasc/pkg/server"
 )
 
+const currentWeatherURL = "https://api.openweathermap.org/data/2.5/weather?lat=%f&lon=%f&units=metric&appid=%s"
+
 type OWM struct {
 	TemperatureItem *item.AnItem
 	HumidityItem    *item.AnItem
+	StatusItem      *item.AnItem
 
-	cwd *owm.CurrentWeatherData
-	lat float64
-	lon float64
-}
-
-func (o *OWM) refreshFnc() {
-	server.Log.Infof("Weather refresh: %f, %f", o.lat, o.lon)
-	o.cwd.CurrentByCoordinates(&owm.Coordinates{Latitude: o.lat, Longitude: o.lon})
-
-	o.TemperatureItem.SetValue(fmt.Sprintf("%.2f", o.cwd.Main.Temp))
-	o.HumidityItem.SetValue(fmt.Sprintf("%d", o.cwd.Main.Humidity))
-}
-
-func (o *OWM) refresh(refresh time.Duration) {
-	// sleep a bit to make the rest of the code ready to accept update
-	time.Sleep(5 * time.Second)
-
-	o.refreshFnc()
-
-	ticker := time.NewTicker(refresh)
-	for range ticker.C {
-		o.refreshFnc()
-	}
+	poller *httpitem.Poller
 }
 
 func NewOWM(id string, label string, apiKey string, lat float64, lon float64, refresh time.Duration) *OWM {
-	cwd, err := owm.NewCurrent("C", "EN", apiKey)
+	url := fmt.Sprintf(currentWeatherURL, lat, lon, apiKey)
+
+	poller, err := httpitem.NewPoller(id, url, httpitem.PollerOpts{
+		Interval: refresh,
+		Items: []httpitem.ItemMapping{
+			{Name: "TEMPERATURE", Label: "Temperature", Img: "temperature", Unit: "°", Path: "main.temp"},
+			{Name: "HUMIDITY", Label: "Humidity", Img: "humidity", Unit: "%", Path: "main.humidity"},
+		},
+	})
 	if err != nil {
 		server.Log.Fatal(err)
 	}
 
-	o := &OWM{
-		cwd: cwd,
-		lat: lat,
-		lon: lon,
-		TemperatureItem: &item.AnItem{
-			ID:    fmt.Sprintf("%s/TEMPERATURE", id),
-			Label: "Temperature",
-			Img:   "temperature",
-			Type:  "value",
-			Unit:  "°",
-		},
-		HumidityItem: &item.AnItem{
-			ID:    fmt.Sprintf("%s/HUMIDITY", id),
-			Label: "Humidity",
-			Img:   "humidity",
-			Type:  "value",
-			Unit:  "%",
-		},
+	return &OWM{
+		TemperatureItem: poller.Item("TEMPERATURE").(*item.AnItem),
+		HumidityItem:    poller.Item("HUMIDITY").(*item.AnItem),
+		StatusItem:      poller.StatusItem,
+		poller:          poller,
 	}
-
-	go o.refresh(refresh)
-
-	server.Registry.Add(o.TemperatureItem)
-	server.Registry.Add(o.HumidityItem)
-
-	return o
 }
@@ -0,0 +1,226 @@
+/*
+ * Copyright (C) 2021 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package presence
+
+import (
+	"sync"
+	"time"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+const (
+	HOME = "HOME"
+	AWAY = "AWAY"
+)
+
+type PersonOpts struct {
+	// AwayDelay is the time to wait, once no source reports the person at
+	// home anymore, before considering the person away. Default to 5 minutes.
+	AwayDelay time.Duration
+}
+
+type sourceState struct {
+	present bool
+	// until is the expiration of a presence reported by a heartbeat
+	until time.Time
+}
+
+// PersonItem reports whether a person is at home or away according to the
+// sources attached to it. The person is at home as soon as one source sees
+// them and away once none of them did during the away delay.
+type PersonItem struct {
+	item.AnItem
+
+	lock      sync.Mutex
+	sources   map[string]*sourceState
+	awayTimer *time.Timer
+	opts      PersonOpts
+}
+
+// GroupItem is ON when at least one of its persons is at home.
+type GroupItem struct {
+	item.AnItem
+
+	lock    sync.RWMutex
+	persons []*PersonItem
+}
+
+func (s *sourceState) isPresent(now time.Time) bool {
+	return s.present && (s.until.IsZero() || s.until.After(now))
+}
+
+func (p *PersonItem) isHome(now time.Time) bool {
+	for _, s := range p.sources {
+		if s.isPresent(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *PersonItem) evaluate() {
+	p.lock.Lock()
+
+	if p.isHome(time.Now()) {
+		if p.awayTimer != nil {
+			p.awayTimer.Stop()
+			p.awayTimer = nil
+		}
+		p.lock.Unlock()
+
+		if p.GetValue() != HOME {
+			server.Log.Infof("Presence %s at home", p.GetID())
+			p.AnItem.SetValue(HOME)
+		}
+		return
+	}
+
+	if p.GetValue() != AWAY && p.awayTimer == nil {
+		p.awayTimer = time.AfterFunc(p.opts.AwayDelay, p.onAwayDelay)
+	}
+	p.lock.Unlock()
+}
+
+func (p *PersonItem) onAwayDelay() {
+	p.lock.Lock()
+	p.awayTimer = nil
+	home := p.isHome(time.Now())
+	p.lock.Unlock()
+
+	if home {
+		p.evaluate()
+	} else if p.GetValue() != AWAY {
+		server.Log.Infof("Presence %s away", p.GetID())
+		p.AnItem.SetValue(AWAY)
+	}
+}
+
+func (p *PersonItem) state(source string) *sourceState {
+	s, ok := p.sources[source]
+	if !ok {
+		s = &sourceState{}
+		p.sources[source] = s
+	}
+	return s
+}
+
+// SetPresent sets the presence reported by the given source.
+func (p *PersonItem) SetPresent(source string, present bool) {
+	p.lock.Lock()
+	s := p.state(source)
+	s.present, s.until = present, time.Time{}
+	p.lock.Unlock()
+
+	p.evaluate()
+}
+
+// Seen reports the person at home for the given source, the presence
+// expires after the given timeout unless seen again.
+func (p *PersonItem) Seen(source string, timeout time.Duration) {
+	p.lock.Lock()
+	s := p.state(source)
+	s.present, s.until = true, time.Now().Add(timeout)
+	p.lock.Unlock()
+
+	time.AfterFunc(timeout, p.evaluate)
+
+	p.evaluate()
+}
+
+func NewPersonItem(id string, label string, opts ...PersonOpts) *PersonItem {
+	p := &PersonItem{
+		AnItem: item.AnItem{
+			ID:    id,
+			Label: label,
+			Type:  "value",
+			Img:   "person",
+		},
+		sources: make(map[string]*sourceState),
+	}
+	if len(opts) > 0 {
+		p.opts = opts[0]
+	}
+	if p.opts.AwayDelay == 0 {
+		p.opts.AwayDelay = 5 * time.Minute
+	}
+
+	server.Registry.Add(p)
+
+	// away unless a source reports the person during the away delay
+	p.evaluate()
+
+	return p
+}
+
+func (g *GroupItem) refresh() {
+	new := item.OFF
+
+	g.lock.RLock()
+	for _, p := range g.persons {
+		if p.GetValue() == HOME {
+			new = item.ON
+			break
+		}
+	}
+	g.lock.RUnlock()
+
+	if g.GetValue() != new {
+		g.AnItem.SetValue(new)
+	}
+}
+
+func (g *GroupItem) OnValueChange(it item.Item, old string, new string) {
+	g.refresh()
+}
+
+// Add adds a person to the group.
+func (g *GroupItem) Add(p *PersonItem) *GroupItem {
+	g.lock.Lock()
+	g.persons = append(g.persons, p)
+	g.lock.Unlock()
+
+	p.AddListener(g)
+
+	g.refresh()
+
+	return g
+}
+
+// NewGroupItem returns an "anyone home" item.
+func NewGroupItem(id string, label string) *GroupItem {
+	g := &GroupItem{
+		AnItem: item.AnItem{
+			ID:    id,
+			Label: label,
+			Type:  "state",
+			Img:   "home",
+		},
+	}
+	g.AnItem.SetValue(item.OFF)
+
+	server.Registry.Add(g)
+
+	return g
+}
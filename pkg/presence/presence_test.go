@@ -0,0 +1,126 @@
+/*
+ * Copyright (C) 2021 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package presence
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/registry"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+func TestPerson(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	p := NewPersonItem("JOHN", "John", PersonOpts{AwayDelay: 200 * time.Millisecond})
+	g := NewGroupItem("ANYONE_HOME", "Anyone home").Add(p)
+
+	netmon := &item.AnItem{ID: "PHONE"}
+	p.AddItem(netmon)
+
+	netmon.SetValue(item.ON)
+	if p.GetValue() != HOME || g.GetValue() != item.ON {
+		t.Fatalf("should be at home, got: %s, %s", p.GetValue(), g.GetValue())
+	}
+
+	// short disconnection, no flapping
+	netmon.SetValue(item.OFF)
+	time.Sleep(100 * time.Millisecond)
+	netmon.SetValue(item.ON)
+	time.Sleep(200 * time.Millisecond)
+	if p.GetValue() != HOME {
+		t.Fatalf("should be at home, got: %s", p.GetValue())
+	}
+
+	// still seen by another source
+	p.Seen("heartbeat", 300*time.Millisecond)
+	netmon.SetValue(item.OFF)
+	time.Sleep(300 * time.Millisecond)
+	if p.GetValue() != HOME {
+		t.Fatalf("should be at home, got: %s", p.GetValue())
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if p.GetValue() != AWAY || g.GetValue() != item.OFF {
+		t.Fatalf("should be away, got: %s, %s", p.GetValue(), g.GetValue())
+	}
+}
+
+func TestARP(t *testing.T) {
+	arp := `IP address       HW type     Flags       HW address            Mask     Device
+192.168.0.10     0x1         0x2         aa:bb:cc:dd:ee:ff     *        eth0
+192.168.0.11     0x1         0x0         11:22:33:44:55:66     *        eth0
+`
+	if !arpPresent(strings.NewReader(arp), "aa:bb:cc:dd:ee:ff") {
+		t.Fatal("should be present")
+	}
+	if arpPresent(strings.NewReader(arp), "11:22:33:44:55:66") {
+		t.Fatal("incomplete entry should not be present")
+	}
+}
+
+func TestDHCPLeases(t *testing.T) {
+	now := time.Date(2021, 6, 21, 12, 0, 0, 0, time.UTC)
+
+	dnsmasq := `1624280400 aa:bb:cc:dd:ee:ff 192.168.0.10 phone 01:aa:bb:cc:dd:ee:ff
+1624269600 11:22:33:44:55:66 192.168.0.11 laptop *
+0 22:33:44:55:66:77 192.168.0.12 nas *
+`
+	for mac, expected := range map[string]bool{
+		"aa:bb:cc:dd:ee:ff": true,
+		"11:22:33:44:55:66": false,
+		"22:33:44:55:66:77": true,
+		"33:44:55:66:77:88": false,
+	} {
+		if leaseActive(strings.NewReader(dnsmasq), mac, now) != expected {
+			t.Fatalf("dnsmasq lease of %s should be %v", mac, expected)
+		}
+	}
+
+	isc := `# The format of this file is documented in the dhcpd.leases(5) manual page.
+lease 192.168.0.10 {
+  starts 1 2021/06/21 11:00:00;
+  ends 1 2021/06/21 13:00:00;
+  binding state active;
+  next binding state free;
+  hardware ethernet AA:BB:CC:DD:EE:FF;
+}
+lease 192.168.0.11 {
+  starts 1 2021/06/21 09:00:00;
+  ends 1 2021/06/21 11:00:00;
+  binding state free;
+  hardware ethernet 11:22:33:44:55:66;
+}
+`
+	for mac, expected := range map[string]bool{
+		"aa:bb:cc:dd:ee:ff": true,
+		"11:22:33:44:55:66": false,
+	} {
+		if leaseActive(strings.NewReader(isc), mac, now) != expected {
+			t.Fatalf("dhcpd lease of %s should be %v", mac, expected)
+		}
+	}
+}
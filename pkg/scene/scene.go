@@ -0,0 +1,81 @@
+/*
+ * Copyright (C) 2021 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package scene
+
+import (
+	"sync"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+type sceneValue struct {
+	item  item.Item
+	value string
+}
+
+// SceneItem sets a list of items to predefined values when activated.
+type SceneItem struct {
+	item.AnItem
+
+	lock   sync.RWMutex
+	values []sceneValue
+}
+
+// Add adds an item to the scene, the given value will be applied on activation.
+func (s *SceneItem) Add(it item.Item, value string) *SceneItem {
+	s.lock.Lock()
+	s.values = append(s.values, sceneValue{item: it, value: value})
+	s.lock.Unlock()
+
+	return s
+}
+
+func (s *SceneItem) SetValue(new string) (string, bool) {
+	server.Log.Infof("Scene %s activated", s.GetID())
+
+	s.lock.RLock()
+	values := s.values
+	s.lock.RUnlock()
+
+	for _, v := range values {
+		v.item.SetValue(v.value)
+	}
+
+	return s.AnItem.SetValue(item.ON)
+}
+
+func NewSceneItem(id string, label string) *SceneItem {
+	s := &SceneItem{
+		AnItem: item.AnItem{
+			ID:    id,
+			Label: label,
+			Type:  "button",
+			Img:   "light",
+		},
+	}
+
+	server.Registry.Add(s)
+
+	return s
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package serial
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrFrameTooLong is returned when a frame doesn't fit the length prefix.
+var ErrFrameTooLong = errors.New("frame too long")
+
+// Framing splits the data read from the port into frames, a nil frame being
+// skipped, and encodes the frames to write.
+type Framing interface {
+	Split(data []byte, atEOF bool) (advance int, frame []byte, err error)
+	Encode(frame []byte) ([]byte, error)
+}
+
+// DelimiterFraming delimits the frames by Delimiter, ex: \n. When the
+// delimiter is \n, the trailing \r of the frames is removed. Empty frames are
+// skipped.
+type DelimiterFraming struct {
+	Delimiter []byte
+}
+
+// LengthFraming prefixes the frames by their length encoded on Size bytes, 1,
+// 2 or 4, big endian unless LittleEndian is set.
+type LengthFraming struct {
+	Size         int
+	LittleEndian bool
+}
+
+func (d *DelimiterFraming) frame(data []byte) []byte {
+	if bytes.Equal(d.Delimiter, []byte("\n")) {
+		data = bytes.TrimSuffix(data, []byte("\r"))
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return data
+}
+
+func (d *DelimiterFraming) Split(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.Index(data, d.Delimiter); i >= 0 {
+		return i + len(d.Delimiter), d.frame(data[:i]), nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), d.frame(data), nil
+	}
+	return 0, nil, nil
+}
+
+func (d *DelimiterFraming) Encode(frame []byte) ([]byte, error) {
+	return append(append([]byte{}, frame...), d.Delimiter...), nil
+}
+
+func (l *LengthFraming) order() binary.ByteOrder {
+	if l.LittleEndian {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+func (l *LengthFraming) Split(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) < l.Size {
+		if atEOF && len(data) > 0 {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return 0, nil, nil
+	}
+
+	var n int
+	switch l.Size {
+	case 1:
+		n = int(data[0])
+	case 2:
+		n = int(l.order().Uint16(data))
+	case 4:
+		n = int(l.order().Uint32(data))
+	default:
+		return 0, nil, fmt.Errorf("wrong length size: %d", l.Size)
+	}
+
+	if len(data) < l.Size+n {
+		if atEOF {
+			return 0, nil, io.ErrUnexpectedEOF
+		}
+		return 0, nil, nil
+	}
+	if n == 0 {
+		return l.Size, nil, nil
+	}
+
+	return l.Size + n, data[l.Size : l.Size+n], nil
+}
+
+func (l *LengthFraming) Encode(frame []byte) ([]byte, error) {
+	data := make([]byte, l.Size, l.Size+len(frame))
+
+	n := len(frame)
+	switch l.Size {
+	case 1:
+		if n > 0xff {
+			return nil, ErrFrameTooLong
+		}
+		data[0] = byte(n)
+	case 2:
+		if n > 0xffff {
+			return nil, ErrFrameTooLong
+		}
+		l.order().PutUint16(data, uint16(n))
+	case 4:
+		if uint64(n) > 0xffffffff {
+			return nil, ErrFrameTooLong
+		}
+		l.order().PutUint32(data, uint32(n))
+	default:
+		return nil, fmt.Errorf("wrong length size: %d", l.Size)
+	}
+
+	return append(data, frame...), nil
+}
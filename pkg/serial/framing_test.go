@@ -0,0 +1,106 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package serial
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func scanFrames(t *testing.T, framing Framing, data []byte) ([]string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Split(framing.Split)
+
+	var frames []string
+	for scanner.Scan() {
+		frames = append(frames, scanner.Text())
+	}
+	return frames, scanner.Err()
+}
+
+func TestDelimiterFraming(t *testing.T) {
+	framing := &DelimiterFraming{Delimiter: []byte("\n")}
+
+	frames, err := scanFrames(t, framing, []byte("abc\r\n\ndef\nghi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"abc", "def", "ghi"}; !reflect.DeepEqual(frames, expected) {
+		t.Errorf("expected %v, got: %v", expected, frames)
+	}
+
+	framing = &DelimiterFraming{Delimiter: []byte("\r\n")}
+	frames, err = scanFrames(t, framing, []byte("a\nb\r\nc\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"a\nb", "c"}; !reflect.DeepEqual(frames, expected) {
+		t.Errorf("expected %v, got: %v", expected, frames)
+	}
+
+	data, _ := framing.Encode([]byte("abc"))
+	if string(data) != "abc\r\n" {
+		t.Errorf("wrong encoding: %q", data)
+	}
+}
+
+func TestLengthFraming(t *testing.T) {
+	for _, framing := range []*LengthFraming{
+		{Size: 1},
+		{Size: 2},
+		{Size: 2, LittleEndian: true},
+		{Size: 4},
+	} {
+		expected := []string{"a\nb", "\x00\x01", strings.Repeat("x", 200)}
+
+		var data []byte
+		for _, frame := range expected {
+			encoded, err := framing.Encode([]byte(frame))
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = append(data, encoded...)
+		}
+
+		frames, err := scanFrames(t, framing, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(frames, expected) {
+			t.Errorf("size %d expected %q, got: %q", framing.Size, expected, frames)
+		}
+
+		// truncated frame
+		if _, err := scanFrames(t, framing, data[:len(data)-1]); err != io.ErrUnexpectedEOF {
+			t.Errorf("size %d expected an unexpected EOF error, got: %v", framing.Size, err)
+		}
+	}
+
+	if _, err := (&LengthFraming{Size: 1}).Encode(make([]byte, 256)); err != ErrFrameTooLong {
+		t.Errorf("expected a frame too long error, got: %v", err)
+	}
+}
@@ -0,0 +1,413 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package serial
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/safchain/hasc/pkg/button"
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/server"
+	"github.com/safchain/hasc/pkg/transform"
+)
+
+const (
+	// FormatKeyValue lines, ex: TEMP=21.5 HUM=40, pairs separated by spaces
+	// or semicolons.
+	FormatKeyValue = "keyvalue"
+	// FormatJSON lines, ex: {"TEMP": 21.5, "HUM": 40}, nested values being
+	// referenced by a dotted key, ex: sensor.temp.
+	FormatJSON = "json"
+)
+
+// ItemMapping maps a key of the lines read from the serial port to an item.
+type ItemMapping struct {
+	// Key of the value in the lines.
+	Key string
+	// Label of the item, default to the key.
+	Label string
+	// Type of the item, value, state or switch. Default to value.
+	Type string
+	// Img of the item. Default to chart for values, switch otherwise.
+	Img string
+	// Unit of the item.
+	Unit string
+	// Transform applied to the numeric values, see the transform package.
+	Transform string
+	// Command written to the serial port when the item is set, %s being
+	// replaced by the value, ex: RELAY=%s. Switches are writable by default,
+	// with a command in the format of the lines, the state being written as
+	// last reported by the device, ex: 1 or on, 1 or 0 by default.
+	Command string
+}
+
+type SerialItemsOpts struct {
+	// Format of the lines, keyvalue or json. Default to keyvalue.
+	Format string
+	// Separator between the keys and the values of the keyvalue format.
+	// Default to =.
+	Separator string
+	// Items mapped.
+	Items []ItemMapping
+}
+
+type serialItem struct {
+	item      item.Item
+	mapping   ItemMapping
+	transform transform.Pipeline
+
+	lock     sync.Mutex
+	reported string
+	// raw state as reported by the device, ex: 1 or on
+	raw string
+}
+
+// SerialItems routes the values of the lines read from a serial port to items
+// and writes a command when a writable item is set.
+type SerialItems struct {
+	id     string
+	serial *Serial
+	items  map[string]*serialItem
+	opts   SerialItemsOpts
+}
+
+// serialConfig is the configuration of a device in the serial section.
+type serialConfig struct {
+	Device          string
+	Baud            int
+	SerialItemsOpts `mapstructure:",squash"`
+}
+
+func normalizeState(value string) string {
+	switch strings.ToLower(value) {
+	case "1", "on", "true":
+		return item.ON
+	}
+	return item.OFF
+}
+
+// rawStates are the forms of the states known, the first being the on state.
+var rawStates = [][2]string{
+	{"1", "0"},
+	{"on", "off"},
+	{"ON", "OFF"},
+	{"On", "Off"},
+	{"true", "false"},
+	{"TRUE", "FALSE"},
+	{"True", "False"},
+}
+
+// rawState returns the state in the form of the raw state last reported by
+// the device, 1 or 0 by default.
+func rawState(raw string, state string) string {
+	pair := rawStates[0]
+	for _, p := range rawStates {
+		if raw == p[0] || raw == p[1] {
+			pair = p
+			break
+		}
+	}
+
+	if state == item.ON {
+		return pair[0]
+	}
+	return pair[1]
+}
+
+// lookupJSON returns the value of a dotted key.
+func lookupJSON(values map[string]interface{}, key string) (interface{}, bool) {
+	if value, ok := values[key]; ok {
+		return value, true
+	}
+
+	parts := strings.SplitN(key, ".", 2)
+	if len(parts) != 2 {
+		return nil, false
+	}
+	sub, ok := values[parts[0]].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	return lookupJSON(sub, parts[1])
+}
+
+func (s *SerialItems) parseKeyValue(line string) map[string]string {
+	values := make(map[string]string)
+
+	fields := strings.FieldsFunc(line, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == ';'
+	})
+	for _, field := range fields {
+		kv := strings.SplitN(field, s.opts.Separator, 2)
+		if len(kv) == 2 {
+			values[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+
+	return values
+}
+
+func (s *SerialItems) parseJSON(line string) (map[string]string, error) {
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &data); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	for key := range s.items {
+		value, ok := lookupJSON(data, key)
+		if !ok {
+			continue
+		}
+
+		switch value := value.(type) {
+		case float64:
+			values[key] = strconv.FormatFloat(value, 'f', -1, 64)
+		case bool:
+			values[key] = strconv.FormatBool(value)
+		case string:
+			values[key] = value
+		case nil:
+		default:
+			data, _ := json.Marshal(value)
+			values[key] = string(data)
+		}
+	}
+
+	return values, nil
+}
+
+func (si *serialItem) update(value string) {
+	if si.mapping.Type == "state" || si.mapping.Type == "switch" {
+		si.lock.Lock()
+		si.raw = value
+		si.lock.Unlock()
+
+		value = normalizeState(value)
+	} else if f, err := strconv.ParseFloat(value, 64); err == nil {
+		if f, ok := si.transform.Apply(f, time.Now()); ok {
+			value = strconv.FormatFloat(f, 'f', -1, 64)
+		} else {
+			return
+		}
+	}
+
+	si.lock.Lock()
+	si.reported = value
+	si.lock.Unlock()
+
+	si.item.SetValue(value)
+}
+
+// OnValueChange handles the lines read from the serial port.
+func (s *SerialItems) OnValueChange(line string) {
+	var (
+		values map[string]string
+		err    error
+	)
+
+	if s.opts.Format == FormatJSON {
+		values, err = s.parseJSON(line)
+	} else {
+		values = s.parseKeyValue(line)
+	}
+	if err != nil {
+		server.Log.Errorf("Serial %s unable to parse %s: %s", s.id, line, err)
+		return
+	}
+
+	for key, value := range values {
+		if si, ok := s.items[key]; ok {
+			si.update(value)
+		} else {
+			server.Log.Debugf("Serial %s unknown key %s", s.id, key)
+		}
+	}
+}
+
+// command returns the line to write for the given value.
+func (s *SerialItems) command(si *serialItem, value string) string {
+	mapping := si.mapping
+	if mapping.Command != "" {
+		return strings.Replace(mapping.Command, "%s", value, -1)
+	}
+
+	if mapping.Type == "switch" {
+		si.lock.Lock()
+		value = rawState(si.raw, value)
+		si.lock.Unlock()
+	}
+
+	if s.opts.Format == FormatJSON {
+		// numbers and booleans are not quoted
+		var v interface{} = value
+		if _, err := strconv.ParseFloat(value, 64); err == nil || value == "true" || value == "false" {
+			v = json.RawMessage(value)
+		}
+		data, _ := json.Marshal(map[string]interface{}{mapping.Key: v})
+		return string(data)
+	}
+	return mapping.Key + s.opts.Separator + value
+}
+
+func (s *SerialItems) newItem(mapping ItemMapping) *serialItem {
+	label := mapping.Label
+	if label == "" {
+		label = mapping.Key
+	}
+	if mapping.Type == "" {
+		mapping.Type = "value"
+	}
+
+	img := mapping.Img
+	if img == "" {
+		img = "switch"
+		if mapping.Type == "value" {
+			img = "chart"
+		}
+	}
+
+	id := fmt.Sprintf("%s/%s", s.id, mapping.Key)
+
+	si := &serialItem{mapping: mapping}
+	if mapping.Type == "switch" {
+		si.item = &button.SwitchItem{
+			AnItem: item.AnItem{
+				ID:    id,
+				Label: label,
+				Type:  mapping.Type,
+				Img:   img,
+				Unit:  mapping.Unit,
+			},
+		}
+	} else {
+		si.item = &item.AnItem{
+			ID:    id,
+			Label: label,
+			Type:  mapping.Type,
+			Img:   img,
+			Unit:  mapping.Unit,
+		}
+	}
+	si.transform = transform.ForItem(id, mapping.Transform)
+
+	if mapping.Command != "" || mapping.Type == "switch" {
+		si.item.AddListener(&item.CallbackListener{
+			CbFnc: func(it item.Item, old string, new string) {
+				si.lock.Lock()
+				reported := si.reported
+				si.lock.Unlock()
+
+				// value read from the device or already written
+				if new == reported {
+					return
+				}
+
+				if err := s.serial.Write([]byte(s.command(si, new))); err != nil {
+					server.Log.Errorf("Serial %s unable to write %s: %s", s.id, it.GetID(), err)
+					return
+				}
+
+				si.lock.Lock()
+				si.reported = new
+				si.lock.Unlock()
+			},
+		})
+	}
+
+	return si
+}
+
+// Item returns the item mapped to the given key.
+func (s *SerialItems) Item(key string) item.Item {
+	if si, ok := s.items[key]; ok {
+		return si.item
+	}
+	return nil
+}
+
+func newSerialItems(id string, s *Serial, opts ...SerialItemsOpts) *SerialItems {
+	si := &SerialItems{
+		id:     id,
+		serial: s,
+		items:  make(map[string]*serialItem),
+	}
+	if len(opts) > 0 {
+		si.opts = opts[0]
+	}
+	if si.opts.Format == "" {
+		si.opts.Format = FormatKeyValue
+	}
+	if si.opts.Separator == "" {
+		si.opts.Separator = "="
+	}
+
+	for _, mapping := range si.opts.Items {
+		si.items[mapping.Key] = si.newItem(mapping)
+	}
+
+	return si
+}
+
+// NewSerialItems registers an item, <id>/<key>, per mapping and updates them
+// with the values of the lines read from the serial port.
+func NewSerialItems(id string, s *Serial, opts ...SerialItemsOpts) (*SerialItems, error) {
+	si := newSerialItems(id, s, opts...)
+	if si.opts.Format != FormatKeyValue && si.opts.Format != FormatJSON {
+		return nil, fmt.Errorf("unknown format: %s", si.opts.Format)
+	}
+
+	for _, mapping := range si.opts.Items {
+		server.Registry.Add(si.items[mapping.Key].item)
+	}
+
+	s.AddListener(si)
+
+	return si, nil
+}
+
+// NewSerialItemsFromConfig opens the device configured under the serial
+// section of the config file for the given ID and registers its items.
+func NewSerialItemsFromConfig(id string) (*SerialItems, error) {
+	if server.Cfg == nil {
+		return nil, fmt.Errorf("no configuration for serial %s", id)
+	}
+
+	var cfg serialConfig
+	if err := server.Cfg.UnmarshalKey("serial."+strings.ToLower(id), &cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Device == "" {
+		return nil, fmt.Errorf("no device configured for serial %s", id)
+	}
+	if cfg.Baud == 0 {
+		cfg.Baud = 9600
+	}
+
+	return NewSerialItems(id, NewSerial(cfg.Device, cfg.Baud), cfg.SerialItemsOpts)
+}
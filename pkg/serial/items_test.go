@@ -0,0 +1,171 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package serial
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/registry"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+func assertItems(t *testing.T, si *SerialItems, expected map[string]string) {
+	for key, value := range expected {
+		it := si.Item(key)
+		if it == nil {
+			t.Fatalf("item %s not found", key)
+		}
+		if it.GetValue() != value {
+			t.Errorf("%s expected %s, got: %s", it.GetID(), value, it.GetValue())
+		}
+	}
+}
+
+func TestSerialItemsKeyValue(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	si, err := NewSerialItems("ARDUINO", &Serial{}, SerialItemsOpts{
+		Items: []ItemMapping{
+			{Key: "TEMP", Unit: "°", Transform: "linear(1, -1)"},
+			{Key: "HUM", Unit: "%"},
+			{Key: "DOOR", Type: "state"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	si.OnValueChange("TEMP=21.5 HUM=40;DOOR=1 OTHER=3")
+	assertItems(t, si, map[string]string{"TEMP": "20.5", "HUM": "40", "DOOR": item.ON})
+
+	if it := server.Registry.Get("ARDUINO/TEMP"); it == nil || it.GetUnit() != "°" {
+		t.Errorf("item not registered: %v", it)
+	}
+
+	si.OnValueChange("DOOR=0")
+	assertItems(t, si, map[string]string{"TEMP": "20.5", "DOOR": item.OFF})
+}
+
+func TestSerialItemsJSON(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	si, err := NewSerialItems("ARDUINO", &Serial{}, SerialItemsOpts{
+		Format: FormatJSON,
+		Items: []ItemMapping{
+			{Key: "temp"},
+			{Key: "sensor.hum"},
+			{Key: "door", Type: "state"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	si.OnValueChange(`{"temp": 21.5, "door": true, "sensor": {"hum": 40}}`)
+	assertItems(t, si, map[string]string{"temp": "21.5", "sensor.hum": "40", "door": item.ON})
+
+	// invalid lines are ignored
+	si.OnValueChange(`{"temp": `)
+	assertItems(t, si, map[string]string{"temp": "21.5"})
+
+	if _, err := NewSerialItems("ARDUINO", &Serial{}, SerialItemsOpts{Format: "xml"}); err == nil {
+		t.Error("expected an unknown format error")
+	}
+}
+
+func TestSerialItemsCommandFormat(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	kv := newSerialItems("ARDUINO", &Serial{}, SerialItemsOpts{
+		Items: []ItemMapping{{Key: "RELAY", Type: "switch"}},
+	})
+	relay := kv.items["RELAY"]
+
+	if cmd := kv.command(relay, item.ON); cmd != "RELAY=1" {
+		t.Errorf("wrong default command: %s", cmd)
+	}
+	kv.OnValueChange("RELAY=off")
+	if cmd := kv.command(relay, item.ON); cmd != "RELAY=on" {
+		t.Errorf("wrong command: %s", cmd)
+	}
+
+	js := newSerialItems("ARDUINO", &Serial{}, SerialItemsOpts{
+		Format: FormatJSON,
+		Items:  []ItemMapping{{Key: "relay", Type: "switch"}},
+	})
+	js.OnValueChange(`{"relay": true}`)
+	if cmd := js.command(js.items["relay"], item.OFF); cmd != `{"relay":false}` {
+		t.Errorf("wrong JSON command: %s", cmd)
+	}
+}
+
+func TestSerialItemsConfig(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	cfg := viper.New()
+	cfg.SetConfigType("yaml")
+	err := cfg.ReadConfig(strings.NewReader(`
+serial:
+  arduino:
+    device: /dev/hasc-test-none
+    format: json
+    items:
+      - key: temp
+        label: Temperature
+        unit: °
+      - key: relay
+        type: switch
+        command: R%s
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Cfg = cfg
+	defer func() { server.Cfg = nil }()
+
+	si, err := NewSerialItemsFromConfig("ARDUINO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer si.serial.Close()
+
+	if si.opts.Format != FormatJSON || si.serial.dev != "/dev/hasc-test-none" || si.serial.baud != 9600 {
+		t.Errorf("wrong configuration: %+v", si.opts)
+	}
+
+	relay := si.Item("relay")
+	if relay == nil || relay.GetType() != "switch" || si.items["relay"].mapping.Command != "R%s" {
+		t.Fatalf("wrong relay item: %v", relay)
+	}
+	if temp := si.Item("temp"); temp == nil || temp.GetLabel() != "Temperature" || temp.GetUnit() != "°" {
+		t.Fatalf("wrong temp item: %v", temp)
+	}
+
+	if _, err := NewSerialItemsFromConfig("UNKNOWN"); err == nil {
+		t.Error("expected a no device error")
+	}
+}
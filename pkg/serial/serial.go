@@ -23,7 +23,10 @@
 package serial
 
 import (
-	"strings"
+	"bufio"
+	"errors"
+	"io"
+	"os"
 	"sync"
 	"time"
 
@@ -32,6 +35,20 @@ import (
 	"github.com/safchain/hasc/pkg/server"
 )
 
+const (
+	// maxFrameSize is the maximum size of a frame read from the port.
+	maxFrameSize = 64 * 1024
+	// readTimeout bounds the blocking reads so that the port can be closed.
+	readTimeout = 500 * time.Millisecond
+)
+
+var (
+	// ErrNotConnected is returned when writing while the port is not opened.
+	ErrNotConnected = errors.New("serial port not connected")
+	// ErrClosed is returned when writing to a closed Serial.
+	ErrClosed = errors.New("serial port closed")
+)
+
 type SerialListener interface {
 	OnValueChange(value string)
 }
@@ -40,20 +57,74 @@ type CallbackListener struct {
 	CbFnc func(value string)
 }
 
-func (c *CallbackListener) OnValueChange(value string) {
-	c.CbFnc(value)
+// StatusListener is notified when the port is opened or lost, err being the
+// reason of the loss or of the failed attempt.
+type StatusListener interface {
+	OnStatusChange(connected bool, err error)
+}
+
+type StatusCallbackListener struct {
+	CbFnc func(connected bool, err error)
+}
+
+// portReader retries the reads of the port on timeout, reported as EOF, as
+// long as the device is present and the Serial is not closed.
+type portReader struct {
+	s    *Serial
+	port *serial.Port
+}
+
+type SerialOpts struct {
+	// Framing of the data exchanged. Default to lines delimited by \n.
+	Framing Framing
+	// MinBackoff is the delay before the first attempt to re-open the port,
+	// doubled after each failure. Default to 1 second.
+	MinBackoff time.Duration
+	// MaxBackoff is the maximum delay between two attempts. Default to 1
+	// minute.
+	MaxBackoff time.Duration
+	// Parity, N, E or O. Default to N.
+	Parity byte
 }
 
 type Serial struct {
 	sync.RWMutex
 
-	dev       string
-	baud      int
-	port      *serial.Port
-	listeners []SerialListener
+	dev             string
+	baud            int
+	port            *serial.Port
+	closed          bool
+	writeLock       sync.Mutex
+	listeners       []SerialListener
+	statusListeners []StatusListener
+	opts            SerialOpts
+}
+
+func (c *CallbackListener) OnValueChange(value string) {
+	c.CbFnc(value)
+}
+
+func (c *StatusCallbackListener) OnStatusChange(connected bool, err error) {
+	c.CbFnc(connected, err)
+}
+
+func (r *portReader) Read(b []byte) (int, error) {
+	for {
+		n, err := r.port.Read(b)
+		if n > 0 || err != io.EOF || r.s.isClosed() {
+			return n, err
+		}
+
+		if _, err := os.Stat(r.s.dev); err != nil {
+			return 0, err
+		}
+	}
 }
 
 func (s *Serial) AddListener(l SerialListener) {
+	s.Lock()
+	defer s.Unlock()
+
 	for _, el := range s.listeners {
 		if el == l {
 			return
@@ -62,72 +133,213 @@ func (s *Serial) AddListener(l SerialListener) {
 	s.listeners = append(s.listeners, l)
 }
 
+func (s *Serial) AddStatusListener(l StatusListener) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, el := range s.statusListeners {
+		if el == l {
+			return
+		}
+	}
+	s.statusListeners = append(s.statusListeners, l)
+}
+
 func (s *Serial) notifyListeners(value string) {
-	for _, l := range s.listeners {
+	s.RLock()
+	listeners := s.listeners
+	s.RUnlock()
+
+	for _, l := range listeners {
 		l.OnValueChange(value)
 	}
 }
 
-func (s *Serial) read() {
+func (s *Serial) notifyStatus(connected bool, err error) {
 	s.RLock()
-	port := s.port
+	listeners := s.statusListeners
 	s.RUnlock()
 
-	buf := make([]byte, 128)
-	for {
-		n, err := port.Read(buf)
+	for _, l := range listeners {
+		l.OnStatusChange(connected, err)
+	}
+}
+
+// Connected returns whether the port is opened.
+func (s *Serial) Connected() bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.port != nil
+}
+
+func (s *Serial) isClosed() bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.closed
+}
+
+func (s *Serial) openPort() (*serial.Port, error) {
+	c := &serial.Config{
+		Name:        s.dev,
+		Baud:        s.baud,
+		Parity:      serial.Parity(s.opts.Parity),
+		ReadTimeout: readTimeout,
+	}
+	port, err := serial.OpenPort(c)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		port.Close()
+		return nil, ErrClosed
+	}
+	s.port = port
+	s.Unlock()
+
+	return port, nil
+}
+
+func (s *Serial) closePort(port *serial.Port) {
+	s.Lock()
+	if s.port == port {
+		s.port = nil
+	}
+	s.Unlock()
+
+	port.Close()
+}
+
+// readFrames reads the frames until the port fails.
+func (s *Serial) readFrames(port *serial.Port) error {
+	scanner := bufio.NewScanner(&portReader{s: s, port: port})
+	scanner.Buffer(make([]byte, 4096), maxFrameSize)
+	scanner.Split(s.opts.Framing.Split)
+
+	for scanner.Scan() {
+		if frame := scanner.Bytes(); len(frame) > 0 {
+			s.notifyListeners(string(frame))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// run opens the port, reads it, and re-opens it when lost with an
+// exponential backoff.
+func (s *Serial) run() {
+	backoff := s.opts.MinBackoff
+
+	for !s.isClosed() {
+		port, err := s.openPort()
 		if err != nil {
-			// try to re-open
-			if err = s.openPort(); err == nil {
-				s.RLock()
-				port = s.port
-				s.RUnlock()
+			if err == ErrClosed {
+				return
 			}
-			time.Sleep(time.Second)
-		}
-		if n > 0 {
-			values := strings.TrimSpace(string(buf[0:n]))
-			for _, value := range strings.Split(values, "\n") {
-				value = strings.Replace(value, "\r", "", -1)
-				if value != "" {
-					s.notifyListeners(value)
-				}
+			server.Log.Errorf("Unable to open serial port %s: %s, retrying in %s", s.dev, err, backoff)
+			s.notifyStatus(false, err)
+
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > s.opts.MaxBackoff {
+				backoff = s.opts.MaxBackoff
 			}
+			continue
 		}
+		backoff = s.opts.MinBackoff
+
+		server.Log.Infof("Serial port %s opened", s.dev)
+		s.notifyStatus(true, nil)
+
+		err = s.readFrames(port)
+		s.closePort(port)
+
+		if s.isClosed() {
+			return
+		}
+		server.Log.Errorf("Serial port %s lost: %s", s.dev, err)
+		s.notifyStatus(false, err)
+
+		time.Sleep(backoff)
 	}
 }
 
+// Write encodes and writes a frame, concurrent writes are serialized.
+func (s *Serial) Write(frame []byte) error {
+	data, err := s.opts.Framing.Encode(frame)
+	if err != nil {
+		return err
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	s.RLock()
+	port, closed := s.port, s.closed
+	s.RUnlock()
+
+	if closed {
+		return ErrClosed
+	}
+	if port == nil {
+		return ErrNotConnected
+	}
+
+	_, err = port.Write(data)
+	return err
+}
+
 func (s *Serial) WriteValue(new string) {
-	if _, err := s.port.Write([]byte(new + "\n")); err != nil {
-		s.openPort()
+	if err := s.Write([]byte(new)); err != nil {
+		server.Log.Errorf("Unable to write to serial port %s: %s", s.dev, err)
 	}
 }
 
-func (s *Serial) openPort() error {
+// Close closes the port and stops re-opening it, a pending read is
+// interrupted within the read timeout.
+func (s *Serial) Close() error {
 	s.Lock()
-	defer s.Unlock()
+	port := s.port
+	s.port, s.closed = nil, true
+	s.Unlock()
 
-	c := &serial.Config{Name: s.dev, Baud: s.baud}
-	port, err := serial.OpenPort(c)
-	if err != nil {
-		return err
+	if port != nil {
+		return port.Close()
 	}
-	s.port = port
-
 	return nil
 }
 
-func NewSerial(dev string, baud int) *Serial {
+// NewSerial returns a Serial reading the frames of the given device, the
+// device doesn't have to be present, it is opened as soon as it shows up and
+// re-opened when lost.
+func NewSerial(dev string, baud int, opts ...SerialOpts) *Serial {
 	s := &Serial{
 		dev:  dev,
 		baud: baud,
 	}
-
-	if err := s.openPort(); err != nil {
-		server.Log.Fatalf("Unable to open serial port %s: %s", dev, err)
+	if len(opts) > 0 {
+		s.opts = opts[0]
+	}
+	if s.opts.Framing == nil {
+		s.opts.Framing = &DelimiterFraming{Delimiter: []byte("\n")}
+	}
+	if s.opts.MinBackoff == 0 {
+		s.opts.MinBackoff = time.Second
+	}
+	if s.opts.MaxBackoff == 0 {
+		s.opts.MaxBackoff = time.Minute
+	}
+	if s.opts.MaxBackoff < s.opts.MinBackoff {
+		s.opts.MaxBackoff = s.opts.MinBackoff
 	}
 
-	go s.read()
+	go s.run()
 
 	return s
 }
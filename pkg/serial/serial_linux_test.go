@@ -0,0 +1,286 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package serial
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/registry"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+// openPty returns the master side of a pseudo-terminal pair and the path of
+// the slave side.
+func openPty(t *testing.T) (*os.File, string) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("pseudo-terminals not available: %s", err)
+	}
+
+	fd := int(master.Fd())
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		t.Skipf("unable to unlock the pseudo-terminal: %s", err)
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		t.Skipf("unable to get the pseudo-terminal number: %s", err)
+	}
+
+	return master, fmt.Sprintf("/dev/pts/%d", n)
+}
+
+type statusRecorder struct {
+	status chan bool
+}
+
+func (r *statusRecorder) OnStatusChange(connected bool, err error) {
+	r.status <- connected
+}
+
+func waitStatus(t *testing.T, r *statusRecorder, expected bool) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case connected := <-r.status:
+			if connected == expected {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("expected connected status %v", expected)
+		}
+	}
+}
+
+func newTestSerial(t *testing.T, dev string, opts SerialOpts) (*Serial, *statusRecorder, chan string) {
+	s := &Serial{dev: dev, baud: 9600, opts: opts}
+	if s.opts.Framing == nil {
+		s.opts.Framing = &DelimiterFraming{Delimiter: []byte("\n")}
+	}
+	if s.opts.MinBackoff == 0 {
+		s.opts.MinBackoff = 50 * time.Millisecond
+	}
+	if s.opts.MaxBackoff == 0 {
+		s.opts.MaxBackoff = 200 * time.Millisecond
+	}
+
+	r := &statusRecorder{status: make(chan bool, 100)}
+	s.AddStatusListener(r)
+
+	values := make(chan string, 100)
+	s.AddListener(&CallbackListener{CbFnc: func(value string) { values <- value }})
+
+	go s.run()
+
+	return s, r, values
+}
+
+func expectValues(t *testing.T, values chan string, expected ...string) {
+	for _, e := range expected {
+		select {
+		case value := <-values:
+			if value != e {
+				t.Fatalf("expected %q, got: %q", e, value)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %q", e)
+		}
+	}
+}
+
+func TestSerialLines(t *testing.T) {
+	master, dev := openPty(t)
+	defer master.Close()
+
+	s, r, values := newTestSerial(t, dev, SerialOpts{})
+	defer s.Close()
+
+	waitStatus(t, r, true)
+
+	// lines spanning several reads
+	for _, chunk := range []string{"hel", "lo\r\nwor", "ld\n\n"} {
+		if _, err := master.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	expectValues(t, values, "hello", "world")
+}
+
+func TestSerialLengthFraming(t *testing.T) {
+	master, dev := openPty(t)
+	defer master.Close()
+
+	framing := &LengthFraming{Size: 2}
+	s, r, values := newTestSerial(t, dev, SerialOpts{Framing: framing})
+	defer s.Close()
+
+	waitStatus(t, r, true)
+
+	frames := []string{"a\nb", "\x00\x01\x02"}
+	for _, frame := range frames {
+		data, _ := framing.Encode([]byte(frame))
+		if _, err := master.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectValues(t, values, frames...)
+}
+
+func TestSerialConcurrentWrites(t *testing.T) {
+	master, dev := openPty(t)
+	defer master.Close()
+
+	s, r, _ := newTestSerial(t, dev, SerialOpts{})
+	defer s.Close()
+
+	waitStatus(t, r, true)
+
+	var expected []string
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		value := fmt.Sprintf("value-%02d-%s", i, "abcdefghijklmnopqrstuvwxyz")
+		expected = append(expected, value)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Write([]byte(value)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var lines []string
+	scanner := bufio.NewScanner(master)
+	for len(lines) < len(expected) && scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	sort.Strings(lines)
+	for i, line := range lines {
+		if line != expected[i] {
+			t.Errorf("expected %s, got: %s", expected[i], line)
+		}
+	}
+}
+
+func TestSerialReconnect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dev := filepath.Join(dir, "tty")
+
+	// the device is not present at startup
+	s, r, values := newTestSerial(t, dev, SerialOpts{})
+	defer s.Close()
+
+	waitStatus(t, r, false)
+	if err := s.Write([]byte("value")); err != ErrNotConnected {
+		t.Fatalf("expected a not connected error, got: %v", err)
+	}
+
+	master, pts := openPty(t)
+	if err := os.Symlink(pts, dev); err != nil {
+		t.Fatal(err)
+	}
+
+	waitStatus(t, r, true)
+	master.Write([]byte("first\n"))
+	expectValues(t, values, "first")
+
+	// the device is lost
+	master.Close()
+	waitStatus(t, r, false)
+
+	// and shows up again
+	master, pts = openPty(t)
+	defer master.Close()
+
+	os.Remove(dev)
+	if err := os.Symlink(pts, dev); err != nil {
+		t.Fatal(err)
+	}
+
+	waitStatus(t, r, true)
+	master.Write([]byte("second\n"))
+	expectValues(t, values, "second")
+}
+
+func TestSerialItemsCommand(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	master, dev := openPty(t)
+	defer master.Close()
+
+	s, r, _ := newTestSerial(t, dev, SerialOpts{})
+	defer s.Close()
+
+	si, err := NewSerialItems("ARDUINO", s, SerialItemsOpts{
+		Items: []ItemMapping{
+			{Key: "RELAY", Type: "switch"},
+			{Key: "SETPOINT", Command: "SET %s"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitStatus(t, r, true)
+
+	// values reported by the device are not written back
+	si.OnValueChange("RELAY=1 SETPOINT=19")
+
+	si.Item("RELAY").SetValue(item.OFF)
+	si.Item("SETPOINT").SetValue("20.5")
+	// written again, even if not echoed by the device
+	si.Item("RELAY").SetValue(item.ON)
+
+	scanner := bufio.NewScanner(master)
+	for _, expected := range []string{"RELAY=0", "SET 20.5", "RELAY=1"} {
+		if !scanner.Scan() {
+			t.Fatalf("expected %s", expected)
+		}
+		if line := scanner.Text(); line != expected {
+			t.Fatalf("expected %s, got: %s", expected, line)
+		}
+	}
+}
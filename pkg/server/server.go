@@ -334,6 +334,12 @@ func GetItem(id string) item.Item {
 	return it
 }
 
+// HandleFunc registers a new route on the server router. It has to be called
+// from the onInit callback of Start, once the router is created.
+func HandleFunc(path string, f func(http.ResponseWriter, *http.Request)) *mux.Route {
+	return router.HandleFunc(path, f)
+}
+
 func listenAndServe(router *mux.Router) {
 	server := &http.Server{Addr: ":" + Cfg.GetString("port"), Handler: router}
 	server.SetKeepAlivesEnabled(false)
@@ -347,13 +353,17 @@ func init() {
 	Cmd = &cobra.Command{}
 }
 
+// WebhookPath is the prefix of the webhook endpoints, not protected by the
+// basic authentication, the webhooks having their own secrets.
+const WebhookPath = "/webhook/"
+
 type Auth struct {
 	stdHandler  http.Handler
 	authHandler http.Handler
 }
 
 func (a *Auth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "OPTIONS" {
+	if r.Method == "OPTIONS" || strings.HasPrefix(r.URL.Path, WebhookPath) {
 		a.stdHandler.ServeHTTP(w, r)
 	} else {
 		a.authHandler.ServeHTTP(w, r)
@@ -31,11 +31,31 @@ import (
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 
 	"github.com/safchain/hasc/pkg/button"
+	"github.com/safchain/hasc/pkg/energy"
 	"github.com/safchain/hasc/pkg/item"
 	hmqtt "github.com/safchain/hasc/pkg/mqtt"
 	"github.com/safchain/hasc/pkg/server"
+	"github.com/safchain/hasc/pkg/transform"
 )
 
+const (
+	// flow meter pulses to liters
+	defaultFlowTransform = "linear(0.5/34887)"
+	// amps to watts
+	defaultCurrentTransform = "linear(220) | threshold(500, 0)"
+)
+
+type SmartBoilerOpts struct {
+	// WaterTariff is the price of a m3 of water. Default to 3 € / m3.
+	WaterTariff *energy.Tariff
+	// FlowTransform converts the flow meter pulses to liters. Default to the
+	// transforms.<id>/instant_meter config key or linear(0.5/34887).
+	FlowTransform transform.Pipeline
+	// CurrentTransform converts the amps to watts. Default to the
+	// transforms.<id>/current config key or linear(220) | threshold(500, 0).
+	CurrentTransform transform.Pipeline
+}
+
 // SmartBoiler Object
 type SmartBoiler struct {
 	TemperatureItem      *item.AnItem
@@ -51,6 +71,8 @@ type SmartBoiler struct {
 	pubTopic string
 	subTopic string
 	conn     *hmqtt.MQTTConn
+	flowRate transform.Pipeline
+	opts     SmartBoilerOpts
 }
 
 type force struct {
@@ -75,16 +97,19 @@ func (s *SmartBoiler) OnMessage(client mqtt.Client, msg mqtt.Message) {
 		now := time.Now()
 
 		// InstantFlowMeterItem
-		si := s.InstantFlowMeterItem
 		value, _ := strconv.ParseFloat(value, 64)
 
-		newFloat := value * 0.5 / 34887                                           // to liter
-		literPerMin := newFloat / now.Sub(si.GetLastValueChange()).Seconds() * 60 // per min
+		newFloat, ok := s.opts.FlowTransform.Apply(value, now) // to liter
+		if !ok {
+			return
+		}
 
-		si.SetValue(fmt.Sprintf("%.4f", literPerMin))
+		if literPerMin, ok := s.flowRate.Apply(newFloat, now); ok {
+			s.InstantFlowMeterItem.SetValue(fmt.Sprintf("%.4f", literPerMin))
+		}
 
 		// SessionFlowMeterItem
-		si = s.SessionFlowMeterItem
+		si := s.SessionFlowMeterItem
 		oldFloat, _ := strconv.ParseFloat(si.GetValue(), 64)
 
 		if si.GetLastValueChange().Add(2 * time.Minute).Before(now) {
@@ -96,17 +121,14 @@ func (s *SmartBoiler) OnMessage(client mqtt.Client, msg mqtt.Message) {
 
 		// SessionFlowPriceItem
 		si = s.SessionFlowPriceItem
-		priceFloat := newFloat * 3 / 1000 // 3 € / m3
+		priceFloat := s.opts.WaterTariff.Cost(newFloat/1000, now) // liter to m3
 
 		si.SetValue(fmt.Sprintf("%.5f", priceFloat))
 	case "smab-br/current":
 		amp, _ := strconv.ParseFloat(value, 64)
-		watt := amp * 220
-		if watt < 500 {
-			watt = 0
+		if watt, ok := s.opts.CurrentTransform.Apply(amp, time.Now()); ok {
+			s.CurrentItem.SetValue(fmt.Sprintf("%.2f", watt))
 		}
-
-		s.CurrentItem.SetValue(fmt.Sprintf("%.2f", watt))
 	case "smab-br/relay-state":
 		si := s.RelayStateItem
 		if value == "off" {
@@ -118,7 +140,7 @@ func (s *SmartBoiler) OnMessage(client mqtt.Client, msg mqtt.Message) {
 }
 
 // NewSmartBoiler creates a new SmartBoiler Object, publishing and subscribing to the given broker/topic
-func NewSmartBoiler(id string, label string, conn *hmqtt.MQTTConn, pubTopic string, subTopic string) *SmartBoiler {
+func NewSmartBoiler(id string, label string, conn *hmqtt.MQTTConn, pubTopic string, subTopic string, opts ...SmartBoilerOpts) *SmartBoiler {
 	if pubTopic == subTopic {
 		fmt.Println("pub topic and sub topic have to be different")
 		os.Exit(1)
@@ -170,6 +192,8 @@ func NewSmartBoiler(id string, label string, conn *hmqtt.MQTTConn, pubTopic stri
 			Type:  "state",
 			Img:   "plug",
 		},
+		// liters per minute, from the liters since the previous reading
+		flowRate: transform.Pipeline{&transform.Rate{Per: time.Minute, Delta: true}},
 		RelayModeItem: &button.SwitchItem{
 			AnItem: item.AnItem{
 				ID:    fmt.Sprintf("%s/RELAY_MODE", id),
@@ -185,6 +209,19 @@ func NewSmartBoiler(id string, label string, conn *hmqtt.MQTTConn, pubTopic stri
 		},
 	}
 
+	if len(opts) > 0 {
+		s.opts = opts[0]
+	}
+	if s.opts.WaterTariff == nil {
+		s.opts.WaterTariff = &energy.Tariff{Price: 3}
+	}
+	if s.opts.FlowTransform == nil {
+		s.opts.FlowTransform = transform.ForItem(s.InstantFlowMeterItem.ID, defaultFlowTransform)
+	}
+	if s.opts.CurrentTransform == nil {
+		s.opts.CurrentTransform = transform.ForItem(s.CurrentItem.ID, defaultCurrentTransform)
+	}
+
 	s.InstantFlowMeterItem.SetValue("0")
 	s.InstantFlowMeterItem.SetValue("0")
 	s.RelayModeItem.SetValue(item.ON)
@@ -0,0 +1,379 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+const kvBucket = "stats"
+
+type StatsOpts struct {
+	// Window of the rolling min, max and mean. Default to 1 hour.
+	Window time.Duration
+	// Refresh is the period at which the value is sampled and the stats
+	// persisted. Default to 1 minute.
+	Refresh time.Duration
+}
+
+type sample struct {
+	Time  time.Time
+	Value float64
+}
+
+// valueCounters is the persisted state of ValueStats.
+type valueCounters struct {
+	Day     string
+	DayMin  float64
+	DayMax  float64
+	Samples []sample
+}
+
+// stateCounters is the persisted state of StateStats.
+type stateCounters struct {
+	Day      string
+	On       bool
+	Count    int
+	Duration time.Duration
+}
+
+// ValueStats exposes the min, max and mean of a numeric item over a sliding
+// window, and its min and max of the day.
+type ValueStats struct {
+	MinItem    *item.AnItem
+	MaxItem    *item.AnItem
+	MeanItem   *item.AnItem
+	DayMinItem *item.AnItem
+	DayMaxItem *item.AnItem
+
+	id       string
+	source   item.Item
+	lock     sync.Mutex
+	counters valueCounters
+	opts     StatsOpts
+}
+
+// StateStats exposes the number of ON transitions of an item and the time
+// spent ON during the day.
+type StateStats struct {
+	CountItem    *item.AnItem
+	DurationItem *item.AnItem
+
+	id       string
+	lock     sync.Mutex
+	last     time.Time
+	counters stateCounters
+	opts     StatsOpts
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(math.Round(f*100)/100, 'f', -1, 64)
+}
+
+func nextMidnight(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, t.Location())
+}
+
+func save(id string, v interface{}) {
+	if server.KV == nil {
+		return
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		server.Log.Errorf("Stats %s unable to marshal counters: %s", id, err)
+		return
+	}
+	if err := server.KV.SetString(kvBucket, id, string(data)); err != nil {
+		server.Log.Errorf("Stats %s unable to save counters: %s", id, err)
+	}
+}
+
+func load(id string, v interface{}) {
+	if server.KV == nil {
+		return
+	}
+
+	data, found, err := server.KV.GetString(kvBucket, id)
+	if err != nil || !found {
+		return
+	}
+	if err := json.Unmarshal([]byte(data), v); err != nil {
+		server.Log.Errorf("Stats %s unable to load counters: %s", id, err)
+	}
+}
+
+func defaultOpts(opts []StatsOpts) StatsOpts {
+	var o StatsOpts
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if o.Window == 0 {
+		o.Window = time.Hour
+	}
+	if o.Refresh == 0 {
+		o.Refresh = time.Minute
+	}
+	return o
+}
+
+// add records a value, the samples out of the window are discarded and the
+// daily min and max are reset when entering a new day.
+func (s *ValueStats) add(t time.Time, value float64) {
+	if day := t.Format("2006-01-02"); day != s.counters.Day {
+		s.counters.Day = day
+		s.counters.DayMin, s.counters.DayMax = value, value
+	}
+	s.counters.DayMin = math.Min(s.counters.DayMin, value)
+	s.counters.DayMax = math.Max(s.counters.DayMax, value)
+
+	samples := s.counters.Samples[:0]
+	for _, smp := range s.counters.Samples {
+		if t.Sub(smp.Time) < s.opts.Window {
+			samples = append(samples, smp)
+		}
+	}
+	s.counters.Samples = append(samples, sample{Time: t, Value: value})
+}
+
+func (s *ValueStats) publish(c valueCounters) {
+	if len(c.Samples) == 0 {
+		return
+	}
+
+	min, max, sum := math.Inf(1), math.Inf(-1), 0.0
+	for _, smp := range c.Samples {
+		min = math.Min(min, smp.Value)
+		max = math.Max(max, smp.Value)
+		sum += smp.Value
+	}
+
+	s.MinItem.SetValue(formatFloat(min))
+	s.MaxItem.SetValue(formatFloat(max))
+	s.MeanItem.SetValue(formatFloat(sum / float64(len(c.Samples))))
+	s.DayMinItem.SetValue(formatFloat(c.DayMin))
+	s.DayMaxItem.SetValue(formatFloat(c.DayMax))
+}
+
+func (s *ValueStats) update(t time.Time, value string) valueCounters {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		s.add(t, f)
+	}
+
+	c := s.counters
+	c.Samples = append([]sample(nil), s.counters.Samples...)
+
+	return c
+}
+
+func (s *ValueStats) OnValueChange(it item.Item, old string, new string) {
+	s.publish(s.update(time.Now(), new))
+}
+
+func (s *ValueStats) refresh() {
+	ticker := time.NewTicker(s.opts.Refresh)
+	for range ticker.C {
+		// sample the current value so that a steady value is accounted
+		c := s.update(time.Now(), s.source.GetValue())
+
+		s.publish(c)
+		save(s.id, c)
+	}
+}
+
+func newValueStats(id string, source item.Item, opts ...StatsOpts) *ValueStats {
+	s := &ValueStats{
+		id:     id,
+		source: source,
+		opts:   defaultOpts(opts),
+	}
+
+	newItem := func(name, label string) *item.AnItem {
+		return &item.AnItem{
+			ID:    fmt.Sprintf("%s/%s", id, name),
+			Label: label,
+			Type:  "value",
+			Img:   "chart",
+			Unit:  source.GetUnit(),
+		}
+	}
+	s.MinItem = newItem("MIN", "Min")
+	s.MaxItem = newItem("MAX", "Max")
+	s.MeanItem = newItem("MEAN", "Mean")
+	s.DayMinItem = newItem("DAY_MIN", "Min today")
+	s.DayMaxItem = newItem("DAY_MAX", "Max today")
+
+	return s
+}
+
+// NewValueStats returns the stats of a numeric item. The stats are persisted
+// in the KV store.
+func NewValueStats(id string, source item.Item, opts ...StatsOpts) *ValueStats {
+	s := newValueStats(id, source, opts...)
+
+	load(id, &s.counters)
+	s.publish(s.update(time.Now(), source.GetValue()))
+
+	server.Registry.Add(s.MinItem)
+	server.Registry.Add(s.MaxItem)
+	server.Registry.Add(s.MeanItem)
+	server.Registry.Add(s.DayMinItem)
+	server.Registry.Add(s.DayMaxItem)
+
+	source.AddListener(s)
+
+	go s.refresh()
+
+	return s
+}
+
+// integrate accumulates the time spent ON since the last update, the interval
+// is split at midnight so that each day gets its own share.
+func (s *StateStats) integrate(now time.Time) {
+	for s.last.Before(now) {
+		s.rollover(s.last)
+
+		end := now
+		if midnight := nextMidnight(s.last); midnight.Before(end) {
+			end = midnight
+		}
+
+		if s.counters.On {
+			s.counters.Duration += end.Sub(s.last)
+		}
+
+		s.last = end
+	}
+	s.rollover(now)
+}
+
+func (s *StateStats) rollover(t time.Time) {
+	if day := t.Format("2006-01-02"); day != s.counters.Day {
+		s.counters.Day = day
+		s.counters.Count, s.counters.Duration = 0, 0
+	}
+}
+
+func (s *StateStats) publish(c stateCounters) {
+	s.CountItem.SetValue(strconv.Itoa(c.Count))
+	s.DurationItem.SetValue(fmt.Sprintf("%.0f", c.Duration.Minutes()))
+}
+
+// update integrates up to the given time, then uses the given state.
+func (s *StateStats) update(now time.Time, value string) stateCounters {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.integrate(now)
+
+	on := value == item.ON
+	if on && !s.counters.On {
+		s.counters.Count++
+	}
+	s.counters.On = on
+
+	return s.counters
+}
+
+func (s *StateStats) OnValueChange(it item.Item, old string, new string) {
+	// unknown state, ex: not yet received
+	if new == "" {
+		return
+	}
+	s.publish(s.update(time.Now(), new))
+}
+
+func (s *StateStats) refresh() {
+	ticker := time.NewTicker(s.opts.Refresh)
+	for range ticker.C {
+		s.lock.Lock()
+		s.integrate(time.Now())
+		c := s.counters
+		s.lock.Unlock()
+
+		s.publish(c)
+		save(s.id, c)
+	}
+}
+
+func newStateStats(id string, opts ...StatsOpts) *StateStats {
+	s := &StateStats{
+		id:   id,
+		opts: defaultOpts(opts),
+	}
+
+	s.CountItem = &item.AnItem{
+		ID:    fmt.Sprintf("%s/COUNT", id),
+		Label: "Count today",
+		Type:  "value",
+		Img:   "chart",
+	}
+	s.DurationItem = &item.AnItem{
+		ID:    fmt.Sprintf("%s/DURATION", id),
+		Label: "Duration today",
+		Type:  "value",
+		Img:   "chart",
+		Unit:  "min",
+	}
+
+	return s
+}
+
+// NewStateStats returns the stats of an ON/OFF item, ex: the number of burner
+// starts and the burner run time of the day from the SlaveFlame item. The
+// stats are persisted in the KV store, the time during which hasc is not
+// running is not accounted.
+func NewStateStats(id string, source item.Item, opts ...StatsOpts) *StateStats {
+	s := newStateStats(id, opts...)
+
+	load(id, &s.counters)
+
+	now := time.Now()
+	s.last = now
+	s.rollover(now)
+	if value := source.GetValue(); value != "" {
+		s.update(now, value)
+	}
+	s.publish(s.counters)
+
+	server.Registry.Add(s.CountItem)
+	server.Registry.Add(s.DurationItem)
+
+	source.AddListener(s)
+
+	go s.refresh()
+
+	return s
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package stats
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/kv"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+func TestValueStats(t *testing.T) {
+	source := &item.AnItem{ID: "SALON/TEMP", Unit: "°C"}
+	s := newValueStats("SALON/TEMP/STATS", source, StatsOpts{Window: time.Hour})
+
+	start := time.Date(2021, 6, 21, 23, 0, 0, 0, time.UTC)
+	s.publish(s.update(start, "20"))
+	s.publish(s.update(start.Add(30*time.Minute), "18"))
+	s.publish(s.update(start.Add(45*time.Minute), "22.5"))
+
+	if s.MinItem.GetValue() != "18" || s.MaxItem.GetValue() != "22.5" || s.MeanItem.GetValue() != "20.17" {
+		t.Fatalf("wrong window stats: %s, %s, %s", s.MinItem.GetValue(), s.MaxItem.GetValue(), s.MeanItem.GetValue())
+	}
+	if s.MinItem.GetUnit() != "°C" {
+		t.Fatalf("wrong unit: %s", s.MinItem.GetUnit())
+	}
+
+	// the first sample is out of the window, and a new day begins
+	s.publish(s.update(start.Add(61*time.Minute), "21"))
+	if s.MinItem.GetValue() != "18" || s.MeanItem.GetValue() != "20.5" {
+		t.Fatalf("wrong window stats: %s, %s", s.MinItem.GetValue(), s.MeanItem.GetValue())
+	}
+
+	// not a number, ignored
+	s.publish(s.update(start.Add(62*time.Minute), "N/A"))
+	if len(s.counters.Samples) != 3 {
+		t.Fatalf("wrong samples: %+v", s.counters.Samples)
+	}
+
+	if s.DayMinItem.GetValue() != "21" || s.DayMaxItem.GetValue() != "21" {
+		t.Fatalf("daily stats not reset: %s, %s", s.DayMinItem.GetValue(), s.DayMaxItem.GetValue())
+	}
+}
+
+func TestStateStats(t *testing.T) {
+	s := newStateStats("BOILER/FLAME/STATS")
+
+	start := time.Date(2021, 6, 21, 23, 0, 0, 0, time.UTC)
+	s.last = start
+	s.rollover(start)
+
+	s.publish(s.update(start, item.ON))
+	s.publish(s.update(start.Add(10*time.Minute), item.ON))
+	s.publish(s.update(start.Add(20*time.Minute), item.OFF))
+	s.publish(s.update(start.Add(40*time.Minute), item.ON))
+
+	if s.CountItem.GetValue() != "2" {
+		t.Fatalf("expected 2 starts, got: %s", s.CountItem.GetValue())
+	}
+
+	// still ON after midnight
+	s.publish(s.update(start.Add(90*time.Minute), item.OFF))
+	if s.CountItem.GetValue() != "0" || s.DurationItem.GetValue() != "30" {
+		t.Fatalf("wrong stats after midnight: %s, %s", s.CountItem.GetValue(), s.DurationItem.GetValue())
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hasc-stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := viper.New()
+	cfg.Set("data", dir)
+	server.KV = kv.NewKVStore(cfg)
+	defer func() { server.KV = nil }()
+
+	s := newStateStats("BOILER/FLAME/STATS")
+	save(s.id, stateCounters{Day: "2021-06-21", On: true, Count: 3, Duration: time.Hour})
+
+	s = newStateStats("BOILER/FLAME/STATS")
+	load(s.id, &s.counters)
+
+	now := time.Date(2021, 6, 21, 12, 0, 0, 0, time.UTC)
+	s.last = now
+
+	// already ON before the restart, not a new start
+	s.update(now, item.ON)
+	if s.counters.Count != 3 || s.counters.Duration != time.Hour {
+		t.Fatalf("counters not restored: %+v", s.counters)
+	}
+}
@@ -0,0 +1,356 @@
+/*
+ * Copyright (C) 2021 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package sun
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+type Event int
+
+const (
+	NauticalDawn Event = iota
+	CivilDawn
+	Sunrise
+	Sunset
+	CivilDusk
+	NauticalDusk
+)
+
+const timeLayout = "15:04"
+
+// zenith angles of the events, sunrise/sunset take the refraction and the
+// sun radius into account.
+var eventZeniths = map[Event]float64{
+	NauticalDawn: 102,
+	CivilDawn:    96,
+	Sunrise:      90.833,
+	Sunset:       90.833,
+	CivilDusk:    96,
+	NauticalDusk: 102,
+}
+
+func (e Event) String() string {
+	switch e {
+	case NauticalDawn:
+		return "Nautical dawn"
+	case CivilDawn:
+		return "Civil dawn"
+	case Sunrise:
+		return "Sunrise"
+	case Sunset:
+		return "Sunset"
+	case CivilDusk:
+		return "Civil dusk"
+	case NauticalDusk:
+		return "Nautical dusk"
+	}
+	return "Unknown"
+}
+
+func (e Event) isMorning() bool {
+	return e == NauticalDawn || e == CivilDawn || e == Sunrise
+}
+
+type Sun struct {
+	NauticalDawnItem *item.AnItem
+	CivilDawnItem    *item.AnItem
+	SunriseItem      *item.AnItem
+	SunsetItem       *item.AnItem
+	CivilDuskItem    *item.AnItem
+	NauticalDuskItem *item.AnItem
+	ElevationItem    *item.AnItem
+	AzimuthItem      *item.AnItem
+	DaylightItem     *item.AnItem
+
+	lat float64
+	lon float64
+}
+
+type SunOpts struct {
+	Value  string
+	Offset time.Duration
+}
+
+func rad(d float64) float64 {
+	return d * math.Pi / 180
+}
+
+func deg(r float64) float64 {
+	return r * 180 / math.Pi
+}
+
+// solarParams returns the sun declination in radians and the equation of time
+// in minutes for the given time, following the NOAA solar calculator.
+func solarParams(t time.Time) (decl float64, eqTime float64) {
+	jd := float64(t.Unix())/86400 + 2440587.5
+	jc := (jd - 2451545) / 36525
+
+	l0 := math.Mod(280.46646+jc*(36000.76983+jc*0.0003032), 360)
+	m := 357.52911 + jc*(35999.05029-0.0001537*jc)
+	e := 0.016708634 - jc*(0.000042037+0.0000001267*jc)
+
+	c := math.Sin(rad(m))*(1.914602-jc*(0.004817+0.000014*jc)) +
+		math.Sin(rad(2*m))*(0.019993-0.000101*jc) +
+		math.Sin(rad(3*m))*0.000289
+
+	omega := 125.04 - 1934.136*jc
+	lambda := l0 + c - 0.00569 - 0.00478*math.Sin(rad(omega))
+
+	eps0 := 23 + (26+(21.448-jc*(46.815+jc*(0.00059-jc*0.001813)))/60)/60
+	eps := eps0 + 0.00256*math.Cos(rad(omega))
+
+	decl = math.Asin(math.Sin(rad(eps)) * math.Sin(rad(lambda)))
+
+	y := math.Pow(math.Tan(rad(eps/2)), 2)
+	eqTime = 4 * deg(y*math.Sin(2*rad(l0))-
+		2*e*math.Sin(rad(m))+
+		4*e*y*math.Sin(rad(m))*math.Cos(2*rad(l0))-
+		0.5*y*y*math.Sin(4*rad(l0))-
+		1.25*e*e*math.Sin(2*rad(m)))
+
+	return
+}
+
+// Position returns the elevation and the azimuth, in degrees, of the sun at
+// the given time and location. The azimuth is measured clockwise from the north.
+func Position(t time.Time, lat float64, lon float64) (elevation float64, azimuth float64) {
+	decl, eqTime := solarParams(t)
+
+	u := t.UTC()
+	minutes := float64(u.Hour()*60+u.Minute()) + float64(u.Second())/60
+
+	tst := math.Mod(minutes+eqTime+4*lon, 1440)
+	ha := rad(tst/4 - 180)
+
+	phi := rad(lat)
+	zenith := math.Acos(math.Sin(phi)*math.Sin(decl) + math.Cos(phi)*math.Cos(decl)*math.Cos(ha))
+	elevation = 90 - deg(zenith)
+
+	azimuth = math.Mod(deg(math.Atan2(math.Sin(ha), math.Cos(ha)*math.Sin(phi)-math.Tan(decl)*math.Cos(phi)))+180, 360)
+
+	return
+}
+
+// EventTime returns the time of the given event for the day of the given date
+// at the given location. It returns false if the event doesn't occur this day,
+// which is the case during polar days or nights.
+func EventTime(event Event, date time.Time, lat float64, lon float64) (time.Time, bool) {
+	y, m, d := date.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+
+	zenith := rad(eventZeniths[event])
+	phi := rad(lat)
+
+	// first approximation at noon then refine using the sun parameters at the
+	// time of the event
+	t := midnight.Add(12 * time.Hour)
+	for i := 0; i != 3; i++ {
+		decl, eqTime := solarParams(t)
+
+		cosHA := math.Cos(zenith)/(math.Cos(phi)*math.Cos(decl)) - math.Tan(phi)*math.Tan(decl)
+		if cosHA < -1 || cosHA > 1 {
+			return time.Time{}, false
+		}
+		ha := deg(math.Acos(cosHA))
+		if event.isMorning() {
+			ha = -ha
+		}
+
+		minutes := 720 - 4*(lon-ha) - eqTime
+		t = midnight.Add(time.Duration(minutes * float64(time.Minute)))
+	}
+
+	return t.In(date.Location()).Truncate(time.Second), true
+}
+
+func (s *Sun) eventItem(event Event) *item.AnItem {
+	switch event {
+	case NauticalDawn:
+		return s.NauticalDawnItem
+	case CivilDawn:
+		return s.CivilDawnItem
+	case Sunrise:
+		return s.SunriseItem
+	case Sunset:
+		return s.SunsetItem
+	case CivilDusk:
+		return s.CivilDuskItem
+	case NauticalDusk:
+		return s.NauticalDuskItem
+	}
+	return nil
+}
+
+// refreshFnc updates all the items and returns the time of the next event.
+func (s *Sun) refreshFnc() time.Time {
+	now := time.Now()
+
+	y, m, d := now.Date()
+	next := time.Date(y, m, d+1, 0, 0, 0, 0, now.Location())
+
+	for event := NauticalDawn; event <= NauticalDusk; event++ {
+		t, ok := EventTime(event, now, s.lat, s.lon)
+		if !ok {
+			s.eventItem(event).SetValue("")
+			continue
+		}
+		s.eventItem(event).SetValue(t.Format(timeLayout))
+
+		if t.After(now) && t.Before(next) {
+			next = t
+		}
+	}
+
+	elevation, azimuth := Position(now, s.lat, s.lon)
+	s.ElevationItem.SetValue(fmt.Sprintf("%.2f", elevation))
+	s.AzimuthItem.SetValue(fmt.Sprintf("%.2f", azimuth))
+
+	if elevation > 90-eventZeniths[Sunrise] {
+		s.DaylightItem.SetValue(item.ON)
+	} else {
+		s.DaylightItem.SetValue(item.OFF)
+	}
+
+	return next
+}
+
+func (s *Sun) refresh(refresh time.Duration) {
+	for {
+		next := s.refreshFnc()
+
+		in := time.Until(next)
+		if in > refresh {
+			in = refresh
+		}
+
+		// wake up slightly after the event so that the sun is really above
+		// or below the horizon
+		time.Sleep(in + time.Second)
+	}
+}
+
+// NewSunTrigger sets the given item when the given event occurs. By default the
+// item state will be set to ON. The state used as well as an offset relative to
+// the event, ex: -30 minutes before the sunset, can be set using the SunOpts parameter.
+func NewSunTrigger(s *Sun, event Event, it item.Item, opts ...SunOpts) {
+	var opt SunOpts
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	if opt.Value == "" {
+		opt.Value = item.ON
+	}
+
+	server.Log.Infof("New Sun trigger %s, offset %s for %s", event, opt.Offset, it.GetID())
+
+	go func() {
+		date := time.Now()
+		for {
+			t, ok := EventTime(event, date, s.lat, s.lon)
+			if ok {
+				t = t.Add(opt.Offset)
+			}
+
+			if !ok || !t.After(time.Now()) {
+				y, m, d := date.Date()
+				date = time.Date(y, m, d+1, 12, 0, 0, 0, date.Location())
+
+				if !ok {
+					time.Sleep(time.Until(time.Date(y, m, d+1, 0, 0, 0, 0, date.Location())))
+				}
+				continue
+			}
+
+			time.Sleep(time.Until(t))
+
+			server.Log.Infof("Sun %s set %s to %s", event, it.GetID(), opt.Value)
+			it.SetValue(opt.Value)
+		}
+	}()
+}
+
+// NewSun returns a Sun object providing the astronomical events for the given
+// latitude/longitude. Event times are computed offline and expressed in the
+// local timezone. The elevation and the azimuth of the sun are refreshed
+// according to the refresh parameter.
+func NewSun(id string, label string, lat float64, lon float64, refresh time.Duration) *Sun {
+	newTimeItem := func(name, label string) *item.AnItem {
+		return &item.AnItem{
+			ID:    fmt.Sprintf("%s/%s", id, name),
+			Label: label,
+			Type:  "value",
+			Img:   "clock",
+		}
+	}
+
+	s := &Sun{
+		lat:              lat,
+		lon:              lon,
+		NauticalDawnItem: newTimeItem("NAUTICAL_DAWN", "Nautical dawn"),
+		CivilDawnItem:    newTimeItem("CIVIL_DAWN", "Civil dawn"),
+		SunriseItem:      newTimeItem("SUNRISE", "Sunrise"),
+		SunsetItem:       newTimeItem("SUNSET", "Sunset"),
+		CivilDuskItem:    newTimeItem("CIVIL_DUSK", "Civil dusk"),
+		NauticalDuskItem: newTimeItem("NAUTICAL_DUSK", "Nautical dusk"),
+		ElevationItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/ELEVATION", id),
+			Label: "Elevation",
+			Type:  "value",
+			Img:   "chart",
+			Unit:  "°",
+		},
+		AzimuthItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/AZIMUTH", id),
+			Label: "Azimuth",
+			Type:  "value",
+			Img:   "chart",
+			Unit:  "°",
+		},
+		DaylightItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/DAYLIGHT", id),
+			Label: label,
+			Type:  "state",
+			Img:   "light",
+		},
+	}
+
+	server.Registry.Add(s.NauticalDawnItem)
+	server.Registry.Add(s.CivilDawnItem)
+	server.Registry.Add(s.SunriseItem)
+	server.Registry.Add(s.SunsetItem)
+	server.Registry.Add(s.CivilDuskItem)
+	server.Registry.Add(s.NauticalDuskItem)
+	server.Registry.Add(s.ElevationItem)
+	server.Registry.Add(s.AzimuthItem)
+	server.Registry.Add(s.DaylightItem)
+
+	go s.refresh(refresh)
+
+	return s
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright (C) 2021 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package sun
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+const (
+	parisLat = 48.8566
+	parisLon = 2.3522
+)
+
+func checkTime(t *testing.T, event Event, got time.Time, expected time.Time) {
+	if diff := got.Sub(expected); diff > 2*time.Minute || diff < -2*time.Minute {
+		t.Fatalf("%s: got %s expected %s", event, got, expected)
+	}
+}
+
+func TestEventTime(t *testing.T) {
+	loc := time.FixedZone("CEST", 2*3600)
+	date := time.Date(2021, 6, 21, 12, 0, 0, 0, loc)
+
+	sunrise, ok := EventTime(Sunrise, date, parisLat, parisLon)
+	if !ok {
+		t.Fatal("sunrise expected")
+	}
+	checkTime(t, Sunrise, sunrise, time.Date(2021, 6, 21, 5, 47, 0, 0, loc))
+
+	sunset, ok := EventTime(Sunset, date, parisLat, parisLon)
+	if !ok {
+		t.Fatal("sunset expected")
+	}
+	checkTime(t, Sunset, sunset, time.Date(2021, 6, 21, 21, 58, 0, 0, loc))
+
+	dawn, _ := EventTime(CivilDawn, date, parisLat, parisLon)
+	dusk, _ := EventTime(CivilDusk, date, parisLat, parisLon)
+	if !dawn.Before(sunrise) || !dusk.After(sunset) {
+		t.Fatalf("wrong civil twilight: %s, %s", dawn, dusk)
+	}
+}
+
+func TestEventTimePolar(t *testing.T) {
+	date := time.Date(2021, 6, 21, 12, 0, 0, 0, time.UTC)
+
+	if _, ok := EventTime(Sunset, date, 69.6496, 18.9560); ok {
+		t.Fatal("no sunset expected during polar day")
+	}
+
+	date = time.Date(2021, 12, 21, 12, 0, 0, 0, time.UTC)
+	if _, ok := EventTime(Sunrise, date, 69.6496, 18.9560); ok {
+		t.Fatal("no sunrise expected during polar night")
+	}
+}
+
+func TestPosition(t *testing.T) {
+	// solar noon in Paris
+	date := time.Date(2021, 6, 21, 11, 52, 0, 0, time.UTC)
+
+	elevation, azimuth := Position(date, parisLat, parisLon)
+	if math.Abs(elevation-64.6) > 0.5 {
+		t.Fatalf("wrong elevation: %f", elevation)
+	}
+	if math.Abs(azimuth-180) > 2 {
+		t.Fatalf("wrong azimuth: %f", azimuth)
+	}
+
+	// evening
+	date = time.Date(2021, 6, 21, 18, 0, 0, 0, time.UTC)
+
+	elevation, azimuth = Position(date, parisLat, parisLon)
+	if elevation < 0 || elevation > 20 {
+		t.Fatalf("wrong elevation: %f", elevation)
+	}
+	if azimuth < 270 || azimuth > 310 {
+		t.Fatalf("wrong azimuth: %f", azimuth)
+	}
+}
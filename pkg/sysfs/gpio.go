@@ -0,0 +1,253 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package sysfs
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/safchain/hasc/pkg/button"
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+// ErrNotSupported is returned when the GPIO character device is not
+// available on the platform.
+var ErrNotSupported = errors.New("GPIO character device not supported")
+
+type GPIOOpts struct {
+	// Chip character device. Default to /dev/gpiochip0.
+	Chip string
+	// ActiveLow inverts the value of the line.
+	ActiveLow bool
+	// Bias of an input line, pull-up, pull-down or disable. Default to the
+	// kernel default.
+	Bias string
+	// Interval between two readings of an input. Edge events are used
+	// when not set.
+	Interval time.Duration
+}
+
+// gpioLine is a line requested to a GPIO chip.
+type gpioLine interface {
+	Value() (bool, error)
+	SetValue(value bool) error
+	// Wait blocks until an edge event occurs on an input line.
+	Wait() error
+	Close() error
+}
+
+// GPIO maps a GPIO line to a state item, an input, or to a switch item, an
+// output.
+type GPIO struct {
+	sync.RWMutex
+	Item item.Item
+
+	line     gpioLine
+	opts     GPIOOpts
+	reported string
+	closed   bool
+}
+
+func boolValue(value bool) string {
+	if value {
+		return item.ON
+	}
+	return item.OFF
+}
+
+// Refresh reads the line and updates the item.
+func (g *GPIO) Refresh() error {
+	value, err := g.line.Value()
+	if err != nil {
+		return err
+	}
+
+	v := boolValue(value)
+
+	g.Lock()
+	g.reported = v
+	g.Unlock()
+
+	g.Item.SetValue(v)
+
+	return nil
+}
+
+func (g *GPIO) isClosed() bool {
+	g.RLock()
+	defer g.RUnlock()
+	return g.closed
+}
+
+func (g *GPIO) poll() {
+	ticker := time.NewTicker(g.opts.Interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if g.isClosed() {
+			return
+		}
+		if err := g.Refresh(); err != nil {
+			server.Log.Errorf("GPIO %s read error: %s", g.Item.GetID(), err)
+		}
+	}
+}
+
+func (g *GPIO) watch() {
+	for {
+		if err := g.line.Wait(); err != nil {
+			if g.isClosed() {
+				return
+			}
+			server.Log.Errorf("GPIO %s event error: %s", g.Item.GetID(), err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		if err := g.Refresh(); err != nil {
+			server.Log.Errorf("GPIO %s read error: %s", g.Item.GetID(), err)
+		}
+	}
+}
+
+// Close releases the line.
+func (g *GPIO) Close() error {
+	g.Lock()
+	g.closed = true
+	g.Unlock()
+
+	return g.line.Close()
+}
+
+func gpioOpts(opts ...GPIOOpts) GPIOOpts {
+	var o GPIOOpts
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if o.Chip == "" {
+		o.Chip = "/dev/gpiochip0"
+	}
+	return o
+}
+
+func newGPIOInput(id, label string, line gpioLine, opts GPIOOpts) *GPIO {
+	g := &GPIO{
+		Item: &item.AnItem{
+			ID:    id,
+			Label: label,
+			Type:  "state",
+			Img:   "switch",
+		},
+		line: line,
+		opts: opts,
+	}
+
+	if err := g.Refresh(); err != nil {
+		server.Log.Errorf("GPIO %s read error: %s", id, err)
+	}
+
+	if g.opts.Interval > 0 {
+		go g.poll()
+	} else {
+		go g.watch()
+	}
+
+	return g
+}
+
+func newGPIOOutput(id, label string, line gpioLine, opts GPIOOpts) *GPIO {
+	g := &GPIO{
+		Item: &button.SwitchItem{
+			AnItem: item.AnItem{
+				ID:    id,
+				Label: label,
+				Type:  "switch",
+				Img:   "switch",
+			},
+		},
+		line: line,
+		opts: opts,
+	}
+
+	if err := g.Refresh(); err != nil {
+		server.Log.Errorf("GPIO %s read error: %s", id, err)
+	}
+
+	g.Item.AddListener(&item.CallbackListener{
+		CbFnc: func(it item.Item, old string, new string) {
+			g.RLock()
+			reported := g.reported
+			g.RUnlock()
+
+			// value read from the line, nothing to write
+			if new == reported {
+				return
+			}
+
+			if err := g.line.SetValue(new == item.ON); err != nil {
+				server.Log.Errorf("GPIO %s write error: %s", id, err)
+				return
+			}
+
+			g.Lock()
+			g.reported = new
+			g.Unlock()
+		},
+	})
+
+	return g
+}
+
+// NewGPIOInput returns a state item following the value of the given line
+// of a GPIO chip, either on edge events or polling when an interval is set.
+func NewGPIOInput(id, label string, offset int, opts ...GPIOOpts) (*GPIO, error) {
+	o := gpioOpts(opts...)
+
+	line, err := openInputLine(o, offset)
+	if err != nil {
+		return nil, fmt.Errorf("unable to request GPIO line %d of %s: %s", offset, o.Chip, err)
+	}
+
+	g := newGPIOInput(id, label, line, o)
+	server.Registry.Add(g.Item)
+
+	return g, nil
+}
+
+// NewGPIOOutput returns a switch item driving the given line of a GPIO chip.
+func NewGPIOOutput(id, label string, offset int, opts ...GPIOOpts) (*GPIO, error) {
+	o := gpioOpts(opts...)
+
+	line, err := openOutputLine(o, offset)
+	if err != nil {
+		return nil, fmt.Errorf("unable to request GPIO line %d of %s: %s", offset, o.Chip, err)
+	}
+
+	g := newGPIOOutput(id, label, line, o)
+	server.Registry.Add(g.Item)
+
+	return g, nil
+}
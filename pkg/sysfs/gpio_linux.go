@@ -0,0 +1,220 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package sysfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// GPIO character device v1 ABI, see linux/gpio.h
+const (
+	gpioGetLineHandleIoctl = 0xc16cb403
+	gpioGetLineEventIoctl  = 0xc030b404
+	gpioGetLineValuesIoctl = 0xc040b408
+	gpioSetLineValuesIoctl = 0xc040b409
+
+	gpioHandleRequestInput       = 1 << 0
+	gpioHandleRequestOutput      = 1 << 1
+	gpioHandleRequestActiveLow   = 1 << 2
+	gpioHandleRequestPullUp      = 1 << 5
+	gpioHandleRequestPullDown    = 1 << 6
+	gpioHandleRequestBiasDisable = 1 << 7
+
+	gpioEventRequestBothEdges = 0x3
+
+	gpioEventDataSize = 16
+	gpioConsumer      = "hasc"
+)
+
+type gpioHandleRequest struct {
+	LineOffsets   [64]uint32
+	Flags         uint32
+	DefaultValues [64]uint8
+	ConsumerLabel [32]byte
+	Lines         uint32
+	Fd            int32
+}
+
+type gpioEventRequest struct {
+	LineOffset    uint32
+	HandleFlags   uint32
+	EventFlags    uint32
+	ConsumerLabel [32]byte
+	Fd            int32
+}
+
+type gpioHandleData struct {
+	Values [64]uint8
+}
+
+// chardevLine is a line requested through the GPIO character device, the
+// input lines being requested as event lines to get the edges.
+type chardevLine struct {
+	file *os.File
+}
+
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func handleFlags(opts GPIOOpts) (uint32, error) {
+	var flags uint32
+	if opts.ActiveLow {
+		flags |= gpioHandleRequestActiveLow
+	}
+
+	switch strings.ToLower(opts.Bias) {
+	case "":
+	case "pull-up":
+		flags |= gpioHandleRequestPullUp
+	case "pull-down":
+		flags |= gpioHandleRequestPullDown
+	case "disable":
+		flags |= gpioHandleRequestBiasDisable
+	default:
+		return 0, fmt.Errorf("unknown GPIO bias: %s", opts.Bias)
+	}
+
+	return flags, nil
+}
+
+func (c *chardevLine) control(req uintptr, arg unsafe.Pointer) error {
+	conn, err := c.file.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var ierr error
+	if err := conn.Control(func(fd uintptr) {
+		ierr = ioctl(fd, req, arg)
+	}); err != nil {
+		return err
+	}
+	return ierr
+}
+
+func (c *chardevLine) Value() (bool, error) {
+	var data gpioHandleData
+	if err := c.control(gpioGetLineValuesIoctl, unsafe.Pointer(&data)); err != nil {
+		return false, err
+	}
+	return data.Values[0] != 0, nil
+}
+
+func (c *chardevLine) SetValue(value bool) error {
+	var data gpioHandleData
+	if value {
+		data.Values[0] = 1
+	}
+	return c.control(gpioSetLineValuesIoctl, unsafe.Pointer(&data))
+}
+
+func (c *chardevLine) Wait() error {
+	// only the occurrence of the event matters, the value being read afterward
+	var event [gpioEventDataSize]byte
+	if _, err := io.ReadFull(c.file, event[:]); err != nil {
+		return err
+	}
+
+	if id := binary.LittleEndian.Uint32(event[8:]); id == 0 {
+		return fmt.Errorf("unexpected GPIO event: %v", event)
+	}
+	return nil
+}
+
+func (c *chardevLine) Close() error {
+	return c.file.Close()
+}
+
+// newChardevLine returns a line from the file descriptor returned by the
+// chip, set as non blocking so that a pending read is released on close.
+func newChardevLine(fd int32, name string) (*chardevLine, error) {
+	if err := syscall.SetNonblock(int(fd), true); err != nil {
+		unix.Close(int(fd))
+		return nil, err
+	}
+	return &chardevLine{file: os.NewFile(uintptr(fd), name)}, nil
+}
+
+func openInputLine(opts GPIOOpts, offset int) (gpioLine, error) {
+	flags, err := handleFlags(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	chip, err := os.OpenFile(opts.Chip, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer chip.Close()
+
+	req := gpioEventRequest{
+		LineOffset:  uint32(offset),
+		HandleFlags: flags | gpioHandleRequestInput,
+		EventFlags:  gpioEventRequestBothEdges,
+	}
+	copy(req.ConsumerLabel[:], gpioConsumer)
+
+	if err := ioctl(chip.Fd(), gpioGetLineEventIoctl, unsafe.Pointer(&req)); err != nil {
+		return nil, err
+	}
+
+	return newChardevLine(req.Fd, fmt.Sprintf("%s:%d", opts.Chip, offset))
+}
+
+func openOutputLine(opts GPIOOpts, offset int) (gpioLine, error) {
+	flags, err := handleFlags(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	chip, err := os.OpenFile(opts.Chip, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer chip.Close()
+
+	req := gpioHandleRequest{
+		Flags: flags | gpioHandleRequestOutput,
+		Lines: 1,
+	}
+	req.LineOffsets[0] = uint32(offset)
+	copy(req.ConsumerLabel[:], gpioConsumer)
+
+	if err := ioctl(chip.Fd(), gpioGetLineHandleIoctl, unsafe.Pointer(&req)); err != nil {
+		return nil, err
+	}
+
+	return newChardevLine(req.Fd, fmt.Sprintf("%s:%d", opts.Chip, offset))
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package sysfs
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/registry"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+type fakeLine struct {
+	sync.Mutex
+	value  bool
+	writes []bool
+	events chan struct{}
+	closed chan struct{}
+}
+
+func newFakeLine(value bool) *fakeLine {
+	return &fakeLine{
+		value:  value,
+		events: make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+}
+
+func (f *fakeLine) Value() (bool, error) {
+	f.Lock()
+	defer f.Unlock()
+	return f.value, nil
+}
+
+func (f *fakeLine) SetValue(value bool) error {
+	f.Lock()
+	defer f.Unlock()
+	f.value = value
+	f.writes = append(f.writes, value)
+	return nil
+}
+
+func (f *fakeLine) Wait() error {
+	select {
+	case <-f.events:
+		return nil
+	case <-f.closed:
+		return errors.New("closed")
+	}
+}
+
+func (f *fakeLine) Close() error {
+	close(f.closed)
+	return nil
+}
+
+// edge changes the value of the line and raises an event.
+func (f *fakeLine) edge(value bool) {
+	f.Lock()
+	f.value = value
+	f.Unlock()
+
+	f.events <- struct{}{}
+}
+
+func waitValue(t *testing.T, it item.Item, expected string) {
+	for i := 0; i < 100; i++ {
+		if it.GetValue() == expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s expected %s, got: %s", it.GetID(), expected, it.GetValue())
+}
+
+func TestGPIOInputEdge(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	line := newFakeLine(false)
+	g := newGPIOInput("GPIO/DOOR", "Door", line, gpioOpts())
+	defer g.Close()
+
+	if g.Item.GetType() != "state" {
+		t.Errorf("expected a state item, got: %s", g.Item.GetType())
+	}
+	waitValue(t, g.Item, item.OFF)
+
+	line.edge(true)
+	waitValue(t, g.Item, item.ON)
+
+	line.edge(false)
+	waitValue(t, g.Item, item.OFF)
+}
+
+func TestGPIOInputPolling(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	line := newFakeLine(true)
+	g := newGPIOInput("GPIO/PIR", "PIR", line, gpioOpts(GPIOOpts{Interval: 10 * time.Millisecond}))
+	defer g.Close()
+
+	waitValue(t, g.Item, item.ON)
+
+	// no event, the value is polled
+	line.Lock()
+	line.value = false
+	line.Unlock()
+
+	waitValue(t, g.Item, item.OFF)
+}
+
+func TestGPIOOutput(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	line := newFakeLine(false)
+	g := newGPIOOutput("GPIO/RELAY", "Relay", line, gpioOpts())
+	defer g.Close()
+
+	if g.Item.GetType() != "switch" || g.Item.GetValue() != item.OFF {
+		t.Fatalf("wrong output item: %s %s", g.Item.GetType(), g.Item.GetValue())
+	}
+
+	g.Item.SetValue("on")
+	g.Item.SetValue("off")
+
+	line.Lock()
+	writes := line.writes
+	line.Unlock()
+
+	if len(writes) != 2 || !writes[0] || writes[1] {
+		t.Errorf("wrong writes: %v", writes)
+	}
+
+	// the refresh of the value read from the line doesn't write it back
+	g.Refresh()
+
+	line.Lock()
+	writes = line.writes
+	line.Unlock()
+
+	if len(writes) != 2 {
+		t.Errorf("unexpected write back: %v", writes)
+	}
+}
@@ -0,0 +1,286 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+// Package sysfs exposes the sensors and the GPIOs of the Linux kernel,
+// 1-Wire and hwmon sensors through sysfs, GPIOs through the character device.
+package sysfs
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/safchain/hasc/pkg/item"
+	"github.com/safchain/hasc/pkg/server"
+	"github.com/safchain/hasc/pkg/transform"
+)
+
+// powerOnReset is the temperature reported by a DS18B20 before its first
+// conversion, usually following a power glitch.
+const powerOnReset = 85000
+
+var (
+	// ErrCRC is returned when the CRC of a 1-Wire reading is wrong.
+	ErrCRC = errors.New("1-Wire CRC error")
+	// ErrPowerOnReset is returned when a 1-Wire sensor reports its power on
+	// reset value.
+	ErrPowerOnReset = errors.New("1-Wire power on reset value")
+)
+
+type SensorOpts struct {
+	// Root of sysfs. Default to /sys.
+	Root string
+	// Interval between two readings. Default to 1 minute.
+	Interval time.Duration
+}
+
+// Sensor periodically reads a value into an item. The readings go through
+// the transforms configured for the item ID, see the transform package.
+type Sensor struct {
+	Item *item.AnItem
+
+	read      func() (float64, error)
+	transform transform.Pipeline
+	opts      SensorOpts
+}
+
+// hwmonScales per sensor type, the values being in milli units, except the
+// fans in RPM and the power in micro watts.
+var hwmonScales = map[string]struct {
+	scale float64
+	unit  string
+	img   string
+}{
+	"temp":     {1000, "°", "temperature"},
+	"in":       {1000, "V", "electricity"},
+	"curr":     {1000, "A", "electricity"},
+	"power":    {1000000, "W", "electricity"},
+	"energy":   {1000000, "J", "electricity"},
+	"humidity": {1000, "%", "humidity"},
+	"fan":      {1, "RPM", "chart"},
+}
+
+func readFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// readOneWire returns the temperature of a 1-Wire sensor from its w1_slave
+// file, ex:
+// 72 01 4b 46 7f ff 0e 10 57 : crc=57 YES
+// 72 01 4b 46 7f ff 0e 10 57 t=23125
+func readOneWire(dir string) (float64, error) {
+	data, err := readFile(filepath.Join(dir, "w1_slave"))
+	if err != nil {
+		return 0, err
+	}
+
+	lines := strings.Split(data, "\n")
+	if len(lines) < 2 {
+		return 0, fmt.Errorf("wrong 1-Wire reading: %s", data)
+	}
+	if !strings.HasSuffix(strings.TrimSpace(lines[0]), "YES") {
+		return 0, ErrCRC
+	}
+
+	i := strings.LastIndex(lines[1], "t=")
+	if i < 0 {
+		return 0, fmt.Errorf("wrong 1-Wire reading: %s", data)
+	}
+	milli, err := strconv.Atoi(strings.TrimSpace(lines[1][i+2:]))
+	if err != nil {
+		return 0, err
+	}
+	if milli == powerOnReset {
+		return 0, ErrPowerOnReset
+	}
+
+	return float64(milli) / 1000, nil
+}
+
+// hwmonDir returns the directory of the hwmon chip of the given name, the
+// numbering of the chips not being stable across reboots.
+func hwmonDir(root, chip string) (string, error) {
+	dirs, err := filepath.Glob(filepath.Join(root, "class", "hwmon", "hwmon*"))
+	if err != nil {
+		return "", err
+	}
+
+	for _, dir := range dirs {
+		if name, err := readFile(filepath.Join(dir, "name")); err == nil && name == chip {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("hwmon chip not found: %s", chip)
+}
+
+// hwmonType returns the type of a sensor, ex: temp for temp1.
+func hwmonType(sensor string) string {
+	return strings.TrimRight(sensor, "0123456789")
+}
+
+func readHwmon(root, chip, sensor string) (float64, error) {
+	dir, err := hwmonDir(root, chip)
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := readFile(filepath.Join(dir, sensor+"_input"))
+	if err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseFloat(data, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	if s, ok := hwmonScales[hwmonType(sensor)]; ok {
+		value /= s.scale
+	}
+	return value, nil
+}
+
+// OneWireDevices returns the IDs of the 1-Wire temperature sensors, DS18S20,
+// DS1822, DS18B20, etc.
+func OneWireDevices(opts ...SensorOpts) ([]string, error) {
+	root := "/sys"
+	if len(opts) > 0 && opts[0].Root != "" {
+		root = opts[0].Root
+	}
+
+	var devices []string
+	for _, family := range []string{"10", "22", "28", "3b", "42"} {
+		dirs, err := filepath.Glob(filepath.Join(root, "bus", "w1", "devices", family+"-*"))
+		if err != nil {
+			return nil, err
+		}
+		for _, dir := range dirs {
+			devices = append(devices, filepath.Base(dir))
+		}
+	}
+	sort.Strings(devices)
+
+	return devices, nil
+}
+
+// Refresh reads the sensor and updates the item.
+func (s *Sensor) Refresh() error {
+	value, err := s.read()
+	if err != nil {
+		server.Log.Errorf("Sensor %s read error: %s", s.Item.ID, err)
+		return err
+	}
+
+	if value, ok := s.transform.Apply(value, time.Now()); ok {
+		s.Item.SetValue(strconv.FormatFloat(value, 'f', -1, 64))
+	}
+	return nil
+}
+
+func (s *Sensor) refresh() {
+	ticker := time.NewTicker(s.opts.Interval)
+	for range ticker.C {
+		s.Refresh()
+	}
+}
+
+func newSensor(id, label, unit, img string, read func() (float64, error), opts ...SensorOpts) *Sensor {
+	s := &Sensor{
+		Item: &item.AnItem{
+			ID:    id,
+			Label: label,
+			Type:  "value",
+			Img:   img,
+			Unit:  unit,
+		},
+		read:      read,
+		transform: transform.ForItem(id, ""),
+	}
+	if len(opts) > 0 {
+		s.opts = opts[0]
+	}
+	if s.opts.Root == "" {
+		s.opts.Root = "/sys"
+	}
+	if s.opts.Interval == 0 {
+		s.opts.Interval = time.Minute
+	}
+
+	return s
+}
+
+func startSensor(s *Sensor) *Sensor {
+	server.Registry.Add(s.Item)
+
+	go func() {
+		s.Refresh()
+		s.refresh()
+	}()
+
+	return s
+}
+
+func newOneWireSensor(id, label, device string, opts ...SensorOpts) *Sensor {
+	s := newSensor(id, label, "°", "temperature", nil, opts...)
+
+	dir := filepath.Join(s.opts.Root, "bus", "w1", "devices", device)
+	s.read = func() (float64, error) {
+		return readOneWire(dir)
+	}
+
+	return s
+}
+
+func newHwmonSensor(id, label, chip, sensor string, opts ...SensorOpts) *Sensor {
+	unit, img := "", "chart"
+	if s, ok := hwmonScales[hwmonType(sensor)]; ok {
+		unit, img = s.unit, s.img
+	}
+
+	s := newSensor(id, label, unit, img, nil, opts...)
+	s.read = func() (float64, error) {
+		return readHwmon(s.opts.Root, chip, sensor)
+	}
+
+	return s
+}
+
+// NewOneWireSensor returns a sensor reading the temperature of the given
+// 1-Wire device, ex: 28-0316a2795eff. The device may not be present yet.
+func NewOneWireSensor(id, label, device string, opts ...SensorOpts) *Sensor {
+	return startSensor(newOneWireSensor(id, label, device, opts...))
+}
+
+// NewHwmonSensor returns a sensor reading a hwmon sensor of the given chip,
+// ex: coretemp and temp1, the value being converted from the sysfs units,
+// millidegrees, millivolts, etc.
+func NewHwmonSensor(id, label, chip, sensor string, opts ...SensorOpts) *Sensor {
+	return startSensor(newHwmonSensor(id, label, chip, sensor, opts...))
+}
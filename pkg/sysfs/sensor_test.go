@@ -0,0 +1,145 @@
+/*
+ * Copyright (C) 2020 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package sysfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/safchain/hasc/pkg/registry"
+	"github.com/safchain/hasc/pkg/server"
+)
+
+func writeFile(t *testing.T, root, path, data string) {
+	path = filepath.Join(root, path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fakeSysfs(t *testing.T) string {
+	root, err := ioutil.TempDir("", "sysfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, root, "bus/w1/devices/28-0316a2795eff/w1_slave",
+		"72 01 4b 46 7f ff 0e 10 57 : crc=57 YES\n72 01 4b 46 7f ff 0e 10 57 t=23125\n")
+	writeFile(t, root, "bus/w1/devices/28-0000075b1d2a/w1_slave",
+		"72 01 4b 46 7f ff 0e 10 57 : crc=ff NO\n72 01 4b 46 7f ff 0e 10 57 t=23125\n")
+	writeFile(t, root, "bus/w1/devices/28-0000075b9c11/w1_slave",
+		"50 05 4b 46 7f ff 0c 10 1c : crc=1c YES\n50 05 4b 46 7f ff 0c 10 1c t=85000\n")
+	writeFile(t, root, "bus/w1/devices/w1_bus_master1/w1_master_slaves", "")
+
+	writeFile(t, root, "class/hwmon/hwmon0/name", "acpitz\n")
+	writeFile(t, root, "class/hwmon/hwmon0/temp1_input", "27800\n")
+	writeFile(t, root, "class/hwmon/hwmon1/name", "coretemp\n")
+	writeFile(t, root, "class/hwmon/hwmon1/temp1_input", "45000\n")
+	writeFile(t, root, "class/hwmon/hwmon1/in0_input", "1224\n")
+	writeFile(t, root, "class/hwmon/hwmon1/fan1_input", "1350\n")
+
+	return root
+}
+
+func TestOneWireSensor(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	root := fakeSysfs(t)
+	defer os.RemoveAll(root)
+
+	devices, err := OneWireDevices(SensorOpts{Root: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"28-0000075b1d2a", "28-0000075b9c11", "28-0316a2795eff"}
+	if !reflect.DeepEqual(devices, expected) {
+		t.Fatalf("expected devices %v, got: %v", expected, devices)
+	}
+
+	s := newOneWireSensor("W1/LIVING", "Living", "28-0316a2795eff", SensorOpts{Root: root})
+	if err := s.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Item.GetValue() != "23.125" || s.Item.GetUnit() != "°" {
+		t.Errorf("wrong temperature: %s%s", s.Item.GetValue(), s.Item.GetUnit())
+	}
+
+	s = newOneWireSensor("W1/CRC", "CRC", "28-0000075b1d2a", SensorOpts{Root: root})
+	if err := s.Refresh(); err != ErrCRC {
+		t.Errorf("expected a CRC error, got: %v", err)
+	}
+
+	s = newOneWireSensor("W1/RESET", "Reset", "28-0000075b9c11", SensorOpts{Root: root})
+	if err := s.Refresh(); err != ErrPowerOnReset {
+		t.Errorf("expected a power on reset error, got: %v", err)
+	}
+	if s.Item.GetValue() != "" {
+		t.Errorf("power on reset value not ignored: %s", s.Item.GetValue())
+	}
+
+	s = newOneWireSensor("W1/MISSING", "Missing", "28-000000000000", SensorOpts{Root: root})
+	if err := s.Refresh(); err == nil {
+		t.Error("expected an error for a missing device")
+	}
+}
+
+func TestHwmonSensor(t *testing.T) {
+	server.Registry = registry.NewRegistry()
+
+	root := fakeSysfs(t)
+	defer os.RemoveAll(root)
+
+	tests := []struct {
+		chip   string
+		sensor string
+		value  string
+		unit   string
+	}{
+		{"acpitz", "temp1", "27.8", "°"},
+		{"coretemp", "temp1", "45", "°"},
+		{"coretemp", "in0", "1.224", "V"},
+		{"coretemp", "fan1", "1350", "RPM"},
+	}
+
+	for _, test := range tests {
+		s := newHwmonSensor("HWMON/"+test.chip, test.chip, test.chip, test.sensor, SensorOpts{Root: root})
+		if err := s.Refresh(); err != nil {
+			t.Fatal(err)
+		}
+		if s.Item.GetValue() != test.value || s.Item.GetUnit() != test.unit {
+			t.Errorf("%s/%s expected %s%s, got: %s%s", test.chip, test.sensor,
+				test.value, test.unit, s.Item.GetValue(), s.Item.GetUnit())
+		}
+	}
+
+	s := newHwmonSensor("HWMON/NCT", "NCT", "nct6775", "temp1", SensorOpts{Root: root})
+	if err := s.Refresh(); err == nil {
+		t.Error("expected an error for a missing chip")
+	}
+}
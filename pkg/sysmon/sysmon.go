@@ -25,21 +25,59 @@ package sysmon
 import (
 	"fmt"
 	"math"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/safchain/hasc/pkg/item"
 	"github.com/safchain/hasc/pkg/server"
+	"github.com/shirou/gopsutil/cpu"
+	"github.com/shirou/gopsutil/disk"
 	"github.com/shirou/gopsutil/host"
 	"github.com/shirou/gopsutil/load"
 	"github.com/shirou/gopsutil/mem"
+	"github.com/shirou/gopsutil/net"
+	"github.com/shirou/gopsutil/process"
 )
 
+type SysMonOpts struct {
+	// Mounts for which the disk usage is reported. Default to /.
+	Mounts []string
+	// Interfaces for which the throughput is reported. Default to all the
+	// interfaces but the loopback.
+	Interfaces []string
+	// TempSensor is the key of the temperature sensor, ex: cpu_thermal_input.
+	// Default to the first CPU sensor found.
+	TempSensor string
+}
+
+type netCounters struct {
+	rx, tx uint64
+	time   time.Time
+}
+
 type SysMon struct {
 	MemPercentItem *item.AnItem
 	CPUAvg1Item    *item.AnItem
 	CPUAvg5Item    *item.AnItem
 	CPUAvg15Item   *item.AnItem
 	UptimeItem     *item.AnItem
+	CPUPercentItem *item.AnItem
+	TempItem       *item.AnItem
+	RSSItem        *item.AnItem
+	GoroutinesItem *item.AnItem
+	// DiskItems per mount point
+	DiskItems map[string]*item.AnItem
+	// NetRxItems and NetTxItems per interface
+	NetRxItems map[string]*item.AnItem
+	NetTxItems map[string]*item.AnItem
+
+	lock     sync.Mutex
+	counters map[string]netCounters
+	opts     SysMonOpts
 }
 
 func secondsToHuman(input uint64) (result string) {
@@ -71,17 +109,61 @@ func secondsToHuman(input uint64) (result string) {
 	return
 }
 
-func (s *SysMon) refreshFnc() {
-	server.Log.Infof("SysMon refresh")
+// itemName returns a suffix usable in an item ID, ex: /mnt/data => MNT_DATA.
+func itemName(name string) string {
+	name = strings.Trim(name, "/")
+	if name == "" {
+		return "ROOT"
+	}
+	return strings.ToUpper(strings.NewReplacer("/", "_", "-", "_", ".", "_").Replace(name))
+}
+
+// pickTemperature returns the temperature of the given sensor or of the first
+// CPU sensor found.
+func pickTemperature(stats []host.TemperatureStat, sensor string) (float64, bool) {
+	if sensor != "" {
+		for _, stat := range stats {
+			if stat.SensorKey == sensor {
+				return stat.Temperature, true
+			}
+		}
+		return 0, false
+	}
 
+	for _, prefix := range []string{"cpu", "soc", "coretemp_package", "k10temp", "coretemp"} {
+		for _, stat := range stats {
+			if strings.HasPrefix(stat.SensorKey, prefix) && !strings.HasSuffix(stat.SensorKey, "_crit") &&
+				!strings.HasSuffix(stat.SensorKey, "_max") {
+				return stat.Temperature, true
+			}
+		}
+	}
+
+	if len(stats) > 0 {
+		return stats[0].Temperature, true
+	}
+	return 0, false
+}
+
+// rate returns the throughput in KB/s between two counter values.
+func rate(old, new uint64, elapsed time.Duration) (float64, bool) {
+	if new < old || elapsed <= 0 {
+		// counter reset
+		return 0, false
+	}
+	return float64(new-old) / 1024 / elapsed.Seconds(), true
+}
+
+func (s *SysMon) refreshMem() {
 	v, err := mem.VirtualMemory()
 	if err != nil {
 		server.Log.Errorf("SysMon memory refresh %s", err)
 		return
 	}
-
 	s.MemPercentItem.SetValue(fmt.Sprintf("%.2f", v.UsedPercent))
+}
 
+func (s *SysMon) refreshLoad() {
 	l, err := load.Avg()
 	if err != nil {
 		server.Log.Errorf("SysMon cpu avg refresh %s", err)
@@ -90,7 +172,9 @@ func (s *SysMon) refreshFnc() {
 	s.CPUAvg1Item.SetValue(fmt.Sprintf("%.2f", l.Load1))
 	s.CPUAvg5Item.SetValue(fmt.Sprintf("%.2f", l.Load5))
 	s.CPUAvg15Item.SetValue(fmt.Sprintf("%.2f", l.Load15))
+}
 
+func (s *SysMon) refreshUptime() {
 	u, err := host.Uptime()
 	if err != nil {
 		server.Log.Errorf("SysMon uptime refresh %s", err)
@@ -99,6 +183,102 @@ func (s *SysMon) refreshFnc() {
 	s.UptimeItem.SetValue(secondsToHuman(u))
 }
 
+func (s *SysMon) refreshCPU() {
+	// usage since the previous call
+	p, err := cpu.Percent(0, false)
+	if err != nil || len(p) == 0 {
+		server.Log.Errorf("SysMon cpu percent refresh %v", err)
+		return
+	}
+	s.CPUPercentItem.SetValue(fmt.Sprintf("%.2f", p[0]))
+}
+
+func (s *SysMon) refreshTemp() {
+	// partial results are returned along with warnings
+	stats, err := host.SensorsTemperatures()
+
+	t, ok := pickTemperature(stats, s.opts.TempSensor)
+	if !ok {
+		server.Log.Errorf("SysMon temperature refresh, no sensor found %v", err)
+		return
+	}
+	s.TempItem.SetValue(fmt.Sprintf("%.1f", t))
+}
+
+func (s *SysMon) refreshDisks() {
+	for mount, it := range s.DiskItems {
+		u, err := disk.Usage(mount)
+		if err != nil {
+			server.Log.Errorf("SysMon disk refresh %s: %s", mount, err)
+			continue
+		}
+		it.SetValue(fmt.Sprintf("%.2f", u.UsedPercent))
+	}
+}
+
+func (s *SysMon) refreshNet() {
+	stats, err := net.IOCounters(true)
+	if err != nil {
+		server.Log.Errorf("SysMon network refresh %s", err)
+		return
+	}
+	now := time.Now()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, stat := range stats {
+		rxItem, ok := s.NetRxItems[stat.Name]
+		if !ok {
+			continue
+		}
+		txItem := s.NetTxItems[stat.Name]
+
+		if last, ok := s.counters[stat.Name]; ok {
+			elapsed := now.Sub(last.time)
+			if rx, ok := rate(last.rx, stat.BytesRecv, elapsed); ok {
+				rxItem.SetValue(fmt.Sprintf("%.2f", rx))
+			}
+			if tx, ok := rate(last.tx, stat.BytesSent, elapsed); ok {
+				txItem.SetValue(fmt.Sprintf("%.2f", tx))
+			}
+		}
+		s.counters[stat.Name] = netCounters{rx: stat.BytesRecv, tx: stat.BytesSent, time: now}
+	}
+}
+
+func (s *SysMon) refreshProcess() {
+	s.GoroutinesItem.SetValue(fmt.Sprintf("%d", runtime.NumGoroutine()))
+
+	p, err := process.NewProcess(int32(os.Getpid()))
+	if err != nil {
+		server.Log.Errorf("SysMon process refresh %s", err)
+		return
+	}
+
+	m, err := p.MemoryInfo()
+	if err != nil {
+		server.Log.Errorf("SysMon process refresh %s", err)
+		return
+	}
+	s.RSSItem.SetValue(fmt.Sprintf("%.2f", float64(m.RSS)/1024/1024))
+}
+
+// refreshFnc refreshes all the metrics, a failing metric doesn't prevent the
+// others from being refreshed.
+func (s *SysMon) refreshFnc() {
+	server.Log.Infof("SysMon refresh")
+
+	s.refreshMem()
+	s.refreshLoad()
+	s.refreshUptime()
+	s.refreshCPU()
+	s.refreshTemp()
+	s.refreshDisks()
+	s.refreshNet()
+	s.refreshProcess()
+}
+
 func (s *SysMon) refresh(refresh time.Duration) {
 	s.refreshFnc()
 
@@ -108,7 +288,23 @@ func (s *SysMon) refresh(refresh time.Duration) {
 	}
 }
 
-func NewSysMon(id string, label string, refresh time.Duration) *SysMon {
+func (s *SysMon) items() []*item.AnItem {
+	items := []*item.AnItem{
+		s.MemPercentItem, s.CPUAvg1Item, s.CPUAvg5Item, s.CPUAvg15Item, s.UptimeItem,
+		s.CPUPercentItem, s.TempItem, s.RSSItem, s.GoroutinesItem,
+	}
+
+	for _, mount := range s.opts.Mounts {
+		items = append(items, s.DiskItems[mount])
+	}
+	for _, intf := range s.opts.Interfaces {
+		items = append(items, s.NetRxItems[intf], s.NetTxItems[intf])
+	}
+
+	return items
+}
+
+func NewSysMon(id string, label string, refresh time.Duration, opts ...SysMonOpts) *SysMon {
 	s := &SysMon{
 		MemPercentItem: &item.AnItem{
 			ID:    fmt.Sprintf("%s/MEM", id),
@@ -144,6 +340,81 @@ func NewSysMon(id string, label string, refresh time.Duration) *SysMon {
 			Type:  "value",
 			Img:   "clock",
 		},
+		CPUPercentItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/CPU", id),
+			Label: "CPU used",
+			Type:  "value",
+			Img:   "cpu",
+			Unit:  "%",
+		},
+		TempItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/TEMP", id),
+			Label: "CPU Temp.",
+			Type:  "value",
+			Img:   "temperature",
+			Unit:  "°C",
+		},
+		RSSItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/RSS", id),
+			Label: "Process mem.",
+			Type:  "value",
+			Img:   "mem",
+			Unit:  "MB",
+		},
+		GoroutinesItem: &item.AnItem{
+			ID:    fmt.Sprintf("%s/GOROUTINES", id),
+			Label: "Goroutines",
+			Type:  "value",
+			Img:   "cpu",
+		},
+		DiskItems:  make(map[string]*item.AnItem),
+		NetRxItems: make(map[string]*item.AnItem),
+		NetTxItems: make(map[string]*item.AnItem),
+		counters:   make(map[string]netCounters),
+	}
+	if len(opts) > 0 {
+		s.opts = opts[0]
+	}
+	if len(s.opts.Mounts) == 0 {
+		s.opts.Mounts = []string{"/"}
+	}
+	if len(s.opts.Interfaces) == 0 {
+		if stats, err := net.IOCounters(true); err == nil {
+			for _, stat := range stats {
+				if stat.Name != "lo" {
+					s.opts.Interfaces = append(s.opts.Interfaces, stat.Name)
+				}
+			}
+			sort.Strings(s.opts.Interfaces)
+		} else {
+			server.Log.Errorf("SysMon unable to list the network interfaces %s", err)
+		}
+	}
+
+	for _, mount := range s.opts.Mounts {
+		s.DiskItems[mount] = &item.AnItem{
+			ID:    fmt.Sprintf("%s/DISK_%s", id, itemName(mount)),
+			Label: fmt.Sprintf("Disk used %s", mount),
+			Type:  "value",
+			Img:   "disk",
+			Unit:  "%",
+		}
+	}
+	for _, intf := range s.opts.Interfaces {
+		s.NetRxItems[intf] = &item.AnItem{
+			ID:    fmt.Sprintf("%s/NET_%s_RX", id, itemName(intf)),
+			Label: fmt.Sprintf("%s RX", intf),
+			Type:  "value",
+			Img:   "netmon",
+			Unit:  "KB/s",
+		}
+		s.NetTxItems[intf] = &item.AnItem{
+			ID:    fmt.Sprintf("%s/NET_%s_TX", id, itemName(intf)),
+			Label: fmt.Sprintf("%s TX", intf),
+			Type:  "value",
+			Img:   "netmon",
+			Unit:  "KB/s",
+		}
 	}
 
 	// first init to retrieve all the items
@@ -151,11 +422,9 @@ func NewSysMon(id string, label string, refresh time.Duration) *SysMon {
 
 	go s.refresh(refresh)
 
-	server.Registry.Add(s.MemPercentItem)
-	server.Registry.Add(s.CPUAvg1Item)
-	server.Registry.Add(s.CPUAvg5Item)
-	server.Registry.Add(s.CPUAvg15Item)
-	server.Registry.Add(s.UptimeItem)
+	for _, it := range s.items() {
+		server.Registry.Add(it)
+	}
 
 	return s
 }
@@ -0,0 +1,78 @@
+/*
+ * Copyright (C) 2017 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package sysmon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shirou/gopsutil/host"
+)
+
+func TestItemName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"/":         "ROOT",
+		"/boot":     "BOOT",
+		"/mnt/data": "MNT_DATA",
+		"wlan0":     "WLAN0",
+		"br-lan.1":  "BR_LAN_1",
+	} {
+		if n := itemName(name); n != expected {
+			t.Fatalf("%s: expected %s, got %s", name, expected, n)
+		}
+	}
+}
+
+func TestPickTemperature(t *testing.T) {
+	stats := []host.TemperatureStat{
+		{SensorKey: "nvme_composite_input", Temperature: 35},
+		{SensorKey: "coretemp_core0_input", Temperature: 48},
+		{SensorKey: "coretemp_packageid0_crit", Temperature: 100},
+		{SensorKey: "coretemp_packageid0_input", Temperature: 50},
+	}
+
+	if temp, _ := pickTemperature(stats, ""); temp != 50 {
+		t.Fatalf("expected package temperature, got: %f", temp)
+	}
+	if temp, _ := pickTemperature(stats, "nvme_composite_input"); temp != 35 {
+		t.Fatalf("expected nvme temperature, got: %f", temp)
+	}
+	if _, ok := pickTemperature(stats, "unknown"); ok {
+		t.Fatal("unknown sensor shouldn't be found")
+	}
+
+	// raspbian thermal zone
+	stats = []host.TemperatureStat{{SensorKey: "cpu-thermal", Temperature: 52.5}}
+	if temp, _ := pickTemperature(stats, ""); temp != 52.5 {
+		t.Fatalf("expected cpu temperature, got: %f", temp)
+	}
+}
+
+func TestRate(t *testing.T) {
+	if r, ok := rate(1024, 11264, 2*time.Second); !ok || r != 5 {
+		t.Fatalf("expected 5KB/s, got: %f", r)
+	}
+	if _, ok := rate(11264, 1024, 2*time.Second); ok {
+		t.Fatal("counter reset should be ignored")
+	}
+}
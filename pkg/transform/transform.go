@@ -0,0 +1,368 @@
+/*
+ * Copyright (C) 2021 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package transform
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/safchain/hasc/pkg/server"
+)
+
+// Transform converts a device reading, false is returned when the reading
+// has to be dropped.
+type Transform interface {
+	Apply(value float64, t time.Time) (float64, bool)
+}
+
+// Pipeline applies transforms in sequence.
+type Pipeline []Transform
+
+// Linear returns value * Scale + Offset.
+type Linear struct {
+	Scale  float64
+	Offset float64
+}
+
+// Polynomial returns Coeffs[0] + Coeffs[1] * value + Coeffs[2] * value^2...
+type Polynomial struct {
+	Coeffs []float64
+}
+
+// Threshold replaces the readings below Below by Value.
+type Threshold struct {
+	Below float64
+	Value float64
+}
+
+// Deadband ignores the variations smaller than Width, the previous reading
+// is returned instead.
+type Deadband struct {
+	sync.Mutex
+	Width float64
+
+	last    float64
+	hasLast bool
+}
+
+// Clamp limits the readings to [Min, Max], or drops them if Drop is set.
+type Clamp struct {
+	Min  float64
+	Max  float64
+	Drop bool
+}
+
+// Rate returns the rate of change per Per. If Delta is set the readings are
+// already increments, ex: pulses since the previous reading. The first
+// reading is dropped.
+type Rate struct {
+	sync.Mutex
+	Per   time.Duration
+	Delta bool
+
+	last     float64
+	lastTime time.Time
+}
+
+// MovingAverage returns the average of the last Window readings.
+type MovingAverage struct {
+	sync.Mutex
+	Window int
+
+	values []float64
+}
+
+var stepRe = regexp.MustCompile(`^\s*([a-z]+)\s*\((.*)\)\s*$`)
+
+func (p Pipeline) Apply(value float64, t time.Time) (float64, bool) {
+	for _, tr := range p {
+		var ok bool
+		if value, ok = tr.Apply(value, t); !ok {
+			return 0, false
+		}
+	}
+	return value, true
+}
+
+func (l *Linear) Apply(value float64, t time.Time) (float64, bool) {
+	return value*l.Scale + l.Offset, true
+}
+
+func (p *Polynomial) Apply(value float64, t time.Time) (float64, bool) {
+	var result float64
+	for i := len(p.Coeffs) - 1; i >= 0; i-- {
+		result = result*value + p.Coeffs[i]
+	}
+	return result, true
+}
+
+func (th *Threshold) Apply(value float64, t time.Time) (float64, bool) {
+	if value < th.Below {
+		return th.Value, true
+	}
+	return value, true
+}
+
+func (d *Deadband) Apply(value float64, t time.Time) (float64, bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.hasLast && math.Abs(value-d.last) < d.Width {
+		return d.last, true
+	}
+	d.last, d.hasLast = value, true
+
+	return value, true
+}
+
+func (c *Clamp) Apply(value float64, t time.Time) (float64, bool) {
+	switch {
+	case value < c.Min:
+		return c.Min, !c.Drop
+	case value > c.Max:
+		return c.Max, !c.Drop
+	}
+	return value, true
+}
+
+func (r *Rate) Apply(value float64, t time.Time) (float64, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	last, lastTime := r.last, r.lastTime
+	r.last, r.lastTime = value, t
+
+	elapsed := t.Sub(lastTime)
+	if lastTime.IsZero() || elapsed <= 0 {
+		return 0, false
+	}
+
+	delta := value
+	if !r.Delta {
+		delta = value - last
+	}
+
+	return delta * float64(r.Per) / float64(elapsed), true
+}
+
+func (m *MovingAverage) Apply(value float64, t time.Time) (float64, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.values = append(m.values, value)
+	if len(m.values) > m.Window {
+		m.values = m.values[len(m.values)-m.Window:]
+	}
+
+	var sum float64
+	for _, v := range m.values {
+		sum += v
+	}
+
+	return sum / float64(len(m.values)), true
+}
+
+// parseArg parses a number, a fraction like 0.5/34887 is accepted. An empty
+// argument returns the default value.
+func parseArg(arg string, def float64) (float64, error) {
+	arg = strings.TrimSpace(arg)
+	if arg == "" {
+		return def, nil
+	}
+
+	if i := strings.Index(arg, "/"); i > 0 {
+		num, err := strconv.ParseFloat(strings.TrimSpace(arg[:i]), 64)
+		if err != nil {
+			return 0, err
+		}
+		den, err := strconv.ParseFloat(strings.TrimSpace(arg[i+1:]), 64)
+		if err != nil {
+			return 0, err
+		}
+		if den == 0 {
+			return 0, fmt.Errorf("division by zero: %s", arg)
+		}
+		return num / den, nil
+	}
+
+	return strconv.ParseFloat(arg, 64)
+}
+
+func parseArgs(args []string, defs ...float64) ([]float64, error) {
+	if len(args) > len(defs) {
+		return nil, fmt.Errorf("too many arguments: %d", len(args))
+	}
+
+	values := make([]float64, len(defs))
+	for i, def := range defs {
+		values[i] = def
+		if i < len(args) {
+			v, err := parseArg(args[i], def)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = v
+		}
+	}
+	return values, nil
+}
+
+func parseStep(step string) (Transform, error) {
+	res := stepRe.FindStringSubmatch(step)
+	if len(res) == 0 {
+		return nil, fmt.Errorf("wrong transform: %s", step)
+	}
+	name := res[1]
+
+	var args []string
+	if strings.TrimSpace(res[2]) != "" {
+		args = strings.Split(res[2], ",")
+	}
+
+	var flag bool
+	if name == "clamp" || name == "rate" {
+		// optional keyword as last argument
+		if n := len(args); n > 0 {
+			switch strings.TrimSpace(args[n-1]) {
+			case "drop", "delta":
+				flag, args = true, args[:n-1]
+			}
+		}
+	}
+
+	switch name {
+	case "linear":
+		v, err := parseArgs(args, 1, 0)
+		if err != nil {
+			return nil, err
+		}
+		return &Linear{Scale: v[0], Offset: v[1]}, nil
+	case "poly":
+		var coeffs []float64
+		for _, arg := range args {
+			c, err := parseArg(arg, 0)
+			if err != nil {
+				return nil, err
+			}
+			coeffs = append(coeffs, c)
+		}
+		return &Polynomial{Coeffs: coeffs}, nil
+	case "threshold":
+		v, err := parseArgs(args, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		return &Threshold{Below: v[0], Value: v[1]}, nil
+	case "deadband":
+		v, err := parseArgs(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		return &Deadband{Width: v[0]}, nil
+	case "clamp":
+		v, err := parseArgs(args, math.Inf(-1), math.Inf(1))
+		if err != nil {
+			return nil, err
+		}
+		return &Clamp{Min: v[0], Max: v[1], Drop: flag}, nil
+	case "rate":
+		v, err := parseArgs(args, 1)
+		if err != nil {
+			return nil, err
+		}
+		return &Rate{Per: time.Duration(v[0] * float64(time.Second)), Delta: flag}, nil
+	case "avg":
+		v, err := parseArgs(args, 1)
+		if err != nil {
+			return nil, err
+		}
+		if v[0] < 1 {
+			return nil, fmt.Errorf("wrong window: %f", v[0])
+		}
+		return &MovingAverage{Window: int(v[0])}, nil
+	}
+
+	return nil, fmt.Errorf("unknown transform: %s", name)
+}
+
+// Parse returns the pipeline described by the given spec, transforms
+// separated by |, ex: linear(220) | threshold(500, 0) | clamp(, 7000, drop).
+// Available transforms :
+// linear(scale[, offset])
+// poly(c0, c1, c2...)
+// threshold(below[, value])
+// deadband(width)
+// clamp([min], [max][, drop])
+// rate([per seconds][, delta])
+// avg(window)
+func Parse(spec string) (Pipeline, error) {
+	var p Pipeline
+
+	for _, step := range strings.Split(spec, "|") {
+		if strings.TrimSpace(step) == "" {
+			continue
+		}
+
+		t, err := parseStep(step)
+		if err != nil {
+			return nil, err
+		}
+		p = append(p, t)
+	}
+
+	return p, nil
+}
+
+// MustParse is like Parse but panics on error.
+func MustParse(spec string) Pipeline {
+	p, err := Parse(spec)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// ForItem returns the pipeline configured under the transforms section of the
+// config file for the given item ID, ex: SMARTBOILER/CURRENT: linear(220). The
+// default spec is used if not configured or invalid.
+func ForItem(id string, def string) Pipeline {
+	spec := def
+	if server.Cfg != nil {
+		if s := server.Cfg.GetString("transforms." + strings.ToLower(id)); s != "" {
+			spec = s
+		}
+	}
+
+	p, err := Parse(spec)
+	if err != nil {
+		server.Log.Errorf("wrong transform for %s: %s, using default: %s", id, err, def)
+		return MustParse(def)
+	}
+
+	return p
+}
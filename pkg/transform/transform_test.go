@@ -0,0 +1,97 @@
+/*
+ * Copyright (C) 2021 Sylvain Afchain
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package transform
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPipeline(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		spec     string
+		input    []float64
+		expected []float64
+	}{
+		{"linear(220) | threshold(500, 0)", []float64{1, 3}, []float64{0, 660}},
+		{"linear(0.5/34887)", []float64{34887}, []float64{0.5}},
+		{"linear(2, -1)", []float64{3}, []float64{5}},
+		{"poly(1, 2, 3)", []float64{2}, []float64{17}},
+		{"deadband(1)", []float64{10, 10.5, 9.2, 11}, []float64{10, 10, 10, 11}},
+		{"clamp(0, 100)", []float64{-5, 50, 150}, []float64{0, 50, 100}},
+		{"clamp(, 7000, drop)", []float64{6000, 7500}, []float64{6000, math.NaN()}},
+		{"avg(3)", []float64{3, 6, 9, 12}, []float64{3, 4.5, 6, 9}},
+		{"linear(220) | threshold(100, 0) | linear(1.13, -324) | clamp(, 7000, drop)", []float64{5, 40}, []float64{919, math.NaN()}},
+	}
+
+	for _, test := range tests {
+		p, err := Parse(test.spec)
+		if err != nil {
+			t.Fatalf("%s: %s", test.spec, err)
+		}
+
+		for i, input := range test.input {
+			value, ok := p.Apply(input, now)
+
+			expected := test.expected[i]
+			if math.IsNaN(expected) {
+				if ok {
+					t.Fatalf("%s: %f should be dropped, got %f", test.spec, input, value)
+				}
+				continue
+			}
+			if !ok || math.Abs(value-expected) > 1e-9 {
+				t.Fatalf("%s: %f expected %f, got %f (%v)", test.spec, input, expected, value, ok)
+			}
+		}
+	}
+}
+
+func TestRate(t *testing.T) {
+	now := time.Now()
+
+	p := MustParse("rate(60)")
+	if _, ok := p.Apply(100, now); ok {
+		t.Fatal("first reading should be dropped")
+	}
+	if value, _ := p.Apply(110, now.Add(30*time.Second)); value != 20 {
+		t.Fatalf("expected 20 per minute, got: %f", value)
+	}
+
+	p = MustParse("rate(60, delta)")
+	p.Apply(0, now)
+	if value, _ := p.Apply(5, now.Add(10*time.Second)); value != 30 {
+		t.Fatalf("expected 30 per minute, got: %f", value)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{"unknown(1)", "linear", "linear(a)", "linear(1, 2, 3)", "linear(1/0)", "avg(0)"} {
+		if _, err := Parse(spec); err == nil {
+			t.Fatalf("%s: error expected", spec)
+		}
+	}
+}